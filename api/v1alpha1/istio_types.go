@@ -16,6 +16,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,10 +26,98 @@ import (
 const (
 	IstioHelmChartName     = "istio"
 	IstioInitHelmChartName = "istio-init"
-	IstioNamespace         = "istio-system"
-	IstioCRDGroupSuffix    = "istio.io"
+	// helm chart installed instead of istio in a remote cluster of a multi-cluster mesh
+	IstioRemoteHelmChartName = "istio-remote"
+	IstioNamespace           = "istio-system"
+	IstioCRDGroupSuffix      = "istio.io"
+	// name of the CRD of istio CR
+	IstioCRDName = "istios.operator.ccp.cisco.com"
+	// label of the namespaces that use the control plane of a revision of istio
+	IstioRevisionLabel = "istio.io/rev"
+	// finalizer added to istio CR so that istio is deleted before the istio CR is deleted
+	IstioFinalizer = "istio.operator.ccp.cisco.com/finalizer"
+	// number of revisions of istio kept in Istio CR status if spec.revisionHistoryLimit is not set
+	DefaultRevisionHistoryLimit = 10
 	// timeout interval in seconds for polling checks
 	TimeoutInternal = 600
+	// registry of istio's images set in the values of istio's helm charts by the
+	// defaulting webhook when spec.version is set
+	DefaultIstioHub = "registry.ci.ciscolabs.com/cpsg_ccp-docker-istio"
+	// pull policy of istio's images set in the values of istio's helm charts by the
+	// defaulting webhook when spec.version is set
+	DefaultIstioImagePullPolicy = "IfNotPresent"
+)
+
+// UpgradeStrategy defines how istio is updated when the Istio CR spec changes
+type UpgradeStrategy string
+
+const (
+	// upgrade the existing istio-init and istio helm releases in place
+	UpgradeStrategyUpgrade UpgradeStrategy = "Upgrade"
+	// delete istio and install it again
+	UpgradeStrategyReinstall UpgradeStrategy = "Reinstall"
+	// install the new version as a second control plane with its own revision and move
+	// the namespaces to it in batches, the old control plane is deleted after all the
+	// namespaces are moved
+	UpgradeStrategyCanary UpgradeStrategy = "Canary"
+)
+
+// DeletionPolicy defines what happens to istio when the Istio CR is deleted
+type DeletionPolicy string
+
+const (
+	// delete istio and istio's CRDs
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// keep istio running
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// delete istio but keep istio's CRDs and the istio custom resources created by users
+	DeletionPolicyRetainCRDs DeletionPolicy = "RetainCRDs"
+)
+
+// DriftPolicy defines what happens when the objects installed by istio's helm releases
+// differ from their rendered state
+type DriftPolicy string
+
+const (
+	// report the drifted objects in Istio CR status
+	DriftPolicyReport DriftPolicy = "Report"
+	// report the drifted objects in Istio CR status and re-apply them
+	DriftPolicyCorrect DriftPolicy = "Correct"
+)
+
+// ChartChangePolicy defines what happens when the charts installed by istio CR are changed
+// on disk after they were installed
+type ChartChangePolicy string
+
+const (
+	// report the changed charts in the ChartContentChanged condition of Istio CR status
+	ChartChangePolicyReport ChartChangePolicy = "Report"
+	// report the changed charts and upgrade istio with them
+	ChartChangePolicyUpgrade ChartChangePolicy = "Upgrade"
+)
+
+// HelmVersion defines the version of helm that manages istio's helm releases
+type HelmVersion string
+
+const (
+	// helm 2, the helm releases are stored by Tiller
+	HelmVersionV2 HelmVersion = "v2"
+	// helm 3, the helm releases are stored in secrets in the namespace of the control plane
+	HelmVersionV3 HelmVersion = "v3"
+)
+
+// Installer defines how istio's charts are installed
+type Installer string
+
+const (
+	// the charts are installed as helm releases by helm
+	InstallerHelm Installer = "Helm"
+	// the charts are directories or tarballs of plain kubernetes manifests that are applied
+	// by istio operator
+	InstallerManifests Installer = "Manifests"
+	// the charts are helm charts that are rendered by helm without creating helm releases,
+	// and the rendered kubernetes objects are applied by istio operator
+	InstallerRendered Installer = "Rendered"
 )
 
 // IstioInitValues defines the istio-init section in Istio CR spec
@@ -43,10 +132,90 @@ type IstioValues struct {
 	Values string `json:"values,omitempty"`
 }
 
-// IstioRemoteValues defines the istio-remote section in Istio CR spec
+// IstioRemoteValues defines the istio-remote section in Istio CR spec. When its chart
+// is set, the cluster is a remote cluster of a multi-cluster mesh and istio-remote is
+// installed instead of istio, using the control plane of the primary cluster.
 type IstioRemoteValues struct {
 	Chart  string `json:"chart,omitempty"`
 	Values string `json:"values,omitempty"`
+
+	// address (IP or hostname) of istio-pilot in the primary cluster, required when
+	// istio-remote is installed
+	RemotePilotAddress string `json:"remotePilotAddress,omitempty"`
+
+	// address (IP or hostname) of istio-policy in the primary cluster
+	RemotePolicyAddress string `json:"remotePolicyAddress,omitempty"`
+
+	// address (IP or hostname) of istio-telemetry in the primary cluster
+	RemoteTelemetryAddress string `json:"remoteTelemetryAddress,omitempty"`
+}
+
+// IstioRollback defines a rollback of istio to an earlier revision
+type IstioRollback struct {
+	// revision of istio in status.revisions to roll back to
+	// +kubebuilder:validation:Minimum=1
+	Revision int64 `json:"revision"`
+}
+
+// IstioControlPlane defines where istio's control plane is installed, several control
+// planes can run side by side when they have different namespaces, release prefixes and
+// revisions
+type IstioControlPlane struct {
+	// namespace istio's control plane is installed in, defaults to istio-system
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+	// +kubebuilder:validation:MaxLength=63
+	Namespace string `json:"namespace,omitempty"`
+
+	// prefix of the names of the istio-init and istio (or istio-remote) helm releases,
+	// for example canary- for the canary-istio-init and canary-istio helm releases
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*)?$
+	// +kubebuilder:validation:MaxLength=40
+	ReleasePrefix string `json:"releasePrefix,omitempty"`
+
+	// name of the revision of the control plane, namespaces labeled with istio.io/rev set
+	// to the revision use this control plane instead of the one without a revision
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+	// +kubebuilder:validation:MaxLength=63
+	Revision string `json:"revision,omitempty"`
+}
+
+// IstioCanaryBatch defines namespaces moved together to the new control plane in a
+// canary upgrade
+type IstioCanaryBatch struct {
+	// names of the namespaces moved in the batch
+	// +kubebuilder:validation:MinItems=1
+	Namespaces []string `json:"namespaces"`
+}
+
+// IstioCanary defines how namespaces are moved to the new control plane in a canary
+// upgrade of istio. The namespaces in batches are moved first, in order, then the other
+// namespaces using the old control plane are moved batchSize namespaces at a time.
+type IstioCanary struct {
+	// number of namespaces moved together after the namespaces in batches, defaults to 1
+	// +kubebuilder:validation:Minimum=1
+	BatchSize int32 `json:"batchSize,omitempty"`
+
+	// batches of namespaces moved first, in order
+	Batches []IstioCanaryBatch `json:"batches,omitempty"`
+}
+
+// IstioDataPlaneRollout defines how the workloads in the namespaces using istio's control
+// plane are restarted after istio is installed or upgraded, so that their pods get the
+// sidecar of the new version of istio. The workloads are restarted batchSize at a time,
+// the next batch is restarted pauseSeconds after the workloads of the batch are ready.
+type IstioDataPlaneRollout struct {
+	// number of Deployments, StatefulSets and DaemonSets restarted together, defaults to 1
+	// +kubebuilder:validation:Minimum=1
+	BatchSize int32 `json:"batchSize,omitempty"`
+
+	// seconds to wait after the workloads of a batch are ready before the next batch is
+	// restarted
+	// +kubebuilder:validation:Minimum=0
+	PauseSeconds int32 `json:"pauseSeconds,omitempty"`
+
+	// labels of the namespaces whose workloads are restarted among the namespaces using
+	// istio's control plane, all of them if not set
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
 }
 
 // IstioSpec defines the desired state of Istio
@@ -57,6 +226,454 @@ type IstioSpec struct {
 	CcpIstioInit   IstioInitValues   `json:"istio-init,omitempty"`
 	CcpIstio       IstioValues       `json:"istio,omitempty"`
 	CcpIstioRemote IstioRemoteValues `json:"istio-remote,omitempty"`
+
+	// strategy used to update istio when the spec changes, Upgrade (default) upgrades
+	// the istio-init and istio helm releases in place, Reinstall deletes istio and
+	// installs it again and Canary installs a new control plane and moves the namespaces
+	// to it in batches
+	// +kubebuilder:validation:Enum=Upgrade;Reinstall;Canary
+	UpgradeStrategy UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+
+	// batches of namespaces moved to the new control plane when upgradeStrategy is Canary
+	Canary *IstioCanary `json:"canary,omitempty"`
+
+	// restart the workloads in the namespaces using istio's control plane after istio is
+	// installed or upgraded, they keep the sidecars of the old version of istio if not set
+	DataPlaneRollout *IstioDataPlaneRollout `json:"dataPlaneRollout,omitempty"`
+
+	// what happens to istio when the istio CR is deleted, Delete (default) deletes istio
+	// and istio's CRDs, Retain keeps istio running and RetainCRDs deletes istio but keeps
+	// istio's CRDs
+	// +kubebuilder:validation:Enum=Delete;Retain;RetainCRDs
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// what happens when the Deployments, Services, ConfigMaps and webhook configurations
+	// installed by istio's helm releases are changed or deleted, Report (default) reports
+	// them in status.drift and Correct also re-applies them
+	// +kubebuilder:validation:Enum=Report;Correct
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// what happens when the charts installed by istio CR are changed on disk (for example
+	// rebuilt with the same name in CHARTS_PATH), Report (default) sets the ChartContentChanged
+	// condition and Upgrade also upgrades istio with the changed charts
+	// +kubebuilder:validation:Enum=Report;Upgrade
+	ChartChangePolicy ChartChangePolicy `json:"chartChangePolicy,omitempty"`
+
+	// version of helm that manages istio's helm releases, v2 or v3, defaults to the
+	// --helm-version of the istio operator. The helm 2 releases stored by Tiller are
+	// migrated to helm 3 when it changes from v2 to v3, it cannot change from v3 to v2
+	// +kubebuilder:validation:Enum=v2;v3
+	HelmVersion HelmVersion `json:"helmVersion,omitempty"`
+
+	// how istio's charts are installed, Helm (default) installs them as helm releases,
+	// Manifests applies the kubernetes manifests in the directories or tarballs of the
+	// charts and Rendered applies the kubernetes objects rendered from the helm charts.
+	// The objects applied by Manifests and Rendered are labeled with the name of their
+	// release and are pruned when they are no longer in the charts, it cannot be changed
+	// once istio is installed
+	// +kubebuilder:validation:Enum=Helm;Manifests;Rendered
+	Installer Installer `json:"installer,omitempty"`
+
+	// number of revisions of istio kept in status.revisions, defaults to 10
+	// +kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// roll back istio to the last revision that was installed successfully when an
+	// install or upgrade of istio fails
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+
+	// roll back istio to an earlier revision in status.revisions, the istio-init, istio
+	// and istio-remote sections of the spec are replaced with the ones of the revision
+	// and rollbackTo is cleared by istio operator
+	RollbackTo *IstioRollback `json:"rollbackTo,omitempty"`
+
+	// version of istio, for example 1.1.8 or 1.1.8-ccp1. When it is set, the defaulting
+	// webhook sets the charts of the istio-init and istio (or istio-remote) sections that
+	// are empty to the charts of the version in CHARTS_PATH, and sets the hub, tag and
+	// imagePullPolicy of istio's images in their values if they are not set
+	// +kubebuilder:validation:Pattern=^[0-9]+\.[0-9]+\.[0-9]+(-.+)?$
+	Version string `json:"version,omitempty"`
+
+	// namespace, helm release prefix and revision of istio's control plane, it cannot be
+	// changed once the istio CR is created
+	ControlPlane IstioControlPlane `json:"controlPlane,omitempty"`
+
+	// credentials and CA bundle used to download the charts that are http, https or oci URLs.
+	// A chart can be pinned to a sha256 digest with @sha256:<digest> at the end of its
+	// path or URL, for example https://charts.example.com/istio-1.1.8-ccp1.tgz@sha256:<digest>
+	ChartSource *IstioChartSource `json:"chartSource,omitempty"`
+
+	// ConfigMap, Secret or PersistentVolumeClaim in the namespace of the istio CR with a
+	// bundle of charts and its signed manifest. The charts of the bundle are set in istio CR
+	// spec as bundle://<file name of the chart in the bundle>, for example
+	// bundle://istio-1.1.8-ccp1.tgz
+	ChartBundle *IstioChartBundle `json:"chartBundle,omitempty"`
+}
+
+// IstioChartSource defines how the charts in istio CR spec that are URLs are downloaded
+type IstioChartSource struct {
+	// name of a secret in the namespace of the istio CR with the credentials of the chart
+	// server, the keys username and password for basic authentication or the key token
+	// for a bearer token
+	SecretName string `json:"secretName,omitempty"`
+
+	// PEM encoded CA certificates that verify the certificate of the chart server in
+	// addition to the system's CA certificates
+	CABundle string `json:"caBundle,omitempty"`
+
+	// name of an image pull secret (kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg)
+	// in the namespace of the istio CR with the credentials of the OCI registries of the
+	// charts that are oci URLs
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
+}
+
+// IstioChartBundle defines where a bundle of istio's charts is loaded from in the cluster,
+// exactly one of configMap, secret and persistentVolumeClaim is set. The bundle has the
+// charts, the manifest bundle.yaml with the sha256 digest of each chart, and the signature
+// bundle.yaml.sig of the manifest, which is verified with the public key of istio operator
+// (--chart-bundle-public-key).
+type IstioChartBundle struct {
+	// name of a ConfigMap with the files of the bundle in binaryData
+	ConfigMap string `json:"configMap,omitempty"`
+
+	// name of a Secret with the files of the bundle in data
+	Secret string `json:"secret,omitempty"`
+
+	// name of a PersistentVolumeClaim with the files of the bundle, they are read by a pod
+	// that mounts the volume on any node it can be attached to
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+
+	// directory of the bundle in the volume of persistentVolumeClaim, the root of the volume
+	// if not set
+	Path string `json:"path,omitempty"`
+}
+
+// IstioConfigRestoreStatus defines the result of restoring istio's custom resources
+// (VirtualServices, DestinationRules, Gateways, ServiceEntries, policies etc.) after
+// istio was reinstalled
+type IstioConfigRestoreStatus struct {
+	// name of the ConfigMap with the snapshot of istio's custom resources
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// number of istio custom resources in the snapshot
+	Total int32 `json:"total"`
+
+	// number of istio custom resources re-created from the snapshot
+	Restored int32 `json:"restored"`
+
+	// number of istio custom resources that still existed and were not changed
+	Unchanged int32 `json:"unchanged"`
+
+	// istio custom resources that could not be restored
+	Failed []string `json:"failed,omitempty"`
+
+	// last time istio's custom resources were restored
+	LastRestoreTime *metav1.Time `json:"lastRestoreTime,omitempty"`
+}
+
+// IstioDriftedObject defines an object installed by istio's helm releases that differs
+// from its rendered state
+type IstioDriftedObject struct {
+	// apiVersion of the object
+	APIVersion string `json:"apiVersion"`
+
+	// kind of the object
+	Kind string `json:"kind"`
+
+	// namespace of the object, empty if the object is not namespaced
+	Namespace string `json:"namespace,omitempty"`
+
+	// name of the object
+	Name string `json:"name"`
+
+	// Missing if the object was deleted, Modified if the object was changed
+	Reason string `json:"reason"`
+
+	// fields of the object that differ from the rendered state
+	Fields []string `json:"fields,omitempty"`
+
+	// true if the object was re-applied by istio operator
+	Corrected bool `json:"corrected,omitempty"`
+}
+
+// IstioDriftStatus defines the result of the last comparison of the objects installed by
+// istio's helm releases with their rendered state
+type IstioDriftStatus struct {
+	// last time the objects installed by istio's helm releases were compared with their
+	// rendered state
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+
+	// objects that differ from their rendered state
+	Objects []IstioDriftedObject `json:"objects,omitempty"`
+}
+
+// IstioRevision defines a revision of istio that was installed successfully
+type IstioRevision struct {
+	// number of the revision, incremented each time istio CR's spec is applied successfully
+	Revision int64 `json:"revision"`
+
+	// generation (metadata.generation in istio CR) applied by the revision
+	Generation int64 `json:"generation"`
+
+	// version of istio installed by the revision
+	Version string `json:"version,omitempty"`
+
+	// time the revision was installed
+	AppliedTime metav1.Time `json:"appliedTime"`
+
+	// istio-init, istio and istio-remote sections of istio CR spec applied by the revision
+	CcpIstioInit   IstioInitValues   `json:"istio-init,omitempty"`
+	CcpIstio       IstioValues       `json:"istio,omitempty"`
+	CcpIstioRemote IstioRemoteValues `json:"istio-remote,omitempty"`
+}
+
+// IstioOperationType defines the kind of operation done on istio
+type IstioOperationType string
+
+const (
+	// delete istio if it exists and install it
+	IstioOperationInstall IstioOperationType = "Install"
+	// upgrade the existing istio-init and istio helm releases in place
+	IstioOperationUpgrade IstioOperationType = "Upgrade"
+	// install a new control plane and move the namespaces to it in batches
+	IstioOperationCanaryUpgrade IstioOperationType = "CanaryUpgrade"
+)
+
+// IstioOperation is the journal of an install or upgrade of istio that has not completed
+// yet. It is saved in Istio CR status before each step runs, so that an operation that was
+// interrupted (for example when the istio operator restarts) is resumed from the step that
+// was running. Each reconcile of istio CR runs at most one step.
+type IstioOperation struct {
+	// kind of operation, Install or Upgrade
+	Type IstioOperationType `json:"type"`
+
+	// generation (metadata.generation in istio CR) applied by the operation
+	Generation int64 `json:"generation"`
+
+	// revision in status.revisions that the operation rolls back to, not set if the
+	// operation applies istio CR's spec
+	Revision int64 `json:"revision,omitempty"`
+
+	// why istio is rolled back to an earlier revision
+	RollbackReason string `json:"rollbackReason,omitempty"`
+
+	// last step of the operation that was started
+	Step string `json:"step,omitempty"`
+
+	// time the last step of the operation was started, steps waiting for istio's pods
+	// and jobs fail when they do not complete within TimeoutInternal seconds
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+
+	// true while the last step of the operation is pending, its objects cannot be applied
+	// yet and the step resumes where it stopped instead of being run again
+	StepPending bool `json:"stepPending,omitempty"`
+
+	// steps of the operation that completed
+	CompletedSteps []string `json:"completedSteps,omitempty"`
+
+	// number of times a step of the operation was run again after it was interrupted or failed
+	Resumes int32 `json:"resumes,omitempty"`
+
+	// time the operation started
+	StartTime metav1.Time `json:"startTime"`
+}
+
+// IstioCanaryNamespacePhase defines the state of a namespace in a canary upgrade
+type IstioCanaryNamespacePhase string
+
+const (
+	// the namespace still uses the old control plane
+	IstioCanaryNamespacePending IstioCanaryNamespacePhase = "Pending"
+	// the namespace is labeled with the new revision and its workloads are restarting
+	IstioCanaryNamespaceMoving IstioCanaryNamespacePhase = "Moving"
+	// the workloads of the namespace are ready with the sidecars of the new control plane
+	IstioCanaryNamespaceMoved IstioCanaryNamespacePhase = "Moved"
+	// the workloads of the namespace did not become ready in time
+	IstioCanaryNamespaceFailed IstioCanaryNamespacePhase = "Failed"
+)
+
+// IstioCanaryNamespace defines the progress of a namespace in a canary upgrade
+type IstioCanaryNamespace struct {
+	// name of the namespace
+	Name string `json:"name"`
+
+	// batch the namespace is moved in, starting at 1
+	Batch int32 `json:"batch"`
+
+	// Pending, Moving, Moved or Failed
+	Phase IstioCanaryNamespacePhase `json:"phase"`
+
+	// workloads of the namespace that are not ready when the namespace failed to move
+	Message string `json:"message,omitempty"`
+
+	// last time the phase changed
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// IstioCanaryStatus defines the progress of a canary upgrade of istio
+type IstioCanaryStatus struct {
+	// control plane the namespaces are moved from, it is deleted after all namespaces moved
+	From IstioControlPlane `json:"from"`
+
+	// control plane installed by the canary upgrade
+	To IstioControlPlane `json:"to"`
+
+	// batch of namespaces being moved, starting at 1
+	CurrentBatch int32 `json:"currentBatch,omitempty"`
+
+	// number of batches of namespaces
+	Batches int32 `json:"batches,omitempty"`
+
+	// time the workloads of the current batch were restarted
+	BatchStartTime *metav1.Time `json:"batchStartTime,omitempty"`
+
+	// namespaces moved by the canary upgrade and their progress
+	Namespaces []IstioCanaryNamespace `json:"namespaces,omitempty"`
+}
+
+// IstioDataPlaneRolloutPhase defines the state of a data plane rollout
+type IstioDataPlaneRolloutPhase string
+
+const (
+	// workloads are being restarted
+	IstioDataPlaneRolloutProgressing IstioDataPlaneRolloutPhase = "Progressing"
+	// all the workloads were restarted and are ready
+	IstioDataPlaneRolloutCompleted IstioDataPlaneRolloutPhase = "Completed"
+	// the workloads of a batch did not become ready in time
+	IstioDataPlaneRolloutFailed IstioDataPlaneRolloutPhase = "Failed"
+)
+
+// IstioDataPlaneRolloutStatus defines the progress of the restart of the workloads in the
+// namespaces using istio's control plane after istio was installed or upgraded
+type IstioDataPlaneRolloutStatus struct {
+	// Progressing, Completed or Failed
+	Phase IstioDataPlaneRolloutPhase `json:"phase"`
+
+	// version of istio whose sidecars are rolled out
+	Version string `json:"version,omitempty"`
+
+	// number of workloads restarted by the rollout
+	Workloads int32 `json:"workloads"`
+
+	// number of workloads restarted so far
+	Restarted int32 `json:"restarted"`
+
+	// workloads of the batch being restarted, Kind namespace/name
+	CurrentBatch []string `json:"currentBatch,omitempty"`
+
+	// time the workloads of the current batch were restarted
+	BatchStartTime *metav1.Time `json:"batchStartTime,omitempty"`
+
+	// time the workloads of the last batch were ready
+	LastBatchReadyTime *metav1.Time `json:"lastBatchReadyTime,omitempty"`
+
+	// workloads that are not ready or that wait for a PodDisruptionBudget
+	Message string `json:"message,omitempty"`
+
+	// time the rollout started
+	StartTime metav1.Time `json:"startTime"`
+
+	// time all the workloads were restarted and ready
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// IstioSidecarNamespaceStatus defines the number of pods of a namespace by the skew
+// between the version of their istio sidecar and the version of istio's control plane
+type IstioSidecarNamespaceStatus struct {
+	// name of the namespace
+	Name string `json:"name"`
+
+	// number of pods whose sidecar has the version of istio's control plane
+	UpToDate int32 `json:"upToDate"`
+
+	// number of pods whose sidecar has another patch version, or is one minor version
+	// older than istio's control plane
+	Stale int32 `json:"stale"`
+
+	// number of pods whose sidecar is more than one minor version older, or newer, than
+	// istio's control plane, or whose version is unknown
+	UnsupportedSkew int32 `json:"unsupportedSkew"`
+
+	// versions of the sidecars that are stale or have an unsupported skew
+	SkewedVersions []string `json:"skewedVersions,omitempty"`
+}
+
+// IstioSidecarAuditStatus defines the versions of the istio sidecars of the pods in the
+// namespaces using istio's control plane compared to the version of the control plane
+type IstioSidecarAuditStatus struct {
+	// version of istio's control plane the sidecars are compared to
+	Version string `json:"version"`
+
+	// last time the sidecars were audited
+	LastAuditTime metav1.Time `json:"lastAuditTime"`
+
+	// number of pods whose sidecar has the version of istio's control plane
+	UpToDate int32 `json:"upToDate"`
+
+	// number of pods whose sidecar is stale
+	Stale int32 `json:"stale"`
+
+	// number of pods whose sidecar has an unsupported skew
+	UnsupportedSkew int32 `json:"unsupportedSkew"`
+
+	// pods by version skew in each namespace with pods with istio's sidecar
+	Namespaces []IstioSidecarNamespaceStatus `json:"namespaces,omitempty"`
+}
+
+// IstioInstalledChart defines a local chart installed by istio CR
+type IstioInstalledChart struct {
+	// name of the chart, istio-init, istio or istio-remote
+	Name string `json:"name"`
+
+	// path of the chart
+	Path string `json:"path"`
+
+	// sha256 digest of the chart when it was installed
+	Sha256 string `json:"sha256"`
+}
+
+// IstioConditionType defines the type of a condition in Istio CR status
+type IstioConditionType string
+
+const (
+	// istio is installed and all its pods are ready
+	IstioConditionReady IstioConditionType = "Ready"
+	// istio is being installed, upgraded or deleted
+	IstioConditionProgressing IstioConditionType = "Progressing"
+	// the last install, upgrade or delete of istio failed
+	IstioConditionDegraded IstioConditionType = "Degraded"
+	// objects installed by istio's helm releases differ from their rendered state
+	IstioConditionDrifted IstioConditionType = "Drifted"
+	// another istio CR in the cluster owns the mesh, this istio CR is ignored
+	IstioConditionConflicted IstioConditionType = "Conflicted"
+	// the charts pinned to a sha256 digest in istio CR spec match their digest
+	IstioConditionChartVerified IstioConditionType = "ChartVerified"
+	// the release of istio in CHARTS_PATH used by istio CR is deprecated or reached its end of life
+	IstioConditionReleaseDeprecated IstioConditionType = "ReleaseDeprecated"
+	// the charts installed by istio CR were changed on disk after they were installed
+	IstioConditionChartContentChanged IstioConditionType = "ChartContentChanged"
+)
+
+// IstioCondition defines a condition in Istio CR status, it has the same fields as
+// metav1.Condition in newer kubernetes releases
+type IstioCondition struct {
+	// type of the condition
+	Type IstioConditionType `json:"type"`
+
+	// status of the condition, one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// generation (metadata.generation in istio CR) the condition was set for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// last time the condition changed from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// reason for the condition's last transition in CamelCase
+	Reason string `json:"reason"`
+
+	// human readable message with details about the last transition
+	Message string `json:"message"`
 }
 
 // IstioStatus defines the observed state of Istio
@@ -67,7 +684,7 @@ type IstioStatus struct {
 	// status of istio
 	Active string `json:"active,omitempty"`
 
-	// generation (metadata.generation in istio CR) observed by istio operator
+	// generation (metadata.generation in istio CR) last applied successfully by istio operator
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 
 	// last time istio's status was updated
@@ -75,14 +692,99 @@ type IstioStatus struct {
 
 	// version of istio installed
 	Version string `json:"version,omitempty"`
+
+	// version of istio in Chart.yaml of the installed istio chart
+	AppVersion string `json:"appVersion,omitempty"`
+
+	// local charts installed by istio CR with their sha256 digest when they were installed,
+	// they are watched for changes on disk
+	InstalledCharts []IstioInstalledChart `json:"installedCharts,omitempty"`
+
+	// version of helm that manages istio's helm releases
+	HelmVersion HelmVersion `json:"helmVersion,omitempty"`
+
+	// revision in status.revisions that is installed, it is the last revision of istio
+	// that was installed successfully
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+
+	// revisions of istio that were installed successfully, the newest revision is last
+	Revisions []IstioRevision `json:"revisions,omitempty"`
+
+	// install or upgrade of istio in progress, nil when no operation is in progress
+	Operation *IstioOperation `json:"operation,omitempty"`
+
+	// objects installed by istio's helm releases that differ from their rendered state
+	Drift *IstioDriftStatus `json:"drift,omitempty"`
+
+	// result of the last restore of istio's custom resources
+	ConfigRestore *IstioConfigRestoreStatus `json:"configRestore,omitempty"`
+
+	// control plane of istio that is installed when it is not the one in spec.controlPlane,
+	// after a canary upgrade of istio
+	ControlPlane *IstioControlPlane `json:"controlPlane,omitempty"`
+
+	// progress of the last canary upgrade of istio
+	Canary *IstioCanaryStatus `json:"canary,omitempty"`
+
+	// progress of the last restart of the workloads after istio was installed or upgraded
+	DataPlaneRollout *IstioDataPlaneRolloutStatus `json:"dataPlaneRollout,omitempty"`
+
+	// version skew of the istio sidecars of the pods with istio's control plane
+	SidecarAudit *IstioSidecarAuditStatus `json:"sidecarAudit,omitempty"`
+
+	// conditions of istio (Ready, Progressing, Degraded and Drifted)
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	Conditions []IstioCondition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// GetCondition returns the condition with the given type, nil if it is not set
+func (s *IstioStatus) GetCondition(conditionType IstioConditionType) *IstioCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition with the same type, LastTransitionTime
+// is changed only if the status of the condition changes
+func (s *IstioStatus) SetCondition(condition IstioCondition) {
+	existing := s.GetCondition(condition.Type)
+	if existing == nil {
+		if condition.LastTransitionTime.IsZero() {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		s.Conditions = append(s.Conditions, condition)
+		return
+	}
+	if existing.Status != condition.Status {
+		existing.Status = condition.Status
+		existing.LastTransitionTime = condition.LastTransitionTime
+		if existing.LastTransitionTime.IsZero() {
+			existing.LastTransitionTime = metav1.Now()
+		}
+	}
+	existing.ObservedGeneration = condition.ObservedGeneration
+	existing.Reason = condition.Reason
+	existing.Message = condition.Message
+}
+
+// IsConditionTrue returns true if the condition with the given type has status True
+func (s *IstioStatus) IsConditionTrue(conditionType IstioConditionType) bool {
+	condition := s.GetCondition(conditionType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
 }
 
 // +kubebuilder:object:root=true
 // +k8s:openapi-gen=true
 // +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:printcolumn:name="status",type="string",JSONPath=".status.active"
+// +kubebuilder:printcolumn:name="ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
 // +kubebuilder:printcolumn:name="version",type="string",JSONPath=".status.version"
 // +kubebuilder:subresource:status
+// +kubebuilder:storageversion
 // Istio is the Schema for the istios API
 type Istio struct {
 	metav1.TypeMeta   `json:",inline"`
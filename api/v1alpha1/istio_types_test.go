@@ -16,10 +16,13 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -73,4 +76,46 @@ var _ = Describe("Istio", func() {
 
 	})
 
+	Context("Conditions", func() {
+
+		It("should change lastTransitionTime only when the status of a condition changes", func() {
+			status := &IstioStatus{}
+			lastTransitionTime := metav1.NewTime(metav1.Now().Add(-time.Hour))
+
+			By("adding a condition")
+			status.SetCondition(IstioCondition{
+				Type:               IstioConditionReady,
+				Status:             corev1.ConditionFalse,
+				LastTransitionTime: lastTransitionTime,
+				Reason:             "InstallingIstio",
+			})
+			Expect(status.Conditions).To(HaveLen(1))
+			Expect(status.IsConditionTrue(IstioConditionReady)).To(BeFalse())
+
+			By("updating the condition without changing its status")
+			status.SetCondition(IstioCondition{
+				Type:               IstioConditionReady,
+				Status:             corev1.ConditionFalse,
+				ObservedGeneration: 2,
+				Reason:             "PostInstallChecks",
+			})
+			Expect(status.Conditions).To(HaveLen(1))
+			Expect(status.GetCondition(IstioConditionReady).Reason).To(Equal("PostInstallChecks"))
+			Expect(status.GetCondition(IstioConditionReady).ObservedGeneration).To(Equal(int64(2)))
+			Expect(status.GetCondition(IstioConditionReady).LastTransitionTime).To(Equal(lastTransitionTime))
+
+			By("changing the status of the condition")
+			status.SetCondition(IstioCondition{
+				Type:   IstioConditionReady,
+				Status: corev1.ConditionTrue,
+				Reason: "IstioInstalledActive",
+			})
+			Expect(status.IsConditionTrue(IstioConditionReady)).To(BeTrue())
+			Expect(status.GetCondition(IstioConditionReady).LastTransitionTime.After(
+				lastTransitionTime.Time)).To(BeTrue())
+			Expect(status.GetCondition(IstioConditionDegraded)).To(BeNil())
+		})
+
+	})
+
 })
@@ -0,0 +1,119 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IstioReleaseSpec defines the flags of a release of istio set by the admins of the cluster
+type IstioReleaseSpec struct {
+	// the release is deprecated, istio operator warns when an istio CR uses it
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// the release reached its end of life, istio operator warns when an istio CR uses it
+	EndOfLife bool `json:"endOfLife,omitempty"`
+
+	// message added to the warnings, for example the release to upgrade to
+	Message string `json:"message,omitempty"`
+}
+
+// IstioReleaseChart defines a chart of a release of istio found in CHARTS_PATH
+type IstioReleaseChart struct {
+	// name of the chart in its Chart.yaml
+	Name string `json:"name"`
+
+	// path of the chart in CHARTS_PATH
+	Path string `json:"path"`
+
+	// version of the chart in its Chart.yaml
+	Version string `json:"version"`
+
+	// version of istio in the chart's Chart.yaml
+	AppVersion string `json:"appVersion,omitempty"`
+
+	// sha256 checksum of the chart, it pins the chart in istio CR spec as <path>@sha256:<checksum>
+	Sha256 string `json:"sha256"`
+
+	// the chart is deprecated in its Chart.yaml
+	Deprecated bool `json:"deprecated,omitempty"`
+}
+
+// IstioReleaseStatus defines the charts of a release of istio found in CHARTS_PATH
+type IstioReleaseStatus struct {
+	// version of the release in Chart.yaml of its istio chart
+	Version string `json:"version,omitempty"`
+
+	// version of istio in Chart.yaml of the release's istio chart
+	AppVersion string `json:"appVersion,omitempty"`
+
+	// istio-init, istio and istio-remote charts of the release
+	Charts []IstioReleaseChart `json:"charts,omitempty"`
+
+	// the release has an istio-init chart and an istio or istio-remote chart of the same version
+	Installable bool `json:"installable"`
+
+	// the release is deprecated in spec or in Chart.yaml of one of its charts
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// why the release can't be installed
+	Message string `json:"message,omitempty"`
+
+	// last time the charts of the release changed in CHARTS_PATH
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// GetChart returns the chart with the given name, nil if the release doesn't have it
+func (s *IstioReleaseStatus) GetChart(name string) *IstioReleaseChart {
+	for i := range s.Charts {
+		if s.Charts[i].Name == name {
+			return &s.Charts[i]
+		}
+	}
+	return nil
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="version",type="string",JSONPath=".status.version"
+// +kubebuilder:printcolumn:name="app version",type="string",JSONPath=".status.appVersion"
+// +kubebuilder:printcolumn:name="installable",type="boolean",JSONPath=".status.installable"
+// +kubebuilder:printcolumn:name="deprecated",type="boolean",JSONPath=".status.deprecated"
+// +kubebuilder:printcolumn:name="end of life",type="boolean",JSONPath=".spec.endOfLife"
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:subresource:status
+// IstioRelease is the Schema for the istioreleases API, istio operator keeps an IstioRelease
+// for each release of istio in CHARTS_PATH
+type IstioRelease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IstioReleaseSpec   `json:"spec,omitempty"`
+	Status IstioReleaseStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IstioReleaseList contains a list of IstioRelease
+type IstioReleaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IstioRelease `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IstioRelease{}, &IstioReleaseList{})
+}
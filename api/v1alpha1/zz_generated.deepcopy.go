@@ -20,6 +20,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -28,8 +29,8 @@ func (in *Istio) DeepCopyInto(out *Istio) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
-	out.Status = in.Status
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Istio.
@@ -50,6 +51,279 @@ func (in *Istio) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCanary) DeepCopyInto(out *IstioCanary) {
+	*out = *in
+	if in.Batches != nil {
+		in, out := &in.Batches, &out.Batches
+		*out = make([]IstioCanaryBatch, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCanary.
+func (in *IstioCanary) DeepCopy() *IstioCanary {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCanary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCanaryBatch) DeepCopyInto(out *IstioCanaryBatch) {
+	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCanaryBatch.
+func (in *IstioCanaryBatch) DeepCopy() *IstioCanaryBatch {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCanaryBatch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCanaryNamespace) DeepCopyInto(out *IstioCanaryNamespace) {
+	*out = *in
+	if in.LastTransitionTime != nil {
+		in, out := &in.LastTransitionTime, &out.LastTransitionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCanaryNamespace.
+func (in *IstioCanaryNamespace) DeepCopy() *IstioCanaryNamespace {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCanaryNamespace)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCanaryStatus) DeepCopyInto(out *IstioCanaryStatus) {
+	*out = *in
+	out.From = in.From
+	out.To = in.To
+	if in.BatchStartTime != nil {
+		in, out := &in.BatchStartTime, &out.BatchStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]IstioCanaryNamespace, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCanaryStatus.
+func (in *IstioCanaryStatus) DeepCopy() *IstioCanaryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCanaryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioChartBundle) DeepCopyInto(out *IstioChartBundle) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioChartBundle.
+func (in *IstioChartBundle) DeepCopy() *IstioChartBundle {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioChartBundle)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioChartSource) DeepCopyInto(out *IstioChartSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioChartSource.
+func (in *IstioChartSource) DeepCopy() *IstioChartSource {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioChartSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCondition) DeepCopyInto(out *IstioCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCondition.
+func (in *IstioCondition) DeepCopy() *IstioCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioConfigRestoreStatus) DeepCopyInto(out *IstioConfigRestoreStatus) {
+	*out = *in
+	if in.Failed != nil {
+		in, out := &in.Failed, &out.Failed
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastRestoreTime != nil {
+		in, out := &in.LastRestoreTime, &out.LastRestoreTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioConfigRestoreStatus.
+func (in *IstioConfigRestoreStatus) DeepCopy() *IstioConfigRestoreStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioConfigRestoreStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioControlPlane) DeepCopyInto(out *IstioControlPlane) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioControlPlane.
+func (in *IstioControlPlane) DeepCopy() *IstioControlPlane {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioControlPlane)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioDataPlaneRollout) DeepCopyInto(out *IstioDataPlaneRollout) {
+	*out = *in
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioDataPlaneRollout.
+func (in *IstioDataPlaneRollout) DeepCopy() *IstioDataPlaneRollout {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioDataPlaneRollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioDataPlaneRolloutStatus) DeepCopyInto(out *IstioDataPlaneRolloutStatus) {
+	*out = *in
+	if in.CurrentBatch != nil {
+		in, out := &in.CurrentBatch, &out.CurrentBatch
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.BatchStartTime != nil {
+		in, out := &in.BatchStartTime, &out.BatchStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastBatchReadyTime != nil {
+		in, out := &in.LastBatchReadyTime, &out.LastBatchReadyTime
+		*out = (*in).DeepCopy()
+	}
+	in.StartTime.DeepCopyInto(&out.StartTime)
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioDataPlaneRolloutStatus.
+func (in *IstioDataPlaneRolloutStatus) DeepCopy() *IstioDataPlaneRolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioDataPlaneRolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioDriftStatus) DeepCopyInto(out *IstioDriftStatus) {
+	*out = *in
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]IstioDriftedObject, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioDriftStatus.
+func (in *IstioDriftStatus) DeepCopy() *IstioDriftStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioDriftStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioDriftedObject) DeepCopyInto(out *IstioDriftedObject) {
+	*out = *in
+	if in.Fields != nil {
+		in, out := &in.Fields, &out.Fields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioDriftedObject.
+func (in *IstioDriftedObject) DeepCopy() *IstioDriftedObject {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioDriftedObject)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioInitValues) DeepCopyInto(out *IstioInitValues) {
 	*out = *in
@@ -65,6 +339,21 @@ func (in *IstioInitValues) DeepCopy() *IstioInitValues {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioInstalledChart) DeepCopyInto(out *IstioInstalledChart) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioInstalledChart.
+func (in *IstioInstalledChart) DeepCopy() *IstioInstalledChart {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioInstalledChart)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioList) DeepCopyInto(out *IstioList) {
 	*out = *in
@@ -97,6 +386,141 @@ func (in *IstioList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioOperation) DeepCopyInto(out *IstioOperation) {
+	*out = *in
+	if in.StepStartTime != nil {
+		in, out := &in.StepStartTime, &out.StepStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletedSteps != nil {
+		in, out := &in.CompletedSteps, &out.CompletedSteps
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.StartTime.DeepCopyInto(&out.StartTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioOperation.
+func (in *IstioOperation) DeepCopy() *IstioOperation {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioOperation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioRelease) DeepCopyInto(out *IstioRelease) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioRelease.
+func (in *IstioRelease) DeepCopy() *IstioRelease {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioRelease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *IstioRelease) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioReleaseChart) DeepCopyInto(out *IstioReleaseChart) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioReleaseChart.
+func (in *IstioReleaseChart) DeepCopy() *IstioReleaseChart {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioReleaseChart)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioReleaseList) DeepCopyInto(out *IstioReleaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]IstioRelease, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioReleaseList.
+func (in *IstioReleaseList) DeepCopy() *IstioReleaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioReleaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *IstioReleaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioReleaseSpec) DeepCopyInto(out *IstioReleaseSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioReleaseSpec.
+func (in *IstioReleaseSpec) DeepCopy() *IstioReleaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioReleaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioReleaseStatus) DeepCopyInto(out *IstioReleaseStatus) {
+	*out = *in
+	if in.Charts != nil {
+		in, out := &in.Charts, &out.Charts
+		*out = make([]IstioReleaseChart, len(*in))
+		copy(*out, *in)
+	}
+	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioReleaseStatus.
+func (in *IstioReleaseStatus) DeepCopy() *IstioReleaseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioReleaseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioRemoteValues) DeepCopyInto(out *IstioRemoteValues) {
 	*out = *in
@@ -112,12 +536,120 @@ func (in *IstioRemoteValues) DeepCopy() *IstioRemoteValues {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioRevision) DeepCopyInto(out *IstioRevision) {
+	*out = *in
+	in.AppliedTime.DeepCopyInto(&out.AppliedTime)
+	out.CcpIstioInit = in.CcpIstioInit
+	out.CcpIstio = in.CcpIstio
+	out.CcpIstioRemote = in.CcpIstioRemote
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioRevision.
+func (in *IstioRevision) DeepCopy() *IstioRevision {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioRevision)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioRollback) DeepCopyInto(out *IstioRollback) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioRollback.
+func (in *IstioRollback) DeepCopy() *IstioRollback {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioRollback)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioSidecarAuditStatus) DeepCopyInto(out *IstioSidecarAuditStatus) {
+	*out = *in
+	in.LastAuditTime.DeepCopyInto(&out.LastAuditTime)
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]IstioSidecarNamespaceStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioSidecarAuditStatus.
+func (in *IstioSidecarAuditStatus) DeepCopy() *IstioSidecarAuditStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioSidecarAuditStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioSidecarNamespaceStatus) DeepCopyInto(out *IstioSidecarNamespaceStatus) {
+	*out = *in
+	if in.SkewedVersions != nil {
+		in, out := &in.SkewedVersions, &out.SkewedVersions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioSidecarNamespaceStatus.
+func (in *IstioSidecarNamespaceStatus) DeepCopy() *IstioSidecarNamespaceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioSidecarNamespaceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioSpec) DeepCopyInto(out *IstioSpec) {
 	*out = *in
 	out.CcpIstioInit = in.CcpIstioInit
 	out.CcpIstio = in.CcpIstio
 	out.CcpIstioRemote = in.CcpIstioRemote
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(IstioCanary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataPlaneRollout != nil {
+		in, out := &in.DataPlaneRollout, &out.DataPlaneRollout
+		*out = new(IstioDataPlaneRollout)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RevisionHistoryLimit != nil {
+		in, out := &in.RevisionHistoryLimit, &out.RevisionHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RollbackTo != nil {
+		in, out := &in.RollbackTo, &out.RollbackTo
+		*out = new(IstioRollback)
+		**out = **in
+	}
+	out.ControlPlane = in.ControlPlane
+	if in.ChartSource != nil {
+		in, out := &in.ChartSource, &out.ChartSource
+		*out = new(IstioChartSource)
+		**out = **in
+	}
+	if in.ChartBundle != nil {
+		in, out := &in.ChartBundle, &out.ChartBundle
+		*out = new(IstioChartBundle)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioSpec.
@@ -133,6 +665,60 @@ func (in *IstioSpec) DeepCopy() *IstioSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioStatus) DeepCopyInto(out *IstioStatus) {
 	*out = *in
+	if in.InstalledCharts != nil {
+		in, out := &in.InstalledCharts, &out.InstalledCharts
+		*out = make([]IstioInstalledChart, len(*in))
+		copy(*out, *in)
+	}
+	if in.Revisions != nil {
+		in, out := &in.Revisions, &out.Revisions
+		*out = make([]IstioRevision, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Operation != nil {
+		in, out := &in.Operation, &out.Operation
+		*out = new(IstioOperation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = new(IstioDriftStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigRestore != nil {
+		in, out := &in.ConfigRestore, &out.ConfigRestore
+		*out = new(IstioConfigRestoreStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ControlPlane != nil {
+		in, out := &in.ControlPlane, &out.ControlPlane
+		*out = new(IstioControlPlane)
+		**out = **in
+	}
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(IstioCanaryStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataPlaneRollout != nil {
+		in, out := &in.DataPlaneRollout, &out.DataPlaneRollout
+		*out = new(IstioDataPlaneRolloutStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SidecarAudit != nil {
+		in, out := &in.SidecarAudit, &out.SidecarAudit
+		*out = new(IstioSidecarAuditStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]IstioCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioStatus.
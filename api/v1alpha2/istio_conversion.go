@@ -0,0 +1,433 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+	"sigs.k8s.io/yaml"
+
+	"wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// annotation with the values of the istio-init, istio and istio-remote sections of a
+// v1alpha1 istio CR converted to v1alpha2, so that the values are converted back to
+// v1alpha1 as they were (with the same comments and order of keys) if they did not change
+const IstioValuesAnnotation = "operator.ccp.cisco.com/v1alpha1-values"
+
+// v1alpha1Values defines the values of a v1alpha1 istio CR in IstioValuesAnnotation
+type v1alpha1Values struct {
+	Init   string `json:"init,omitempty"`
+	Istio  string `json:"istio,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// istioChartValues defines the values of the istio helm chart set by the typed sections
+// of the spec, with the same layout as the values of the istio helm chart
+type istioChartValues struct {
+	Global                 *IstioGlobal    `json:"global,omitempty"`
+	Gateways               *IstioGateways  `json:"gateways,omitempty"`
+	Pilot                  *IstioPilot     `json:"pilot,omitempty"`
+	Mixer                  *IstioMixer     `json:"mixer,omitempty"`
+	Security               *IstioSecurity  `json:"security,omitempty"`
+	Galley                 *IstioComponent `json:"galley,omitempty"`
+	SidecarInjectorWebhook *IstioComponent `json:"sidecarInjectorWebhook,omitempty"`
+	Grafana                *IstioAddon     `json:"grafana,omitempty"`
+	Prometheus             *IstioAddon     `json:"prometheus,omitempty"`
+	Tracing                *IstioAddon     `json:"tracing,omitempty"`
+	Kiali                  *IstioAddon     `json:"kiali,omitempty"`
+	ServiceGraph           *IstioAddon     `json:"servicegraph,omitempty"`
+}
+
+// typed sections of the spec by the key of their values in the istio helm chart
+func (v *istioChartValues) sections() map[string]interface{} {
+	return map[string]interface{}{
+		"global":                 &v.Global,
+		"gateways":               &v.Gateways,
+		"pilot":                  &v.Pilot,
+		"mixer":                  &v.Mixer,
+		"security":               &v.Security,
+		"galley":                 &v.Galley,
+		"sidecarInjectorWebhook": &v.SidecarInjectorWebhook,
+		"grafana":                &v.Grafana,
+		"prometheus":             &v.Prometheus,
+		"tracing":                &v.Tracing,
+		"kiali":                  &v.Kiali,
+		"servicegraph":           &v.ServiceGraph,
+	}
+}
+
+// ConvertTo converts a v1alpha2 istio CR to the hub version v1alpha1
+func (src *Istio) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha1.Istio)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Status = *src.Status.DeepCopy()
+
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.UpgradeStrategy = src.Spec.UpgradeStrategy
+	dst.Spec.DeletionPolicy = src.Spec.DeletionPolicy
+	dst.Spec.DriftPolicy = src.Spec.DriftPolicy
+	dst.Spec.ChartChangePolicy = src.Spec.ChartChangePolicy
+	dst.Spec.HelmVersion = src.Spec.HelmVersion
+	dst.Spec.Installer = src.Spec.Installer
+	dst.Spec.ControlPlane = src.Spec.ControlPlane
+	if src.Spec.ChartSource != nil {
+		dst.Spec.ChartSource = src.Spec.ChartSource.DeepCopy()
+	}
+	if src.Spec.ChartBundle != nil {
+		dst.Spec.ChartBundle = src.Spec.ChartBundle.DeepCopy()
+	}
+	dst.Spec.RollbackOnFailure = src.Spec.RollbackOnFailure
+	if src.Spec.RevisionHistoryLimit != nil {
+		limit := *src.Spec.RevisionHistoryLimit
+		dst.Spec.RevisionHistoryLimit = &limit
+	}
+	if src.Spec.RollbackTo != nil {
+		dst.Spec.RollbackTo = src.Spec.RollbackTo.DeepCopy()
+	}
+	if src.Spec.Canary != nil {
+		dst.Spec.Canary = src.Spec.Canary.DeepCopy()
+	}
+	if src.Spec.DataPlaneRollout != nil {
+		dst.Spec.DataPlaneRollout = src.Spec.DataPlaneRollout.DeepCopy()
+	}
+
+	// values of the istio helm chart are the values in spec.values overridden by the
+	// values of the typed sections
+	istioValues, err := rawExtensionToMap(src.Spec.Values)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid values in istio CR spec, %s", err.Error()))
+	}
+	typed := istioChartValues{
+		Global:                 src.Spec.Global,
+		Gateways:               src.Spec.Gateways,
+		Pilot:                  src.Spec.Pilot,
+		Mixer:                  src.Spec.Mixer,
+		Security:               src.Spec.Security,
+		Galley:                 src.Spec.Galley,
+		SidecarInjectorWebhook: src.Spec.SidecarInjectorWebhook,
+	}
+	if src.Spec.Addons != nil {
+		typed.Grafana = src.Spec.Addons.Grafana
+		typed.Prometheus = src.Spec.Addons.Prometheus
+		typed.Tracing = src.Spec.Addons.Tracing
+		typed.Kiali = src.Spec.Addons.Kiali
+		typed.ServiceGraph = src.Spec.Addons.ServiceGraph
+	}
+	typedValues, err := toMap(typed)
+	if err != nil {
+		return err
+	}
+	istioValues = mergeValues(istioValues, typedValues)
+
+	initValues, err := rawExtensionToMap(src.Spec.InitValues)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid initValues in istio CR spec, %s", err.Error()))
+	}
+	var remoteValues map[string]interface{}
+	if src.Spec.Remote != nil {
+		if remoteValues, err = rawExtensionToMap(src.Spec.Remote.Values); err != nil {
+			return errors.New(fmt.Sprintf("invalid remote.values in istio CR spec, %s", err.Error()))
+		}
+		dst.Spec.CcpIstioRemote.RemotePilotAddress = src.Spec.Remote.PilotAddress
+		dst.Spec.CcpIstioRemote.RemotePolicyAddress = src.Spec.Remote.PolicyAddress
+		dst.Spec.CcpIstioRemote.RemoteTelemetryAddress = src.Spec.Remote.TelemetryAddress
+	}
+
+	// the values of a v1alpha1 istio CR that did not change are kept as they were
+	var original v1alpha1Values
+	if annotation, ok := src.ObjectMeta.Annotations[IstioValuesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(annotation), &original); err != nil {
+			original = v1alpha1Values{}
+		}
+		delete(dst.ObjectMeta.Annotations, IstioValuesAnnotation)
+		if len(dst.ObjectMeta.Annotations) == 0 {
+			dst.ObjectMeta.Annotations = nil
+		}
+	}
+	dst.Spec.CcpIstioInit.Chart = src.Spec.Charts.Init
+	if dst.Spec.CcpIstioInit.Values, err = valuesToYAML(initValues, original.Init); err != nil {
+		return err
+	}
+	dst.Spec.CcpIstio.Chart = src.Spec.Charts.Istio
+	if dst.Spec.CcpIstio.Values, err = valuesToYAML(istioValues, original.Istio); err != nil {
+		return err
+	}
+	dst.Spec.CcpIstioRemote.Chart = src.Spec.Charts.Remote
+	if dst.Spec.CcpIstioRemote.Values, err = valuesToYAML(remoteValues, original.Remote); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConvertFrom converts an istio CR of the hub version v1alpha1 to v1alpha2
+func (dst *Istio) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha1.Istio)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Status = *src.Status.DeepCopy()
+
+	dst.Spec.Version = src.Spec.Version
+	dst.Spec.UpgradeStrategy = src.Spec.UpgradeStrategy
+	dst.Spec.DeletionPolicy = src.Spec.DeletionPolicy
+	dst.Spec.DriftPolicy = src.Spec.DriftPolicy
+	dst.Spec.ChartChangePolicy = src.Spec.ChartChangePolicy
+	dst.Spec.HelmVersion = src.Spec.HelmVersion
+	dst.Spec.Installer = src.Spec.Installer
+	dst.Spec.ControlPlane = src.Spec.ControlPlane
+	if src.Spec.ChartSource != nil {
+		dst.Spec.ChartSource = src.Spec.ChartSource.DeepCopy()
+	}
+	if src.Spec.ChartBundle != nil {
+		dst.Spec.ChartBundle = src.Spec.ChartBundle.DeepCopy()
+	}
+	dst.Spec.RollbackOnFailure = src.Spec.RollbackOnFailure
+	if src.Spec.RevisionHistoryLimit != nil {
+		limit := *src.Spec.RevisionHistoryLimit
+		dst.Spec.RevisionHistoryLimit = &limit
+	}
+	if src.Spec.RollbackTo != nil {
+		dst.Spec.RollbackTo = src.Spec.RollbackTo.DeepCopy()
+	}
+	if src.Spec.Canary != nil {
+		dst.Spec.Canary = src.Spec.Canary.DeepCopy()
+	}
+	if src.Spec.DataPlaneRollout != nil {
+		dst.Spec.DataPlaneRollout = src.Spec.DataPlaneRollout.DeepCopy()
+	}
+	dst.Spec.Charts = IstioCharts{
+		Init:   src.Spec.CcpIstioInit.Chart,
+		Istio:  src.Spec.CcpIstio.Chart,
+		Remote: src.Spec.CcpIstioRemote.Chart,
+	}
+
+	// the values of the istio helm chart that have a typed section are set in the typed
+	// section, the other values are kept in spec.values. Values that are not valid YAML
+	// are only kept in IstioValuesAnnotation.
+	if istioValues, err := yamlToMap(src.Spec.CcpIstio.Values); err == nil {
+		var typed istioChartValues
+		for key, section := range typed.sections() {
+			value, ok := istioValues[key]
+			if !ok {
+				continue
+			}
+			raw, err := json.Marshal(value)
+			if err == nil {
+				err = json.Unmarshal(raw, section)
+			}
+			if err != nil {
+				// values of the section that do not match the typed section are only
+				// kept in spec.values
+				reflect.ValueOf(section).Elem().Set(reflect.Zero(reflect.ValueOf(section).Elem().Type()))
+			}
+		}
+		typedValues, err := toMap(typed)
+		if err != nil {
+			return err
+		}
+		dst.Spec.Global = typed.Global
+		dst.Spec.Gateways = typed.Gateways
+		dst.Spec.Pilot = typed.Pilot
+		dst.Spec.Mixer = typed.Mixer
+		dst.Spec.Security = typed.Security
+		dst.Spec.Galley = typed.Galley
+		dst.Spec.SidecarInjectorWebhook = typed.SidecarInjectorWebhook
+		if typed.Grafana != nil || typed.Prometheus != nil || typed.Tracing != nil || typed.Kiali != nil ||
+			typed.ServiceGraph != nil {
+			dst.Spec.Addons = &IstioAddons{
+				Grafana:      typed.Grafana,
+				Prometheus:   typed.Prometheus,
+				Tracing:      typed.Tracing,
+				Kiali:        typed.Kiali,
+				ServiceGraph: typed.ServiceGraph,
+			}
+		}
+		if dst.Spec.Values, err = mapToRawExtension(subtractValues(istioValues, typedValues)); err != nil {
+			return err
+		}
+	}
+	if initValues, err := yamlToMap(src.Spec.CcpIstioInit.Values); err == nil {
+		if dst.Spec.InitValues, err = mapToRawExtension(initValues); err != nil {
+			return err
+		}
+	}
+	remote := src.Spec.CcpIstioRemote
+	if remote.RemotePilotAddress != "" || remote.RemotePolicyAddress != "" || remote.RemoteTelemetryAddress != "" ||
+		remote.Values != "" {
+		dst.Spec.Remote = &IstioRemote{
+			PilotAddress:     remote.RemotePilotAddress,
+			PolicyAddress:    remote.RemotePolicyAddress,
+			TelemetryAddress: remote.RemoteTelemetryAddress,
+		}
+		if remoteValues, err := yamlToMap(remote.Values); err == nil {
+			if dst.Spec.Remote.Values, err = mapToRawExtension(remoteValues); err != nil {
+				return err
+			}
+		}
+	}
+
+	original := v1alpha1Values{
+		Init:   src.Spec.CcpIstioInit.Values,
+		Istio:  src.Spec.CcpIstio.Values,
+		Remote: src.Spec.CcpIstioRemote.Values,
+	}
+	if original != (v1alpha1Values{}) {
+		annotation, err := json.Marshal(original)
+		if err != nil {
+			return err
+		}
+		if dst.ObjectMeta.Annotations == nil {
+			dst.ObjectMeta.Annotations = map[string]string{}
+		}
+		dst.ObjectMeta.Annotations[IstioValuesAnnotation] = string(annotation)
+	}
+	return nil
+}
+
+// parse the YAML values of a helm chart in a v1alpha1 istio CR
+func yamlToMap(values string) (map[string]interface{}, error) {
+	parsed := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(values), &parsed); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// YAML values of a helm chart in a v1alpha1 istio CR. The original values are used if
+// they have the same content, so that their comments and the order of their keys are kept.
+func valuesToYAML(values map[string]interface{}, original string) (string, error) {
+	rendered := ""
+	if len(values) != 0 {
+		f, err := yaml.Marshal(values)
+		if err != nil {
+			return "", err
+		}
+		rendered = string(f)
+	}
+	if original == "" {
+		return rendered, nil
+	}
+	parsed, err := yamlToMap(original)
+	if err != nil {
+		// values that are not valid YAML are not converted to v1alpha2
+		if rendered == "" {
+			return original, nil
+		}
+		return rendered, nil
+	}
+	if reflect.DeepEqual(parsed, normalize(values)) {
+		return original, nil
+	}
+	return rendered, nil
+}
+
+// parse the values of a helm chart in a v1alpha2 istio CR
+func rawExtensionToMap(raw *runtime.RawExtension) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if raw == nil || len(raw.Raw) == 0 {
+		return values, nil
+	}
+	if err := json.Unmarshal(raw.Raw, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+// values of a helm chart in a v1alpha2 istio CR, nil if there are no values
+func mapToRawExtension(values map[string]interface{}) (*runtime.RawExtension, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.RawExtension{Raw: raw}, nil
+}
+
+// convert an object to its unstructured JSON representation
+func toMap(object interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// normalize the values of a helm chart so that they can be compared with values parsed
+// from YAML, for example numbers are float64
+func normalize(values map[string]interface{}) map[string]interface{} {
+	normalized, err := toMap(values)
+	if err != nil {
+		return values
+	}
+	return normalized
+}
+
+// merge the values of a helm chart, the values in override take precedence over the
+// values in base and maps are merged recursively
+func mergeValues(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseMap, baseIsMap := merged[key].(map[string]interface{})
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[key] = mergeValues(baseMap, overrideMap)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// values of a helm chart that are not in subtracted, so that merging subtracted into
+// the result gives the values again
+func subtractValues(values map[string]interface{}, subtracted map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range values {
+		subtractedValue, ok := subtracted[key]
+		if !ok {
+			result[key] = value
+			continue
+		}
+		valueMap, valueIsMap := value.(map[string]interface{})
+		subtractedMap, subtractedIsMap := subtractedValue.(map[string]interface{})
+		if valueIsMap && subtractedIsMap {
+			if remaining := subtractValues(valueMap, subtractedMap); len(remaining) != 0 {
+				result[key] = remaining
+			}
+			continue
+		}
+		if !reflect.DeepEqual(value, subtractedValue) {
+			result[key] = value
+		}
+	}
+	return result
+}
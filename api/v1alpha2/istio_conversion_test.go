@@ -0,0 +1,109 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	"wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// These tests are written in BDD-style using Ginkgo framework. Refer to
+// http://onsi.github.io/ginkgo to learn more.
+
+var _ = Describe("Istio conversion", func() {
+
+	readCR := func(name string) *v1alpha1.Istio {
+		data, err := ioutil.ReadFile(filepath.Join("..", "..", "cr", name))
+		Expect(err).ToNot(HaveOccurred())
+		ist := &v1alpha1.Istio{}
+		Expect(yaml.Unmarshal(data, ist)).To(Succeed())
+		return ist
+	}
+
+	Context("v1alpha1 to v1alpha2 and back", func() {
+
+		It("should round-trip the istio CRs in cr/ without loss", func() {
+			for _, name := range []string{"ccp-istio-1.1.3-cr.yaml", "ccp-istio-1.1.8-cr.yaml",
+				"ccp-istio-remote-1.1.8-cr.yaml"} {
+				By("converting " + name)
+				hub := readCR(name)
+				spoke := &Istio{}
+				Expect(spoke.ConvertFrom(hub)).To(Succeed())
+
+				converted := &v1alpha1.Istio{TypeMeta: hub.TypeMeta}
+				Expect(spoke.ConvertTo(converted)).To(Succeed())
+				Expect(converted).To(Equal(hub))
+			}
+		})
+
+		It("should set the typed sections from the values of the istio chart", func() {
+			spoke := &Istio{}
+			Expect(spoke.ConvertFrom(readCR("ccp-istio-1.1.8-cr.yaml"))).To(Succeed())
+			Expect(spoke.Spec.Charts.Istio).To(Equal("/opt/ccp/charts/istio-1.1.8-ccp1.tgz"))
+			Expect(spoke.Spec.Global.Tag).To(Equal("1.1.8-ccp1"))
+			Expect(spoke.Spec.Global.Proxy.Resources.Limits).To(HaveKeyWithValue(corev1.ResourceCPU, "2000m"))
+			Expect(*spoke.Spec.Mixer.Telemetry.Enabled).To(BeTrue())
+			Expect(*spoke.Spec.Addons.Kiali.Enabled).To(BeFalse())
+
+			values, err := rawExtensionToMap(spoke.Spec.Values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values).To(HaveKey("nodeagent"))
+			Expect(values).ToNot(HaveKey("pilot"))
+		})
+
+		It("should keep values that are not valid YAML", func() {
+			hub := &v1alpha1.Istio{}
+			hub.Spec.CcpIstio.Values = "global: [hub"
+			spoke := &Istio{}
+			Expect(spoke.ConvertFrom(hub)).To(Succeed())
+
+			converted := &v1alpha1.Istio{}
+			Expect(spoke.ConvertTo(converted)).To(Succeed())
+			Expect(converted.Spec.CcpIstio.Values).To(Equal("global: [hub"))
+		})
+
+	})
+
+	Context("v1alpha2 to v1alpha1", func() {
+
+		It("should override values with the typed sections", func() {
+			enabled := false
+			spoke := &Istio{}
+			spoke.Spec.Charts.Istio = "/opt/ccp/charts/istio-1.1.8-ccp1.tgz"
+			spoke.Spec.Pilot = &IstioPilot{IstioComponent: IstioComponent{Enabled: &enabled}}
+			spoke.Spec.Values = &runtime.RawExtension{
+				Raw: []byte(`{"pilot":{"enabled":true,"traceSampling":1},"kiali":{"enabled":true}}`)}
+
+			hub := &v1alpha1.Istio{}
+			Expect(spoke.ConvertTo(hub)).To(Succeed())
+			values, err := yamlToMap(hub.Spec.CcpIstio.Values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values["pilot"]).To(Equal(map[string]interface{}{"enabled": false, "traceSampling": float64(1)}))
+			Expect(values["kiali"]).To(Equal(map[string]interface{}{"enabled": true}))
+		})
+
+	})
+
+})
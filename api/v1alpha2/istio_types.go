@@ -0,0 +1,385 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// IstioCharts defines the helm charts of istio in Istio CR spec
+type IstioCharts struct {
+	// helm chart of istio-init, installs istio's CRDs
+	Init string `json:"init,omitempty"`
+
+	// helm chart of istio, installed in the primary cluster of a multi-cluster mesh
+	Istio string `json:"istio,omitempty"`
+
+	// helm chart of istio-remote, installed instead of istio in a remote cluster of a
+	// multi-cluster mesh
+	Remote string `json:"remote,omitempty"`
+}
+
+// IstioRemote defines the addresses of istio's control plane in the primary cluster
+// used by istio-remote in a remote cluster of a multi-cluster mesh
+type IstioRemote struct {
+	// address (IP or hostname) of istio-pilot in the primary cluster
+	PilotAddress string `json:"pilotAddress,omitempty"`
+
+	// address (IP or hostname) of istio-policy in the primary cluster
+	PolicyAddress string `json:"policyAddress,omitempty"`
+
+	// address (IP or hostname) of istio-telemetry in the primary cluster
+	TelemetryAddress string `json:"telemetryAddress,omitempty"`
+
+	// values of the istio-remote helm chart
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Values *runtime.RawExtension `json:"values,omitempty"`
+}
+
+// IstioResources defines the compute resources of a component of istio, the quantities
+// are passed to istio's helm charts as they are written, for example 100m or 128Mi
+type IstioResources struct {
+	// minimum amount of compute resources, cpu and memory
+	Requests map[corev1.ResourceName]string `json:"requests,omitempty"`
+
+	// maximum amount of compute resources, cpu and memory
+	Limits map[corev1.ResourceName]string `json:"limits,omitempty"`
+}
+
+// IstioComponent defines the settings of a component of istio's control plane
+type IstioComponent struct {
+	// install the component
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// number of replicas of the component when autoscaling is disabled
+	// +kubebuilder:validation:Minimum=0
+	ReplicaCount *int32 `json:"replicaCount,omitempty"`
+
+	// scale the component with a HorizontalPodAutoscaler
+	AutoscaleEnabled *bool `json:"autoscaleEnabled,omitempty"`
+
+	// minimum number of replicas when autoscaling is enabled
+	// +kubebuilder:validation:Minimum=1
+	AutoscaleMin *int32 `json:"autoscaleMin,omitempty"`
+
+	// maximum number of replicas when autoscaling is enabled
+	// +kubebuilder:validation:Minimum=1
+	AutoscaleMax *int32 `json:"autoscaleMax,omitempty"`
+
+	// image of the component, the name of the image in global.hub or a full image name
+	Image string `json:"image,omitempty"`
+
+	// compute resources of the component
+	Resources *IstioResources `json:"resources,omitempty"`
+}
+
+// IstioGateway defines the settings of an ingress or egress gateway of istio
+type IstioGateway struct {
+	IstioComponent `json:",inline"`
+
+	// type of the gateway's Service
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	Type corev1.ServiceType `json:"type,omitempty"`
+}
+
+// IstioGateways defines the settings of istio's gateways
+type IstioGateways struct {
+	// install istio's gateways
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// istio-ingressgateway
+	IngressGateway *IstioGateway `json:"istio-ingressgateway,omitempty"`
+
+	// istio-egressgateway
+	EgressGateway *IstioGateway `json:"istio-egressgateway,omitempty"`
+}
+
+// IstioPilot defines the settings of istio-pilot
+type IstioPilot struct {
+	IstioComponent `json:",inline"`
+
+	// run istio-pilot with a sidecar proxy
+	Sidecar *bool `json:"sidecar,omitempty"`
+}
+
+// IstioMixer defines the settings of mixer, istio-policy and istio-telemetry
+type IstioMixer struct {
+	// install mixer
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// istio-policy
+	Policy *IstioComponent `json:"policy,omitempty"`
+
+	// istio-telemetry
+	Telemetry *IstioComponent `json:"telemetry,omitempty"`
+}
+
+// IstioSecurity defines the settings of citadel
+type IstioSecurity struct {
+	IstioComponent `json:",inline"`
+
+	// use a self-signed CA for istio's certificates
+	SelfSigned *bool `json:"selfSigned,omitempty"`
+}
+
+// IstioAddon defines the settings of an addon installed with istio
+type IstioAddon struct {
+	// install the addon
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// number of replicas of the addon
+	// +kubebuilder:validation:Minimum=0
+	ReplicaCount *int32 `json:"replicaCount,omitempty"`
+}
+
+// IstioAddons defines the addons installed with istio
+type IstioAddons struct {
+	Grafana      *IstioAddon `json:"grafana,omitempty"`
+	Prometheus   *IstioAddon `json:"prometheus,omitempty"`
+	Tracing      *IstioAddon `json:"tracing,omitempty"`
+	Kiali        *IstioAddon `json:"kiali,omitempty"`
+	ServiceGraph *IstioAddon `json:"servicegraph,omitempty"`
+}
+
+// IstioProxy defines the settings of istio's sidecar proxies
+type IstioProxy struct {
+	// image of the sidecar proxy
+	Image string `json:"image,omitempty"`
+
+	// compute resources of the sidecar proxy
+	Resources *IstioResources `json:"resources,omitempty"`
+
+	// number of worker threads of the sidecar proxy, 0 uses one thread per core
+	// +kubebuilder:validation:Minimum=0
+	Concurrency *int32 `json:"concurrency,omitempty"`
+
+	// file the sidecar proxy writes its access log to, /dev/stdout or empty to disable it
+	AccessLogFile *string `json:"accessLogFile,omitempty"`
+
+	// inject the sidecar proxy in pods of namespaces with the istio-injection label,
+	// enabled or disabled
+	// +kubebuilder:validation:Enum=enabled;disabled
+	AutoInject string `json:"autoInject,omitempty"`
+
+	// IP ranges (CIDRs) redirected to the sidecar proxy, * redirects all outbound traffic
+	IncludeIPRanges *string `json:"includeIPRanges,omitempty"`
+
+	// IP ranges (CIDRs) not redirected to the sidecar proxy
+	ExcludeIPRanges *string `json:"excludeIPRanges,omitempty"`
+
+	// run the sidecar proxy as a privileged container
+	Privileged *bool `json:"privileged,omitempty"`
+}
+
+// IstioMTLS defines mutual TLS between the sidecar proxies
+type IstioMTLS struct {
+	// enable mutual TLS
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// IstioOutboundTrafficPolicy defines the traffic to services outside the mesh
+type IstioOutboundTrafficPolicy struct {
+	// ALLOW_ANY allows traffic to unknown services, REGISTRY_ONLY only allows traffic to
+	// services in the mesh or defined with ServiceEntries
+	// +kubebuilder:validation:Enum=ALLOW_ANY;REGISTRY_ONLY
+	Mode string `json:"mode,omitempty"`
+}
+
+// IstioGlobal defines the settings shared by all of istio's components
+type IstioGlobal struct {
+	// registry of istio's images
+	Hub string `json:"hub,omitempty"`
+
+	// tag of istio's images
+	Tag string `json:"tag,omitempty"`
+
+	// pull policy of istio's images
+	// +kubebuilder:validation:Enum=Always;IfNotPresent;Never
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// sidecar proxies
+	Proxy *IstioProxy `json:"proxy,omitempty"`
+
+	// mutual TLS between the sidecar proxies
+	MTLS *IstioMTLS `json:"mtls,omitempty"`
+
+	// use mutual TLS between istio's control plane components
+	ControlPlaneSecurityEnabled *bool `json:"controlPlaneSecurityEnabled,omitempty"`
+
+	// disable mixer's policy checks
+	DisablePolicyChecks *bool `json:"disablePolicyChecks,omitempty"`
+
+	// trace requests in the mesh
+	EnableTracing *bool `json:"enableTracing,omitempty"`
+
+	// traffic to services outside the mesh
+	OutboundTrafficPolicy *IstioOutboundTrafficPolicy `json:"outboundTrafficPolicy,omitempty"`
+}
+
+// IstioSpec defines the desired state of Istio. The typed sections set the values of
+// the istio helm chart with the same names, values not in the typed sections are set in
+// values. The typed sections take precedence over values.
+type IstioSpec struct {
+	// version of istio, the charts of the version in CHARTS_PATH are used when they are
+	// not set
+	// +kubebuilder:validation:Pattern=^[0-9]+\.[0-9]+\.[0-9]+(-.+)?$
+	Version string `json:"version,omitempty"`
+
+	// helm charts of istio
+	Charts IstioCharts `json:"charts,omitempty"`
+
+	// settings shared by all of istio's components
+	Global *IstioGlobal `json:"global,omitempty"`
+
+	// istio's ingress and egress gateways
+	Gateways *IstioGateways `json:"gateways,omitempty"`
+
+	// istio-pilot
+	Pilot *IstioPilot `json:"pilot,omitempty"`
+
+	// mixer, istio-policy and istio-telemetry
+	Mixer *IstioMixer `json:"mixer,omitempty"`
+
+	// citadel
+	Security *IstioSecurity `json:"security,omitempty"`
+
+	// istio-galley
+	Galley *IstioComponent `json:"galley,omitempty"`
+
+	// istio-sidecar-injector
+	SidecarInjectorWebhook *IstioComponent `json:"sidecarInjectorWebhook,omitempty"`
+
+	// addons installed with istio
+	Addons *IstioAddons `json:"addons,omitempty"`
+
+	// values of the istio helm chart not in the typed sections
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Values *runtime.RawExtension `json:"values,omitempty"`
+
+	// values of the istio-init helm chart
+	// +kubebuilder:pruning:PreserveUnknownFields
+	InitValues *runtime.RawExtension `json:"initValues,omitempty"`
+
+	// addresses of istio's control plane in the primary cluster and values of the
+	// istio-remote helm chart, used in a remote cluster of a multi-cluster mesh
+	Remote *IstioRemote `json:"remote,omitempty"`
+
+	// strategy used to update istio when the spec changes, Upgrade (default) upgrades
+	// the istio-init and istio helm releases in place, Reinstall deletes istio and
+	// installs it again and Canary installs a new control plane and moves the namespaces
+	// to it in batches
+	// +kubebuilder:validation:Enum=Upgrade;Reinstall;Canary
+	UpgradeStrategy v1alpha1.UpgradeStrategy `json:"upgradeStrategy,omitempty"`
+
+	// batches of namespaces moved to the new control plane when upgradeStrategy is Canary
+	Canary *v1alpha1.IstioCanary `json:"canary,omitempty"`
+
+	// restart the workloads in the namespaces using istio's control plane after istio is
+	// installed or upgraded, they keep the sidecars of the old version of istio if not set
+	DataPlaneRollout *v1alpha1.IstioDataPlaneRollout `json:"dataPlaneRollout,omitempty"`
+
+	// what happens to istio when the istio CR is deleted, Delete (default) deletes istio
+	// and istio's CRDs, Retain keeps istio running and RetainCRDs deletes istio but keeps
+	// istio's CRDs
+	// +kubebuilder:validation:Enum=Delete;Retain;RetainCRDs
+	DeletionPolicy v1alpha1.DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// what happens when the Deployments, Services, ConfigMaps and webhook configurations
+	// installed by istio's helm releases are changed or deleted, Report (default) reports
+	// them in status.drift and Correct also re-applies them
+	// +kubebuilder:validation:Enum=Report;Correct
+	DriftPolicy v1alpha1.DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// what happens when the charts installed by istio CR are changed on disk (for example
+	// rebuilt with the same name in CHARTS_PATH), Report (default) sets the ChartContentChanged
+	// condition and Upgrade also upgrades istio with the changed charts
+	// +kubebuilder:validation:Enum=Report;Upgrade
+	ChartChangePolicy v1alpha1.ChartChangePolicy `json:"chartChangePolicy,omitempty"`
+
+	// version of helm that manages istio's helm releases, v2 or v3, defaults to the
+	// --helm-version of the istio operator. The helm 2 releases stored by Tiller are
+	// migrated to helm 3 when it changes from v2 to v3, it cannot change from v3 to v2
+	// +kubebuilder:validation:Enum=v2;v3
+	HelmVersion v1alpha1.HelmVersion `json:"helmVersion,omitempty"`
+
+	// how istio's charts are installed, Helm (default) installs them as helm releases,
+	// Manifests applies the kubernetes manifests in the directories or tarballs of the
+	// charts and Rendered applies the kubernetes objects rendered from the helm charts.
+	// The objects applied by Manifests and Rendered are labeled with the name of their
+	// release and are pruned when they are no longer in the charts, it cannot be changed
+	// once istio is installed
+	// +kubebuilder:validation:Enum=Helm;Manifests;Rendered
+	Installer v1alpha1.Installer `json:"installer,omitempty"`
+
+	// number of revisions of istio kept in status.revisions, defaults to 10
+	// +kubebuilder:validation:Minimum=1
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// roll back istio to the last revision that was installed successfully when an
+	// install or upgrade of istio fails
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+
+	// roll back istio to an earlier revision in status.revisions
+	RollbackTo *v1alpha1.IstioRollback `json:"rollbackTo,omitempty"`
+
+	// namespace, helm release prefix and revision of istio's control plane, it cannot be
+	// changed once the istio CR is created
+	ControlPlane v1alpha1.IstioControlPlane `json:"controlPlane,omitempty"`
+
+	// credentials and CA bundle used to download the charts that are http, https or oci URLs.
+	// A chart can be pinned to a sha256 digest with @sha256:<digest> at the end of its
+	// path or URL, for example https://charts.example.com/istio-1.1.8-ccp1.tgz@sha256:<digest>
+	ChartSource *v1alpha1.IstioChartSource `json:"chartSource,omitempty"`
+
+	// ConfigMap, Secret or PersistentVolumeClaim in the namespace of the istio CR with a
+	// bundle of charts and its signed manifest. The charts of the bundle are set in istio CR
+	// spec as bundle://<file name of the chart in the bundle>, for example
+	// bundle://istio-1.1.8-ccp1.tgz
+	ChartBundle *v1alpha1.IstioChartBundle `json:"chartBundle,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:printcolumn:name="status",type="string",JSONPath=".status.active"
+// +kubebuilder:printcolumn:name="ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="version",type="string",JSONPath=".status.version"
+// +kubebuilder:subresource:status
+// Istio is the Schema for the istios API
+type Istio struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IstioSpec `json:"spec,omitempty"`
+	// status of istio is the same in all versions of the istios API
+	Status v1alpha1.IstioStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IstioList contains a list of Istio
+type IstioList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Istio `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Istio{}, &IstioList{})
+}
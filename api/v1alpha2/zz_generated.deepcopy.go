@@ -0,0 +1,604 @@
+// +build !ignore_autogenerated
+
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// autogenerated by controller-gen object, do not modify manually
+
+package v1alpha2
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Istio) DeepCopyInto(out *Istio) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Istio.
+func (in *Istio) DeepCopy() *Istio {
+	if in == nil {
+		return nil
+	}
+	out := new(Istio)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Istio) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioAddon) DeepCopyInto(out *IstioAddon) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ReplicaCount != nil {
+		in, out := &in.ReplicaCount, &out.ReplicaCount
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioAddon.
+func (in *IstioAddon) DeepCopy() *IstioAddon {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioAddon)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioAddons) DeepCopyInto(out *IstioAddons) {
+	*out = *in
+	if in.Grafana != nil {
+		in, out := &in.Grafana, &out.Grafana
+		*out = new(IstioAddon)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Prometheus != nil {
+		in, out := &in.Prometheus, &out.Prometheus
+		*out = new(IstioAddon)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Tracing != nil {
+		in, out := &in.Tracing, &out.Tracing
+		*out = new(IstioAddon)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Kiali != nil {
+		in, out := &in.Kiali, &out.Kiali
+		*out = new(IstioAddon)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ServiceGraph != nil {
+		in, out := &in.ServiceGraph, &out.ServiceGraph
+		*out = new(IstioAddon)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioAddons.
+func (in *IstioAddons) DeepCopy() *IstioAddons {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioAddons)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioCharts) DeepCopyInto(out *IstioCharts) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioCharts.
+func (in *IstioCharts) DeepCopy() *IstioCharts {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioCharts)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioComponent) DeepCopyInto(out *IstioComponent) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ReplicaCount != nil {
+		in, out := &in.ReplicaCount, &out.ReplicaCount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.AutoscaleEnabled != nil {
+		in, out := &in.AutoscaleEnabled, &out.AutoscaleEnabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AutoscaleMin != nil {
+		in, out := &in.AutoscaleMin, &out.AutoscaleMin
+		*out = new(int32)
+		**out = **in
+	}
+	if in.AutoscaleMax != nil {
+		in, out := &in.AutoscaleMax, &out.AutoscaleMax
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(IstioResources)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioComponent.
+func (in *IstioComponent) DeepCopy() *IstioComponent {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioComponent)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioGateway) DeepCopyInto(out *IstioGateway) {
+	*out = *in
+	in.IstioComponent.DeepCopyInto(&out.IstioComponent)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioGateway.
+func (in *IstioGateway) DeepCopy() *IstioGateway {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioGateway)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioGateways) DeepCopyInto(out *IstioGateways) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.IngressGateway != nil {
+		in, out := &in.IngressGateway, &out.IngressGateway
+		*out = new(IstioGateway)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.EgressGateway != nil {
+		in, out := &in.EgressGateway, &out.EgressGateway
+		*out = new(IstioGateway)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioGateways.
+func (in *IstioGateways) DeepCopy() *IstioGateways {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioGateways)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioGlobal) DeepCopyInto(out *IstioGlobal) {
+	*out = *in
+	if in.Proxy != nil {
+		in, out := &in.Proxy, &out.Proxy
+		*out = new(IstioProxy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MTLS != nil {
+		in, out := &in.MTLS, &out.MTLS
+		*out = new(IstioMTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ControlPlaneSecurityEnabled != nil {
+		in, out := &in.ControlPlaneSecurityEnabled, &out.ControlPlaneSecurityEnabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.DisablePolicyChecks != nil {
+		in, out := &in.DisablePolicyChecks, &out.DisablePolicyChecks
+		*out = new(bool)
+		**out = **in
+	}
+	if in.EnableTracing != nil {
+		in, out := &in.EnableTracing, &out.EnableTracing
+		*out = new(bool)
+		**out = **in
+	}
+	if in.OutboundTrafficPolicy != nil {
+		in, out := &in.OutboundTrafficPolicy, &out.OutboundTrafficPolicy
+		*out = new(IstioOutboundTrafficPolicy)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioGlobal.
+func (in *IstioGlobal) DeepCopy() *IstioGlobal {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioGlobal)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioList) DeepCopyInto(out *IstioList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Istio, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioList.
+func (in *IstioList) DeepCopy() *IstioList {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *IstioList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioMTLS) DeepCopyInto(out *IstioMTLS) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioMTLS.
+func (in *IstioMTLS) DeepCopy() *IstioMTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioMTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioMixer) DeepCopyInto(out *IstioMixer) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Policy != nil {
+		in, out := &in.Policy, &out.Policy
+		*out = new(IstioComponent)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Telemetry != nil {
+		in, out := &in.Telemetry, &out.Telemetry
+		*out = new(IstioComponent)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioMixer.
+func (in *IstioMixer) DeepCopy() *IstioMixer {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioMixer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioOutboundTrafficPolicy) DeepCopyInto(out *IstioOutboundTrafficPolicy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioOutboundTrafficPolicy.
+func (in *IstioOutboundTrafficPolicy) DeepCopy() *IstioOutboundTrafficPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioOutboundTrafficPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioPilot) DeepCopyInto(out *IstioPilot) {
+	*out = *in
+	in.IstioComponent.DeepCopyInto(&out.IstioComponent)
+	if in.Sidecar != nil {
+		in, out := &in.Sidecar, &out.Sidecar
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioPilot.
+func (in *IstioPilot) DeepCopy() *IstioPilot {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioPilot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioProxy) DeepCopyInto(out *IstioProxy) {
+	*out = *in
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(IstioResources)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Concurrency != nil {
+		in, out := &in.Concurrency, &out.Concurrency
+		*out = new(int32)
+		**out = **in
+	}
+	if in.AccessLogFile != nil {
+		in, out := &in.AccessLogFile, &out.AccessLogFile
+		*out = new(string)
+		**out = **in
+	}
+	if in.IncludeIPRanges != nil {
+		in, out := &in.IncludeIPRanges, &out.IncludeIPRanges
+		*out = new(string)
+		**out = **in
+	}
+	if in.ExcludeIPRanges != nil {
+		in, out := &in.ExcludeIPRanges, &out.ExcludeIPRanges
+		*out = new(string)
+		**out = **in
+	}
+	if in.Privileged != nil {
+		in, out := &in.Privileged, &out.Privileged
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioProxy.
+func (in *IstioProxy) DeepCopy() *IstioProxy {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioProxy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioRemote) DeepCopyInto(out *IstioRemote) {
+	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioRemote.
+func (in *IstioRemote) DeepCopy() *IstioRemote {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioRemote)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioResources) DeepCopyInto(out *IstioResources) {
+	*out = *in
+	if in.Requests != nil {
+		in, out := &in.Requests, &out.Requests
+		*out = make(map[v1.ResourceName]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Limits != nil {
+		in, out := &in.Limits, &out.Limits
+		*out = make(map[v1.ResourceName]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioResources.
+func (in *IstioResources) DeepCopy() *IstioResources {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioResources)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioSecurity) DeepCopyInto(out *IstioSecurity) {
+	*out = *in
+	in.IstioComponent.DeepCopyInto(&out.IstioComponent)
+	if in.SelfSigned != nil {
+		in, out := &in.SelfSigned, &out.SelfSigned
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioSecurity.
+func (in *IstioSecurity) DeepCopy() *IstioSecurity {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioSecurity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IstioSpec) DeepCopyInto(out *IstioSpec) {
+	*out = *in
+	out.Charts = in.Charts
+	if in.Global != nil {
+		in, out := &in.Global, &out.Global
+		*out = new(IstioGlobal)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Gateways != nil {
+		in, out := &in.Gateways, &out.Gateways
+		*out = new(IstioGateways)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Pilot != nil {
+		in, out := &in.Pilot, &out.Pilot
+		*out = new(IstioPilot)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Mixer != nil {
+		in, out := &in.Mixer, &out.Mixer
+		*out = new(IstioMixer)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Security != nil {
+		in, out := &in.Security, &out.Security
+		*out = new(IstioSecurity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Galley != nil {
+		in, out := &in.Galley, &out.Galley
+		*out = new(IstioComponent)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SidecarInjectorWebhook != nil {
+		in, out := &in.SidecarInjectorWebhook, &out.SidecarInjectorWebhook
+		*out = new(IstioComponent)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Addons != nil {
+		in, out := &in.Addons, &out.Addons
+		*out = new(IstioAddons)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.InitValues != nil {
+		in, out := &in.InitValues, &out.InitValues
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Remote != nil {
+		in, out := &in.Remote, &out.Remote
+		*out = new(IstioRemote)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Canary != nil {
+		in, out := &in.Canary, &out.Canary
+		*out = new(v1alpha1.IstioCanary)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DataPlaneRollout != nil {
+		in, out := &in.DataPlaneRollout, &out.DataPlaneRollout
+		*out = new(v1alpha1.IstioDataPlaneRollout)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RevisionHistoryLimit != nil {
+		in, out := &in.RevisionHistoryLimit, &out.RevisionHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RollbackTo != nil {
+		in, out := &in.RollbackTo, &out.RollbackTo
+		*out = new(v1alpha1.IstioRollback)
+		**out = **in
+	}
+	out.ControlPlane = in.ControlPlane
+	if in.ChartSource != nil {
+		in, out := &in.ChartSource, &out.ChartSource
+		*out = new(v1alpha1.IstioChartSource)
+		**out = **in
+	}
+	if in.ChartBundle != nil {
+		in, out := &in.ChartBundle, &out.ChartBundle
+		*out = new(v1alpha1.IstioChartBundle)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IstioSpec.
+func (in *IstioSpec) DeepCopy() *IstioSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(IstioSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,507 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// prefix of the charts in istio CR spec that are loaded from the chart bundle of istio CR
+	chartBundlePrefix = "bundle://"
+	// manifest of a chart bundle with the sha256 digest of each chart of the bundle
+	ChartBundleManifestFile = "bundle.yaml"
+	// signature of the manifest of a chart bundle
+	ChartBundleSignatureFile = "bundle.yaml.sig"
+	// largest chart bundle read from a persistent volume claim
+	maxChartBundleSize = 4 * maxChartSize
+	// how long reading a chart bundle from a persistent volume claim can take, including
+	// scheduling the pod that reads it
+	chartBundleLoadTimeout = 5 * time.Minute
+	// interval between two checks of the pod reading a chart bundle from a persistent
+	// volume claim, istio CR is also reconciled when the pod changes
+	chartBundleLoadInterval = 10 * time.Second
+	// label of the pods reading chart bundles from persistent volume claims
+	ChartBundleLoaderLabel = "operator.ccp.cisco.com/chart-bundle-loader"
+)
+
+// chartBundleManifest is the manifest bundle.yaml of a chart bundle
+type chartBundleManifest struct {
+	// sha256 digest of each chart of the bundle by its file name
+	Charts map[string]string `json:"charts"`
+}
+
+// ChartBundleError is returned when a chart bundle has no manifest, or when its manifest
+// is not signed with the public key of istio operator
+type ChartBundleError struct {
+	// ConfigMap, Secret or PersistentVolumeClaim of the bundle
+	Bundle string
+	// why the bundle is not trusted
+	Reason string
+}
+
+func (e *ChartBundleError) Error() string {
+	return fmt.Sprintf("chart bundle %s is not trusted, %s", e.Bundle, e.Reason)
+}
+
+// IsChartBundleInvalid returns true if err means that a chart bundle is not trusted
+func IsChartBundleInvalid(err error) bool {
+	_, ok := err.(*ChartBundleError)
+	return ok
+}
+
+// ChartBundleLoadingError is returned while the pod reading a chart bundle from a
+// persistent volume claim runs, the bundle is read from its log once it completes
+type ChartBundleLoadingError struct {
+	// PersistentVolumeClaim of the bundle
+	Bundle string
+	// pod reading the bundle
+	Pod string
+}
+
+func (e *ChartBundleLoadingError) Error() string {
+	return fmt.Sprintf("chart bundle %s is being read by pod %s", e.Bundle, e.Pod)
+}
+
+// IsChartBundleLoading returns true if err means that a chart bundle is still being read
+func IsChartBundleLoading(err error) bool {
+	_, ok := err.(*ChartBundleLoadingError)
+	return ok
+}
+
+// check if a chart in istio CR spec is loaded from the chart bundle of istio CR
+func IsBundleChart(location string) bool {
+	return strings.HasPrefix(location, chartBundlePrefix)
+}
+
+// file name of a chart in the chart bundle, istio-1.1.8-ccp1.tgz for bundle://istio-1.1.8-ccp1.tgz
+func bundleChartName(location string) string {
+	return strings.TrimPrefix(location, chartBundlePrefix)
+}
+
+// chartBundle is a chart bundle whose manifest is signed with the public key of istio
+// operator, the charts are verified against the digests of the manifest when they are
+// stored in the chart cache
+type chartBundle struct {
+	// ConfigMap, Secret or PersistentVolumeClaim of the bundle
+	source string
+	// sha256 digest of each chart by its file name
+	digests map[string]string
+	// files of the bundle by their name
+	files map[string][]byte
+}
+
+// sha256 digest of a chart in the signed manifest of the bundle
+func (b *chartBundle) digest(name string) (string, error) {
+	digest, found := b.digests[name]
+	if !found {
+		return "", errors.New(fmt.Sprintf("chart %s is not in the manifest of chart bundle %s", name, b.source))
+	}
+	return digest, nil
+}
+
+// content of a chart of the bundle
+func (b *chartBundle) chart(name string) (io.ReadCloser, error) {
+	content, found := b.files[name]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("chart %s not found in chart bundle %s", name, b.source))
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// check that the chart bundle of istio CR's spec sets exactly one of its sources
+func ValidateIstioChartBundle(spec operatorv1alpha1.IstioSpec) error {
+	for _, chart := range []string{spec.CcpIstioInit.Chart, spec.CcpIstio.Chart, spec.CcpIstioRemote.Chart} {
+		if location, _ := ParseChartReference(chart); IsBundleChart(location) && spec.ChartBundle == nil {
+			return errors.New(fmt.Sprintf("helm chart %s is in a chart bundle but spec.chartBundle is not set "+
+				"in istio CR.", chart))
+		}
+	}
+	if spec.ChartBundle == nil {
+		return nil
+	}
+	sources := 0
+	for _, source := range []string{spec.ChartBundle.ConfigMap, spec.ChartBundle.Secret,
+		spec.ChartBundle.PersistentVolumeClaim} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of configMap, secret and persistentVolumeClaim must be set in " +
+			"spec.chartBundle of istio CR.")
+	}
+	if spec.ChartBundle.Path != "" && spec.ChartBundle.PersistentVolumeClaim == "" {
+		return errors.New("path is set only with persistentVolumeClaim in spec.chartBundle of istio CR.")
+	}
+	return nil
+}
+
+// read the chart bundle of istio CR from its ConfigMap, Secret or PersistentVolumeClaim and
+// verify the signature of its manifest
+func (r *IstioReconciler) LoadChartBundle(ctx context.Context, ist *operatorv1alpha1.Istio,
+	bundle *operatorv1alpha1.IstioChartBundle) (*chartBundle, error) {
+	if bundle == nil {
+		return nil, errors.New("spec.chartBundle is not set in istio CR")
+	}
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	key := types.NamespacedName{Namespace: ist.ObjectMeta.Namespace}
+	var source string
+	files := map[string][]byte{}
+	switch {
+	case bundle.ConfigMap != "":
+		source = fmt.Sprintf("ConfigMap %s", bundle.ConfigMap)
+		key.Name = bundle.ConfigMap
+		var configMap corev1.ConfigMap
+		if err := reader.Get(ctx, key, &configMap); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to get chart bundle %s, %s", source, err.Error()))
+		}
+		for name, content := range configMap.Data {
+			files[name] = []byte(content)
+		}
+		for name, content := range configMap.BinaryData {
+			files[name] = content
+		}
+	case bundle.Secret != "":
+		// the secret is read from the API server so that secrets are not cached
+		source = fmt.Sprintf("Secret %s", bundle.Secret)
+		key.Name = bundle.Secret
+		var secret corev1.Secret
+		if err := reader.Get(ctx, key, &secret); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to get chart bundle %s, %s", source, err.Error()))
+		}
+		files = secret.Data
+	case bundle.PersistentVolumeClaim != "":
+		source = fmt.Sprintf("PersistentVolumeClaim %s", bundle.PersistentVolumeClaim)
+		var err error
+		if files, err = r.loadVolumeChartBundle(ctx, ist, bundle); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no configMap, secret or persistentVolumeClaim in spec.chartBundle of istio CR")
+	}
+	return VerifyChartBundle(r.ChartBundleKey, source, files)
+}
+
+// verify that the manifest of a chart bundle is signed with the public key of istio operator
+func VerifyChartBundle(key crypto.PublicKey, source string, files map[string][]byte) (*chartBundle, error) {
+	if key == nil {
+		return nil, &ChartBundleError{Bundle: source, Reason: "istio operator has no public key to verify the " +
+			"manifests of chart bundles, set --chart-bundle-public-key"}
+	}
+	manifest, found := files[ChartBundleManifestFile]
+	if !found {
+		return nil, &ChartBundleError{Bundle: source, Reason: fmt.Sprintf("it has no manifest %s",
+			ChartBundleManifestFile)}
+	}
+	signature, found := files[ChartBundleSignatureFile]
+	if !found {
+		return nil, &ChartBundleError{Bundle: source, Reason: fmt.Sprintf("it has no signature %s of its manifest",
+			ChartBundleSignatureFile)}
+	}
+	if err := verifyChartBundleSignature(key, manifest, signature); err != nil {
+		return nil, &ChartBundleError{Bundle: source, Reason: err.Error()}
+	}
+	var parsed chartBundleManifest
+	if err := yaml.Unmarshal(manifest, &parsed); err != nil {
+		return nil, &ChartBundleError{Bundle: source, Reason: fmt.Sprintf("invalid manifest %s, %s",
+			ChartBundleManifestFile, err.Error())}
+	}
+	for name, digest := range parsed.Charts {
+		if !chartDigestRegexp.MatchString(digest) {
+			return nil, &ChartBundleError{Bundle: source, Reason: fmt.Sprintf("sha256 digest %s of chart %s in "+
+				"its manifest is not 64 lowercase hexadecimal characters", digest, name)}
+		}
+	}
+	return &chartBundle{source: source, digests: parsed.Charts, files: files}, nil
+}
+
+// verify the signature of the sha256 digest of a manifest, made with an RSA (PKCS #1 v1.5)
+// or ECDSA private key, or the ed25519 signature of the manifest
+func verifyChartBundleSignature(key crypto.PublicKey, manifest []byte, signature []byte) error {
+	hash := sha256.Sum256(manifest)
+	verified := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 && sig.R != nil &&
+			sig.S != nil {
+			verified = ecdsa.Verify(k, hash[:], sig.R, sig.S)
+		}
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(k, manifest, signature)
+	default:
+		return errors.New(fmt.Sprintf("unsupported public key %T", key))
+	}
+	if !verified {
+		return errors.New(fmt.Sprintf("signature %s of manifest %s does not match the public key of istio operator",
+			ChartBundleSignatureFile, ChartBundleManifestFile))
+	}
+	return nil
+}
+
+// ASN.1 encoded ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// object identifier of ed25519 public keys in PKIX, RFC 8410
+var oidPublicKeyEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// PKIX encoded public key
+type pkixPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// parse a PKIX encoded ed25519 public key, x509 parses them only from go 1.13
+func parseEd25519PublicKey(der []byte) (ed25519.PublicKey, bool) {
+	var key pkixPublicKey
+	if rest, err := asn1.Unmarshal(der, &key); err != nil || len(rest) != 0 {
+		return nil, false
+	}
+	if !key.Algorithm.Algorithm.Equal(oidPublicKeyEd25519) || len(key.PublicKey.Bytes) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(key.PublicKey.Bytes), true
+}
+
+// read the PEM encoded public key (RSA, ECDSA or ed25519) that verifies the manifests of
+// chart bundles
+func LoadChartBundlePublicKey(file string) (crypto.PublicKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read public key of chart bundles %s, %s", file, err.Error()))
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("public key of chart bundles %s is not PEM encoded", file))
+	}
+	if key, ok := parseEd25519PublicKey(block.Bytes); ok {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid public key of chart bundles %s, %s", file, err.Error()))
+	}
+	return key, nil
+}
+
+// read the files of a chart bundle in a persistent volume claim. The volume may not be
+// attachable to the node of istio operator, so a pod that mounts it reads the bundle and
+// writes it to its log as a base64 encoded tarball. ChartBundleLoadingError is returned
+// until the pod completes, the bundle is then read from its log and kept in the chart
+// cache for the generation of istio CR, so the pod runs once per generation.
+func (r *IstioReconciler) loadVolumeChartBundle(ctx context.Context, ist *operatorv1alpha1.Istio,
+	bundle *operatorv1alpha1.IstioChartBundle) (map[string][]byte, error) {
+	source := fmt.Sprintf("PersistentVolumeClaim %s", bundle.PersistentVolumeClaim)
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	var claim corev1.PersistentVolumeClaim
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: ist.ObjectMeta.Namespace,
+		Name: bundle.PersistentVolumeClaim}, &claim); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get chart bundle %s, %s", source, err.Error()))
+	}
+	cacheDir := r.ChartCacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultChartCacheDir
+	}
+	id := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", claim.ObjectMeta.UID, bundle.Path,
+		ist.ObjectMeta.Generation)))
+	cached := filepath.Join(cacheDir, "bundles", hex.EncodeToString(id[:])+".tgz")
+	if content, err := ioutil.ReadFile(cached); err == nil {
+		return readChartBundleTarball(source, content)
+	}
+	if r.ChartBundleLoaderImage == "" {
+		return nil, &ChartBundleError{Bundle: source, Reason: "istio operator has no image to read chart bundles " +
+			"from persistent volume claims, set --chart-bundle-loader-image"}
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, %s", source, err.Error()))
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, %s", source, err.Error()))
+	}
+	pods := clientset.CoreV1().Pods(ist.ObjectMeta.Namespace)
+	pod := ChartBundleLoaderPod(ist, bundle, r.ChartBundleLoaderImage, hex.EncodeToString(id[:5]))
+	loader, err := pods.Get(pod.ObjectMeta.Name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := pods.Create(pod); err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, errors.New(fmt.Sprintf("failed to create pod %s reading chart bundle %s, %s",
+				pod.ObjectMeta.Name, source, err.Error()))
+		}
+		r.Log.Info(fmt.Sprintf("reading chart bundle %s with pod %s", source, pod.ObjectMeta.Name))
+		return nil, &ChartBundleLoadingError{Bundle: source, Pod: pod.ObjectMeta.Name}
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get pod %s reading chart bundle %s, %s",
+			pod.ObjectMeta.Name, source, err.Error()))
+	}
+	switch loader.Status.Phase {
+	case corev1.PodSucceeded:
+	case corev1.PodFailed:
+		// the bundle is read by a new pod when istio CR is reconciled again
+		pods.Delete(pod.ObjectMeta.Name, &v1.DeleteOptions{})
+		message := loader.Status.Message
+		for _, status := range loader.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				message = status.State.Terminated.Message
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, pod %s failed, %s", source,
+			pod.ObjectMeta.Name, message))
+	default:
+		if time.Since(loader.ObjectMeta.CreationTimestamp.Time) > chartBundleLoadTimeout {
+			pods.Delete(pod.ObjectMeta.Name, &v1.DeleteOptions{})
+			return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, pod %s did not complete in %s",
+				source, pod.ObjectMeta.Name, chartBundleLoadTimeout))
+		}
+		return nil, &ChartBundleLoadingError{Bundle: source, Pod: pod.ObjectMeta.Name}
+	}
+	defer pods.Delete(pod.ObjectMeta.Name, &v1.DeleteOptions{})
+
+	logs, err := pods.GetLogs(pod.ObjectMeta.Name, &corev1.PodLogOptions{}).Stream()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s from the log of pod %s, %s", source,
+			pod.ObjectMeta.Name, err.Error()))
+	}
+	defer logs.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(base64.NewDecoder(base64.StdEncoding, logs),
+		maxChartBundleSize+1))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s from the log of pod %s, %s", source,
+			pod.ObjectMeta.Name, err.Error()))
+	}
+	if len(content) > maxChartBundleSize {
+		return nil, errors.New(fmt.Sprintf("chart bundle %s is larger than %d bytes", source, maxChartBundleSize))
+	}
+	files, err := readChartBundleTarball(source, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err == nil {
+		ioutil.WriteFile(cached, content, 0644)
+	}
+	return files, nil
+}
+
+// pod that writes the chart bundle in a persistent volume claim to its log as a base64
+// encoded tarball
+func ChartBundleLoaderPod(ist *operatorv1alpha1.Istio, bundle *operatorv1alpha1.IstioChartBundle, image string,
+	suffix string) *corev1.Pod {
+	// the bundle's path can't leave the volume
+	dir := filepath.Join("/bundle", filepath.Clean("/"+bundle.Path))
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("ccp-istio-chart-bundle-%s", suffix),
+			Namespace: ist.ObjectMeta.Namespace,
+			Labels:    map[string]string{ChartBundleLoaderLabel: ist.ObjectMeta.Name},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:    "chart-bundle",
+				Image:   image,
+				Command: []string{"sh", "-c", `tar cf - -C "$BUNDLE_DIR" . | gzip | base64`},
+				Env:     []corev1.EnvVar{{Name: "BUNDLE_DIR", Value: dir}},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "chart-bundle",
+					MountPath: "/bundle",
+					ReadOnly:  true,
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "chart-bundle",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: bundle.PersistentVolumeClaim,
+						ReadOnly:  true,
+					},
+				},
+			}},
+		},
+	}
+}
+
+// files at the root of a gzipped tarball of a chart bundle
+func readChartBundleTarball(source string, content []byte) (map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, %s", source, err.Error()))
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	files := map[string][]byte{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, %s", source, err.Error()))
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if header.Typeflag != tar.TypeReg || strings.Contains(name, "/") {
+			continue
+		}
+		if files[name], err = ioutil.ReadAll(io.LimitReader(tarReader, maxChartSize)); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read chart bundle %s, %s", source, err.Error()))
+		}
+	}
+}
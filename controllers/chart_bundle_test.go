@@ -0,0 +1,375 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// manifest of a chart bundle with the digests of charts
+func testChartBundleManifest(charts map[string][]byte) string {
+	manifest := "charts:\n"
+	for file, content := range charts {
+		digest := sha256.Sum256(content)
+		manifest += fmt.Sprintf("  %s: %s\n", file, hex.EncodeToString(digest[:]))
+	}
+	return manifest
+}
+
+// ECDSA signature of the sha256 digest of a manifest
+func testSignChartBundleManifest(t *testing.T, key *ecdsa.PrivateKey, manifest string) []byte {
+	hash := sha256.Sum256([]byte(manifest))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// bundle of charts in a ConfigMap with a manifest signed with key
+func testChartBundle(t *testing.T, key *ecdsa.PrivateKey, name string, charts map[string][]byte) *corev1.ConfigMap {
+	manifest := testChartBundleManifest(charts)
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       map[string]string{ChartBundleManifestFile: manifest},
+		BinaryData: map[string][]byte{ChartBundleSignatureFile: testSignChartBundleManifest(t, key, manifest)},
+	}
+	for file, content := range charts {
+		configMap.BinaryData[file] = content
+	}
+	return configMap
+}
+
+func testChartBundleSpec(configMap string) operatorv1alpha1.IstioSpec {
+	spec := operatorv1alpha1.IstioSpec{ChartBundle: &operatorv1alpha1.IstioChartBundle{ConfigMap: configMap}}
+	spec.CcpIstioInit.Chart = "bundle://istio-init-1.1.8-ccp1.tgz"
+	spec.CcpIstio.Chart = "bundle://istio-1.1.8-ccp1.tgz"
+	return spec
+}
+
+// reconciler verifying chart bundles with key, with a chart cache and a workspace, the
+// returned func removes them
+func testChartBundleReconciler(t *testing.T, key *ecdsa.PrivateKey, configMap *corev1.ConfigMap) (
+	*IstioReconciler, string, func()) {
+	cacheDir, err := ioutil.TempDir("", "chart-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace, err := ioutil.TempDir("", "workspace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fakeIstioReconciler(configMap)
+	r.ChartCacheDir = cacheDir
+	r.ChartBundleKey = &key.PublicKey
+	return r, workspace, func() {
+		os.RemoveAll(cacheDir)
+		os.RemoveAll(workspace)
+	}
+}
+
+func testIstioCRWithChartBundle() *operatorv1alpha1.Istio {
+	ist := &operatorv1alpha1.Istio{}
+	ist.ObjectMeta.Namespace = "default"
+	return ist
+}
+
+func TestFetchChartBundle(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, workspace, cleanup := testChartBundleReconciler(t, key, testChartBundle(t, key, "istio-1.1.8-charts",
+		map[string][]byte{
+			"istio-init-1.1.8-ccp1.tgz": []byte("istio-init chart"),
+			"istio-1.1.8-ccp1.tgz":      []byte("istio chart"),
+		}))
+	defer cleanup()
+	spec := testChartBundleSpec("istio-1.1.8-charts")
+	if err := ValidateIstioChartBundle(spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateIstioChart("istio", spec.CcpIstio.Chart); err != nil {
+		t.Fatal(err)
+	}
+
+	ist := testIstioCRWithChartBundle()
+	if err := r.FetchIstioCharts(context.TODO(), ist, spec, workspace); err != nil {
+		t.Fatal(err)
+	}
+	chart := IstioReleaseChart(workspace, operatorv1alpha1.IstioHelmChartName, spec.CcpIstio.Chart)
+	if filepath.Base(chart) != "istio-1.1.8-ccp1.tgz" {
+		t.Errorf("unexpected chart %s in the workspace", chart)
+	}
+	if b, err := ioutil.ReadFile(chart); err != nil || string(b) != "istio chart" {
+		t.Errorf("unexpected chart %q, %v", b, err)
+	}
+	condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartVerified)
+	if condition == nil || condition.Status != corev1.ConditionTrue || condition.Reason != "ChartBundleVerified" {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+}
+
+func TestFetchChartBundleNotTrusted(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	charts := map[string][]byte{
+		"istio-init-1.1.8-ccp1.tgz": []byte("istio-init chart"),
+		"istio-1.1.8-ccp1.tgz":      []byte("istio chart"),
+	}
+	tests := []struct {
+		name   string
+		update func(r *IstioReconciler, configMap *corev1.ConfigMap)
+		// in the error
+		message string
+	}{
+		{
+			name: "manifest changed after it was signed",
+			update: func(r *IstioReconciler, configMap *corev1.ConfigMap) {
+				configMap.Data[ChartBundleManifestFile] += "  istio-remote-1.1.8-ccp1.tgz: " +
+					"0000000000000000000000000000000000000000000000000000000000000000\n"
+			},
+			message: "does not match the public key",
+		},
+		{
+			name: "chart that does not match the signed manifest",
+			update: func(r *IstioReconciler, configMap *corev1.ConfigMap) {
+				configMap.BinaryData["istio-1.1.8-ccp1.tgz"] = []byte("rebuilt istio chart")
+			},
+			message: "istio-1.1.8-ccp1.tgz",
+		},
+		{
+			name:    "no public key",
+			update:  func(r *IstioReconciler, configMap *corev1.ConfigMap) { r.ChartBundleKey = nil },
+			message: "--chart-bundle-public-key",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configMap := testChartBundle(t, key, "istio-1.1.8-charts", charts)
+			r, workspace, cleanup := testChartBundleReconciler(t, key, configMap)
+			defer cleanup()
+			test.update(r, configMap)
+			if err := r.Update(context.TODO(), configMap); err != nil {
+				t.Fatal(err)
+			}
+
+			ist := testIstioCRWithChartBundle()
+			err := r.FetchIstioCharts(context.TODO(), ist, testChartBundleSpec("istio-1.1.8-charts"), workspace)
+			if !IsChartBundleInvalid(err) || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("expected invalid chart bundle with %q, got %v", test.message, err)
+			}
+			condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartVerified)
+			if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != "ChartBundleInvalid" {
+				t.Errorf("unexpected condition %+v", condition)
+			}
+		})
+	}
+}
+
+func TestValidateIstioChartBundle(t *testing.T) {
+	tests := []struct {
+		name   string
+		bundle *operatorv1alpha1.IstioChartBundle
+		chart  string
+	}{
+		{name: "no source", bundle: &operatorv1alpha1.IstioChartBundle{}},
+		{name: "two sources", bundle: &operatorv1alpha1.IstioChartBundle{ConfigMap: "charts", Secret: "charts"}},
+		{name: "path without a persistent volume claim", bundle: &operatorv1alpha1.IstioChartBundle{
+			ConfigMap: "charts", Path: "charts"}},
+		{name: "bundle charts without a bundle"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := testChartBundleSpec("")
+			spec.ChartBundle = test.bundle
+			if err := ValidateIstioChartBundle(spec); err == nil {
+				t.Error("invalid chart bundle validated")
+			}
+		})
+	}
+	if err := ValidateIstioChart("istio", "bundle://charts/istio-1.1.8-ccp1.tgz"); err == nil {
+		t.Error("validated a chart in a directory of a chart bundle")
+	}
+}
+
+func TestVerifyChartBundleSignature(t *testing.T) {
+	manifest := []byte(testChartBundleManifest(map[string][]byte{"istio-1.1.8-ccp1.tgz": []byte("istio chart")}))
+	hash := sha256.Sum256(manifest)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519PublicKey, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		key       crypto.PublicKey
+		signature []byte
+	}{
+		{name: "ecdsa", key: &ecdsaKey.PublicKey, signature: testSignChartBundleManifest(t, ecdsaKey,
+			string(manifest))},
+		{name: "rsa", key: &rsaKey.PublicKey, signature: rsaSignature},
+		{name: "ed25519", key: ed25519PublicKey, signature: ed25519.Sign(ed25519Key, manifest)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verifyChartBundleSignature(test.key, manifest, test.signature); err != nil {
+				t.Error(err)
+			}
+			changed := append([]byte{}, manifest...)
+			changed[0] = 'C'
+			if err := verifyChartBundleSignature(test.key, changed, test.signature); err == nil {
+				t.Error("verified the signature of a manifest changed after it was signed")
+			}
+			if err := verifyChartBundleSignature(test.key, manifest, []byte("not a signature")); err == nil {
+				t.Error("verified an invalid signature")
+			}
+		})
+	}
+}
+
+func TestLoadChartBundlePublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-bundle-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaDer, err := x509.MarshalPKIXPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Der, err := asn1.Marshal(pkixPublicKey{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyEd25519},
+		PublicKey: asn1.BitString{Bytes: ed25519Key, BitLength: 8 * len(ed25519Key)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		der  []byte
+		key  crypto.PublicKey
+	}{
+		{name: "ecdsa", der: ecdsaDer, key: &ecdsaKey.PublicKey},
+		{name: "ed25519", der: ed25519Der, key: ed25519Key},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, test.name+".pem")
+			if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: test.der}),
+				0644); err != nil {
+				t.Fatal(err)
+			}
+			key, err := LoadChartBundlePublicKey(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(key, test.key) {
+				t.Errorf("expected public key %v, got %v", test.key, key)
+			}
+		})
+	}
+}
+
+func TestChartBundleLoaderPod(t *testing.T) {
+	ist := testIstioCRWithChartBundle()
+	ist.ObjectMeta.Name = "ccp-istio"
+	pod := ChartBundleLoaderPod(ist, &operatorv1alpha1.IstioChartBundle{PersistentVolumeClaim: "charts",
+		Path: "../../etc"}, "registry.example.com/ccp-istio-operator:1.0", "0a1b2c")
+	// the bundle's path is kept in its volume
+	if dir := pod.Spec.Containers[0].Env[0].Value; dir != "/bundle/etc" {
+		t.Errorf("expected bundle directory /bundle/etc, got %s", dir)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "registry.example.com/ccp-istio-operator:1.0" {
+		t.Errorf("unexpected image %s", image)
+	}
+
+	// istio CR is reconciled when the pod changes
+	r := fakeIstioReconciler()
+	requests := r.IstioCRReadingChartBundle(handler.MapObject{Meta: pod, Object: pod})
+	if len(requests) != 1 || requests[0].Name != "ccp-istio" || requests[0].Namespace != "default" {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+	if !isIstioCROrIstioObject(pod, pod) {
+		t.Error("events of the pod reading the chart bundle are filtered out")
+	}
+}
+
+func TestLoadVolumeChartBundleWithoutLoaderImage(t *testing.T) {
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: "charts", Namespace: "default"}}
+	r := fakeIstioReconciler(claim)
+	cacheDir, err := ioutil.TempDir("", "chart-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	r.ChartCacheDir = cacheDir
+	_, err = r.LoadChartBundle(context.TODO(), testIstioCRWithChartBundle(),
+		&operatorv1alpha1.IstioChartBundle{PersistentVolumeClaim: "charts"})
+	if !IsChartBundleInvalid(err) || !strings.Contains(err.Error(), "--chart-bundle-loader-image") {
+		t.Errorf("expected invalid chart bundle without a loader image, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// media type of the manifests of helm charts in OCI registries
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// media type of the layer with the chart tarball pushed by helm 3
+	helmChartLayerMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	// media type of the layer with the chart tarball, helm 3.0 pre-releases
+	helmChartLegacyLayerMediaType = "application/tar+gzip"
+)
+
+var (
+	ociReferenceRegexp   = regexp.MustCompile(`^oci://([^/]+)/(.+):([\w][\w.-]{0,127})$`)
+	authChallengeRegexp  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	ociRepositoryRegexp  = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+	ociLayerDigestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// check if the URL of a chart is an OCI reference, for example
+// oci://registry.ci.ciscolabs.com/cpsg_ccp-charts/istio:1.1.8-ccp1
+func IsOCIChart(location string) bool {
+	return strings.HasPrefix(location, "oci://")
+}
+
+// ociReference defines a chart in an OCI registry
+type ociReference struct {
+	// host and port of the registry
+	registry string
+	// repository of the chart in the registry
+	repository string
+	// tag of the chart
+	tag string
+}
+
+// parse an OCI reference oci://<registry>/<repository>:<tag>
+func parseOCIReference(location string) (ociReference, error) {
+	match := ociReferenceRegexp.FindStringSubmatch(location)
+	if match == nil || !ociRepositoryRegexp.MatchString(match[2]) {
+		return ociReference{}, errors.New(fmt.Sprintf("chart %s is not an OCI reference "+
+			"oci://<registry>/<repository>:<tag>", location))
+	}
+	return ociReference{registry: match[1], repository: match[2], tag: match[3]}, nil
+}
+
+// URL of a path of the repository in the registry API. Registries on localhost are
+// accessed with http, for example a local registry that stands in for the real one.
+func (ref ociReference) url(path string) string {
+	scheme := "https"
+	host := ref.registry
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.registry, ref.repository, path)
+}
+
+// ociManifest defines the fields of an OCI image manifest read by istio operator
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ociDescriptor defines a layer in an OCI image manifest
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// registryClient gets manifests and blobs from an OCI registry. A request rejected with
+// a bearer challenge is sent again with a token of the registry's token service, and a
+// request rejected with a basic challenge is sent again with the credentials.
+type registryClient struct {
+	client   *http.Client
+	username string
+	password string
+	// authorization header of the requests after a challenge
+	authorization string
+}
+
+// get a manifest or a blob from the registry
+func (c *registryClient) get(location string, accept string) (*http.Response, error) {
+	response, err := c.do(location, accept)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	response.Body.Close()
+	if err := c.authorize(response.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	return c.do(location, accept)
+}
+
+func (c *registryClient) do(location string, accept string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	if c.authorization != "" {
+		request.Header.Set("Authorization", c.authorization)
+	}
+	return c.client.Do(request)
+}
+
+// answer the authentication challenge of the registry
+func (c *registryClient) authorize(challenge string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return errors.New("the registry requires credentials, set spec.chartSource.imagePullSecret")
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return nil
+	case "bearer":
+		params := map[string]string{}
+		for _, match := range authChallengeRegexp.FindAllStringSubmatch(challenge, -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+		if params["realm"] == "" {
+			return errors.New(fmt.Sprintf("the registry's bearer challenge %s has no realm", challenge))
+		}
+		tokenURL, err := url.Parse(params["realm"])
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid realm in the registry's bearer challenge, %s", err.Error()))
+		}
+		query := tokenURL.Query()
+		for _, key := range []string{"service", "scope"} {
+			if params[key] != "" {
+				query.Set(key, params[key])
+			}
+		}
+		tokenURL.RawQuery = query.Encode()
+		request, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		if c.username != "" {
+			request.SetBasicAuth(c.username, c.password)
+		}
+		response, err := c.client.Do(request)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to get a token of the registry, %s", err.Error()))
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return errors.New(fmt.Sprintf("failed to get a token of the registry, %s", response.Status))
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+			return errors.New(fmt.Sprintf("failed to get a token of the registry, %s", err.Error()))
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return errors.New("failed to get a token of the registry, the token service returned no token")
+		}
+		c.authorization = "Bearer " + token.Token
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unsupported authentication challenge of the registry %q", challenge))
+}
+
+// pull a chart from an OCI registry with the credentials of the registry in the image
+// pull secret of the chart source. Returns the chart tarball (the chart layer of the
+// OCI manifest) and its sha256 digest. A chart pinned to a digest must have a chart
+// layer with the digest, it is the sha256 digest of the chart tarball as for the
+// charts that are http or https URLs.
+func (r *IstioReconciler) pullOCIChart(ctx context.Context, ist *operatorv1alpha1.Istio,
+	source *operatorv1alpha1.IstioChartSource, location string, digest string) (io.ReadCloser, string, error) {
+	ref, err := parseOCIReference(location)
+	if err != nil {
+		return nil, "", err
+	}
+	httpClient, err := ChartHTTPClient(source)
+	if err != nil {
+		return nil, "", err
+	}
+	registry := &registryClient{client: httpClient}
+	if source != nil && source.ImagePullSecret != "" {
+		secret, err := r.chartSourceSecret(ctx, ist, source.ImagePullSecret)
+		if err != nil {
+			return nil, "", err
+		}
+		if registry.username, registry.password, err = RegistryCredentials(secret, ref.registry); err != nil {
+			return nil, "", err
+		}
+	}
+	return registry.pullChart(ref, digest)
+}
+
+// pull the chart layer of a chart in the registry
+func (c *registryClient) pullChart(ref ociReference, digest string) (io.ReadCloser, string, error) {
+	location := fmt.Sprintf("oci://%s/%s:%s", ref.registry, ref.repository, ref.tag)
+	response, err := c.get(ref.url("manifests/"+ref.tag), ociManifestMediaType)
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("failed to pull chart %s, %s", location, err.Error()))
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, "", errors.New(fmt.Sprintf("failed to pull the manifest of chart %s, %s", location,
+			response.Status))
+	}
+	var manifest ociManifest
+	if err := json.NewDecoder(io.LimitReader(response.Body, 4<<20)).Decode(&manifest); err != nil {
+		return nil, "", errors.New(fmt.Sprintf("failed to parse the manifest of chart %s, %s", location,
+			err.Error()))
+	}
+	var layer *ociDescriptor
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == helmChartLayerMediaType ||
+			manifest.Layers[i].MediaType == helmChartLegacyLayerMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, "", errors.New(fmt.Sprintf("%s is not a helm chart, its manifest has no layer of media type %s",
+			location, helmChartLayerMediaType))
+	}
+	if !ociLayerDigestRegexp.MatchString(layer.Digest) {
+		return nil, "", errors.New(fmt.Sprintf("the chart layer of %s has an unsupported digest %s", location,
+			layer.Digest))
+	}
+	layerDigest := strings.TrimPrefix(layer.Digest, "sha256:")
+	if digest != "" && layerDigest != digest {
+		return nil, "", &ChartDigestError{Chart: location, Expected: digest, Actual: layerDigest}
+	}
+	blob, err := c.get(ref.url("blobs/"+layer.Digest), "")
+	if err != nil {
+		return nil, "", errors.New(fmt.Sprintf("failed to pull chart %s, %s", location, err.Error()))
+	}
+	if blob.StatusCode != http.StatusOK {
+		blob.Body.Close()
+		return nil, "", errors.New(fmt.Sprintf("failed to pull the chart layer of %s, %s", location, blob.Status))
+	}
+	// the chart cache checks that the chart layer matches its digest
+	return blob.Body, layerDigest, nil
+}
+
+// dockerConfig defines the credentials of registries in an image pull secret
+type dockerConfig struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// dockerConfigEntry defines the credentials of a registry in an image pull secret
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// username and password of a registry in an image pull secret
+func RegistryCredentials(secret *corev1.Secret, registry string) (string, string, error) {
+	var auths map[string]dockerConfigEntry
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config dockerConfig
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return "", "", errors.New(fmt.Sprintf("invalid image pull secret %s, %s", secret.Name, err.Error()))
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return "", "", errors.New(fmt.Sprintf("invalid image pull secret %s, %s", secret.Name, err.Error()))
+		}
+	default:
+		return "", "", errors.New(fmt.Sprintf("secret %s is not an image pull secret of type %s or %s",
+			secret.Name, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeDockercfg))
+	}
+	for key, entry := range auths {
+		// the registries are keyed by host or by URL, for example https://registry.example.com/v1/
+		host := key
+		if u, err := url.Parse(key); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if host != registry {
+			continue
+		}
+		if entry.Username == "" && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", "", errors.New(fmt.Sprintf("invalid auth of registry %s in image pull secret %s, %s",
+					registry, secret.Name, err.Error()))
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", errors.New(fmt.Sprintf("invalid auth of registry %s in image pull secret %s",
+					registry, secret.Name))
+			}
+			return parts[0], parts[1], nil
+		}
+		return entry.Username, entry.Password, nil
+	}
+	return "", "", errors.New(fmt.Sprintf("image pull secret %s has no credentials of registry %s", secret.Name,
+		registry))
+}
@@ -0,0 +1,270 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// localRegistry is a local OCI registry that stands in for the real one, it serves the
+// charts pushed to it and requires a token of its token service, or basic
+// authentication if it has a username
+type localRegistry struct {
+	server   *httptest.Server
+	charts   map[string][]byte
+	username string
+	password string
+	// number of chart layers pulled
+	pulls int
+}
+
+func newLocalRegistry() *localRegistry {
+	registry := &localRegistry{charts: map[string][]byte{}}
+	registry.server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	return registry
+}
+
+// host and port of the registry in oci references
+func (l *localRegistry) host() string {
+	return strings.TrimPrefix(l.server.URL, "http://")
+}
+
+// push a chart to repository:tag, returns the sha256 digest of the chart
+func (l *localRegistry) push(repository string, tag string, chart []byte) string {
+	hash := sha256.Sum256(chart)
+	digest := hex.EncodeToString(hash[:])
+	l.charts["blobs/sha256:"+digest] = chart
+	manifest, _ := json.Marshal(ociManifest{Layers: []ociDescriptor{{
+		MediaType: helmChartLayerMediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(chart)),
+	}}})
+	l.charts[fmt.Sprintf("%s/manifests/%s", repository, tag)] = manifest
+	return digest
+}
+
+func (l *localRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if user, password, _ := req.BasicAuth(); user != l.username || password != l.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"local-token"}`))
+		return
+	}
+	authorized := req.Header.Get("Authorization") == "Bearer local-token"
+	if l.username != "" {
+		user, password, _ := req.BasicAuth()
+		authorized = user == l.username && password == l.password
+	}
+	if !authorized {
+		if l.username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="local"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="local",`+
+				`scope="repository:charts:pull"`, l.server.URL))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for key, content := range l.charts {
+		if strings.HasSuffix(path, key) && (strings.HasPrefix(key, "blobs/") || path == key) {
+			if strings.HasPrefix(key, "blobs/") {
+				l.pulls++
+			}
+			w.Write(content)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// local registry, chart cache and workspace of a test, the returned func removes them
+func testOCIReconciler(t *testing.T) (*localRegistry, *IstioReconciler, string, func()) {
+	registry := newLocalRegistry()
+	cacheDir, err := ioutil.TempDir("", "chart-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace, err := ioutil.TempDir("", "workspace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fakeIstioReconciler()
+	r.ChartCacheDir = cacheDir
+	return registry, r, workspace, func() {
+		registry.server.Close()
+		os.RemoveAll(cacheDir)
+		os.RemoveAll(workspace)
+	}
+}
+
+func testOCIIstioSpec(init string, istio string) operatorv1alpha1.IstioSpec {
+	spec := operatorv1alpha1.IstioSpec{}
+	spec.CcpIstioInit.Chart = init
+	spec.CcpIstio.Chart = istio
+	return spec
+}
+
+func TestParseOCIReference(t *testing.T) {
+	ref, err := parseOCIReference("oci://registry.ci.ciscolabs.com/cpsg_ccp-charts/istio:1.1.8-ccp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ociReference{registry: "registry.ci.ciscolabs.com", repository: "cpsg_ccp-charts/istio",
+		tag: "1.1.8-ccp1"}
+	if ref != expected {
+		t.Errorf("expected %+v, got %+v", expected, ref)
+	}
+	url := "https://registry.ci.ciscolabs.com/v2/cpsg_ccp-charts/istio/manifests/1.1.8-ccp1"
+	if got := ref.url("manifests/1.1.8-ccp1"); got != url {
+		t.Errorf("expected url %s, got %s", url, got)
+	}
+
+	if _, err := parseOCIReference("oci://registry.ci.ciscolabs.com/cpsg_ccp-charts/istio"); err == nil {
+		t.Error("parsed an oci reference without a tag")
+	}
+	if err := ValidateIstioChart("istio", "oci://registry.ci.ciscolabs.com/istio"); err == nil {
+		t.Error("validated an oci chart without a tag")
+	}
+	if tag := IstioChartTag("oci://registry.ci.ciscolabs.com/cpsg_ccp-charts/istio:1.1.8-ccp1"); tag != "1.1.8-ccp1" {
+		t.Errorf("expected tag 1.1.8-ccp1, got %s", tag)
+	}
+}
+
+func TestFetchOCICharts(t *testing.T) {
+	registry, r, workspace, cleanup := testOCIReconciler(t)
+	defer cleanup()
+	registry.push("charts/istio-init", "1.1.8-ccp1", []byte("istio-init chart"))
+	registry.push("charts/istio", "1.1.8-ccp1", []byte("istio chart"))
+	spec := testOCIIstioSpec(fmt.Sprintf("oci://%s/charts/istio-init:1.1.8-ccp1", registry.host()),
+		fmt.Sprintf("oci://%s/charts/istio:1.1.8-ccp1", registry.host()))
+	if err := ValidateIstioChart("istio", spec.CcpIstio.Chart); err != nil {
+		t.Fatal(err)
+	}
+
+	ist := &operatorv1alpha1.Istio{}
+	if err := r.FetchIstioCharts(context.TODO(), ist, spec, workspace); err != nil {
+		t.Fatal(err)
+	}
+	chart := IstioReleaseChart(workspace, operatorv1alpha1.IstioHelmChartName, spec.CcpIstio.Chart)
+	if filepath.Base(chart) != "istio-1.1.8-ccp1.tgz" {
+		t.Errorf("unexpected chart %s in the workspace", chart)
+	}
+	if b, err := ioutil.ReadFile(chart); err != nil || string(b) != "istio chart" {
+		t.Errorf("unexpected chart %q, %v", b, err)
+	}
+	if registry.pulls != 2 {
+		t.Errorf("expected 2 charts pulled, got %d", registry.pulls)
+	}
+
+	// the charts in the chart cache are reused
+	other, err := ioutil.TempDir("", "workspace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+	if err := r.FetchIstioCharts(context.TODO(), ist, spec, other); err != nil {
+		t.Fatal(err)
+	}
+	if registry.pulls != 2 {
+		t.Errorf("charts of the chart cache pulled again, %d charts pulled", registry.pulls)
+	}
+}
+
+func TestFetchPinnedOCIChart(t *testing.T) {
+	registry, r, workspace, cleanup := testOCIReconciler(t)
+	defer cleanup()
+	initDigest := registry.push("charts/istio-init", "1.1.8-ccp1", []byte("istio-init chart"))
+	registry.push("charts/istio", "1.1.8-ccp1", []byte("istio chart"))
+	spec := testOCIIstioSpec(fmt.Sprintf("oci://%s/charts/istio-init:1.1.8-ccp1@sha256:%s", registry.host(),
+		initDigest), fmt.Sprintf("oci://%s/charts/istio:1.1.8-ccp1", registry.host()))
+	ist := &operatorv1alpha1.Istio{}
+	if err := r.FetchIstioCharts(context.TODO(), ist, spec, workspace); err != nil {
+		t.Fatal(err)
+	}
+	if !ist.Status.IsConditionTrue(operatorv1alpha1.IstioConditionChartVerified) {
+		t.Error("pinned chart not verified")
+	}
+
+	// a chart pushed again with the same tag is rejected
+	registry.push("charts/istio-init", "1.1.8-ccp1", []byte("rebuilt istio-init chart"))
+	if err := os.RemoveAll(r.ChartCacheDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.FetchIstioCharts(context.TODO(), ist, spec, workspace); !IsChartDigestMismatch(err) {
+		t.Fatalf("expected chart digest mismatch, got %v", err)
+	}
+	condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartVerified)
+	if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != "ChartDigestMismatch" {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+}
+
+func TestPullOCIChartWithPullSecret(t *testing.T) {
+	registry, _, _, cleanup := testOCIReconciler(t)
+	defer cleanup()
+	registry.username, registry.password = "ccp", "secret"
+	registry.push("charts/istio", "1.1.8-ccp1", []byte("istio chart"))
+	config, _ := json.Marshal(dockerConfig{Auths: map[string]dockerConfigEntry{
+		"https://" + registry.host(): {Auth: base64.StdEncoding.EncodeToString([]byte("ccp:secret"))},
+	}})
+	secret := &corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: config},
+	}
+	username, password, err := RegistryCredentials(secret, registry.host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "ccp" || password != "secret" {
+		t.Errorf("unexpected credentials %s:%s", username, password)
+	}
+
+	ref, err := parseOCIReference(fmt.Sprintf("oci://%s/charts/istio:1.1.8-ccp1", registry.host()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (&registryClient{client: http.DefaultClient}).pullChart(ref, ""); err == nil {
+		t.Error("pulled a chart without credentials")
+	}
+	body, _, err := (&registryClient{client: http.DefaultClient, username: username,
+		password: password}).pullChart(ref, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, err := ioutil.ReadAll(body); err != nil || string(b) != "istio chart" {
+		t.Errorf("unexpected chart %q, %v", b, err)
+	}
+}
@@ -0,0 +1,444 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// separator between the path or URL of a chart in istio CR spec and its sha256 digest
+	chartDigestSeparator = "@sha256:"
+	// directory of the charts downloaded by istio operator if --chart-cache-dir is not set
+	DefaultChartCacheDir = "/var/cache/ccp-istio-operator/charts"
+	// largest chart downloaded by istio operator
+	maxChartSize = 64 << 20
+	// how long downloading a chart can take
+	chartDownloadTimeout = 5 * time.Minute
+)
+
+var chartDigestRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// ChartDigestError is returned when a chart does not match the sha256 digest it is
+// pinned to in istio CR spec
+type ChartDigestError struct {
+	// path or URL of the chart
+	Chart string
+	// sha256 digest in istio CR spec
+	Expected string
+	// sha256 digest of the chart
+	Actual string
+}
+
+func (e *ChartDigestError) Error() string {
+	return fmt.Sprintf("chart %s has sha256 digest %s but is pinned to sha256 digest %s in istio CR spec",
+		e.Chart, e.Actual, e.Expected)
+}
+
+// IsChartDigestMismatch returns true if err means that a chart does not match its digest
+func IsChartDigestMismatch(err error) bool {
+	_, ok := err.(*ChartDigestError)
+	return ok
+}
+
+// split a chart in istio CR spec into its path or URL and its sha256 digest, the digest
+// is empty if the chart is not pinned to a digest
+func ParseChartReference(chart string) (string, string) {
+	if i := strings.LastIndex(chart, chartDigestSeparator); i >= 0 {
+		return chart[:i], chart[i+len(chartDigestSeparator):]
+	}
+	return chart, ""
+}
+
+// check if the path or URL of a chart is a URL fetched by istio operator, an http, https
+// or oci URL, or a chart of the chart bundle of istio CR
+func IsRemoteChart(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") ||
+		IsOCIChart(location) || IsBundleChart(location)
+}
+
+// path of a chart downloaded by istio operator in the workspace
+func ChartFilePath(workspace string, chartName string, location string) string {
+	name := path.Base(location)
+	if IsOCIChart(location) {
+		// oci://registry/repository/istio:1.1.8-ccp1 is downloaded to istio-1.1.8-ccp1.tgz
+		name = strings.Replace(name, ":", "-", 1) + ".tgz"
+	} else if IsBundleChart(location) {
+		name = bundleChartName(location)
+	} else if u, err := url.Parse(location); err == nil {
+		name = path.Base(u.Path)
+	}
+	return filepath.Join(workspace, "charts", chartName, name)
+}
+
+// path of a chart in istio CR spec used by helm, the chart downloaded into the workspace
+// if it is a URL
+func IstioReleaseChart(workspace string, chartName string, chart string) string {
+	location, _ := ParseChartReference(chart)
+	if IsRemoteChart(location) {
+		return ChartFilePath(workspace, chartName, location)
+	}
+	return location
+}
+
+// download the charts of istio CR's spec that are URLs into the workspace and check
+// that the charts pinned to a sha256 digest match it. The downloaded charts are kept in
+// the chart cache of istio operator and are not downloaded again. The charts of the chart
+// bundle of istio CR are verified against the digests of its signed manifest. The
+// ChartVerified condition is set in istio CR's status if a chart is pinned to a digest or
+// is in the chart bundle.
+func (r *IstioReconciler) FetchIstioCharts(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec, workspace string) error {
+	charts := map[string]string{
+		operatorv1alpha1.IstioInitHelmChartName: spec.CcpIstioInit.Chart,
+		IstioControlPlaneChartName(spec):        IstioControlPlaneChart(spec),
+	}
+	pinned := false
+	var bundle *chartBundle
+	for chartName, chart := range charts {
+		location, digest := ParseChartReference(chart)
+		if digest != "" {
+			pinned = true
+		}
+		var err error
+		if IsBundleChart(location) && bundle == nil {
+			// the bundle is read and verified once for all of its charts
+			bundle, err = r.LoadChartBundle(ctx, ist, spec.ChartBundle)
+		}
+		if err == nil && IsRemoteChart(location) {
+			err = r.fetchRemoteChart(ctx, ist, spec, bundle, location, digest,
+				ChartFilePath(workspace, chartName, location))
+		} else if err == nil && digest != "" {
+			err = verifyChartDigest(location, digest)
+		}
+		if err != nil {
+			if IsChartDigestMismatch(err) {
+				ist.Status.SetCondition(operatorv1alpha1.IstioCondition{
+					Type:               operatorv1alpha1.IstioConditionChartVerified,
+					Status:             corev1.ConditionFalse,
+					ObservedGeneration: ist.ObjectMeta.Generation,
+					Reason:             "ChartDigestMismatch",
+					Message:            err.Error(),
+				})
+			} else if IsChartBundleInvalid(err) {
+				ist.Status.SetCondition(operatorv1alpha1.IstioCondition{
+					Type:               operatorv1alpha1.IstioConditionChartVerified,
+					Status:             corev1.ConditionFalse,
+					ObservedGeneration: ist.ObjectMeta.Generation,
+					Reason:             "ChartBundleInvalid",
+					Message:            err.Error(),
+				})
+			}
+			return err
+		}
+	}
+	if bundle != nil {
+		ist.Status.SetCondition(operatorv1alpha1.IstioCondition{
+			Type:               operatorv1alpha1.IstioConditionChartVerified,
+			Status:             corev1.ConditionTrue,
+			ObservedGeneration: ist.ObjectMeta.Generation,
+			Reason:             "ChartBundleVerified",
+			Message: fmt.Sprintf("the manifest of chart bundle %s is signed and the charts match its digests",
+				bundle.source),
+		})
+	} else if pinned {
+		ist.Status.SetCondition(operatorv1alpha1.IstioCondition{
+			Type:               operatorv1alpha1.IstioConditionChartVerified,
+			Status:             corev1.ConditionTrue,
+			ObservedGeneration: ist.ObjectMeta.Generation,
+			Reason:             "ChartDigestVerified",
+			Message:            "the charts pinned to a sha256 digest match their digest",
+		})
+	}
+	return nil
+}
+
+// get a chart from the chart cache or download it into the cache, and link it into the
+// workspace. The charts of the chart bundle are pinned to their digest in its manifest.
+func (r *IstioReconciler) fetchRemoteChart(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec, bundle *chartBundle, location string, digest string, file string) error {
+	cache := chartCache{dir: r.ChartCacheDir}
+	if cache.dir == "" {
+		cache.dir = DefaultChartCacheDir
+	}
+	if IsBundleChart(location) {
+		manifestDigest, err := bundle.digest(bundleChartName(location))
+		if err != nil {
+			return err
+		}
+		if digest != "" && digest != manifestDigest {
+			return &ChartDigestError{Chart: location, Expected: digest, Actual: manifestDigest}
+		}
+		digest = manifestDigest
+	}
+	cached, err := cache.lookup(location, digest)
+	if err != nil {
+		return err
+	}
+	if cached == "" {
+		r.Log.Info(fmt.Sprintf("downloading chart %s", location))
+		var body io.ReadCloser
+		if IsOCIChart(location) {
+			body, digest, err = r.pullOCIChart(ctx, ist, spec.ChartSource, location, digest)
+		} else if IsBundleChart(location) {
+			body, err = bundle.chart(bundleChartName(location))
+		} else {
+			body, err = r.downloadChart(ctx, ist, spec.ChartSource, location)
+		}
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if cached, err = cache.store(location, digest, body); err != nil {
+			if mismatch, ok := err.(*ChartDigestError); ok && IsBundleChart(location) {
+				return &ChartBundleError{Bundle: bundle.source, Reason: fmt.Sprintf("chart %s has sha256 digest %s "+
+					"but its manifest has sha256 digest %s", bundleChartName(location), mismatch.Actual, digest)}
+			}
+			return err
+		}
+		r.Log.Info(fmt.Sprintf("chart %s downloaded to %s", location, cached))
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return errors.New(fmt.Sprintf("failed to link chart %s into the workspace, %s", location, err.Error()))
+	}
+	if err := os.Symlink(cached, file); err != nil && !os.IsExist(err) {
+		return errors.New(fmt.Sprintf("failed to link chart %s into the workspace, %s", location, err.Error()))
+	}
+	return nil
+}
+
+// download a chart from an http or https URL with the credentials in the secret of the
+// chart source
+func (r *IstioReconciler) downloadChart(ctx context.Context, ist *operatorv1alpha1.Istio,
+	source *operatorv1alpha1.IstioChartSource, location string) (io.ReadCloser, error) {
+	request, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to download chart %s, %s", location, err.Error()))
+	}
+	httpClient, err := ChartHTTPClient(source)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil && source.SecretName != "" {
+		secret, err := r.chartSourceSecret(ctx, ist, source.SecretName)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(secret.Data["token"]) > 0:
+			request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(secret.Data["token"])))
+		case len(secret.Data["username"]) > 0:
+			request.SetBasicAuth(string(secret.Data["username"]), string(secret.Data["password"]))
+		default:
+			return nil, errors.New(fmt.Sprintf("secret %s has neither the key token nor the keys username and "+
+				"password of the chart server", source.SecretName))
+		}
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to download chart %s, %s", location, err.Error()))
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, errors.New(fmt.Sprintf("failed to download chart %s, %s", location, response.Status))
+	}
+	return response.Body, nil
+}
+
+// http client that downloads charts, with the CA bundle of the chart source
+func ChartHTTPClient(source *operatorv1alpha1.IstioChartSource) (*http.Client, error) {
+	httpClient := &http.Client{Timeout: chartDownloadTimeout}
+	if source == nil || source.CABundle == "" {
+		return httpClient, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(source.CABundle)) {
+		return nil, errors.New("failed to download charts, spec.chartSource.caBundle of istio CR has no PEM " +
+			"encoded certificates")
+	}
+	// the settings of http.DefaultTransport, which cannot be cloned with go 1.12
+	httpClient.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{RootCAs: pool},
+	}
+	return httpClient, nil
+}
+
+// get a secret of the chart source in the namespace of istio CR, the secret is read
+// from the API server so that secrets are not cached
+func (r *IstioReconciler) chartSourceSecret(ctx context.Context, ist *operatorv1alpha1.Istio,
+	name string) (*corev1.Secret, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	var secret corev1.Secret
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: ist.ObjectMeta.Namespace, Name: name},
+		&secret); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get secret %s with the credentials of the chart server, %s",
+			name, err.Error()))
+	}
+	return &secret, nil
+}
+
+// sha256 digest of a file
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// check that a chart on disk matches its sha256 digest
+func verifyChartDigest(location string, digest string) error {
+	actual, err := fileDigest(location)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to verify the digest of chart %s, %s", location, err.Error()))
+	}
+	if actual != digest {
+		return &ChartDigestError{Chart: location, Expected: digest, Actual: actual}
+	}
+	return nil
+}
+
+// chartCache keeps the downloaded charts in a directory by their sha256 digest,
+// sha256/<digest>.tgz, and the digest of the chart downloaded from a URL in
+// urls/<sha256 of the URL>. A chart pinned to a digest is downloaded only if the cache
+// has no chart with the digest, and a chart that is not pinned is downloaded once.
+type chartCache struct {
+	dir string
+}
+
+// path of the chart with a sha256 digest in the cache
+func (c chartCache) chartPath(digest string) string {
+	return filepath.Join(c.dir, "sha256", digest+".tgz")
+}
+
+// path of the digest of the chart downloaded from a URL in the cache
+func (c chartCache) urlPath(location string) string {
+	hash := sha256.Sum256([]byte(location))
+	return filepath.Join(c.dir, "urls", hex.EncodeToString(hash[:]))
+}
+
+// path of a chart in the cache, empty if the chart is not in the cache
+func (c chartCache) lookup(location string, digest string) (string, error) {
+	if digest == "" {
+		b, err := ioutil.ReadFile(c.urlPath(location))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("failed to read chart cache %s, %s", c.dir, err.Error()))
+		}
+		digest = strings.TrimSpace(string(b))
+	}
+	file := c.chartPath(digest)
+	actual, err := fileDigest(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read chart cache %s, %s", c.dir, err.Error()))
+	}
+	if actual != digest {
+		// the cached chart is corrupted, it is downloaded again
+		os.Remove(file)
+		return "", nil
+	}
+	return file, nil
+}
+
+// store a downloaded chart in the cache, returns a ChartDigestError if the chart is
+// pinned to another digest
+func (c chartCache) store(location string, digest string, body io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, "sha256"), 0755); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to create chart cache %s, %s", c.dir, err.Error()))
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, "urls"), 0755); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to create chart cache %s, %s", c.dir, err.Error()))
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, "sha256"), "download-")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to download chart %s, %s", location, err.Error()))
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, maxChartSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to download chart %s, %s", location, err.Error()))
+	}
+	if n > maxChartSize {
+		return "", errors.New(fmt.Sprintf("failed to download chart %s, it is larger than %d bytes", location,
+			maxChartSize))
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if digest != "" && actual != digest {
+		return "", &ChartDigestError{Chart: location, Expected: digest, Actual: actual}
+	}
+	file := c.chartPath(actual)
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to store chart %s in chart cache %s, %s", location, c.dir,
+			err.Error()))
+	}
+	if err := ioutil.WriteFile(c.urlPath(location), []byte(actual), 0644); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to store chart %s in chart cache %s, %s", location, c.dir,
+			err.Error()))
+	}
+	return file, nil
+}
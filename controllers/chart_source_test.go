@@ -0,0 +1,376 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// sha256 digest of a chart in the chart source tests
+func testChartDigest(chart string) string {
+	hash := sha256.Sum256([]byte(chart))
+	return hex.EncodeToString(hash[:])
+}
+
+// temporary directory of a test, removed by the test
+func testTempDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestParseChartReference(t *testing.T) {
+	digest := testChartDigest("istio chart")
+	tests := []struct {
+		chart          string
+		expectedChart  string
+		expectedDigest string
+	}{
+		{chart: "/charts/istio-1.1.8-ccp1.tgz", expectedChart: "/charts/istio-1.1.8-ccp1.tgz"},
+		{chart: "/charts/istio-1.1.8-ccp1.tgz@sha256:" + digest, expectedChart: "/charts/istio-1.1.8-ccp1.tgz",
+			expectedDigest: digest},
+		{chart: "https://charts.example.com/istio.tgz@sha256:" + digest,
+			expectedChart: "https://charts.example.com/istio.tgz", expectedDigest: digest},
+		// the tag of an oci URL is not a digest
+		{chart: "oci://registry.example.com/charts/istio:1.1.8-ccp1",
+			expectedChart: "oci://registry.example.com/charts/istio:1.1.8-ccp1"},
+		{chart: "oci://registry.example.com/charts/istio:1.1.8-ccp1@sha256:" + digest,
+			expectedChart: "oci://registry.example.com/charts/istio:1.1.8-ccp1", expectedDigest: digest},
+	}
+	for _, test := range tests {
+		t.Run(test.chart, func(t *testing.T) {
+			chart, digest := ParseChartReference(test.chart)
+			if chart != test.expectedChart || digest != test.expectedDigest {
+				t.Errorf("expected %s and digest %q, got %s and digest %q", test.expectedChart,
+					test.expectedDigest, chart, digest)
+			}
+		})
+	}
+}
+
+func TestIstioReleaseChart(t *testing.T) {
+	digest := testChartDigest("istio chart")
+	tests := []struct {
+		chart    string
+		remote   bool
+		expected string
+	}{
+		{chart: "/charts/istio-1.1.8-ccp1.tgz", expected: "/charts/istio-1.1.8-ccp1.tgz"},
+		{chart: "/charts/istio-1.1.8-ccp1.tgz@sha256:" + digest, expected: "/charts/istio-1.1.8-ccp1.tgz"},
+		{chart: "https://charts.example.com/istio-1.1.8-ccp1.tgz?token=x@sha256:" + digest, remote: true,
+			expected: "/workspace/charts/istio/istio-1.1.8-ccp1.tgz"},
+		{chart: "http://charts.example.com/istio-1.1.8-ccp1.tgz", remote: true,
+			expected: "/workspace/charts/istio/istio-1.1.8-ccp1.tgz"},
+		{chart: "oci://registry.example.com/charts/istio:1.1.8-ccp1", remote: true,
+			expected: "/workspace/charts/istio/istio-1.1.8-ccp1.tgz"},
+	}
+	for _, test := range tests {
+		t.Run(test.chart, func(t *testing.T) {
+			location, _ := ParseChartReference(test.chart)
+			if IsRemoteChart(location) != test.remote {
+				t.Errorf("expected remote %v for %s", test.remote, location)
+			}
+			if chart := IstioReleaseChart("/workspace", "istio", test.chart); chart != test.expected {
+				t.Errorf("expected chart %s, got %s", test.expected, chart)
+			}
+		})
+	}
+}
+
+func TestVerifyChartDigest(t *testing.T) {
+	dir := testTempDir(t, "chart-")
+	defer os.RemoveAll(dir)
+	chart := filepath.Join(dir, "istio.tgz")
+	if err := ioutil.WriteFile(chart, []byte("istio chart"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		chart    string
+		digest   string
+		mismatch bool
+		wantErr  bool
+	}{
+		{name: "matching digest", chart: chart, digest: testChartDigest("istio chart")},
+		{name: "other digest", chart: chart, digest: testChartDigest("other chart"), mismatch: true,
+			wantErr: true},
+		{name: "missing chart", chart: filepath.Join(dir, "missing.tgz"), digest: testChartDigest("istio chart"),
+			wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyChartDigest(test.chart, test.digest)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("verifyChartDigest() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if IsChartDigestMismatch(err) != test.mismatch {
+				t.Errorf("expected digest mismatch %v, got %v", test.mismatch, err)
+			}
+		})
+	}
+}
+
+func TestChartCache(t *testing.T) {
+	const location = "https://charts.example.com/istio.tgz"
+	istioDigest := testChartDigest("istio chart")
+
+	tests := []struct {
+		name string
+		// charts stored in the cache before the lookup, by location
+		stored map[string]string
+		// corrupt the cached chart of the location before the lookup
+		corrupt bool
+		// digest the chart is pinned to in the lookup
+		digest string
+		cached bool
+	}{
+		{name: "empty cache", digest: istioDigest},
+		{name: "empty cache, not pinned"},
+		{name: "pinned chart", stored: map[string]string{location: "istio chart"}, digest: istioDigest,
+			cached: true},
+		{name: "chart of another URL with the pinned digest",
+			stored: map[string]string{"https://mirror.example.com/istio.tgz": "istio chart"}, digest: istioDigest,
+			cached: true},
+		{name: "chart not pinned, found by its URL", stored: map[string]string{location: "istio chart"},
+			cached: true},
+		{name: "chart not pinned, another URL",
+			stored: map[string]string{"https://mirror.example.com/istio.tgz": "istio chart"}},
+		{name: "chart pinned to another digest", stored: map[string]string{location: "istio chart"},
+			digest: testChartDigest("other chart")},
+		{name: "corrupted chart", stored: map[string]string{location: "istio chart"}, corrupt: true,
+			digest: istioDigest},
+		{name: "corrupted chart, not pinned", stored: map[string]string{location: "istio chart"}, corrupt: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := chartCache{dir: testTempDir(t, "chart-cache-")}
+			defer os.RemoveAll(cache.dir)
+			for storedLocation, chart := range test.stored {
+				if _, err := cache.store(storedLocation, "", strings.NewReader(chart)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.corrupt {
+				if err := ioutil.WriteFile(cache.chartPath(istioDigest), []byte("corrupted"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file, err := cache.lookup(location, test.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (file != "") != test.cached {
+				t.Fatalf("expected cached %v, got %q", test.cached, file)
+			}
+			if test.cached && file != cache.chartPath(istioDigest) {
+				t.Errorf("expected chart %s, got %s", cache.chartPath(istioDigest), file)
+			}
+			if _, err := os.Stat(cache.chartPath(istioDigest)); test.corrupt && !os.IsNotExist(err) {
+				t.Errorf("corrupted chart %s not removed from the cache", cache.chartPath(istioDigest))
+			}
+		})
+	}
+}
+
+func TestChartCacheStore(t *testing.T) {
+	const location = "https://charts.example.com/istio.tgz"
+	tests := []struct {
+		name     string
+		chart    []byte
+		digest   string
+		mismatch bool
+		wantErr  bool
+	}{
+		{name: "chart pinned to its digest", chart: []byte("istio chart"), digest: testChartDigest("istio chart")},
+		{name: "chart not pinned", chart: []byte("istio chart")},
+		{name: "chart pinned to another digest", chart: []byte("istio chart"),
+			digest: testChartDigest("other chart"), mismatch: true, wantErr: true},
+		{name: "chart too large", chart: bytes.Repeat([]byte("x"), maxChartSize+1), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := chartCache{dir: testTempDir(t, "chart-cache-")}
+			defer os.RemoveAll(cache.dir)
+
+			file, err := cache.store(location, test.digest, bytes.NewReader(test.chart))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("store() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if IsChartDigestMismatch(err) != test.mismatch {
+				t.Errorf("expected digest mismatch %v, got %v", test.mismatch, err)
+			}
+			// neither the chart nor its download are left in the cache after an error
+			files, _ := ioutil.ReadDir(filepath.Join(cache.dir, "sha256"))
+			if test.wantErr {
+				if len(files) != 0 {
+					t.Errorf("chart cache not empty after an error: %d files", len(files))
+				}
+				return
+			}
+			digest := testChartDigest(string(test.chart))
+			if file != cache.chartPath(digest) || len(files) != 1 {
+				t.Errorf("expected chart %s alone in the cache, got %s and %d files", cache.chartPath(digest),
+					file, len(files))
+			}
+			if cached, err := cache.lookup(location, ""); err != nil || cached != file {
+				t.Errorf("chart not found by its URL: %q, %v", cached, err)
+			}
+		})
+	}
+}
+
+func TestFetchIstioCharts(t *testing.T) {
+	const chart = "istio chart"
+	digest := testChartDigest(chart)
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, password, ok := req.BasicAuth(); ok && (user != "istio" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if token := req.Header.Get("Authorization"); strings.HasPrefix(token, "Bearer ") &&
+			token != "Bearer istio-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		downloads++
+		w.Write([]byte(chart))
+	}))
+	defer server.Close()
+	local := testTempDir(t, "chart-")
+	defer os.RemoveAll(local)
+	localChart := filepath.Join(local, "istio-init.tgz")
+	if err := ioutil.WriteFile(localChart, []byte(chart), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secret := func(data map[string]string) runtime.Object {
+		s := &corev1.Secret{Data: map[string][]byte{}}
+		s.Namespace, s.Name = "default", "charts"
+		for key, value := range data {
+			s.Data[key] = []byte(value)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name       string
+		chart      string
+		source     *operatorv1alpha1.IstioChartSource
+		objs       []runtime.Object
+		downloaded int
+		// reason of the ChartVerified condition, empty if it is not set
+		reason  string
+		status  corev1.ConditionStatus
+		wantErr bool
+	}{
+		{name: "chart not pinned", chart: server.URL + "/istio.tgz", downloaded: 1},
+		{name: "chart pinned to its digest", chart: server.URL + "/istio.tgz@sha256:" + digest, downloaded: 1,
+			reason: "ChartDigestVerified", status: corev1.ConditionTrue},
+		{name: "chart pinned to another digest",
+			chart: server.URL + "/istio.tgz@sha256:" + testChartDigest("other chart"), downloaded: 1,
+			reason: "ChartDigestMismatch", status: corev1.ConditionFalse, wantErr: true},
+		{name: "local chart pinned to its digest", chart: localChart + "@sha256:" + digest,
+			reason: "ChartDigestVerified", status: corev1.ConditionTrue},
+		{name: "local chart pinned to another digest", chart: localChart + "@sha256:" + testChartDigest("other"),
+			reason: "ChartDigestMismatch", status: corev1.ConditionFalse, wantErr: true},
+		{name: "basic authentication", chart: server.URL + "/istio.tgz",
+			source:     &operatorv1alpha1.IstioChartSource{SecretName: "charts"},
+			objs:       []runtime.Object{secret(map[string]string{"username": "istio", "password": "secret"})},
+			downloaded: 1},
+		{name: "bearer token", chart: server.URL + "/istio.tgz",
+			source:     &operatorv1alpha1.IstioChartSource{SecretName: "charts"},
+			objs:       []runtime.Object{secret(map[string]string{"token": "istio-token\n"})},
+			downloaded: 1},
+		{name: "wrong password", chart: server.URL + "/istio.tgz",
+			source:  &operatorv1alpha1.IstioChartSource{SecretName: "charts"},
+			objs:    []runtime.Object{secret(map[string]string{"username": "istio", "password": "wrong"})},
+			wantErr: true},
+		{name: "secret without credentials", chart: server.URL + "/istio.tgz",
+			source:  &operatorv1alpha1.IstioChartSource{SecretName: "charts"},
+			objs:    []runtime.Object{secret(map[string]string{"ca.crt": "certificate"})},
+			wantErr: true},
+		{name: "missing secret", chart: server.URL + "/istio.tgz",
+			source: &operatorv1alpha1.IstioChartSource{SecretName: "charts"}, wantErr: true},
+		{name: "CA bundle without certificates", chart: server.URL + "/istio.tgz",
+			source: &operatorv1alpha1.IstioChartSource{CABundle: "not a certificate"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			downloads = 0
+			r := fakeIstioReconciler(test.objs...)
+			r.ChartCacheDir = testTempDir(t, "chart-cache-")
+			defer os.RemoveAll(r.ChartCacheDir)
+			workspace := testTempDir(t, "workspace-")
+			defer os.RemoveAll(workspace)
+			ist := &operatorv1alpha1.Istio{}
+			ist.Namespace, ist.Name = "default", "ccp-istio"
+			ist.Spec.ChartSource = test.source
+			ist.Spec.CcpIstioInit.Chart = localChart
+			ist.Spec.CcpIstio.Chart = test.chart
+
+			err := r.FetchIstioCharts(context.TODO(), ist, ist.Spec, workspace)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("FetchIstioCharts() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if downloads != test.downloaded {
+				t.Errorf("expected %d downloads, got %d", test.downloaded, downloads)
+			}
+			condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartVerified)
+			if test.reason == "" && condition != nil {
+				t.Errorf("unexpected condition %+v", *condition)
+			}
+			if test.reason != "" && (condition == nil || condition.Reason != test.reason ||
+				condition.Status != test.status) {
+				t.Errorf("expected condition %s %s, got %+v", test.reason, test.status, condition)
+			}
+			if err != nil {
+				return
+			}
+			// the chart is linked into the workspace and is not downloaded again
+			b, err := ioutil.ReadFile(IstioReleaseChart(workspace, "istio", test.chart))
+			if err != nil || string(b) != chart {
+				t.Errorf("chart not in the workspace: %q, %v", b, err)
+			}
+			again := testTempDir(t, "workspace-")
+			defer os.RemoveAll(again)
+			if err := r.FetchIstioCharts(context.TODO(), ist, ist.Spec, again); err != nil {
+				t.Fatal(err)
+			}
+			if downloads != test.downloaded {
+				t.Errorf("chart downloaded again from the cache, %d downloads", downloads)
+			}
+		})
+	}
+}
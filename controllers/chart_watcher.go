@@ -0,0 +1,224 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/fsnotify.v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// time without changes in CHARTS_PATH after which the changed charts are checked, so that
+// a chart being copied is checked only once it is complete
+const DefaultChartSettleInterval = 2 * time.Second
+
+// IstioChartWatcher watches CHARTS_PATH for charts that are added, replaced or removed on
+// disk. Once the changes settle, the catalog of istio releases is scanned again and the
+// istio CRs with charts installed from CHARTS_PATH are reconciled to compare the charts
+// with the digests they were installed with.
+type IstioChartWatcher struct {
+	client.Client
+	Log logr.Logger
+	// directory of istio's charts, it is not watched if it is not set
+	ChartsPath string
+	// istio CRs reconciled when the charts change are sent to Events
+	Events chan<- event.GenericEvent
+	// catalog of istio releases scanned again when the charts change, not scanned if nil
+	Catalog *IstioReleaseCatalog
+	// time without changes before the charts are checked, DefaultChartSettleInterval if not set
+	SettleInterval time.Duration
+}
+
+// Start watches CHARTS_PATH until stop is closed, it is run by the manager
+func (w *IstioChartWatcher) Start(stop <-chan struct{}) error {
+	if w.ChartsPath == "" {
+		// the manager stops when a runnable returns
+		<-stop
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(w.ChartsPath); err != nil {
+			// the watcher's inotify instance and goroutine are released
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		// the charts are still compared with their digests when istio CRs are reconciled
+		w.Log.Error(err, fmt.Sprintf("failed to watch CHARTS_PATH %s, changes to the charts are not "+
+			"detected as soon as they happen", w.ChartsPath))
+		<-stop
+		return nil
+	}
+	defer watcher.Close()
+	w.Log.Info(fmt.Sprintf("watching CHARTS_PATH %s for changes to istio's charts", w.ChartsPath))
+
+	interval := w.SettleInterval
+	if interval == 0 {
+		interval = DefaultChartSettleInterval
+	}
+	changed := map[string]bool{}
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e := <-watcher.Events:
+			// charts mounted from ConfigMaps are symlinks to files that are replaced
+			// together, so every change in CHARTS_PATH is counted
+			changed[filepath.Base(e.Name)] = true
+			settled = time.After(interval)
+		case err := <-watcher.Errors:
+			w.Log.Error(err, fmt.Sprintf("error watching CHARTS_PATH %s", w.ChartsPath))
+		case <-settled:
+			w.chartsChanged(changed)
+			changed = map[string]bool{}
+			settled = nil
+		}
+	}
+}
+
+// scan the catalog again and reconcile the istio CRs with charts installed from CHARTS_PATH
+func (w *IstioChartWatcher) chartsChanged(changed map[string]bool) {
+	var files []string
+	for file := range changed {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	w.Log.Info(fmt.Sprintf("%s changed in CHARTS_PATH %s", strings.Join(files, ", "), w.ChartsPath))
+
+	ctx := context.Background()
+	if w.Catalog != nil {
+		if err := w.Catalog.Sync(ctx); err != nil {
+			w.Log.Error(err, fmt.Sprintf("failed to scan CHARTS_PATH %s for istio releases", w.ChartsPath))
+		}
+	}
+	var IstioList operatorv1alpha1.IstioList
+	if err := w.List(ctx, &IstioList); err != nil {
+		w.Log.Error(err, "Failed to get list of istio CRs")
+		return
+	}
+	chartsPath := filepath.Clean(w.ChartsPath) + string(os.PathSeparator)
+	for i := range IstioList.Items {
+		istio := &IstioList.Items[i]
+		for _, chart := range istio.Status.InstalledCharts {
+			if strings.HasPrefix(filepath.Clean(chart.Path), chartsPath) {
+				w.Events <- event.GenericEvent{Meta: istio, Object: istio}
+				break
+			}
+		}
+	}
+}
+
+// the local charts of istio CR's spec installed by an operation on istio, with their
+// sha256 digest. Charts that are URLs are pinned to a digest instead.
+func InstalledIstioCharts(spec operatorv1alpha1.IstioSpec) ([]operatorv1alpha1.IstioInstalledChart, error) {
+	var charts []operatorv1alpha1.IstioInstalledChart
+	for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName, IstioControlPlaneChartName(spec)} {
+		chart := spec.CcpIstioInit.Chart
+		if chartName != operatorv1alpha1.IstioInitHelmChartName {
+			chart = IstioControlPlaneChart(spec)
+		}
+		location, _ := ParseChartReference(chart)
+		if location == "" || IsRemoteChart(location) {
+			continue
+		}
+		digest, err := fileDigest(location)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to compute the digest of chart %s, %s", location,
+				err.Error()))
+		}
+		charts = append(charts, operatorv1alpha1.IstioInstalledChart{Name: chartName, Path: location,
+			Sha256: digest})
+	}
+	return charts, nil
+}
+
+// compare the charts installed by istio CR with their digests when they were installed and
+// set the ChartContentChanged condition of istio CR. Charts removed from disk are not
+// changed, they fail the next operation on istio. Returns true if the condition changed.
+func (r *IstioReconciler) CheckIstioChartContent(ist *operatorv1alpha1.Istio) (bool, error) {
+	var messages []string
+	for _, chart := range ist.Status.InstalledCharts {
+		digest, err := fileDigest(chart.Path)
+		if os.IsNotExist(err) {
+			r.Log.Info(fmt.Sprintf("chart %s installed by Istio CR %s not found", chart.Path, istioCRName(ist)))
+			continue
+		}
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("failed to compute the digest of chart %s, %s", chart.Path,
+				err.Error()))
+		}
+		if digest != chart.Sha256 {
+			messages = append(messages, fmt.Sprintf("chart %s changed on disk, sha256 %s was installed and it is "+
+				"now %s", chart.Path, chart.Sha256, digest))
+		}
+	}
+	existing := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartContentChanged)
+	if len(messages) == 0 && existing == nil {
+		return false, nil
+	}
+	condition := operatorv1alpha1.IstioCondition{
+		Type:               operatorv1alpha1.IstioConditionChartContentChanged,
+		Status:             corev1.ConditionFalse,
+		ObservedGeneration: ist.ObjectMeta.Generation,
+		Reason:             "ChartContentUnchanged",
+		Message:            "the charts installed are unchanged",
+	}
+	if len(messages) != 0 {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "ChartContentChanged"
+		condition.Message = strings.Join(messages, "; ")
+	}
+	// the condition set when the charts were installed is kept while they are unchanged
+	if existing != nil && existing.Status == condition.Status &&
+		(condition.Status == corev1.ConditionFalse || existing.Message == condition.Message) {
+		return false, nil
+	}
+	if condition.Status == corev1.ConditionTrue {
+		r.Log.Info(fmt.Sprintf("Istio CR %s: %s", istioCRName(ist), condition.Message))
+	}
+	ist.Status.SetCondition(condition)
+	return true, nil
+}
+
+// record the charts installed by an operation on istio, the ChartContentChanged condition
+// is reset as istio now has the charts on disk
+func RecordInstalledIstioCharts(ist *operatorv1alpha1.Istio, charts []operatorv1alpha1.IstioInstalledChart) {
+	ist.Status.InstalledCharts = charts
+	if ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartContentChanged) != nil {
+		ist.Status.SetCondition(operatorv1alpha1.IstioCondition{
+			Type:               operatorv1alpha1.IstioConditionChartContentChanged,
+			Status:             corev1.ConditionFalse,
+			ObservedGeneration: ist.ObjectMeta.Generation,
+			Reason:             "ChartsInstalled",
+			Message:            "the charts on disk were installed",
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestCheckIstioChartContent(t *testing.T) {
+	chartsPath, cleanup := testChartsPath(t)
+	defer cleanup()
+	r := fakeIstioReconciler()
+	writeTestChartArchive(t, chartsPath, "istio-init-1.1.8-ccp1.tgz", "istio-init",
+		"name: istio-init\nversion: 1.1.8\n")
+	istioChart := writeTestChartArchive(t, chartsPath, "istio-1.1.8-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.1.8\n")
+	ist := &operatorv1alpha1.Istio{}
+	ist.Spec.CcpIstioInit.Chart = filepath.Join(chartsPath, "istio-init-1.1.8-ccp1.tgz")
+	ist.Spec.CcpIstio.Chart = istioChart
+	charts, err := InstalledIstioCharts(ist.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 2 {
+		t.Fatalf("expected 2 installed charts, got %+v", charts)
+	}
+	RecordInstalledIstioCharts(ist, charts)
+
+	if changed, err := r.CheckIstioChartContent(ist); err != nil || changed {
+		t.Fatalf("charts changed %v, %v", changed, err)
+	}
+	if condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartContentChanged); condition != nil {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+
+	// the istio chart is rebuilt with the same name
+	writeTestChartArchive(t, chartsPath, "istio-1.1.8-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.1.8\nappVersion: 1.1.8\n")
+	if changed, err := r.CheckIstioChartContent(ist); err != nil || !changed {
+		t.Fatalf("rebuilt chart not detected, %v", err)
+	}
+	condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionChartContentChanged)
+	if condition == nil || condition.Status != corev1.ConditionTrue || !strings.Contains(condition.Message, istioChart) {
+		t.Errorf("unexpected condition %+v", condition)
+	}
+	if changed, err := r.CheckIstioChartContent(ist); err != nil || changed {
+		t.Errorf("condition changed again %v, %v", changed, err)
+	}
+
+	// the rebuilt chart is installed
+	charts, err = InstalledIstioCharts(ist.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RecordInstalledIstioCharts(ist, charts)
+	if ist.Status.IsConditionTrue(operatorv1alpha1.IstioConditionChartContentChanged) {
+		t.Error("ChartContentChanged still true after the rebuilt chart is installed")
+	}
+	if changed, err := r.CheckIstioChartContent(ist); err != nil || changed {
+		t.Errorf("installed charts changed %v, %v", changed, err)
+	}
+}
+
+func TestInstalledIstioChartsURLs(t *testing.T) {
+	spec := operatorv1alpha1.IstioSpec{}
+	spec.CcpIstioInit.Chart = "https://charts.example.com/istio-init-1.1.8-ccp1.tgz"
+	spec.CcpIstio.Chart = "oci://registry.example.com/charts/istio:1.1.8-ccp1"
+	charts, err := InstalledIstioCharts(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 0 {
+		t.Errorf("charts that are URLs recorded, %+v", charts)
+	}
+}
+
+func TestIstioChartWatcherMissingChartsPath(t *testing.T) {
+	chartsPath, cleanup := testChartsPath(t)
+	defer cleanup()
+	w := &IstioChartWatcher{Log: zap.Logger(true), ChartsPath: filepath.Join(chartsPath, "missing")}
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- w.Start(stop) }()
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("chart watcher did not stop")
+	}
+}
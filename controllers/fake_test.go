@@ -0,0 +1,140 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// istio reconciler with a fake client serving objs and a fake helm client, for the unit
+// tests that do not need the api-server of the test environment
+func fakeIstioReconciler(objs ...runtime.Object) *IstioReconciler {
+	scheme := runtime.NewScheme()
+	clientgoscheme.AddToScheme(scheme)
+	operatorv1alpha1.AddToScheme(scheme)
+	return &IstioReconciler{
+		Client: fake.NewFakeClientWithScheme(scheme, objs...),
+		Log:    zap.Logger(true),
+		Scheme: scheme,
+		Helm:   newFakeHelm(),
+	}
+}
+
+// helm client that keeps its helm releases in memory and records the helm operations
+type fakeHelm struct {
+	releases map[string]*HelmReleaseInfo
+	history  map[string][]HelmReleaseRevision
+	// manifest of the helm releases by chart
+	manifests map[string]string
+	// helm operations run, for example "install istio-init"
+	ops []string
+	// helm releases whose install or upgrade is pending
+	pending map[string]bool
+}
+
+func newFakeHelm() *fakeHelm {
+	return &fakeHelm{releases: map[string]*HelmReleaseInfo{}, history: map[string][]HelmReleaseRevision{},
+		manifests: map[string]string{}}
+}
+
+func (h *fakeHelm) deploy(release HelmRelease, revision int32, description string) {
+	if previous, found := h.releases[release.Name]; found {
+		h.history[release.Name][len(h.history[release.Name])-1].Status = HelmStatusSuperseded
+		release.Namespace = previous.Namespace
+	}
+	chart := filepath.Base(release.Chart)
+	h.releases[release.Name] = &HelmReleaseInfo{Name: release.Name, Namespace: release.Namespace,
+		Revision: revision, Status: HelmStatusDeployed, Chart: chart}
+	h.history[release.Name] = append(h.history[release.Name], HelmReleaseRevision{Revision: revision,
+		Status: HelmStatusDeployed, Chart: chart, Description: description})
+}
+
+func (h *fakeHelm) Install(release HelmRelease) error {
+	h.ops = append(h.ops, "install "+release.Name)
+	if h.pending[release.Name] {
+		return &InstallPendingError{Release: release.Name, Reason: "its objects cannot be applied yet"}
+	}
+	if _, found := h.releases[release.Name]; found {
+		return &HelmError{Op: "install", Release: release.Name, Err: fmt.Errorf("%s already exists", release.Name)}
+	}
+	h.deploy(release, 1, "Install complete")
+	return nil
+}
+
+func (h *fakeHelm) Upgrade(release HelmRelease) error {
+	h.ops = append(h.ops, "upgrade "+release.Name)
+	if h.pending[release.Name] {
+		return &InstallPendingError{Release: release.Name, Reason: "its objects cannot be applied yet"}
+	}
+	previous, found := h.releases[release.Name]
+	if !found {
+		return &HelmError{Op: "upgrade", Release: release.Name, Err: ErrHelmReleaseNotFound}
+	}
+	h.deploy(release, previous.Revision+1, "Upgrade complete")
+	return nil
+}
+
+func (h *fakeHelm) Uninstall(name string) error {
+	h.ops = append(h.ops, "uninstall "+name)
+	if _, found := h.releases[name]; !found {
+		return &HelmError{Op: "uninstall", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	delete(h.releases, name)
+	delete(h.history, name)
+	return nil
+}
+
+func (h *fakeHelm) List() ([]HelmReleaseInfo, error) {
+	var releases []HelmReleaseInfo
+	for _, release := range h.releases {
+		releases = append(releases, *release)
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].Name < releases[j].Name })
+	return releases, nil
+}
+
+func (h *fakeHelm) Status(name string) (*HelmReleaseInfo, error) {
+	release, found := h.releases[name]
+	if !found {
+		return nil, &HelmError{Op: "status", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	info := *release
+	return &info, nil
+}
+
+func (h *fakeHelm) History(name string) ([]HelmReleaseRevision, error) {
+	if _, found := h.releases[name]; !found {
+		return nil, &HelmError{Op: "history", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	return append([]HelmReleaseRevision{}, h.history[name]...), nil
+}
+
+func (h *fakeHelm) Manifest(name string) (string, error) {
+	release, found := h.releases[name]
+	if !found {
+		return "", &HelmError{Op: "get manifest", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	return h.manifests[release.Chart], nil
+}
@@ -0,0 +1,487 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// label of the objects of the helm 3 releases, helm 3 manages the objects labeled as
+	// managed by Helm and annotated with the name and namespace of their release
+	helm3ManagedByLabel = "app.kubernetes.io/managed-by"
+	// annotation of the objects of the helm 3 releases with the name of their release
+	helm3ReleaseNameAnnotation = "meta.helm.sh/release-name"
+	// annotation of the objects of the helm 3 releases with the namespace of their release
+	helm3ReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+	// annotation of the helm hooks with their delete policies
+	helmHookDeletePolicyAnnotation = "helm.sh/hook-delete-policy"
+)
+
+// helm3Client implements HelmClient in-process like helm 3, without the helm 3 binary.
+// Helm 3 needs no Tiller, its helm releases are stored in secrets in the namespace they
+// are installed in, one secret per revision. The charts are rendered by the istio
+// operator and their objects are applied like the objects of the Rendered installer, the
+// objects in the manifest of a helm release are deleted whether or not they carry the
+// release label like helm 3 does. The names of istio's helm releases are unique in the
+// cluster, the namespace of a helm release is found by listing the release secrets in
+// all namespaces.
+type helm3Client struct {
+	// saves the release secrets and creates the namespaces of the helm releases
+	client client.Client
+	// applies the objects of the helm releases
+	objects client.Client
+	// rest mapper of objects, finds the scope of the kinds of the objects
+	mapper meta.RESTMapper
+	// reads the release secrets from the API server instead of the cache
+	reader client.Reader
+	log    logr.Logger
+}
+
+// NewHelm3Client returns a HelmClient that manages helm 3 releases in-process, the
+// objects of the helm releases are applied with objects and the release secrets are
+// read with reader
+func NewHelm3Client(c client.Client, objects client.Client, mapper meta.RESTMapper, reader client.Reader,
+	log logr.Logger) HelmClient {
+	return &helm3Client{client: c, objects: objects, mapper: mapper, reader: reader, log: log}
+}
+
+// status of a helm 3 release in the format of helm 2, for example pending-upgrade is
+// PENDING_UPGRADE and uninstalled is DELETED
+func helm3Status(status string) string {
+	switch status {
+	case "uninstalled":
+		return HelmStatusDeleted
+	case "uninstalling":
+		return "DELETING"
+	}
+	return strings.ToUpper(strings.Replace(status, "-", "_", -1))
+}
+
+// install a new helm release, an install that is pending resumes where it stopped
+func (h *helm3Client) Install(release HelmRelease) error {
+	ctx := context.Background()
+	revisions, err := h.revisions(ctx, release.Name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) != 0 && revisions[len(revisions)-1].Info.Status != "pending-install" {
+		return &HelmError{Op: "install", Release: release.Name,
+			Err: errors.New("cannot re-use a name that is still in use")}
+	}
+	namespace := &corev1.Namespace{}
+	namespace.Name = release.Namespace
+	if err := h.client.Create(ctx, namespace); err != nil && !apierrors.IsAlreadyExists(err) {
+		return &HelmError{Op: "install", Release: release.Name,
+			Err: errors.New(fmt.Sprintf("failed to create namespace %s, %s", release.Namespace, err.Error()))}
+	}
+	return h.deploy(ctx, release, revisions, 1, "install")
+}
+
+// upgrade a helm release in the namespace it was installed in, an upgrade that is
+// pending resumes where it stopped with the same revision
+func (h *helm3Client) Upgrade(release HelmRelease) error {
+	ctx := context.Background()
+	revisions, err := h.revisions(ctx, release.Name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return &HelmError{Op: "upgrade", Release: release.Name, Err: ErrHelmReleaseNotFound}
+	}
+	last := revisions[len(revisions)-1]
+	version := last.Version + 1
+	if last.Info.Status == "pending-upgrade" {
+		version = last.Version
+	}
+	release.Namespace = last.Namespace
+	return h.deploy(ctx, release, revisions, version, "upgrade")
+}
+
+// render a helm release and apply its objects, the objects of the last deployed revision
+// that are no longer rendered are pruned. The revision is stored pending before its
+// objects are applied, and the last deployed revision is superseded once they are.
+func (h *helm3Client) deploy(ctx context.Context, release HelmRelease, revisions []*helm3Release, version int,
+	phase string) error {
+	chart, values, err := loadHelmChart(release)
+	if err != nil {
+		return &HelmError{Op: phase, Release: release.Name, Err: err}
+	}
+	objects, hooks, err := desiredObjects(func(release HelmRelease) (string, error) {
+		return renderHelmChart(chart, values, release)
+	}, release)
+	if err != nil {
+		return &HelmError{Op: phase, Release: release.Name, Err: err}
+	}
+	setHelm3Ownership(objects, release)
+	setHelm3Ownership(hooks, release)
+
+	var deployed *helm3Release
+	firstDeployed := helm3Time(time.Now().UTC())
+	var recorded []unstructured.Unstructured
+	for _, revision := range revisions {
+		if revision.Version == 1 {
+			firstDeployed = revision.Info.FirstDeployed
+		}
+		if revision.Info.Status == "deployed" {
+			deployed = revision
+		}
+		// the objects of a pending revision were applied when it was started
+		if revision.Info.Status == "deployed" || revision.Version == version {
+			revisionObjects, err := ParseManifest(revision.Manifest)
+			if err != nil {
+				return &HelmError{Op: phase, Release: release.Name, Err: err}
+			}
+			recorded = append(recorded, revisionObjects...)
+		}
+	}
+	desired := map[string]bool{}
+	for _, object := range objects {
+		desired[helm3ObjectKey(release, object)] = true
+	}
+	var pruned []unstructured.Unstructured
+	for _, object := range recorded {
+		if !desired[helm3ObjectKey(release, object)] {
+			desired[helm3ObjectKey(release, object)] = true
+			pruned = append(pruned, object)
+		}
+	}
+
+	rel, err := helm3ReleaseFor(release, chart, values, objects, hooks, version)
+	if err != nil {
+		return &HelmError{Op: phase, Release: release.Name, Err: err}
+	}
+	rel.Info.FirstDeployed = firstDeployed
+	rel.Info.Status = "pending-" + phase
+	rel.Info.Description = fmt.Sprintf("Preparing %s", phase)
+	if err := h.save(ctx, rel); err != nil {
+		return err
+	}
+	a := &applier{client: h.objects, mapper: h.mapper, deleteUnlabeled: true, log: h.log}
+	if err := a.applyRelease(ctx, release, objects, pruned, hooks, phase); err != nil {
+		if IsInstallPending(err) {
+			h.log.Info(err.Error())
+			return err
+		}
+		rel.Info.Status = "failed"
+		rel.Info.Description = fmt.Sprintf("Release %q failed: %s", release.Name, err.Error())
+		if saveErr := h.save(ctx, rel); saveErr != nil {
+			h.log.Error(saveErr, fmt.Sprintf("failed to record the failed %s of helm release %s", phase,
+				release.Name))
+		}
+		return &HelmError{Op: phase, Release: release.Name, Err: err}
+	}
+	rel.Info.Status = "deployed"
+	rel.Info.Description = fmt.Sprintf("%s complete", strings.Title(phase))
+	if err := h.save(ctx, rel); err != nil {
+		return err
+	}
+	if deployed != nil && deployed.Version != version {
+		deployed.Info.Status = "superseded"
+		if err := h.save(ctx, deployed); err != nil {
+			return err
+		}
+	}
+	h.log.Info(fmt.Sprintf("revision %d of helm release %s deployed", version, release.Name))
+	return nil
+}
+
+// delete the objects of a helm release and its release secrets, the CRDs are kept
+func (h *helm3Client) Uninstall(name string) error {
+	ctx := context.Background()
+	revisions, err := h.revisions(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		return &HelmError{Op: "uninstall", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	last := revisions[len(revisions)-1]
+	var objects []unstructured.Unstructured
+	keys := map[string]bool{}
+	for _, revision := range revisions {
+		if revision.Info.Status != "deployed" && revision != last {
+			continue
+		}
+		revisionObjects, err := ParseManifest(revision.Manifest)
+		if err != nil {
+			return &HelmError{Op: "uninstall", Release: name, Err: err}
+		}
+		for _, object := range revisionObjects {
+			if !keys[objectKey(object)] {
+				keys[objectKey(object)] = true
+				objects = append(objects, object)
+			}
+		}
+	}
+	a := &applier{client: h.objects, mapper: h.mapper, deleteUnlabeled: true, log: h.log}
+	if err := a.applyRelease(ctx, HelmRelease{Name: name, Namespace: last.Namespace}, nil, objects, nil,
+		""); err != nil {
+		return &HelmError{Op: "uninstall", Release: name, Err: err}
+	}
+	for _, revision := range revisions {
+		secret := &corev1.Secret{}
+		secret.Namespace = revision.Namespace
+		secret.Name = helm3ReleaseSecretName(revision)
+		if err := h.client.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return &HelmError{Op: "uninstall", Release: name, Err: err}
+		}
+	}
+	h.log.Info(fmt.Sprintf("helm release %s uninstalled", name))
+	return nil
+}
+
+func (h *helm3Client) List() ([]HelmReleaseInfo, error) {
+	releases, err := h.list(context.Background(), map[string]string{"owner": "helm"})
+	if err != nil {
+		return nil, err
+	}
+	// the last revision of each helm release
+	last := map[string]*helm3Release{}
+	for _, release := range releases {
+		last[release.Name] = release
+	}
+	infos := make([]HelmReleaseInfo, 0, len(last))
+	for _, release := range last {
+		infos = append(infos, helm3ReleaseInfo(release))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (h *helm3Client) Status(name string) (*HelmReleaseInfo, error) {
+	revisions, err := h.revisions(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, &HelmError{Op: "status", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	info := helm3ReleaseInfo(revisions[len(revisions)-1])
+	return &info, nil
+}
+
+func (h *helm3Client) History(name string) ([]HelmReleaseRevision, error) {
+	revisions, err := h.revisions(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, &HelmError{Op: "history", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	history := make([]HelmReleaseRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		history = append(history, HelmReleaseRevision{
+			Revision:    int32(revision.Version),
+			Updated:     helm3Updated(revision),
+			Status:      helm3Status(revision.Info.Status),
+			Chart:       helm3ChartName(revision),
+			Description: revision.Info.Description,
+		})
+	}
+	return history, nil
+}
+
+func (h *helm3Client) Manifest(name string) (string, error) {
+	revisions, err := h.revisions(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	if len(revisions) == 0 {
+		return "", &HelmError{Op: "get manifest", Release: name, Err: ErrHelmReleaseNotFound}
+	}
+	return revisions[len(revisions)-1].Manifest, nil
+}
+
+// revisions of a helm release stored in release secrets, sorted by version
+func (h *helm3Client) revisions(ctx context.Context, name string) ([]*helm3Release, error) {
+	return h.list(ctx, map[string]string{"owner": "helm", "name": name})
+}
+
+// helm 3 releases stored in the release secrets with labels in all namespaces, sorted by
+// name and version
+func (h *helm3Client) list(ctx context.Context, labels map[string]string) ([]*helm3Release, error) {
+	var secretList corev1.SecretList
+	if err := h.reader.List(ctx, &secretList, client.MatchingLabels(labels)); err != nil {
+		return nil, &HelmError{Op: "list", Release: labels["name"], Err: err}
+	}
+	var releases []*helm3Release
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if secret.Type != helm3ReleaseSecretType {
+			continue
+		}
+		release, err := decodeHelm3ReleaseSecret(secret)
+		if err != nil {
+			return nil, &HelmError{Op: "list", Release: labels["name"], Err: errors.New(fmt.Sprintf(
+				"failed to decode helm 3 release secret %s/%s, %s", secret.Namespace, secret.Name, err.Error()))}
+		}
+		releases = append(releases, release)
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].Name != releases[j].Name {
+			return releases[i].Name < releases[j].Name
+		}
+		return releases[i].Version < releases[j].Version
+	})
+	return releases, nil
+}
+
+// store a revision of a helm release in its release secret
+func (h *helm3Client) save(ctx context.Context, release *helm3Release) error {
+	secret, err := encodeHelm3ReleaseSecret(release)
+	if err != nil {
+		return &HelmError{Op: "save", Release: release.Name, Err: err}
+	}
+	err = h.client.Create(ctx, secret)
+	if apierrors.IsAlreadyExists(err) {
+		err = h.client.Update(ctx, secret)
+	}
+	if err != nil {
+		return &HelmError{Op: "save", Release: release.Name, Err: errors.New(fmt.Sprintf(
+			"failed to save helm 3 release secret %s/%s, %s", secret.Namespace, secret.Name, err.Error()))}
+	}
+	return nil
+}
+
+// revision of a helm release rendered from a chart, its status is set by the caller
+func helm3ReleaseFor(release HelmRelease, chart *hapichart.Chart, values []byte,
+	objects []unstructured.Unstructured, hooks []unstructured.Unstructured, version int) (*helm3Release, error) {
+	converted, err := helm3ChartOf(chart)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(values, &config); err != nil {
+		return nil, err
+	}
+	manifest, err := manifestOf(objects)
+	if err != nil {
+		return nil, err
+	}
+	rel := &helm3Release{
+		Name:      release.Name,
+		Info:      &helm3Info{LastDeployed: helm3Time(time.Now().UTC())},
+		Chart:     converted,
+		Config:    config,
+		Manifest:  manifest,
+		Version:   version,
+		Namespace: release.Namespace,
+	}
+	for _, hook := range hooks {
+		hookManifest, err := manifestOf([]unstructured.Unstructured{hook})
+		if err != nil {
+			return nil, err
+		}
+		weight, _ := strconv.Atoi(hook.GetAnnotations()[helmHookWeightAnnotation])
+		converted := &helm3Hook{
+			Name:     hook.GetName(),
+			Kind:     hook.GetKind(),
+			Manifest: hookManifest,
+			Weight:   weight,
+			LastRun:  helm3HookExecution{Phase: "Unknown"},
+		}
+		for _, event := range strings.Split(hook.GetAnnotations()[helmHookAnnotation], ",") {
+			converted.Events = append(converted.Events, strings.TrimSpace(event))
+		}
+		if policies := hook.GetAnnotations()[helmHookDeletePolicyAnnotation]; policies != "" {
+			for _, policy := range strings.Split(policies, ",") {
+				converted.DeletePolicies = append(converted.DeletePolicies, strings.TrimSpace(policy))
+			}
+		}
+		rel.Hooks = append(rel.Hooks, converted)
+	}
+	return rel, nil
+}
+
+// label and annotate the objects of a helm release so that helm 3 manages them
+func setHelm3Ownership(objects []unstructured.Unstructured, release HelmRelease) {
+	for i := range objects {
+		labels := objects[i].GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[helm3ManagedByLabel] = "Helm"
+		objects[i].SetLabels(labels)
+		annotations := objects[i].GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[helm3ReleaseNameAnnotation] = release.Name
+		annotations[helm3ReleaseNamespaceAnnotation] = release.Namespace
+		objects[i].SetAnnotations(annotations)
+	}
+}
+
+// key of an object of a helm release, the objects without a namespace are keyed in the
+// namespace of the helm release since the revisions rendered by Tiller and by the istio
+// operator may have the same object with and without its namespace
+func helm3ObjectKey(release HelmRelease, object unstructured.Unstructured) string {
+	if object.GetNamespace() == "" {
+		object = *object.DeepCopy()
+		object.SetNamespace(release.Namespace)
+	}
+	return objectKey(object)
+}
+
+// name of the secret helm 3 stores a revision of a helm release in
+func helm3ReleaseSecretName(release *helm3Release) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", release.Name, release.Version)
+}
+
+// name of the chart of a helm 3 release in helm ls, <name>-<version>
+func helm3ChartName(release *helm3Release) string {
+	if release.Chart == nil || release.Chart.Metadata == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", release.Chart.Metadata.Name, release.Chart.Metadata.Version)
+}
+
+// time a revision of a helm 3 release was deployed, in the format of the helm 2 client
+func helm3Updated(release *helm3Release) string {
+	return time.Time(release.Info.LastDeployed).Format(time.ANSIC)
+}
+
+// state of a revision of a helm 3 release
+func helm3ReleaseInfo(release *helm3Release) HelmReleaseInfo {
+	info := HelmReleaseInfo{
+		Name:      release.Name,
+		Namespace: release.Namespace,
+		Revision:  int32(release.Version),
+		Status:    helm3Status(release.Info.Status),
+		Chart:     helm3ChartName(release),
+		Updated:   helm3Updated(release),
+	}
+	if release.Chart != nil && release.Chart.Metadata != nil {
+		info.AppVersion = release.Chart.Metadata.AppVersion
+	}
+	return info
+}
@@ -0,0 +1,201 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testConfigMapKind = schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+
+// helm 3 client storing its release secrets in the fake client of r and applying the
+// objects of its helm releases with the fake object client of r
+func testHelm3Client(r *IstioReconciler) *helm3Client {
+	return NewHelm3Client(r.Client, r.ObjectClient, r.ObjectMapper, r.Client, r.Log).(*helm3Client)
+}
+
+// statuses of the release secrets of a helm release by name
+func testHelm3Secrets(t *testing.T, r *IstioReconciler, name string) map[string]string {
+	var secretList corev1.SecretList
+	if err := r.List(context.TODO(), &secretList,
+		client.MatchingLabels(map[string]string{"owner": "helm", "name": name})); err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]string{}
+	for _, secret := range secretList.Items {
+		secrets[secret.Namespace+"/"+secret.Name] = secret.Labels["status"]
+	}
+	return secrets
+}
+
+func TestHelm3Client(t *testing.T) {
+	dir := writeTestChart(t, testChart)
+	defer os.RemoveAll(dir)
+	r := testObjectReconciler()
+	h := testHelm3Client(r)
+	release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: filepath.Join(dir, "mesh"),
+		ValuesFiles: []string{filepath.Join(dir, "values.yaml")}}
+
+	if _, err := h.Status("istio"); !IsHelmReleaseNotFound(err) {
+		t.Fatalf("expected helm release not found, got %v", err)
+	}
+	if err := h.Upgrade(release); !IsHelmReleaseNotFound(err) {
+		t.Fatalf("expected helm release not found, got %v", err)
+	}
+	if err := h.Install(release); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.Status("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HelmReleaseInfo{Name: "istio", Namespace: "istio-system", Revision: 1, Status: HelmStatusDeployed,
+		Chart: "mesh-1.1.8-ccp1", AppVersion: "1.1.8", Updated: info.Updated}
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+	namespace := &corev1.Namespace{}
+	if err := r.Get(context.TODO(), client.ObjectKey{Name: "istio-system"}, namespace); err != nil {
+		t.Errorf("namespace of the helm release not created, %v", err)
+	}
+	for _, name := range []string{"pilot", "mixer"} {
+		object := testAppliedObject(t, r, testConfigMapKind, "istio-system", name)
+		if object == nil {
+			t.Fatalf("ConfigMap %s not applied", name)
+		}
+		if object.GetLabels()[helm3ManagedByLabel] != "Helm" ||
+			object.GetAnnotations()[helm3ReleaseNameAnnotation] != "istio" ||
+			object.GetAnnotations()[helm3ReleaseNamespaceAnnotation] != "istio-system" {
+			t.Errorf("ConfigMap %s is not owned by helm 3 release istio: labels %v, annotations %v", name,
+				object.GetLabels(), object.GetAnnotations())
+		}
+	}
+	if err := h.Install(release); err == nil {
+		t.Error("installed a helm release that exists")
+	}
+
+	// mixer is disabled by the values override, it is pruned
+	release.ValuesFiles = append(release.ValuesFiles, filepath.Join(dir, "values-override.yaml"))
+	if err := h.Upgrade(release); err != nil {
+		t.Fatal(err)
+	}
+	if testAppliedObject(t, r, testConfigMapKind, "istio-system", "mixer") != nil {
+		t.Error("ConfigMap mixer not pruned")
+	}
+	pilot := testAppliedObject(t, r, testConfigMapKind, "istio-system", "pilot")
+	if pilot == nil || pilot.Object["data"].(map[string]interface{})["replicas"] != "3" {
+		t.Errorf("ConfigMap pilot not upgraded: %v", pilot)
+	}
+	history, err := h.History("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Status != "SUPERSEDED" || history[1].Revision != 2 ||
+		history[1].Status != HelmStatusDeployed || history[1].Description != "Upgrade complete" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	expectedSecrets := map[string]string{
+		"istio-system/sh.helm.release.v1.istio.v1": "superseded",
+		"istio-system/sh.helm.release.v1.istio.v2": "deployed",
+	}
+	if secrets := testHelm3Secrets(t, r, "istio"); !reflect.DeepEqual(secrets, expectedSecrets) {
+		t.Errorf("expected release secrets %v, got %v", expectedSecrets, secrets)
+	}
+	manifest, err := h.Manifest("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(manifest, "name: pilot") || strings.Contains(manifest, "name: mixer") {
+		t.Errorf("unexpected manifest %s", manifest)
+	}
+	releases, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 1 || releases[0].Name != "istio" || releases[0].Revision != 2 {
+		t.Errorf("unexpected helm releases %+v", releases)
+	}
+
+	if err := h.Uninstall("istio"); err != nil {
+		t.Fatal(err)
+	}
+	if testAppliedObject(t, r, testConfigMapKind, "istio-system", "pilot") != nil {
+		t.Error("ConfigMap pilot not deleted")
+	}
+	if secrets := testHelm3Secrets(t, r, "istio"); len(secrets) != 0 {
+		t.Errorf("release secrets not deleted: %v", secrets)
+	}
+	for _, err := range []error{h.Uninstall("istio"), h.Upgrade(release)} {
+		if !IsHelmReleaseNotFound(err) {
+			t.Errorf("expected helm release not found, got %v", err)
+		}
+	}
+}
+
+func TestHelm3ClientUpgradeMigrated(t *testing.T) {
+	dir := writeTestChart(t, testChart)
+	defer os.RemoveAll(dir)
+	// helm release installed by Tiller and migrated to helm 3, its objects have neither the
+	// release label nor the labels of helm 3
+	migrated, err := encodeHelm3ReleaseSecret(&helm3Release{Name: "istio", Version: 1, Namespace: "istio-system",
+		Info: &helm3Info{Status: "deployed", Description: "Install complete"},
+		Manifest: "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: pilot\n  namespace: istio-system\n" +
+			"---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mixer\n  namespace: istio-system\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objs []runtime.Object
+	for _, name := range []string{"pilot", "mixer"} {
+		configMap := &corev1.ConfigMap{}
+		configMap.APIVersion, configMap.Kind = testConfigMapKind.ToAPIVersionAndKind()
+		configMap.Namespace, configMap.Name = "istio-system", name
+		objs = append(objs, configMap)
+	}
+	r := testObjectReconciler(objs...)
+	r.Client = fake.NewFakeClientWithScheme(r.Scheme, migrated)
+	h := testHelm3Client(r)
+
+	release := HelmRelease{Name: "istio", Chart: filepath.Join(dir, "mesh"),
+		ValuesFiles: []string{filepath.Join(dir, "values-override.yaml")}}
+	if err := h.Upgrade(release); err != nil {
+		t.Fatal(err)
+	}
+	if testAppliedObject(t, r, testConfigMapKind, "istio-system", "mixer") != nil {
+		t.Error("ConfigMap mixer of the migrated helm release not pruned")
+	}
+	pilot := testAppliedObject(t, r, testConfigMapKind, "istio-system", "pilot")
+	if pilot == nil || pilot.GetLabels()[IstioReleaseLabel] != "istio" {
+		t.Errorf("ConfigMap pilot of the migrated helm release not upgraded: %v", pilot)
+	}
+	info, err := h.Status("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Namespace != "istio-system" || info.Revision != 2 || info.Status != HelmStatusDeployed {
+		t.Errorf("unexpected helm release %+v", *info)
+	}
+}
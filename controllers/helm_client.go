@@ -0,0 +1,362 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/helm"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/renderutil"
+	"k8s.io/helm/pkg/timeconv"
+	"sigs.k8s.io/yaml"
+)
+
+// helm release statuses
+const (
+	HelmStatusDeployed       = "DEPLOYED"
+	HelmStatusDeleted        = "DELETED"
+	HelmStatusSuperseded     = "SUPERSEDED"
+	HelmStatusFailed         = "FAILED"
+	HelmStatusPendingInstall = "PENDING_INSTALL"
+	HelmStatusPendingUpgrade = "PENDING_UPGRADE"
+)
+
+// ErrHelmReleaseNotFound is returned when a helm release does not exist
+var ErrHelmReleaseNotFound = errors.New("helm release not found")
+
+// HelmError is returned when a helm operation fails
+type HelmError struct {
+	// helm operation that failed, for example install or upgrade
+	Op string
+	// name of the helm release
+	Release string
+	// stderr of the failed helm operation, set by the helm clients that run a helm binary
+	Stderr string
+	// underlying error
+	Err error
+}
+
+func (e *HelmError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("helm %s of release %s failed, error: %s", e.Op, e.Release, e.Err)
+	}
+	return fmt.Sprintf("helm %s of release %s failed, error: %s, %s", e.Op, e.Release,
+		strings.TrimSpace(e.Stderr), e.Err)
+}
+
+// IsHelmReleaseNotFound returns true if err means that a helm release does not exist
+func IsHelmReleaseNotFound(err error) bool {
+	if err == ErrHelmReleaseNotFound {
+		return true
+	}
+	if helmErr, ok := err.(*HelmError); ok {
+		return helmErr.Err == ErrHelmReleaseNotFound
+	}
+	return false
+}
+
+// HelmRelease defines a helm release to install or upgrade
+type HelmRelease struct {
+	// name of the helm release
+	Name string
+	// path or URL of the helm chart
+	Chart string
+	// namespace the helm release is installed in
+	Namespace string
+	// values files passed to helm, later files take precedence
+	ValuesFiles []string
+}
+
+// HelmReleaseInfo defines the state of an installed helm release
+type HelmReleaseInfo struct {
+	Name       string `json:"Name"`
+	Namespace  string `json:"Namespace"`
+	Revision   int32  `json:"Revision"`
+	Status     string `json:"Status"`
+	Chart      string `json:"Chart"`
+	AppVersion string `json:"AppVersion"`
+	Updated    string `json:"Updated"`
+}
+
+// HelmReleaseRevision defines one revision in the history of a helm release
+type HelmReleaseRevision struct {
+	Revision    int32  `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	Description string `json:"description"`
+}
+
+// HelmClient manages helm releases
+type HelmClient interface {
+	// install a new helm release
+	Install(release HelmRelease) error
+	// upgrade an existing helm release
+	Upgrade(release HelmRelease) error
+	// uninstall a helm release and purge its history
+	Uninstall(name string) error
+	// list all helm releases
+	List() ([]HelmReleaseInfo, error)
+	// get the state of a helm release, returns ErrHelmReleaseNotFound if it does not exist
+	Status(name string) (*HelmReleaseInfo, error)
+	// get the revision history of a helm release
+	History(name string) ([]HelmReleaseRevision, error)
+	// get the manifest (rendered kubernetes objects) of a helm release
+	Manifest(name string) (string, error)
+}
+
+// helmClient implements HelmClient in-process with the helm 2 libraries, the helm
+// releases are managed by Tiller through its gRPC API and the charts are loaded and
+// rendered by the istio operator
+type helmClient struct {
+	client helm.Interface
+	log    logr.Logger
+}
+
+// port of Tiller's gRPC API
+const tillerPort = 44134
+
+// TillerHost is the address of the gRPC API of Tiller deployed in a namespace by helm init
+func TillerHost(namespace string) string {
+	return fmt.Sprintf("tiller-deploy.%s:%d", namespace, tillerPort)
+}
+
+// NewHelmClient returns a HelmClient that manages helm releases with Tiller at host
+func NewHelmClient(host string, log logr.Logger) HelmClient {
+	return &helmClient{client: helm.NewClient(helm.Host(host)), log: log}
+}
+
+// helm release statuses listed by helm ls --all
+var helmListStatuses = []release.Status_Code{
+	release.Status_UNKNOWN,
+	release.Status_DEPLOYED,
+	release.Status_DELETED,
+	release.Status_DELETING,
+	release.Status_FAILED,
+	release.Status_PENDING_INSTALL,
+	release.Status_PENDING_UPGRADE,
+	release.Status_PENDING_ROLLBACK,
+}
+
+func (h *helmClient) Install(rel HelmRelease) error {
+	chart, values, err := loadHelmChart(rel)
+	if err != nil {
+		return &HelmError{Op: "install", Release: rel.Name, Err: err}
+	}
+	h.log.Info(fmt.Sprintf("installing helm release %s of chart %s in namespace %s", rel.Name, rel.Chart,
+		rel.Namespace))
+	_, err = h.client.InstallReleaseFromChart(chart, rel.Namespace, helm.ReleaseName(rel.Name),
+		helm.ValueOverrides(values))
+	return h.error("install", rel.Name, err)
+}
+
+func (h *helmClient) Upgrade(rel HelmRelease) error {
+	chart, values, err := loadHelmChart(rel)
+	if err != nil {
+		return &HelmError{Op: "upgrade", Release: rel.Name, Err: err}
+	}
+	h.log.Info(fmt.Sprintf("upgrading helm release %s to chart %s", rel.Name, rel.Chart))
+	_, err = h.client.UpdateReleaseFromChart(rel.Name, chart, helm.UpdateValueOverrides(values))
+	return h.error("upgrade", rel.Name, err)
+}
+
+func (h *helmClient) Uninstall(name string) error {
+	h.log.Info(fmt.Sprintf("deleting helm release %s", name))
+	_, err := h.client.DeleteRelease(name, helm.DeletePurge(true))
+	return h.error("uninstall", name, err)
+}
+
+func (h *helmClient) List() ([]HelmReleaseInfo, error) {
+	return h.list("")
+}
+
+func (h *helmClient) Status(name string) (*HelmReleaseInfo, error) {
+	releases, err := h.list(fmt.Sprintf("^%s$", regexp.QuoteMeta(name)))
+	if err != nil {
+		return nil, err
+	}
+	for _, release := range releases {
+		if release.Name == name {
+			return &release, nil
+		}
+	}
+	return nil, &HelmError{Op: "status", Release: name, Err: ErrHelmReleaseNotFound}
+}
+
+func (h *helmClient) History(name string) ([]HelmReleaseRevision, error) {
+	resp, err := h.client.ReleaseHistory(name, helm.WithMaxHistory(256))
+	if err != nil {
+		return nil, h.error("history", name, err)
+	}
+	history := make([]HelmReleaseRevision, 0, len(resp.GetReleases()))
+	for _, rel := range resp.GetReleases() {
+		if rel.GetName() != name {
+			continue
+		}
+		history = append(history, HelmReleaseRevision{
+			Revision:    rel.GetVersion(),
+			Updated:     timeconv.String(rel.GetInfo().GetLastDeployed()),
+			Status:      rel.GetInfo().GetStatus().GetCode().String(),
+			Chart:       helmChartName(rel.GetChart()),
+			Description: rel.GetInfo().GetDescription(),
+		})
+	}
+	// helm history lists the oldest revision first
+	sort.Slice(history, func(i, j int) bool { return history[i].Revision < history[j].Revision })
+	return history, nil
+}
+
+func (h *helmClient) Manifest(name string) (string, error) {
+	resp, err := h.client.ReleaseContent(name)
+	if err != nil {
+		return "", h.error("get manifest", name, err)
+	}
+	return resp.GetRelease().GetManifest(), nil
+}
+
+// list helm releases in all states whose names match filter
+func (h *helmClient) list(filter string) ([]HelmReleaseInfo, error) {
+	opts := []helm.ReleaseListOption{helm.ReleaseListStatuses(helmListStatuses)}
+	if filter != "" {
+		opts = append(opts, helm.ReleaseListFilter(filter))
+	}
+	resp, err := h.client.ListReleases(opts...)
+	if err != nil {
+		return nil, h.error("list", filter, err)
+	}
+	releases := make([]HelmReleaseInfo, 0, len(resp.GetReleases()))
+	for _, rel := range resp.GetReleases() {
+		releases = append(releases, HelmReleaseInfo{
+			Name:       rel.GetName(),
+			Namespace:  rel.GetNamespace(),
+			Revision:   rel.GetVersion(),
+			Status:     rel.GetInfo().GetStatus().GetCode().String(),
+			Chart:      helmChartName(rel.GetChart()),
+			AppVersion: rel.GetChart().GetMetadata().GetAppVersion(),
+			Updated:    timeconv.String(rel.GetInfo().GetLastDeployed()),
+		})
+	}
+	return releases, nil
+}
+
+// wrap the error of a helm operation in a HelmError, Tiller returns the error
+// `release: "<name>" not found` when a helm release does not exist
+func (h *helmClient) error(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), fmt.Sprintf("%q not found", name)) {
+		err = ErrHelmReleaseNotFound
+	}
+	return &HelmError{Op: op, Release: name, Err: err}
+}
+
+// name of a chart in helm ls, <name>-<version>
+func helmChartName(chart *hapichart.Chart) string {
+	return fmt.Sprintf("%s-%s", chart.GetMetadata().GetName(), chart.GetMetadata().GetVersion())
+}
+
+// load the chart of a helm release (a chart directory or tarball) and the values of its
+// values files merged in YAML, later files take precedence
+func loadHelmChart(release HelmRelease) (*hapichart.Chart, []byte, error) {
+	chart, err := chartutil.Load(release.Chart)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("failed to load chart %s, %s", release.Chart, err.Error()))
+	}
+	values := map[string]interface{}{}
+	for _, file := range release.ValuesFiles {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("failed to read values file %s, %s", file, err.Error()))
+		}
+		fileValues := map[string]interface{}{}
+		if err := yaml.Unmarshal(b, &fileValues); err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("failed to parse values file %s, %s", file, err.Error()))
+		}
+		values = mergeHelmValues(values, fileValues)
+	}
+	b, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chart, b, nil
+}
+
+// merge the values of src into dest like helm -f, the maps in both are merged and the
+// other values of src replace the ones of dest
+func mergeHelmValues(dest map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		srcMap, isMap := value.(map[string]interface{})
+		destMap, destIsMap := dest[key].(map[string]interface{})
+		if isMap && destIsMap {
+			dest[key] = mergeHelmValues(destMap, srcMap)
+			continue
+		}
+		dest[key] = value
+	}
+	return dest
+}
+
+// render the kubernetes objects of a helm chart like helm template, without Tiller.
+// The templates are rendered in the order of their paths, the NOTES.txt files and the
+// templates that render no objects are skipped.
+func RenderHelmChart(release HelmRelease) (string, error) {
+	chart, values, err := loadHelmChart(release)
+	if err != nil {
+		return "", err
+	}
+	return renderHelmChart(chart, values, release)
+}
+
+// render the kubernetes objects of a chart loaded with the values of a helm release
+func renderHelmChart(chart *hapichart.Chart, values []byte, release HelmRelease) (string, error) {
+	files, err := renderutil.Render(chart, &hapichart.Config{Raw: string(values)}, renderutil.Options{
+		ReleaseOptions: chartutil.ReleaseOptions{
+			Name:      release.Name,
+			Namespace: release.Namespace,
+			Revision:  1,
+			IsInstall: true,
+		},
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to render chart %s, %s", release.Chart, err.Error()))
+	}
+	paths := make([]string, 0, len(files))
+	for path, content := range files {
+		if strings.HasSuffix(path, "NOTES.txt") || strings.TrimSpace(content) == "" {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var manifest bytes.Buffer
+	for _, path := range paths {
+		manifest.WriteString(fmt.Sprintf("---\n# Source: %s\n", path))
+		manifest.WriteString(files[path])
+		manifest.WriteString("\n")
+	}
+	return manifest.String(), nil
+}
@@ -0,0 +1,257 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/helm/pkg/helm"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// write a helm chart with its values files in a temporary directory
+func writeTestChart(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "chart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// write a chart tarball with the given Chart.yaml in dir, returns its path
+func writeTestChartArchive(t *testing.T, dir string, file string, chartName string, chartYaml string) string {
+	var content bytes.Buffer
+	gzipWriter := gzip.NewWriter(&content)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, f := range []struct{ name, data string }{
+		{chartName + "/Chart.yaml", chartYaml},
+		{chartName + "/values.yaml", "global: {}\n"},
+	} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)),
+			Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var testChart = map[string]string{
+	"mesh/Chart.yaml":  "name: mesh\nversion: 1.1.8-ccp1\nappVersion: 1.1.8\n",
+	"mesh/values.yaml": "mixer:\n  enabled: true\n  replicas: 1\npilot:\n  replicas: 1\n",
+	"mesh/templates/_helpers.tpl": `{{- define "mesh.labels" -}}
+release: {{ .Release.Name }}
+{{- end -}}`,
+	"mesh/templates/pilot.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pilot
+  namespace: {{ .Release.Namespace }}
+  labels:
+{{ include "mesh.labels" . | indent 4 }}
+data:
+  replicas: "{{ .Values.pilot.replicas }}"
+`,
+	"mesh/templates/mixer.yaml": `{{- if .Values.mixer.enabled }}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: mixer
+data:
+  replicas: "{{ .Values.mixer.replicas }}"
+{{- end }}
+`,
+	"mesh/templates/NOTES.txt": "istio is installed in {{ .Release.Namespace }}\n",
+	"values.yaml":              "mixer:\n  replicas: 2\n",
+	"values-override.yaml":     "mixer:\n  enabled: false\npilot:\n  replicas: 3\n",
+}
+
+func TestRenderHelmChart(t *testing.T) {
+	dir := writeTestChart(t, testChart)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		valuesFiles []string
+		contains    []string
+		excludes    []string
+	}{
+		{
+			name: "chart values",
+			contains: []string{"# Source: mesh/templates/mixer.yaml", "# Source: mesh/templates/pilot.yaml",
+				"namespace: istio-system", "release: istio", `replicas: "1"`},
+			excludes: []string{"NOTES.txt", "_helpers.tpl", "istio is installed"},
+		},
+		{
+			name:        "values file merged with chart values",
+			valuesFiles: []string{"values.yaml"},
+			contains:    []string{"name: mixer", `replicas: "2"`},
+		},
+		{
+			name:        "later values files take precedence",
+			valuesFiles: []string{"values.yaml", "values-override.yaml"},
+			contains:    []string{`replicas: "3"`},
+			excludes:    []string{"mesh/templates/mixer.yaml", "name: mixer"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: filepath.Join(dir, "mesh")}
+			for _, file := range test.valuesFiles {
+				release.ValuesFiles = append(release.ValuesFiles, filepath.Join(dir, file))
+			}
+			manifest, err := RenderHelmChart(release)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(manifest, s) {
+					t.Errorf("manifest does not contain %q:\n%s", s, manifest)
+				}
+			}
+			for _, s := range test.excludes {
+				if strings.Contains(manifest, s) {
+					t.Errorf("manifest contains %q:\n%s", s, manifest)
+				}
+			}
+		})
+	}
+
+	if _, err := RenderHelmChart(HelmRelease{Name: "istio", Chart: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("rendered a chart that does not exist")
+	}
+}
+
+func TestMergeHelmValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		dest     map[string]interface{}
+		src      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "maps are merged",
+			dest:     map[string]interface{}{"global": map[string]interface{}{"hub": "a", "tag": "1"}},
+			src:      map[string]interface{}{"global": map[string]interface{}{"tag": "2"}},
+			expected: map[string]interface{}{"global": map[string]interface{}{"hub": "a", "tag": "2"}},
+		},
+		{
+			name:     "values replace maps",
+			dest:     map[string]interface{}{"gateways": map[string]interface{}{"enabled": true}},
+			src:      map[string]interface{}{"gateways": nil},
+			expected: map[string]interface{}{"gateways": nil},
+		},
+		{
+			name:     "lists are replaced",
+			dest:     map[string]interface{}{"ports": []interface{}{80, 443}},
+			src:      map[string]interface{}{"ports": []interface{}{15443}, "mtls": true},
+			expected: map[string]interface{}{"ports": []interface{}{15443}, "mtls": true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if merged := mergeHelmValues(test.dest, test.src); !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, merged)
+			}
+		})
+	}
+}
+
+func TestHelmClient(t *testing.T) {
+	dir := writeTestChart(t, testChart)
+	defer os.RemoveAll(dir)
+	fake := &helm.FakeClient{}
+	client := &helmClient{client: fake, log: zap.Logger(true)}
+	release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: filepath.Join(dir, "mesh"),
+		ValuesFiles: []string{filepath.Join(dir, "values.yaml")}}
+
+	if _, err := client.Status("istio"); !IsHelmReleaseNotFound(err) {
+		t.Fatalf("expected helm release not found, got %v", err)
+	}
+	if err := client.Install(release); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fake.Rels[0].GetConfig().GetRaw(), "replicas: 2") {
+		t.Errorf("values file not passed to Tiller: %s", fake.Rels[0].GetConfig().GetRaw())
+	}
+	info, err := client.Status("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HelmReleaseInfo{Name: "istio", Namespace: "istio-system", Revision: 1, Status: HelmStatusDeployed,
+		Chart: "mesh-1.1.8-ccp1", AppVersion: "1.1.8", Updated: info.Updated}
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+
+	if err := client.Upgrade(release); err != nil {
+		t.Fatal(err)
+	}
+	history, err := client.History("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Revision != 2 || history[0].Status != HelmStatusDeployed {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if manifest, err := client.Manifest("istio"); err != nil || manifest == "" {
+		t.Errorf("unexpected manifest %q, error %v", manifest, err)
+	}
+
+	if err := client.Uninstall("istio"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{client.Uninstall("istio"), client.Upgrade(release)} {
+		if !IsHelmReleaseNotFound(err) {
+			t.Errorf("expected helm release not found, got %v", err)
+		}
+	}
+	if _, err := client.Manifest("istio"); !IsHelmReleaseNotFound(err) {
+		t.Errorf("expected helm release not found, got %v", err)
+	}
+}
@@ -0,0 +1,494 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	hapirelease "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/timeconv"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// namespace Tiller stores the helm 2 releases in if --tiller-namespace is not set
+	DefaultTillerNamespace = "kube-system"
+	// type of the secrets helm 3 stores its releases in
+	helm3ReleaseSecretType = "helm.sh/release.v1"
+)
+
+// statuses of a helm 2 release in the format of helm 3
+var helm2StatusCodes = map[hapirelease.Status_Code]string{
+	hapirelease.Status_UNKNOWN:          "unknown",
+	hapirelease.Status_DEPLOYED:         "deployed",
+	hapirelease.Status_DELETED:          "uninstalled",
+	hapirelease.Status_SUPERSEDED:       "superseded",
+	hapirelease.Status_FAILED:           "failed",
+	hapirelease.Status_DELETING:         "uninstalling",
+	hapirelease.Status_PENDING_INSTALL:  "pending-install",
+	hapirelease.Status_PENDING_UPGRADE:  "pending-upgrade",
+	hapirelease.Status_PENDING_ROLLBACK: "pending-rollback",
+}
+
+// events of a helm 2 hook in the format of helm 3. The crd-install hooks are not
+// supported by helm 3 and are dropped.
+var helm2HookEvents = map[hapirelease.Hook_Event]string{
+	hapirelease.Hook_PRE_INSTALL:          "pre-install",
+	hapirelease.Hook_POST_INSTALL:         "post-install",
+	hapirelease.Hook_PRE_DELETE:           "pre-delete",
+	hapirelease.Hook_POST_DELETE:          "post-delete",
+	hapirelease.Hook_PRE_UPGRADE:          "pre-upgrade",
+	hapirelease.Hook_POST_UPGRADE:         "post-upgrade",
+	hapirelease.Hook_PRE_ROLLBACK:         "pre-rollback",
+	hapirelease.Hook_POST_ROLLBACK:        "post-rollback",
+	hapirelease.Hook_RELEASE_TEST_SUCCESS: "test",
+	hapirelease.Hook_RELEASE_TEST_FAILURE: "test",
+}
+
+// delete policies of a helm 2 hook in the format of helm 3
+var helm2HookDeletePolicies = map[hapirelease.Hook_DeletePolicy]string{
+	hapirelease.Hook_SUCCEEDED:            "hook-succeeded",
+	hapirelease.Hook_FAILED:               "hook-failed",
+	hapirelease.Hook_BEFORE_HOOK_CREATION: "before-hook-creation",
+}
+
+// time in a helm 3 release, an empty string when it is not set
+type helm3Time time.Time
+
+func (t helm3Time) MarshalJSON() ([]byte, error) {
+	if time.Time(t).IsZero() {
+		return []byte(`""`), nil
+	}
+	return time.Time(t).MarshalJSON()
+}
+
+func (t *helm3Time) UnmarshalJSON(b []byte) error {
+	if string(b) == `""` || string(b) == "null" {
+		*t = helm3Time{}
+		return nil
+	}
+	var parsed time.Time
+	if err := parsed.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	*t = helm3Time(parsed)
+	return nil
+}
+
+// release stored by helm 3, it has the fields of helm.sh/helm/v3/pkg/release.Release
+type helm3Release struct {
+	Name      string                 `json:"name,omitempty"`
+	Info      *helm3Info             `json:"info,omitempty"`
+	Chart     *helm3Chart            `json:"chart,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Manifest  string                 `json:"manifest,omitempty"`
+	Hooks     []*helm3Hook           `json:"hooks,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"`
+}
+
+type helm3Info struct {
+	FirstDeployed helm3Time `json:"first_deployed,omitempty"`
+	LastDeployed  helm3Time `json:"last_deployed,omitempty"`
+	Deleted       helm3Time `json:"deleted"`
+	Description   string    `json:"description,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	Notes         string    `json:"notes,omitempty"`
+}
+
+type helm3Chart struct {
+	Metadata  *helm3Metadata         `json:"metadata"`
+	Lock      interface{}            `json:"lock"`
+	Templates []*helm3File           `json:"templates"`
+	Values    map[string]interface{} `json:"values"`
+	Schema    []byte                 `json:"schema"`
+	Files     []*helm3File           `json:"files"`
+}
+
+type helm3Metadata struct {
+	Name        string             `json:"name,omitempty"`
+	Home        string             `json:"home,omitempty"`
+	Sources     []string           `json:"sources,omitempty"`
+	Version     string             `json:"version,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Keywords    []string           `json:"keywords,omitempty"`
+	Maintainers []*helm3Maintainer `json:"maintainers,omitempty"`
+	Icon        string             `json:"icon,omitempty"`
+	APIVersion  string             `json:"apiVersion,omitempty"`
+	Condition   string             `json:"condition,omitempty"`
+	Tags        string             `json:"tags,omitempty"`
+	AppVersion  string             `json:"appVersion,omitempty"`
+	Deprecated  bool               `json:"deprecated,omitempty"`
+	Annotations map[string]string  `json:"annotations,omitempty"`
+	KubeVersion string             `json:"kubeVersion,omitempty"`
+}
+
+type helm3Maintainer struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+type helm3File struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+type helm3Hook struct {
+	Name           string             `json:"name,omitempty"`
+	Kind           string             `json:"kind,omitempty"`
+	Path           string             `json:"path,omitempty"`
+	Manifest       string             `json:"manifest,omitempty"`
+	Events         []string           `json:"events,omitempty"`
+	LastRun        helm3HookExecution `json:"last_run"`
+	Weight         int                `json:"weight,omitempty"`
+	DeletePolicies []string           `json:"delete_policies,omitempty"`
+}
+
+type helm3HookExecution struct {
+	StartedAt   helm3Time `json:"started_at,omitempty"`
+	CompletedAt helm3Time `json:"completed_at,omitempty"`
+	Phase       string    `json:"phase"`
+}
+
+// time of a helm 2 release in a helm 3 release, zero when it is not set
+func helm3TimeOf(ts *timestamp.Timestamp) helm3Time {
+	if ts == nil {
+		return helm3Time{}
+	}
+	return helm3Time(timeconv.Time(ts).UTC())
+}
+
+// values of a helm 2 chart or release, only the raw YAML of hapi.chart.Config is used
+func helm3ValuesOf(config *hapichart.Config) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if config.GetRaw() == "" {
+		return values, nil
+	}
+	if err := yaml.Unmarshal([]byte(config.GetRaw()), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// helm 2 chart in a helm 3 release, the dependencies of the chart are not stored in helm
+// 3 releases
+func helm3ChartOf(chart *hapichart.Chart) (*helm3Chart, error) {
+	metadata := chart.GetMetadata()
+	converted := &helm3Chart{Metadata: &helm3Metadata{
+		Name:        metadata.GetName(),
+		Home:        metadata.GetHome(),
+		Sources:     metadata.GetSources(),
+		Version:     metadata.GetVersion(),
+		Description: metadata.GetDescription(),
+		Keywords:    metadata.GetKeywords(),
+		Icon:        metadata.GetIcon(),
+		APIVersion:  metadata.GetApiVersion(),
+		Condition:   metadata.GetCondition(),
+		Tags:        metadata.GetTags(),
+		AppVersion:  metadata.GetAppVersion(),
+		Deprecated:  metadata.GetDeprecated(),
+		Annotations: metadata.GetAnnotations(),
+		KubeVersion: metadata.GetKubeVersion(),
+	}}
+	// the charts of helm 2 have the v1 API version of helm 3
+	if converted.Metadata.APIVersion == "" {
+		converted.Metadata.APIVersion = "v1"
+	}
+	for _, maintainer := range metadata.GetMaintainers() {
+		converted.Metadata.Maintainers = append(converted.Metadata.Maintainers, &helm3Maintainer{
+			Name: maintainer.GetName(), Email: maintainer.GetEmail(), URL: maintainer.GetUrl()})
+	}
+	for _, template := range chart.GetTemplates() {
+		converted.Templates = append(converted.Templates, &helm3File{Name: template.GetName(),
+			Data: append([]byte{}, template.GetData()...)})
+	}
+	for _, file := range chart.GetFiles() {
+		converted.Files = append(converted.Files, &helm3File{Name: file.GetTypeUrl(),
+			Data: append([]byte{}, file.GetValue()...)})
+	}
+	var err error
+	if converted.Values, err = helm3ValuesOf(chart.GetValues()); err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
+
+// hook of a helm 2 release in a helm 3 release
+func helm3HookOf(hook *hapirelease.Hook) *helm3Hook {
+	converted := &helm3Hook{
+		Name:     hook.GetName(),
+		Kind:     hook.GetKind(),
+		Path:     hook.GetPath(),
+		Manifest: hook.GetManifest(),
+		Weight:   int(hook.GetWeight()),
+		LastRun:  helm3HookExecution{Phase: "Unknown"},
+	}
+	for _, event := range hook.GetEvents() {
+		if helm3Event, found := helm2HookEvents[event]; found {
+			converted.Events = append(converted.Events, helm3Event)
+		}
+	}
+	for _, policy := range hook.GetDeletePolicies() {
+		if helm3Policy, found := helm2HookDeletePolicies[policy]; found {
+			converted.DeletePolicies = append(converted.DeletePolicies, helm3Policy)
+		}
+	}
+	if hook.GetLastRun() != nil {
+		lastRun := helm3TimeOf(hook.GetLastRun())
+		converted.LastRun = helm3HookExecution{StartedAt: lastRun, CompletedAt: lastRun, Phase: "Succeeded"}
+	}
+	return converted
+}
+
+// helm 2 release stored by Tiller in a helm 3 release
+func helm3ReleaseOf(release *hapirelease.Release) (*helm3Release, error) {
+	if release.GetName() == "" || release.GetVersion() == 0 || release.GetInfo() == nil {
+		return nil, errors.New("helm 2 release has no name, version or info")
+	}
+	info := release.GetInfo()
+	status, found := helm2StatusCodes[info.GetStatus().GetCode()]
+	if !found {
+		status = helm2StatusCodes[hapirelease.Status_UNKNOWN]
+	}
+	converted := &helm3Release{
+		Name: release.GetName(),
+		Info: &helm3Info{
+			FirstDeployed: helm3TimeOf(info.GetFirstDeployed()),
+			LastDeployed:  helm3TimeOf(info.GetLastDeployed()),
+			Deleted:       helm3TimeOf(info.GetDeleted()),
+			Description:   info.GetDescription(),
+			Status:        status,
+			Notes:         info.GetStatus().GetNotes(),
+		},
+		Manifest:  release.GetManifest(),
+		Version:   int(release.GetVersion()),
+		Namespace: release.GetNamespace(),
+	}
+	var err error
+	if release.GetChart() != nil {
+		if converted.Chart, err = helm3ChartOf(release.GetChart()); err != nil {
+			return nil, err
+		}
+	}
+	if converted.Config, err = helm3ValuesOf(release.GetConfig()); err != nil {
+		return nil, err
+	}
+	for _, hook := range release.GetHooks() {
+		converted.Hooks = append(converted.Hooks, helm3HookOf(hook))
+	}
+	return converted, nil
+}
+
+// decode a helm 2 release stored by Tiller (hapi.release.Release) into a helm 3 release.
+// Tiller stores the release encoded in protobuf, gzipped and base64 encoded.
+func decodeHelm2Release(data string) (*helm3Release, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 3 && bytes.Equal(b[0:3], []byte{0x1f, 0x8b, 0x08}) {
+		reader, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		if b, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	release := &hapirelease.Release{}
+	if err := proto.Unmarshal(b, release); err != nil {
+		return nil, err
+	}
+	return helm3ReleaseOf(release)
+}
+
+// encode a helm 3 release in the secret helm 3 stores it in, the release is encoded in
+// JSON, gzipped and base64 encoded in the release key of the secret
+func encodeHelm3ReleaseSecret(release *helm3Release) (*corev1.Secret, error) {
+	b, err := json.Marshal(release)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(b); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	version := strconv.Itoa(release.Version)
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("sh.helm.release.v1.%s.v%s", release.Name, version),
+			Namespace: release.Namespace,
+			Labels: map[string]string{
+				"name":    release.Name,
+				"owner":   "helm",
+				"status":  release.Info.Status,
+				"version": version,
+			},
+		},
+		Type: helm3ReleaseSecretType,
+		Data: map[string][]byte{"release": []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))},
+	}, nil
+}
+
+// decode a helm 3 release stored in a secret by helm 3
+func decodeHelm3ReleaseSecret(secret *corev1.Secret) (*helm3Release, error) {
+	b, err := base64.StdEncoding.DecodeString(string(secret.Data["release"]))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if b, err = ioutil.ReadAll(reader); err != nil {
+		return nil, err
+	}
+	release := &helm3Release{}
+	if err := json.Unmarshal(b, release); err != nil {
+		return nil, err
+	}
+	if release.Info == nil {
+		return nil, errors.New("helm 3 release has no info")
+	}
+	return release, nil
+}
+
+// migrate a helm 2 release stored by Tiller to helm 3 without reinstalling it, every
+// revision of the helm release in Tiller's namespace is stored in a helm 3 release secret
+// in the namespace of the helm release. The revisions already migrated are skipped and
+// the helm 2 release is kept, it is deleted with Tiller. Returns true if the helm release
+// was found in Tiller's namespace.
+func (r *IstioReconciler) MigrateHelm2Release(ctx context.Context, name string) (bool, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	tillerNamespace := r.TillerNamespace
+	if tillerNamespace == "" {
+		tillerNamespace = DefaultTillerNamespace
+	}
+	var configMapList corev1.ConfigMapList
+	if err := reader.List(ctx, &configMapList, client.InNamespace(tillerNamespace),
+		client.MatchingLabels(map[string]string{"NAME": name, "OWNER": "TILLER"})); err != nil {
+		return false, errors.New(fmt.Sprintf("failed to list helm 2 releases of %s in namespace %s, %s", name,
+			tillerNamespace, err.Error()))
+	}
+	if len(configMapList.Items) == 0 {
+		return false, nil
+	}
+	sort.Slice(configMapList.Items, func(i, j int) bool {
+		return configMapList.Items[i].ObjectMeta.Name < configMapList.Items[j].ObjectMeta.Name
+	})
+	for _, configMap := range configMapList.Items {
+		release, err := decodeHelm2Release(configMap.Data["release"])
+		if err != nil {
+			return true, errors.New(fmt.Sprintf("failed to decode helm 2 release %s/%s, %s", tillerNamespace,
+				configMap.ObjectMeta.Name, err.Error()))
+		}
+		secret, err := encodeHelm3ReleaseSecret(release)
+		if err != nil {
+			return true, errors.New(fmt.Sprintf("failed to encode helm 3 release of %s/%s, %s", tillerNamespace,
+				configMap.ObjectMeta.Name, err.Error()))
+		}
+		existing := &corev1.Secret{}
+		err = reader.Get(ctx, types.NamespacedName{Namespace: secret.ObjectMeta.Namespace,
+			Name: secret.ObjectMeta.Name}, existing)
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return true, errors.New(fmt.Sprintf("failed to get helm 3 release secret %s/%s, %s",
+				secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err.Error()))
+		}
+		if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+			return true, errors.New(fmt.Sprintf("failed to create helm 3 release secret %s/%s, %s",
+				secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err.Error()))
+		}
+		r.Log.Info(fmt.Sprintf("revision %d of helm release %s migrated from helm 2 to helm 3", release.Version,
+			release.Name))
+	}
+	return true, nil
+}
+
+// migrate istio's helm releases to helm 3 when istio CR changes from helm 2 to helm 3 and
+// save the version of helm that manages them in istio CR's status. istio's helm releases
+// are not reinstalled, istio keeps running. Helm releases migrated to helm 3 cannot be
+// managed by helm 2 again.
+func (r *IstioReconciler) MigrateIstioHelmReleases(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	helmVersion := r.IstioHelmVersion(IstioInstalledSpec(ist))
+	if ist.Status.HelmVersion == helmVersion {
+		return nil
+	}
+	if ist.Status.HelmVersion == operatorv1alpha1.HelmVersionV3 {
+		return errors.New(fmt.Sprintf("istio's helm releases of Istio CR %s are managed by helm 3 and cannot be "+
+			"managed by helm 2, set spec.helmVersion to v3", ist.ObjectMeta.Name))
+	}
+	if helmVersion == operatorv1alpha1.HelmVersionV3 {
+		specs := []operatorv1alpha1.IstioSpec{IstioInstalledSpec(ist)}
+		if IstioCanaryUpgradeInProgress(ist) {
+			specs = append(specs, IstioSpecWithControlPlane(ist.Spec, ist.Status.Canary.To))
+		}
+		for _, spec := range specs {
+			for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName,
+				operatorv1alpha1.IstioHelmChartName, operatorv1alpha1.IstioRemoteHelmChartName} {
+				releaseName := IstioReleaseName(spec, chartName)
+				migrated, err := r.MigrateHelm2Release(ctx, releaseName)
+				if err != nil {
+					return err
+				}
+				if migrated {
+					r.Log.Info(fmt.Sprintf("%s helm release migrated from helm 2 to helm 3", releaseName))
+				}
+			}
+		}
+	}
+	ist.Status.HelmVersion = helmVersion
+	if err := r.Status().Update(ctx, ist); err != nil {
+		return errors.New(fmt.Sprintf("failed to save helm version in Istio CR %s status, %s",
+			ist.ObjectMeta.Name, err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// the golden helm 3 release secrets are written instead of compared with
+// go test ./controllers -run TestMigrateHelm2Release -update
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// helm 3 release secret in the golden files, the release is decoded to compare it
+type testHelm3ReleaseSecret struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	Labels    map[string]string      `json:"labels"`
+	Type      corev1.SecretType      `json:"type"`
+	Release   map[string]interface{} `json:"release"`
+}
+
+// helm 2 releases stored by Tiller in testdata/helm2-migration/<case>/configmaps.yaml
+func testTillerConfigMaps(t *testing.T, dir string) []runtime.Object {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "configmaps.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objs []runtime.Object
+	for _, doc := range strings.Split(string(b), "---\n") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		configMap := &corev1.ConfigMap{}
+		if err := yaml.Unmarshal([]byte(doc), configMap); err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, configMap)
+	}
+	return objs
+}
+
+func TestMigrateHelm2Release(t *testing.T) {
+	tests := []struct {
+		name    string
+		release string
+		// revisions of the helm release already migrated, they are not migrated again
+		migrated []int
+	}{
+		{name: "istio-init", release: "istio-init"},
+		{name: "istio-upgraded", release: "istio", migrated: []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "helm2-migration", tt.name)
+			objs := testTillerConfigMaps(t, dir)
+			for _, version := range tt.migrated {
+				secret, err := encodeHelm3ReleaseSecret(&helm3Release{Name: tt.release, Version: version,
+					Namespace: "istio-system", Info: &helm3Info{Status: "deployed", Description: "Migrated"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				objs = append(objs, secret)
+			}
+			r := fakeIstioReconciler(objs...)
+
+			found, err := r.MigrateHelm2Release(context.Background(), tt.release)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found {
+				t.Fatalf("helm 2 release %s not found", tt.release)
+			}
+			var secretList corev1.SecretList
+			if err := r.List(context.Background(), &secretList,
+				client.MatchingLabels(map[string]string{"owner": "helm"})); err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			for i := range secretList.Items {
+				secret := &secretList.Items[i]
+				release, err := decodeHelm3ReleaseSecret(secret)
+				if err != nil {
+					t.Fatalf("secret %s: %v", secret.Name, err)
+				}
+				// the release is compared as helm 3 decodes it, in JSON
+				b, err := json.Marshal(release)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded := map[string]interface{}{}
+				if err := json.Unmarshal(b, &decoded); err != nil {
+					t.Fatal(err)
+				}
+				b, err = yaml.Marshal(testHelm3ReleaseSecret{Name: secret.Name, Namespace: secret.Namespace,
+					Labels: secret.Labels, Type: secret.Type, Release: decoded})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got.WriteString("---\n")
+				got.Write(b)
+			}
+
+			golden := filepath.Join(dir, "secrets.yaml")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != string(want) {
+				t.Errorf("helm 3 release secrets differ from %s, got\n%s", golden, got.String())
+			}
+
+			// the helm releases are migrated once
+			if _, err := r.MigrateHelm2Release(context.Background(), tt.release); err != nil {
+				t.Fatal(err)
+			}
+			var again corev1.SecretList
+			if err := r.List(context.Background(), &again,
+				client.MatchingLabels(map[string]string{"owner": "helm"})); err != nil {
+				t.Fatal(err)
+			}
+			if len(again.Items) != len(secretList.Items) {
+				t.Errorf("%d helm 3 release secrets after migrating again, want %d", len(again.Items),
+					len(secretList.Items))
+			}
+		})
+	}
+}
+
+func TestDecodeHelm2Release(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "not base64", data: "not base64!", wantErr: true},
+		{name: "not protobuf", data: "bm90IHByb3RvYnVm", wantErr: true},
+		// an empty hapi.release.Release has no name
+		{name: "empty", data: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeHelm2Release(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeHelm2Release() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMigrateIstioHelmReleasesVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		specVersion   operatorv1alpha1.HelmVersion
+		statusVersion operatorv1alpha1.HelmVersion
+		// default version of helm of the istio operator
+		defaultVersion operatorv1alpha1.HelmVersion
+		expected       operatorv1alpha1.HelmVersion
+		err            bool
+	}{
+		{name: "helm 2 by default", expected: operatorv1alpha1.HelmVersionV2},
+		{name: "helm 3 by default", defaultVersion: operatorv1alpha1.HelmVersionV3,
+			expected: operatorv1alpha1.HelmVersionV3},
+		{name: "helmVersion removed after migration", statusVersion: operatorv1alpha1.HelmVersionV3,
+			expected: operatorv1alpha1.HelmVersionV3},
+		{name: "default changed to helm 2 after migration", statusVersion: operatorv1alpha1.HelmVersionV3,
+			defaultVersion: operatorv1alpha1.HelmVersionV2, expected: operatorv1alpha1.HelmVersionV3},
+		{name: "helmVersion changed back to v2", specVersion: operatorv1alpha1.HelmVersionV2,
+			statusVersion: operatorv1alpha1.HelmVersionV3, expected: operatorv1alpha1.HelmVersionV3, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.HelmVersion = test.specVersion
+			ist.Status.HelmVersion = test.statusVersion
+			r := fakeIstioReconciler(ist)
+			r.DefaultHelmVersion = test.defaultVersion
+
+			if err := r.MigrateIstioHelmReleases(context.Background(), ist); (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ist.Status.HelmVersion != test.expected {
+				t.Errorf("expected helm version %s, got %s", test.expected, ist.Status.HelmVersion)
+			}
+			if version := r.IstioHelmVersion(IstioInstalledSpec(ist)); !test.err && version != test.expected {
+				t.Errorf("istio's helm releases managed by helm %s, expected %s", version, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,935 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// label of the objects applied by istio operator with the name of their release
+	IstioReleaseLabel = "operator.ccp.cisco.com/release"
+	// label of the configmaps that record the releases applied by istio operator
+	IstioReleaseRecordLabel = "operator.ccp.cisco.com/release-record"
+	// label of the configmaps that record the releases applied by istio operator with
+	// the installer that applied them
+	IstioInstallerLabel = "operator.ccp.cisco.com/installer"
+	// prefix of the names of the configmaps that record the releases applied by istio operator
+	istioReleaseRecordPrefix = "ccp-istio-release-"
+	// annotation of the helm hooks with the events they run at
+	helmHookAnnotation = "helm.sh/hook"
+	// annotation of the helm hooks with their weight, hooks run in ascending weight
+	helmHookWeightAnnotation = "helm.sh/hook-weight"
+)
+
+// order in which the kinds of a release are applied, helm's install order. Kinds that are
+// not in the list are applied last and the objects are deleted in the reverse order.
+var istioInstallOrder = []string{"Namespace", "ResourceQuota", "LimitRange", "PodSecurityPolicy",
+	"PodDisruptionBudget", "Secret", "ConfigMap", "StorageClass", "PersistentVolume", "PersistentVolumeClaim",
+	"ServiceAccount", "CustomResourceDefinition", "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding",
+	"Service", "DaemonSet", "Pod", "ReplicationController", "ReplicaSet", "Deployment", "HorizontalPodAutoscaler",
+	"StatefulSet", "Job", "CronJob", "Ingress", "APIService"}
+
+// helm hooks run before the objects of a release are applied by phase, install or upgrade
+var helmPreHooks = map[string][]string{
+	"install": {"crd-install", "pre-install"},
+	"upgrade": {"pre-upgrade"},
+}
+
+// helm hooks run after the objects of a release are applied by phase. The delete,
+// rollback and test hooks are never run.
+var helmPostHooks = map[string][]string{
+	"install": {"post-install"},
+	"upgrade": {"post-upgrade"},
+}
+
+// Installer installs, upgrades and uninstalls the releases of istio's charts. The
+// helm clients install them as helm releases, the other installers apply the
+// kubernetes objects of the charts with the API server.
+type Installer interface {
+	// install a new release
+	Install(release HelmRelease) error
+	// upgrade an existing release
+	Upgrade(release HelmRelease) error
+	// uninstall a release
+	Uninstall(name string) error
+	// get the state of a release, returns ErrHelmReleaseNotFound if it does not exist
+	Status(name string) (*HelmReleaseInfo, error)
+	// get the manifest (kubernetes objects) of a release
+	Manifest(name string) (string, error)
+}
+
+// installer of istio CR's spec, Helm if spec.installer is not set
+func IstioInstaller(spec operatorv1alpha1.IstioSpec) operatorv1alpha1.Installer {
+	if spec.Installer == "" {
+		return operatorv1alpha1.InstallerHelm
+	}
+	return spec.Installer
+}
+
+// InstallPendingError is returned by the installers that apply the kubernetes objects of
+// the charts when the objects of a release cannot be applied yet, for example when the
+// kind of a custom resource is not served until its CRD is established or when a job of
+// a pre-install hook has not completed. The install or upgrade is requeued and resumes
+// where it stopped.
+type InstallPendingError struct {
+	Release string
+	Reason  string
+}
+
+func (e *InstallPendingError) Error() string {
+	return fmt.Sprintf("release %s is pending, %s", e.Release, e.Reason)
+}
+
+// check if an error is an InstallPendingError
+func IsInstallPending(err error) bool {
+	_, pending := err.(*InstallPendingError)
+	return pending
+}
+
+// installer of istio CR's spec, the helm client of its helm version if spec.installer
+// is Helm or not set
+func (r *IstioReconciler) InstallerFor(spec operatorv1alpha1.IstioSpec) Installer {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+	objects := r.ObjectClient
+	if objects == nil {
+		objects = r.Client
+	}
+	switch IstioInstaller(spec) {
+	case operatorv1alpha1.InstallerManifests:
+		return &objectInstaller{
+			installer: operatorv1alpha1.InstallerManifests,
+			render:    RenderManifests,
+			client:    r.Client,
+			objects:   objects,
+			mapper:    r.ObjectMapper,
+			reader:    reader,
+			log:       r.Log.WithName("manifests"),
+		}
+	case operatorv1alpha1.InstallerRendered:
+		return &objectInstaller{
+			installer: operatorv1alpha1.InstallerRendered,
+			render:    RenderHelmChart,
+			client:    r.Client,
+			objects:   objects,
+			mapper:    r.ObjectMapper,
+			reader:    reader,
+			log:       r.Log.WithName("rendered"),
+		}
+	}
+	return r.HelmFor(spec)
+}
+
+// client of the kubernetes objects applied by the installers that apply the objects of
+// the charts and its rest mapper. The rest mapper discovers the kinds served by the API
+// server again when a kind is not found, so that the custom resources of a release are
+// applied once their CRDs are established.
+func NewObjectClient(config *rest.Config, scheme *runtime.Scheme) (client.Client, meta.RESTMapper, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("failed to create the discovery client, %s", err.Error()))
+	}
+	mapper := &discoveryRESTMapper{discovery: discoveryClient}
+	objectClient, err := client.New(config, client.Options{Scheme: scheme, Mapper: mapper})
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("failed to create the client of istio's objects, %s",
+			err.Error()))
+	}
+	return objectClient, mapper, nil
+}
+
+// discoveryRESTMapper is a rest mapper of the kinds served by the API server that
+// discovers them again when the mapping of a kind is not found
+type discoveryRESTMapper struct {
+	discovery discovery.DiscoveryInterface
+	mutex     sync.Mutex
+	mapper    meta.RESTMapper
+}
+
+// rest mapper of the kinds served by the API server, discovered if it does not exist yet
+// or if rediscover is true
+func (m *discoveryRESTMapper) current(rediscover bool) (meta.RESTMapper, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.mapper != nil && !rediscover {
+		return m.mapper, nil
+	}
+	groupResources, err := restmapper.GetAPIGroupResources(m.discovery)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to discover the kinds served by the API server, %s",
+			err.Error()))
+	}
+	m.mapper = restmapper.NewDiscoveryRESTMapper(groupResources)
+	return m.mapper, nil
+}
+
+func (m *discoveryRESTMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return mapper.KindFor(resource)
+}
+
+func (m *discoveryRESTMapper) KindsFor(resource schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return nil, err
+	}
+	return mapper.KindsFor(resource)
+}
+
+func (m *discoveryRESTMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource,
+	error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	return mapper.ResourceFor(input)
+}
+
+func (m *discoveryRESTMapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource,
+	error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return nil, err
+	}
+	return mapper.ResourcesFor(input)
+}
+
+func (m *discoveryRESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return nil, err
+	}
+	mapping, err := mapper.RESTMapping(gk, versions...)
+	if !meta.IsNoMatchError(err) {
+		return mapping, err
+	}
+	// the kind may be served since the kinds were discovered, for example after its CRD
+	// was applied
+	if mapper, err = m.current(true); err != nil {
+		return nil, err
+	}
+	return mapper.RESTMapping(gk, versions...)
+}
+
+func (m *discoveryRESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := mapper.RESTMappings(gk, versions...)
+	if !meta.IsNoMatchError(err) {
+		return mappings, err
+	}
+	if mapper, err = m.current(true); err != nil {
+		return nil, err
+	}
+	return mapper.RESTMappings(gk, versions...)
+}
+
+func (m *discoveryRESTMapper) ResourceSingularizer(resource string) (string, error) {
+	mapper, err := m.current(false)
+	if err != nil {
+		return "", err
+	}
+	return mapper.ResourceSingularizer(resource)
+}
+
+// objectInstaller implements Installer by applying the kubernetes objects rendered
+// from a chart with the API server. The objects are labeled with the name of their
+// release, and the objects of a release are recorded in a configmap in the namespace
+// of the release so that the objects no longer rendered are pruned on upgrade and
+// all of them are deleted on uninstall. Objects without the release label are never
+// deleted, and CRDs are not deleted so that the custom resources are kept. The helm
+// hooks of the charts run at their phase of an install or upgrade and are not recorded,
+// the delete, rollback and test hooks are not run.
+type objectInstaller struct {
+	installer operatorv1alpha1.Installer
+	// render the kubernetes objects of a release
+	render func(release HelmRelease) (string, error)
+	// saves the release records and creates the namespaces of the releases
+	client client.Client
+	// applies the objects of the releases
+	objects client.Client
+	// rest mapper of objects, finds the scope of the kinds of the objects
+	mapper meta.RESTMapper
+	// reads the release records from the API server instead of the cache
+	reader client.Reader
+	log    logr.Logger
+}
+
+// install a new release, an install that is pending resumes where it stopped
+func (o *objectInstaller) Install(release HelmRelease) error {
+	ctx := context.Background()
+	record, err := o.record(ctx, release.Name)
+	if err != nil && !IsHelmReleaseNotFound(err) {
+		return err
+	}
+	if record != nil && record.Data["status"] != HelmStatusPendingInstall {
+		return errors.New(fmt.Sprintf("failed to install release %s, it already exists in namespace %s",
+			release.Name, record.Namespace))
+	}
+	if record == nil {
+		if err := o.createNamespace(ctx, release.Namespace); err != nil {
+			return err
+		}
+		record = &corev1.ConfigMap{}
+		record.Name = istioReleaseRecordPrefix + release.Name
+		record.Namespace = release.Namespace
+	}
+	return o.deploy(ctx, record, release, 1, HelmStatusPendingInstall, "install")
+}
+
+// upgrade an existing release, an upgrade that is pending resumes where it stopped with
+// the same revision
+func (o *objectInstaller) Upgrade(release HelmRelease) error {
+	ctx := context.Background()
+	record, err := o.record(ctx, release.Name)
+	if err != nil {
+		return err
+	}
+	revision := recordRevision(record)
+	if record.Data["status"] != HelmStatusPendingUpgrade {
+		revision++
+	}
+	return o.deploy(ctx, record, release, revision, HelmStatusPendingUpgrade, "upgrade")
+}
+
+// apply the objects of a release and prune the recorded objects that are no longer
+// rendered. The objects are recorded before they are applied so that the objects applied
+// by a failed install or upgrade are deleted when the release is uninstalled, and the
+// pruned objects stay recorded until they are deleted.
+func (o *objectInstaller) deploy(ctx context.Context, record *corev1.ConfigMap, release HelmRelease,
+	revision int32, pendingStatus string, phase string) error {
+	var recorded []unstructured.Unstructured
+	if record.BinaryData["manifest"] != nil {
+		var err error
+		if recorded, err = recordedObjects(record); err != nil {
+			return err
+		}
+	}
+	objects, hooks, err := desiredObjects(o.render, release)
+	if err != nil {
+		return err
+	}
+	desired := map[string]bool{}
+	for _, object := range objects {
+		desired[objectKey(object)] = true
+	}
+	var pruned []unstructured.Unstructured
+	for _, object := range recorded {
+		if !desired[objectKey(object)] {
+			pruned = append(pruned, object)
+		}
+	}
+	if err := o.saveRecord(ctx, record, release, append(objects, pruned...), revision, pendingStatus); err != nil {
+		return err
+	}
+	if err := o.apply(ctx, release, objects, pruned, hooks, phase); err != nil {
+		if IsInstallPending(err) {
+			o.log.Info(err.Error())
+			return err
+		}
+		if saveErr := o.saveRecord(ctx, record, release, append(objects, pruned...), revision,
+			HelmStatusFailed); saveErr != nil {
+			o.log.Error(saveErr, fmt.Sprintf("failed to record the failed %s of release %s", phase, release.Name))
+		}
+		return err
+	}
+	return o.saveRecord(ctx, record, release, objects, revision, HelmStatusDeployed)
+}
+
+func (o *objectInstaller) Uninstall(name string) error {
+	ctx := context.Background()
+	record, err := o.record(ctx, name)
+	if err != nil {
+		return err
+	}
+	objects, err := recordedObjects(record)
+	if err != nil {
+		return err
+	}
+	if err := o.apply(ctx, HelmRelease{Name: name, Namespace: record.Namespace}, nil, objects, nil,
+		""); err != nil {
+		return err
+	}
+	if err := o.client.Delete(ctx, record); err != nil && !apierrors.IsNotFound(err) {
+		return errors.New(fmt.Sprintf("failed to delete the record of release %s, %s", name, err.Error()))
+	}
+	o.log.Info(fmt.Sprintf("release %s uninstalled", name))
+	return nil
+}
+
+func (o *objectInstaller) Status(name string) (*HelmReleaseInfo, error) {
+	record, err := o.record(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return &HelmReleaseInfo{
+		Name:      name,
+		Namespace: record.Namespace,
+		Revision:  recordRevision(record),
+		Status:    record.Data["status"],
+		Chart:     record.Data["chart"],
+		Updated:   record.Data["updated"],
+	}, nil
+}
+
+func (o *objectInstaller) Manifest(name string) (string, error) {
+	record, err := o.record(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	return recordManifest(record)
+}
+
+// render the objects and the helm hooks of a release and label them with the name of
+// the release
+func desiredObjects(render func(release HelmRelease) (string, error), release HelmRelease) (
+	[]unstructured.Unstructured, []unstructured.Unstructured, error) {
+	manifest, err := render(release)
+	if err != nil {
+		return nil, nil, err
+	}
+	rendered, err := ParseManifest(manifest)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("failed to parse the objects of release %s, %s", release.Name,
+			err.Error()))
+	}
+	var objects, hooks []unstructured.Unstructured
+	keys := map[string]bool{}
+	for _, object := range rendered {
+		if object.GetKind() == "" || object.GetAPIVersion() == "" || object.GetName() == "" {
+			return nil, nil, errors.New(fmt.Sprintf("failed to parse the objects of release %s, %v is not a "+
+				"kubernetes object", release.Name, object.Object))
+		}
+		if keys[objectKey(object)] {
+			return nil, nil, errors.New(fmt.Sprintf("failed to parse the objects of release %s, %s %s is "+
+				"duplicated", release.Name, object.GetKind(), object.GetName()))
+		}
+		keys[objectKey(object)] = true
+		labels := object.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[IstioReleaseLabel] = release.Name
+		object.SetLabels(labels)
+		if _, hook := object.GetAnnotations()[helmHookAnnotation]; hook {
+			hooks = append(hooks, object)
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return objects, hooks, nil
+}
+
+// create the namespace of a release if it does not exist
+func (o *objectInstaller) createNamespace(ctx context.Context, name string) error {
+	namespace := &corev1.Namespace{}
+	namespace.Name = name
+	if err := o.client.Create(ctx, namespace); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.New(fmt.Sprintf("failed to create namespace %s, %s", name, err.Error()))
+	}
+	return nil
+}
+
+// get the configmap that records a release, returns ErrHelmReleaseNotFound if it does not exist
+func (o *objectInstaller) record(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	var configMapList corev1.ConfigMapList
+	if err := o.reader.List(ctx, &configMapList,
+		client.MatchingLabels(map[string]string{IstioReleaseRecordLabel: name})); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get the record of release %s, %s", name, err.Error()))
+	}
+	for i := range configMapList.Items {
+		if configMapList.Items[i].Name == istioReleaseRecordPrefix+name {
+			return &configMapList.Items[i], nil
+		}
+	}
+	return nil, &HelmError{Op: "status", Release: name, Err: ErrHelmReleaseNotFound}
+}
+
+// save the objects, revision and status of a release in its record
+func (o *objectInstaller) saveRecord(ctx context.Context, record *corev1.ConfigMap, release HelmRelease,
+	objects []unstructured.Unstructured, revision int32, status string) error {
+	manifest, err := manifestOf(objects)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to record release %s, %s", release.Name, err.Error()))
+	}
+	// the manifest is compressed since istio's charts render more objects than fit in a
+	// configmap uncompressed
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(manifest)); err != nil {
+		return errors.New(fmt.Sprintf("failed to record release %s, %s", release.Name, err.Error()))
+	}
+	if err := writer.Close(); err != nil {
+		return errors.New(fmt.Sprintf("failed to record release %s, %s", release.Name, err.Error()))
+	}
+	record.Labels = map[string]string{
+		IstioReleaseRecordLabel: release.Name,
+		IstioInstallerLabel:     string(o.installer),
+	}
+	record.Data = map[string]string{
+		"chart":    IstioChartTag(release.Chart),
+		"revision": strconv.Itoa(int(revision)),
+		"status":   status,
+		"updated":  time.Now().UTC().Format(time.RFC3339),
+	}
+	record.BinaryData = map[string][]byte{"manifest": compressed.Bytes()}
+	if record.ResourceVersion == "" {
+		err = o.client.Create(ctx, record)
+	}
+	// the record is updated when it exists, also when it was created by this install
+	// and its resource version is not known
+	if record.ResourceVersion != "" || apierrors.IsAlreadyExists(err) {
+		err = o.client.Update(ctx, record)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to record release %s, %s", release.Name, err.Error()))
+	}
+	return nil
+}
+
+// revision of a release in its record
+func recordRevision(record *corev1.ConfigMap) int32 {
+	revision, _ := strconv.Atoi(record.Data["revision"])
+	return int32(revision)
+}
+
+// manifest of a release in its record
+func recordManifest(record *corev1.ConfigMap) (string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(record.BinaryData["manifest"]))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read the manifest in %s/%s, %s", record.Namespace,
+			record.Name, err.Error()))
+	}
+	manifest, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read the manifest in %s/%s, %s", record.Namespace,
+			record.Name, err.Error()))
+	}
+	return string(manifest), nil
+}
+
+// objects of a release in its record
+func recordedObjects(record *corev1.ConfigMap) ([]unstructured.Unstructured, error) {
+	manifest, err := recordManifest(record)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := ParseManifest(manifest)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse the manifest in %s/%s, %s", record.Namespace,
+			record.Name, err.Error()))
+	}
+	return objects, nil
+}
+
+// manifest of objects, the objects in YAML separated by ---
+func manifestOf(objects []unstructured.Unstructured) (string, error) {
+	var manifest bytes.Buffer
+	for _, object := range objects {
+		b, err := yaml.Marshal(object.Object)
+		if err != nil {
+			return "", err
+		}
+		manifest.WriteString("---\n")
+		manifest.Write(b)
+	}
+	return manifest.String(), nil
+}
+
+// key of an object in a release, the namespace is the one in the rendered object
+func objectKey(object unstructured.Unstructured) string {
+	return fmt.Sprintf("%s/%s/%s", object.GroupVersionKind().GroupKind().String(), object.GetNamespace(),
+		object.GetName())
+}
+
+// position of a kind in the install order
+func installOrder(kind string) int {
+	for i, k := range istioInstallOrder {
+		if k == kind {
+			return i
+		}
+	}
+	return len(istioInstallOrder)
+}
+
+// helm hooks of a release run at one of events, sorted by weight and name like helm
+func hooksOf(hooks []unstructured.Unstructured, events []string) []unstructured.Unstructured {
+	var matched []unstructured.Unstructured
+	for _, hook := range hooks {
+		for _, event := range strings.Split(hook.GetAnnotations()[helmHookAnnotation], ",") {
+			if containsString(events, strings.TrimSpace(event)) {
+				matched = append(matched, hook)
+				break
+			}
+		}
+	}
+	weight := func(hook unstructured.Unstructured) int {
+		weight, _ := strconv.Atoi(hook.GetAnnotations()[helmHookWeightAnnotation])
+		return weight
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if weight(matched[i]) != weight(matched[j]) {
+			return weight(matched[i]) < weight(matched[j])
+		}
+		return matched[i].GetName() < matched[j].GetName()
+	})
+	return matched
+}
+
+// applier applies and deletes the objects of a release with the API server
+type applier struct {
+	client client.Client
+	mapper meta.RESTMapper
+	// delete the objects without the release label too, like helm 3 deletes all the
+	// objects in the manifest of its releases
+	deleteUnlabeled bool
+	log             logr.Logger
+}
+
+// apply the objects of a release with the applier of the installer
+func (o *objectInstaller) apply(ctx context.Context, release HelmRelease, objects []unstructured.Unstructured,
+	pruned []unstructured.Unstructured, hooks []unstructured.Unstructured, phase string) error {
+	a := &applier{client: o.objects, mapper: o.mapper, log: o.log}
+	return a.applyRelease(ctx, release, objects, pruned, hooks, phase)
+}
+
+// apply the objects of a release in install order and then delete the pruned objects
+// in the reverse order. The pre hooks of the phase (install or upgrade) are applied
+// first and their jobs must complete before the objects are applied, the post hooks
+// are applied last.
+func (a *applier) applyRelease(ctx context.Context, release HelmRelease, objects []unstructured.Unstructured,
+	pruned []unstructured.Unstructured, hooks []unstructured.Unstructured, phase string) error {
+	if a.mapper == nil {
+		return errors.New(fmt.Sprintf("failed to apply release %s, no rest mapper", release.Name))
+	}
+	for _, hook := range hooksOf(hooks, helmPreHooks[phase]) {
+		if err := a.apply(ctx, release, hook); err != nil {
+			return err
+		}
+		if err := a.jobCompleted(ctx, release, hook); err != nil {
+			return err
+		}
+	}
+	objects = append([]unstructured.Unstructured{}, objects...)
+	sort.SliceStable(objects, func(i, j int) bool {
+		return installOrder(objects[i].GetKind()) < installOrder(objects[j].GetKind())
+	})
+	for _, object := range objects {
+		if err := a.apply(ctx, release, object); err != nil {
+			return err
+		}
+	}
+	pruned = append([]unstructured.Unstructured{}, pruned...)
+	sort.SliceStable(pruned, func(i, j int) bool {
+		return installOrder(pruned[i].GetKind()) > installOrder(pruned[j].GetKind())
+	})
+	for _, object := range pruned {
+		if err := a.delete(ctx, release, object); err != nil {
+			return err
+		}
+	}
+	for _, hook := range hooksOf(hooks, helmPostHooks[phase]) {
+		if err := a.apply(ctx, release, hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set the namespace of an object, the namespaced objects without a namespace are in the
+// namespace of the release. The release is pending while the kind of the object is not
+// served, for example until its CRD is established.
+func (a *applier) setNamespace(release HelmRelease, object *unstructured.Unstructured) error {
+	gvk := object.GroupVersionKind()
+	mapping, err := a.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return &InstallPendingError{Release: release.Name, Reason: fmt.Sprintf("%s %s is not served yet",
+			gvk.String(), object.GetName())}
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to find the resource of %s %s, %s", gvk.String(),
+			object.GetName(), err.Error()))
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		object.SetNamespace("")
+	} else if object.GetNamespace() == "" {
+		object.SetNamespace(release.Namespace)
+	}
+	return nil
+}
+
+// get the live object of an object, returns nil if it does not exist
+func (a *applier) get(ctx context.Context, object unstructured.Unstructured) (*unstructured.Unstructured,
+	error) {
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(object.GroupVersionKind())
+	err := a.client.Get(ctx, client.ObjectKey{Namespace: object.GetNamespace(), Name: object.GetName()}, live)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get %s %s/%s, %s", object.GetKind(), object.GetNamespace(),
+			object.GetName(), err.Error()))
+	}
+	return live, nil
+}
+
+// create an object or update the fields set in it, the other fields of the live object
+// are kept. Jobs cannot be updated, a job that changed is deleted and the release is
+// pending until the job is deleted and created again.
+func (a *applier) apply(ctx context.Context, release HelmRelease, object unstructured.Unstructured) error {
+	object = *object.DeepCopy()
+	if err := a.setNamespace(release, &object); err != nil {
+		return err
+	}
+	live, err := a.get(ctx, object)
+	if err != nil {
+		return err
+	}
+	if live == nil {
+		if err := a.client.Create(ctx, &object); err != nil {
+			return errors.New(fmt.Sprintf("failed to create %s %s/%s, %s", object.GetKind(),
+				object.GetNamespace(), object.GetName(), err.Error()))
+		}
+		a.log.Info(fmt.Sprintf("%s %s/%s created", object.GetKind(), object.GetNamespace(), object.GetName()))
+		return nil
+	}
+	if live.GetDeletionTimestamp() != nil {
+		return &InstallPendingError{Release: release.Name, Reason: fmt.Sprintf("%s %s/%s is being deleted",
+			object.GetKind(), object.GetNamespace(), object.GetName())}
+	}
+	if len(DriftedFields(object.Object, live.Object)) == 0 {
+		return nil
+	}
+	if object.GetKind() == "Job" {
+		if err := a.client.Delete(ctx, live,
+			client.PropagationPolicy(v1.DeletePropagationForeground)); err != nil && !apierrors.IsNotFound(err) {
+			return errors.New(fmt.Sprintf("failed to delete %s %s/%s, %s", object.GetKind(),
+				object.GetNamespace(), object.GetName(), err.Error()))
+		}
+		a.log.Info(fmt.Sprintf("%s %s/%s deleted to be created again", object.GetKind(), object.GetNamespace(),
+			object.GetName()))
+		return &InstallPendingError{Release: release.Name, Reason: fmt.Sprintf("%s %s/%s is created again",
+			object.GetKind(), object.GetNamespace(), object.GetName())}
+	}
+	live.Object = MergeRenderedFields(live.Object, object.Object)
+	if err := a.client.Update(ctx, live); err != nil {
+		return errors.New(fmt.Sprintf("failed to update %s %s/%s, %s", object.GetKind(), object.GetNamespace(),
+			object.GetName(), err.Error()))
+	}
+	a.log.Info(fmt.Sprintf("%s %s/%s updated", object.GetKind(), object.GetNamespace(), object.GetName()))
+	return nil
+}
+
+// check if the job of a helm hook completed, the release is pending until it completes.
+// Hooks that are not jobs complete when they are applied.
+func (a *applier) jobCompleted(ctx context.Context, release HelmRelease, hook unstructured.Unstructured) error {
+	if hook.GetKind() != "Job" {
+		return nil
+	}
+	hook = *hook.DeepCopy()
+	if err := a.setNamespace(release, &hook); err != nil {
+		return err
+	}
+	live, err := a.get(ctx, hook)
+	if err != nil {
+		return err
+	}
+	if live != nil {
+		conditions, _, _ := unstructured.NestedSlice(live.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, _ := c.(map[string]interface{})
+			if condition["status"] != string(corev1.ConditionTrue) {
+				continue
+			}
+			switch condition["type"] {
+			case "Complete":
+				return nil
+			case "Failed":
+				return errors.New(fmt.Sprintf("failed to run hook %s/%s of release %s, %v", hook.GetNamespace(),
+					hook.GetName(), release.Name, condition["message"]))
+			}
+		}
+	}
+	return &InstallPendingError{Release: release.Name, Reason: fmt.Sprintf("hook %s/%s has not completed",
+		hook.GetNamespace(), hook.GetName())}
+}
+
+// delete an object of a release if it is still labeled with the name of the release
+func (a *applier) delete(ctx context.Context, release HelmRelease, object unstructured.Unstructured) error {
+	if object.GetKind() == "CustomResourceDefinition" {
+		a.log.Info(fmt.Sprintf("CustomResourceDefinition %s kept", object.GetName()))
+		return nil
+	}
+	object = *object.DeepCopy()
+	if err := a.setNamespace(release, &object); err != nil {
+		if IsInstallPending(err) {
+			// the kind is no longer served, the object does not exist
+			return nil
+		}
+		return err
+	}
+	live, err := a.get(ctx, object)
+	if err != nil || live == nil {
+		return err
+	}
+	if !a.deleteUnlabeled && live.GetLabels()[IstioReleaseLabel] != release.Name {
+		a.log.Info(fmt.Sprintf("%s %s/%s kept, it is not labeled with release %s", object.GetKind(),
+			object.GetNamespace(), object.GetName(), release.Name))
+		return nil
+	}
+	if err := a.client.Delete(ctx, live,
+		client.PropagationPolicy(v1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+		return errors.New(fmt.Sprintf("failed to delete %s %s/%s, %s", object.GetKind(), object.GetNamespace(),
+			object.GetName(), err.Error()))
+	}
+	a.log.Info(fmt.Sprintf("%s %s/%s deleted", object.GetKind(), object.GetNamespace(), object.GetName()))
+	return nil
+}
+
+// render the kubernetes manifests in a directory or a tarball (.tgz, .tar.gz or .tar)
+// of manifests, the .yaml, .yml and .json files are read in the order of their paths.
+// The values files are not used.
+func RenderManifests(release HelmRelease) (string, error) {
+	info, err := os.Stat(release.Chart)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read manifests %s, %s", release.Chart, err.Error()))
+	}
+	files := map[string][]byte{}
+	if info.IsDir() {
+		err = filepath.Walk(release.Chart, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !isManifestFile(path) {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(release.Chart, path)
+			if err != nil {
+				return err
+			}
+			files[rel] = b
+			return nil
+		})
+	} else {
+		files, err = readManifestTarball(release.Chart)
+	}
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("failed to read manifests %s, %s", release.Chart, err.Error()))
+	}
+	if len(files) == 0 {
+		return "", errors.New(fmt.Sprintf("failed to read manifests %s, it has no .yaml, .yml or .json files",
+			release.Chart))
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var manifest bytes.Buffer
+	for _, path := range paths {
+		// the separator also makes the decoder read the JSON files as YAML documents
+		manifest.WriteString(fmt.Sprintf("---\n# Source: %s\n", path))
+		manifest.Write(files[path])
+		manifest.WriteString("\n")
+	}
+	return manifest.String(), nil
+}
+
+// true if a file is a kubernetes manifest
+func isManifestFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// read the kubernetes manifests in a tarball
+func readManifestTarball(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reader io.Reader = f
+	if strings.HasSuffix(path, ".tgz") || strings.HasSuffix(path, ".tar.gz") {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	files := map[string][]byte{}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || !isManifestFile(header.Name) {
+			continue
+		}
+		b, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = b
+	}
+}
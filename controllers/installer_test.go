@@ -0,0 +1,531 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// kinds served by the rest mapper of the installer tests
+var testNamespacedKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "ConfigMap"},
+	{Version: "v1", Kind: "Service"},
+	{Group: "batch", Version: "v1", Kind: "Job"},
+}
+
+var testClusterKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "Namespace"},
+	{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition"},
+}
+
+var testGatewayKind = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1alpha3", Kind: "Gateway"}
+
+// rest mapper serving the kinds of the installer tests
+func testObjectMapper() *meta.DefaultRESTMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range testNamespacedKinds {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	for _, gvk := range testClusterKinds {
+		mapper.Add(gvk, meta.RESTScopeRoot)
+	}
+	return mapper
+}
+
+// istio reconciler whose installers apply the objects with their own fake client serving
+// objs, the release records are saved with the client of the reconciler
+func testObjectReconciler(objs ...runtime.Object) *IstioReconciler {
+	r := fakeIstioReconciler()
+	r.ObjectClient = fake.NewFakeClientWithScheme(r.Scheme, objs...)
+	r.ObjectMapper = testObjectMapper()
+	return r
+}
+
+// installer of istio CR's spec.installer applying the objects rendered in *manifest with
+// the fake client
+func testObjectInstaller(t *testing.T, r *IstioReconciler, installer operatorv1alpha1.Installer,
+	manifest *string) *objectInstaller {
+	o, ok := r.InstallerFor(operatorv1alpha1.IstioSpec{Installer: installer}).(*objectInstaller)
+	if !ok {
+		t.Fatalf("installer %s does not apply objects", installer)
+	}
+	o.render = func(release HelmRelease) (string, error) {
+		return *manifest, nil
+	}
+	return o
+}
+
+// object applied by the installer tests, nil if it does not exist
+func testAppliedObject(t *testing.T, r *IstioReconciler, gvk schema.GroupVersionKind, namespace string,
+	name string) *unstructured.Unstructured {
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(gvk)
+	err := r.ObjectClient.Get(context.TODO(), client.ObjectKey{Namespace: namespace, Name: name}, object)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	return object
+}
+
+func TestRenderManifests(t *testing.T) {
+	files := map[string]string{
+		"manifests/b.yaml":          "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n",
+		"manifests/crds/a.yml":      "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"manifests/c.json":          `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "c"}}`,
+		"manifests/README.md":       "not a manifest",
+		"manifests/values.yaml.bak": "not a manifest",
+	}
+	dir := writeTestChart(t, files)
+	defer os.RemoveAll(dir)
+
+	// the same manifests in a tarball
+	tarball := filepath.Join(dir, "manifests.tgz")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		header := &tar.Header{Name: strings.TrimPrefix(name, "manifests/"), Mode: 0644,
+			Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tests := []struct {
+		name  string
+		chart string
+		err   bool
+	}{
+		{name: "directory", chart: filepath.Join(dir, "manifests")},
+		{name: "tarball", chart: tarball},
+		{name: "missing", chart: filepath.Join(dir, "missing"), err: true},
+		{name: "no manifests", chart: filepath.Join(dir, "manifests", "crds", "empty"), err: true},
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "manifests", "crds", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, err := RenderManifests(HelmRelease{Name: "istio", Chart: test.chart})
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if test.err {
+				return
+			}
+			objects, err := ParseManifest(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, object := range objects {
+				names = append(names, object.GetName())
+			}
+			// the files are read in the order of their paths
+			if expected := []string{"b", "c", "a"}; !reflect.DeepEqual(names, expected) {
+				t.Errorf("expected objects %v, got %v", expected, names)
+			}
+		})
+	}
+}
+
+func TestHooksOf(t *testing.T) {
+	hook := func(name string, events string, weight string) unstructured.Unstructured {
+		object := unstructured.Unstructured{}
+		object.SetName(name)
+		annotations := map[string]string{helmHookAnnotation: events}
+		if weight != "" {
+			annotations[helmHookWeightAnnotation] = weight
+		}
+		object.SetAnnotations(annotations)
+		return object
+	}
+	hooks := []unstructured.Unstructured{
+		hook("cleanup", "post-delete", ""),
+		hook("security", "post-install, post-upgrade", ""),
+		hook("grafana", "post-install", "-5"),
+		hook("crds", "crd-install", ""),
+		hook("test", "test-success", ""),
+		hook("migrate", "pre-upgrade,pre-rollback", "1"),
+		hook("certs", "pre-install,pre-upgrade", ""),
+	}
+	tests := []struct {
+		name     string
+		events   []string
+		expected []string
+	}{
+		{name: "pre-install", events: helmPreHooks["install"], expected: []string{"certs", "crds"}},
+		{name: "post-install", events: helmPostHooks["install"], expected: []string{"grafana", "security"}},
+		{name: "pre-upgrade", events: helmPreHooks["upgrade"], expected: []string{"certs", "migrate"}},
+		{name: "post-upgrade", events: helmPostHooks["upgrade"], expected: []string{"security"}},
+		{name: "uninstall", events: helmPreHooks[""]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var names []string
+			for _, hook := range hooksOf(hooks, test.events) {
+				names = append(names, hook.GetName())
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected hooks %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestObjectInstallerRecord(t *testing.T) {
+	r := testObjectReconciler()
+	manifest := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pilot
+  labels:
+    app: pilot
+data:
+  replicas: "1"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: pilot
+  namespace: istio-system
+`
+	o := testObjectInstaller(t, r, operatorv1alpha1.InstallerRendered, &manifest)
+	release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: "/opt/ccp/charts/istio-1.3.0.tgz"}
+
+	if _, err := o.Status("istio"); !IsHelmReleaseNotFound(err) {
+		t.Fatalf("expected release not found, got %v", err)
+	}
+	if err := o.Install(release); err != nil {
+		t.Fatal(err)
+	}
+	info, err := o.Status("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HelmReleaseInfo{Name: "istio", Namespace: "istio-system", Revision: 1,
+		Status: HelmStatusDeployed, Chart: "1.3.0", Updated: info.Updated}
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+
+	// the objects recorded are the rendered objects labeled with the release
+	recorded, err := o.Manifest("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := ParseManifest(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, objectKey(object))
+		if object.GetLabels()[IstioReleaseLabel] != "istio" {
+			t.Errorf("%s recorded without the release label", objectKey(object))
+		}
+	}
+	if expected := []string{"ConfigMap//pilot", "Service/istio-system/pilot"}; !reflect.DeepEqual(keys,
+		expected) {
+		t.Errorf("expected recorded objects %v, got %v", expected, keys)
+	}
+	var record corev1.ConfigMap
+	if err := r.Get(context.TODO(), client.ObjectKey{Namespace: "istio-system",
+		Name: istioReleaseRecordPrefix + "istio"}, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Labels[IstioInstallerLabel] != string(operatorv1alpha1.InstallerRendered) {
+		t.Errorf("record labeled with installer %s", record.Labels[IstioInstallerLabel])
+	}
+
+	// the objects are applied, in the namespace of the release if they have none
+	pilot := testAppliedObject(t, r, schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, "istio-system",
+		"pilot")
+	if pilot == nil || pilot.GetLabels()["app"] != "pilot" || pilot.GetLabels()[IstioReleaseLabel] != "istio" {
+		t.Errorf("unexpected configmap %v", pilot)
+	}
+	var namespace corev1.Namespace
+	if err := r.Get(context.TODO(), client.ObjectKey{Name: "istio-system"}, &namespace); err != nil {
+		t.Errorf("namespace of the release not created, %v", err)
+	}
+
+	// a release that exists is not installed again
+	if err := o.Install(release); err == nil {
+		t.Error("release installed twice")
+	}
+}
+
+func TestObjectInstallerUpgrade(t *testing.T) {
+	unlabeled := &corev1.ConfigMap{}
+	unlabeled.APIVersion = "v1"
+	unlabeled.Kind = "ConfigMap"
+	unlabeled.Namespace = "istio-system"
+	unlabeled.Name = "mixer"
+	r := testObjectReconciler(unlabeled)
+	manifest := `---
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: gateways.networking.istio.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pilot
+data:
+  replicas: "1"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: galley
+`
+	o := testObjectInstaller(t, r, operatorv1alpha1.InstallerManifests, &manifest)
+	release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: "/opt/ccp/manifests/istio-1.2.5"}
+	if err := o.Install(release); err != nil {
+		t.Fatal(err)
+	}
+	// mixer was created by the user, it is recorded but never labeled with the release
+	record, err := o.record(context.TODO(), "istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixer := unstructured.Unstructured{}
+	mixer.SetAPIVersion("v1")
+	mixer.SetKind("ConfigMap")
+	mixer.SetNamespace("istio-system")
+	mixer.SetName("mixer")
+	objects, err := recordedObjects(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.saveRecord(context.TODO(), record, release, append(objects, mixer), 1,
+		HelmStatusDeployed); err != nil {
+		t.Fatal(err)
+	}
+
+	// the objects no longer rendered are pruned, except the CRDs and the objects without
+	// the release label
+	manifest = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pilot
+data:
+  replicas: "2"
+`
+	release.Chart = "/opt/ccp/manifests/istio-1.3.0"
+	if err := o.Upgrade(release); err != nil {
+		t.Fatal(err)
+	}
+	info, err := o.Status("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Revision != 2 || info.Status != HelmStatusDeployed || info.Chart != "1.3.0" {
+		t.Errorf("unexpected release %+v", *info)
+	}
+	configMap := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	pilot := testAppliedObject(t, r, configMap, "istio-system", "pilot")
+	if replicas, _, _ := unstructured.NestedString(pilot.Object, "data", "replicas"); replicas != "2" {
+		t.Errorf("pilot not updated, replicas %s", replicas)
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "galley") != nil {
+		t.Error("galley not pruned")
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "mixer") == nil {
+		t.Error("mixer pruned without the release label")
+	}
+	if testAppliedObject(t, r, testClusterKinds[1], "", "gateways.networking.istio.io") == nil {
+		t.Error("CRD pruned")
+	}
+	recorded, err := o.Manifest("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(recorded, "galley") || strings.Contains(recorded, "gateways.networking.istio.io") {
+		t.Errorf("pruned objects still recorded:\n%s", recorded)
+	}
+
+	// all the objects are deleted on uninstall except the CRDs, and the record is deleted
+	if err := o.Uninstall("istio"); err != nil {
+		t.Fatal(err)
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "pilot") != nil {
+		t.Error("pilot not deleted")
+	}
+	if _, err := o.Status("istio"); !IsHelmReleaseNotFound(err) {
+		t.Errorf("expected release not found, got %v", err)
+	}
+}
+
+func TestObjectInstallerPending(t *testing.T) {
+	r := testObjectReconciler()
+	mapper := r.ObjectMapper.(*meta.DefaultRESTMapper)
+	manifest := `---
+apiVersion: networking.istio.io/v1alpha3
+kind: Gateway
+metadata:
+  name: ingressgateway
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: create-crds
+  annotations:
+    helm.sh/hook: crd-install
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: security
+  annotations:
+    helm.sh/hook: post-install
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cleanup
+  annotations:
+    helm.sh/hook: post-delete
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: pilot
+`
+	o := testObjectInstaller(t, r, operatorv1alpha1.InstallerRendered, &manifest)
+	release := HelmRelease{Name: "istio", Namespace: "istio-system", Chart: "istio-1.3.0.tgz"}
+	configMap := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	job := schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+
+	// the install is pending until the job of the crd-install hook completes, the objects
+	// of the release are not applied before
+	err := o.Install(release)
+	if !IsInstallPending(err) {
+		t.Fatalf("expected install pending, got %v", err)
+	}
+	if testAppliedObject(t, r, job, "istio-system", "create-crds") == nil {
+		t.Error("job of the crd-install hook not created")
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "pilot") != nil {
+		t.Error("pilot created before the crd-install hook completed")
+	}
+	if info, err := o.Status("istio"); err != nil || info.Status != HelmStatusPendingInstall {
+		t.Errorf("expected release pending install, got %+v, %v", info, err)
+	}
+
+	// the install resumes when the job completed and is pending until gateways are served
+	createCRDs := testAppliedObject(t, r, job, "istio-system", "create-crds")
+	unstructured.SetNestedSlice(createCRDs.Object, []interface{}{map[string]interface{}{"type": "Complete",
+		"status": "True"}}, "status", "conditions")
+	if err := r.ObjectClient.Update(context.TODO(), createCRDs); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Install(release); !IsInstallPending(err) ||
+		!strings.Contains(err.Error(), "ingressgateway is not served yet") {
+		t.Fatalf("expected install pending on gateways, got %v", err)
+	}
+	mapper.Add(testGatewayKind, meta.RESTScopeNamespace)
+	if err := o.Install(release); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := o.Status("istio"); err != nil || info.Status != HelmStatusDeployed || info.Revision != 1 {
+		t.Errorf("expected revision 1 deployed, got %+v, %v", info, err)
+	}
+	if testAppliedObject(t, r, testGatewayKind, "istio-system", "ingressgateway") == nil {
+		t.Error("gateway not created")
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "security") == nil {
+		t.Error("post-install hook not applied")
+	}
+	if testAppliedObject(t, r, configMap, "istio-system", "cleanup") != nil {
+		t.Error("post-delete hook applied on install")
+	}
+
+	// the hooks are not recorded
+	recorded, err := o.Manifest("istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(recorded, "create-crds") || strings.Contains(recorded, "security") {
+		t.Errorf("hooks recorded:\n%s", recorded)
+	}
+
+	// a job that changed is deleted and the upgrade is pending until it is created again,
+	// with the same revision
+	manifest = strings.Replace(manifest, "name: create-crds", "name: create-crds\n  labels:\n    version: 1.3.1", 1)
+	manifest = strings.Replace(manifest, "crd-install", "pre-upgrade", 1)
+	if err := o.Upgrade(release); !IsInstallPending(err) {
+		t.Fatalf("expected upgrade pending, got %v", err)
+	}
+	if testAppliedObject(t, r, job, "istio-system", "create-crds") != nil {
+		t.Error("job that changed not deleted")
+	}
+	if err := o.Upgrade(release); !IsInstallPending(err) ||
+		!strings.Contains(err.Error(), "has not completed") {
+		t.Fatalf("expected upgrade pending on the job, got %v", err)
+	}
+	if info, err := o.Status("istio"); err != nil || info.Status != HelmStatusPendingUpgrade || info.Revision != 2 {
+		t.Errorf("expected revision 2 pending upgrade, got %+v, %v", info, err)
+	}
+	createCRDs = testAppliedObject(t, r, job, "istio-system", "create-crds")
+	unstructured.SetNestedSlice(createCRDs.Object, []interface{}{map[string]interface{}{"type": "Failed",
+		"status": "True", "message": "BackoffLimitExceeded"}}, "status", "conditions")
+	if err := r.ObjectClient.Update(context.TODO(), createCRDs); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Upgrade(release); err == nil || IsInstallPending(err) {
+		t.Fatalf("expected upgrade failed, got %v", err)
+	}
+	if info, err := o.Status("istio"); err != nil || info.Status != HelmStatusFailed || info.Revision != 2 {
+		t.Errorf("expected revision 2 failed, got %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// label of the namespaces whose pods get the sidecar of the control plane without a revision
+	istioInjectionLabel = "istio-injection"
+	// annotation set in the pod template of the workloads of a namespace moved to a new
+	// control plane so that their pods are re-created with the new sidecar
+	IstioRestartedAtAnnotation = "operator.ccp.cisco.com/restartedAt"
+	// maximum length of the name of a namespace and of the value of a label
+	istioNameMaxLength = 63
+)
+
+// characters of a version of istio that are not allowed in the name of a revision
+var istioRevisionInvalidChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// control plane of istio that is installed for istio CR, the control plane in status
+// after a canary upgrade or the one in spec.controlPlane
+func IstioInstalledControlPlane(ist *operatorv1alpha1.Istio) operatorv1alpha1.IstioControlPlane {
+	if ist.Status.ControlPlane != nil {
+		return *ist.Status.ControlPlane
+	}
+	return ist.Spec.ControlPlane
+}
+
+// istio CR's spec with the control plane of istio that is installed and the version of
+// helm that manages its helm releases, helm 3 once they are migrated to helm 3 even if
+// spec.helmVersion is removed or the default version of helm of the istio operator is v2
+func IstioInstalledSpec(ist *operatorv1alpha1.Istio) operatorv1alpha1.IstioSpec {
+	spec := IstioSpecWithControlPlane(ist.Spec, IstioInstalledControlPlane(ist))
+	if spec.HelmVersion == "" && ist.Status.HelmVersion == operatorv1alpha1.HelmVersionV3 {
+		spec.HelmVersion = operatorv1alpha1.HelmVersionV3
+	}
+	return spec
+}
+
+// istio CR's spec with another control plane
+func IstioSpecWithControlPlane(spec operatorv1alpha1.IstioSpec,
+	controlPlane operatorv1alpha1.IstioControlPlane) operatorv1alpha1.IstioSpec {
+	spec.ControlPlane = controlPlane
+	return spec
+}
+
+// check if a canary upgrade of istio is in progress for istio CR
+func IstioCanaryUpgradeInProgress(ist *operatorv1alpha1.Istio) bool {
+	return ist.Status.Operation != nil && ist.Status.Operation.Type == operatorv1alpha1.IstioOperationCanaryUpgrade &&
+		ist.Status.Canary != nil
+}
+
+// name of the revision of the control plane installed by a canary upgrade to istio CR's
+// spec, the version of istio (1-1-8 for istio 1.1.8) prefixed with spec.controlPlane.revision
+func IstioCanaryRevision(spec operatorv1alpha1.IstioSpec) string {
+	version := spec.Version
+	if version == "" {
+		chartName := IstioControlPlaneChartName(spec)
+		version = strings.TrimPrefix(strings.TrimSuffix(filepath.Base(IstioControlPlaneChart(spec)), ".tgz"),
+			chartName+"-")
+	}
+	revision := strings.Trim(istioRevisionInvalidChars.ReplaceAllString(strings.ToLower(version), "-"), "-")
+	if spec.ControlPlane.Revision != "" {
+		revision = spec.ControlPlane.Revision + "-" + revision
+	}
+	return truncateIstioName(revision)
+}
+
+// control plane installed by a canary upgrade to istio CR's spec, its namespace, release
+// prefix and revision are the ones in spec.controlPlane suffixed with the canary revision
+func IstioCanaryControlPlane(spec operatorv1alpha1.IstioSpec) operatorv1alpha1.IstioControlPlane {
+	revision := IstioCanaryRevision(spec)
+	version := strings.TrimPrefix(revision, spec.ControlPlane.Revision+"-")
+	return operatorv1alpha1.IstioControlPlane{
+		Namespace:     truncateIstioName(IstioControlPlaneNamespace(spec) + "-" + version),
+		ReleasePrefix: spec.ControlPlane.ReleasePrefix + version + "-",
+		Revision:      revision,
+	}
+}
+
+// truncate a name to the maximum length of a namespace or label value
+func truncateIstioName(name string) string {
+	if len(name) > istioNameMaxLength {
+		name = strings.TrimRight(name[:istioNameMaxLength], "-")
+	}
+	return name
+}
+
+// check if the pods of a namespace get the sidecar of a control plane of istio, the
+// namespace is labeled with the revision of the control plane or with istio-injection
+// enabled for the control plane without a revision
+func IstioNamespaceUsesControlPlane(namespace corev1.Namespace, controlPlane operatorv1alpha1.IstioControlPlane) bool {
+	revision, ok := namespace.ObjectMeta.Labels[operatorv1alpha1.IstioRevisionLabel]
+	if controlPlane.Revision != "" {
+		return ok && revision == controlPlane.Revision
+	}
+	return !ok && namespace.ObjectMeta.Labels[istioInjectionLabel] == "enabled"
+}
+
+// plan the canary upgrade of istio to istio CR's spec in istio CR's status. The namespaces
+// using the installed control plane are split in batches, the namespaces in
+// spec.canary.batches first and then the other namespaces batchSize at a time.
+func (r *IstioReconciler) PlanIstioCanaryUpgrade(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	from := IstioInstalledControlPlane(ist)
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return errors.New(fmt.Sprintf("%s, %s", "failed to list namespaces for canary upgrade of istio",
+			err.Error()))
+	}
+	using := map[string]bool{}
+	var names []string
+	for _, namespace := range namespaceList.Items {
+		if IstioNamespaceUsesControlPlane(namespace, from) {
+			using[namespace.ObjectMeta.Name] = true
+			names = append(names, namespace.ObjectMeta.Name)
+		}
+	}
+	sort.Strings(names)
+
+	canary := operatorv1alpha1.IstioCanary{}
+	if ist.Spec.Canary != nil {
+		canary = *ist.Spec.Canary
+	}
+	batchSize := canary.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	status := &operatorv1alpha1.IstioCanaryStatus{
+		From:         from,
+		To:           IstioCanaryControlPlane(ist.Spec),
+		CurrentBatch: 1,
+	}
+	planned := map[string]bool{}
+	addBatch := func(batch []string) {
+		if len(batch) == 0 {
+			return
+		}
+		status.Batches++
+		for _, name := range batch {
+			planned[name] = true
+			status.Namespaces = append(status.Namespaces, operatorv1alpha1.IstioCanaryNamespace{
+				Name:  name,
+				Batch: status.Batches,
+				Phase: operatorv1alpha1.IstioCanaryNamespacePending,
+			})
+		}
+	}
+	for _, batch := range canary.Batches {
+		var namespaces []string
+		for _, name := range batch.Namespaces {
+			if !using[name] || planned[name] {
+				r.Log.Info(fmt.Sprintf("namespace %s in spec.canary.batches does not use the control plane of "+
+					"istio in %s or is in another batch, it is not moved", name, IstioControlPlaneNamespace(
+					IstioSpecWithControlPlane(ist.Spec, from))))
+				continue
+			}
+			namespaces = append(namespaces, name)
+		}
+		addBatch(namespaces)
+	}
+	var batch []string
+	for _, name := range names {
+		if planned[name] {
+			continue
+		}
+		batch = append(batch, name)
+		if int32(len(batch)) == batchSize {
+			addBatch(batch)
+			batch = nil
+		}
+	}
+	addBatch(batch)
+
+	ist.Status.Canary = status
+	r.Log.Info(fmt.Sprintf("canary upgrade of istio planned, %d namespace(s) are moved to revision %s in %d "+
+		"batch(es)", len(status.Namespaces), status.To.Revision, status.Batches))
+	return nil
+}
+
+// move the namespaces of the current batch of the canary upgrade of istio to the new
+// control plane. The namespaces are labeled with the new revision and their workloads are
+// restarted, the next batch is moved once all the workloads of the batch and the pods of
+// the new control plane are ready. Returns true when all the batches are moved.
+func (r *IstioReconciler) MoveIstioNamespaces(ctx context.Context, ist *operatorv1alpha1.Istio) (bool, error) {
+	canary := ist.Status.Canary
+	if canary.CurrentBatch > canary.Batches {
+		return true, nil
+	}
+	var batch []*operatorv1alpha1.IstioCanaryNamespace
+	for i := range canary.Namespaces {
+		if canary.Namespaces[i].Batch == canary.CurrentBatch {
+			batch = append(batch, &canary.Namespaces[i])
+		}
+	}
+	now := v1.Now()
+	changed := false
+	setPhase := func(namespace *operatorv1alpha1.IstioCanaryNamespace, phase operatorv1alpha1.IstioCanaryNamespacePhase,
+		message string) {
+		changed = true
+		namespace.Phase = phase
+		namespace.Message = message
+		namespace.LastTransitionTime = &now
+	}
+
+	// the namespaces of a batch that failed are moved again when the step runs again
+	for _, namespace := range batch {
+		if namespace.Phase == operatorv1alpha1.IstioCanaryNamespaceFailed {
+			setPhase(namespace, operatorv1alpha1.IstioCanaryNamespacePending, "")
+			canary.BatchStartTime = nil
+		}
+	}
+
+	if canary.BatchStartTime == nil {
+		for _, namespace := range batch {
+			if namespace.Phase != operatorv1alpha1.IstioCanaryNamespacePending {
+				continue
+			}
+			if err := r.MoveIstioNamespace(ctx, namespace.Name, canary.To); err != nil {
+				return false, err
+			}
+			setPhase(namespace, operatorv1alpha1.IstioCanaryNamespaceMoving, "")
+		}
+		canary.BatchStartTime = &now
+		r.Log.Info(fmt.Sprintf("moving batch %d of %d of namespaces to revision %s of istio", canary.CurrentBatch,
+			canary.Batches, canary.To.Revision))
+		return false, r.SaveIstioOperation(ctx, ist)
+	}
+
+	// check the health of the batch
+	moved := true
+	var notReady []string
+	for _, namespace := range batch {
+		if namespace.Phase != operatorv1alpha1.IstioCanaryNamespaceMoving {
+			continue
+		}
+		workloads, err := r.IstioNamespaceWorkloadsNotReady(ctx, namespace.Name)
+		if err != nil {
+			return false, err
+		}
+		if len(workloads) == 0 {
+			setPhase(namespace, operatorv1alpha1.IstioCanaryNamespaceMoved, "")
+			r.Log.Info(fmt.Sprintf("namespace %s moved to revision %s of istio", namespace.Name, canary.To.Revision))
+			continue
+		}
+		moved = false
+		notReady = append(notReady, fmt.Sprintf("%s (%s)", namespace.Name, strings.Join(workloads, ", ")))
+		if time.Since(canary.BatchStartTime.Time) >= operatorv1alpha1.TimeoutInternal*time.Second {
+			setPhase(namespace, operatorv1alpha1.IstioCanaryNamespaceFailed,
+				fmt.Sprintf("workloads not ready: %s", strings.Join(workloads, ", ")))
+		}
+	}
+	if moved {
+		ready, err := r.IstioPodsAreReady(ctx, IstioControlPlaneNamespace(
+			IstioSpecWithControlPlane(ist.Spec, canary.To)))
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			moved = false
+			notReady = append(notReady, "istio's pods of revision "+canary.To.Revision)
+		}
+	}
+	if moved {
+		r.Log.Info(fmt.Sprintf("batch %d of %d of namespaces moved to revision %s of istio", canary.CurrentBatch,
+			canary.Batches, canary.To.Revision))
+		canary.CurrentBatch++
+		canary.BatchStartTime = nil
+		if err := r.SaveIstioOperation(ctx, ist); err != nil {
+			return false, err
+		}
+		return canary.CurrentBatch > canary.Batches, nil
+	}
+	if time.Since(canary.BatchStartTime.Time) >= operatorv1alpha1.TimeoutInternal*time.Second {
+		return false, errors.New(fmt.Sprintf("batch %d of namespaces was not ready %d seconds after it was moved "+
+			"to revision %s of istio: %s", canary.CurrentBatch, operatorv1alpha1.TimeoutInternal, canary.To.Revision,
+			strings.Join(notReady, "; ")))
+	}
+	if !changed {
+		return false, nil
+	}
+	return false, r.SaveIstioOperation(ctx, ist)
+}
+
+// move a namespace to a control plane of istio, the namespace is labeled with the revision
+// of the control plane and its Deployments, StatefulSets and DaemonSets are restarted so
+// that their pods get the sidecar of the control plane
+func (r *IstioReconciler) MoveIstioNamespace(ctx context.Context, name string,
+	controlPlane operatorv1alpha1.IstioControlPlane) error {
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return errors.New(fmt.Sprintf("failed to get namespace %s, %s", name, err.Error()))
+	}
+	original := namespace.DeepCopy()
+	if namespace.ObjectMeta.Labels == nil {
+		namespace.ObjectMeta.Labels = map[string]string{}
+	}
+	delete(namespace.ObjectMeta.Labels, istioInjectionLabel)
+	namespace.ObjectMeta.Labels[operatorv1alpha1.IstioRevisionLabel] = controlPlane.Revision
+	if err := r.Patch(ctx, namespace, client.MergeFrom(original)); err != nil {
+		return errors.New(fmt.Sprintf("failed to label namespace %s with revision %s, %s", name,
+			controlPlane.Revision, err.Error()))
+	}
+
+	restartedAt := time.Now().UTC().Format(time.RFC3339)
+	workloads, err := r.IstioNamespaceWorkloads(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, workload := range workloads {
+		if err := r.RestartIstioWorkload(ctx, workload, restartedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deployments, StatefulSets and DaemonSets of a namespace that are not rolled out and
+// available yet
+func (r *IstioReconciler) IstioNamespaceWorkloadsNotReady(ctx context.Context, name string) ([]string, error) {
+	workloads, err := r.IstioNamespaceWorkloads(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var notReady []string
+	for _, workload := range workloads {
+		if !workload.ready {
+			notReady = append(notReady, workload.kind+" "+workload.meta.Name)
+		}
+	}
+	return notReady, nil
+}
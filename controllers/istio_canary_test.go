@@ -0,0 +1,265 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// namespace with labels
+func testNamespace(name string, labels map[string]string) *corev1.Namespace {
+	namespace := &corev1.Namespace{}
+	namespace.ObjectMeta.Name = name
+	namespace.ObjectMeta.Labels = labels
+	return namespace
+}
+
+// Deployment with one replica that is rolled out and available when ready
+func testDeployment(namespace string, name string, ready bool) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{}
+	deployment.ObjectMeta.Namespace = namespace
+	deployment.ObjectMeta.Name = name
+	if ready {
+		deployment.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	}
+	return deployment
+}
+
+func TestIstioCanaryControlPlane(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     operatorv1alpha1.IstioSpec
+		expected operatorv1alpha1.IstioControlPlane
+	}{
+		{
+			name: "version of istio",
+			spec: operatorv1alpha1.IstioSpec{Version: "1.3.0"},
+			expected: operatorv1alpha1.IstioControlPlane{Namespace: "istio-system-1-3-0", ReleasePrefix: "1-3-0-",
+				Revision: "1-3-0"},
+		},
+		{
+			name: "version of the chart",
+			spec: operatorv1alpha1.IstioSpec{CcpIstio: operatorv1alpha1.IstioValues{
+				Chart: "/opt/ccp/charts/istio-1.3.0-ccp1.tgz"}},
+			expected: operatorv1alpha1.IstioControlPlane{Namespace: "istio-system-1-3-0-ccp1",
+				ReleasePrefix: "1-3-0-ccp1-", Revision: "1-3-0-ccp1"},
+		},
+		{
+			name: "control plane with a revision",
+			spec: func() operatorv1alpha1.IstioSpec {
+				spec := testControlPlaneSpec("istio-canary", "canary-", "canary")
+				spec.Version = "1.3.0_RC1"
+				return spec
+			}(),
+			expected: operatorv1alpha1.IstioControlPlane{Namespace: "istio-canary-1-3-0-rc1",
+				ReleasePrefix: "canary-1-3-0-rc1-", Revision: "canary-1-3-0-rc1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if revision := IstioCanaryRevision(test.spec); revision != test.expected.Revision {
+				t.Errorf("expected revision %s, got %s", test.expected.Revision, revision)
+			}
+			if controlPlane := IstioCanaryControlPlane(test.spec); controlPlane != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, controlPlane)
+			}
+		})
+	}
+
+	// names longer than a label value are truncated
+	spec := testControlPlaneSpec("", "", strings.Repeat("r", 60))
+	spec.Version = "1.3.0"
+	controlPlane := IstioCanaryControlPlane(spec)
+	if len(controlPlane.Revision) > istioNameMaxLength || len(controlPlane.Namespace) > istioNameMaxLength ||
+		strings.HasSuffix(controlPlane.Revision, "-") || strings.HasSuffix(controlPlane.Namespace, "-") {
+		t.Errorf("names not truncated: %+v", controlPlane)
+	}
+}
+
+func TestIstioNamespaceUsesControlPlane(t *testing.T) {
+	canary := operatorv1alpha1.IstioControlPlane{Namespace: "istio-canary", Revision: "canary"}
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		controlPlane operatorv1alpha1.IstioControlPlane
+		expected     bool
+	}{
+		{name: "injection enabled", labels: map[string]string{istioInjectionLabel: "enabled"}, expected: true},
+		{name: "injection disabled", labels: map[string]string{istioInjectionLabel: "disabled"}},
+		{name: "no labels"},
+		{name: "revision of another control plane", labels: map[string]string{
+			istioInjectionLabel: "enabled", operatorv1alpha1.IstioRevisionLabel: "canary"}},
+		{name: "revision of the control plane", labels: map[string]string{
+			operatorv1alpha1.IstioRevisionLabel: "canary"}, controlPlane: canary, expected: true},
+		{name: "injection enabled without the revision", labels: map[string]string{istioInjectionLabel: "enabled"},
+			controlPlane: canary},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			namespace := testNamespace("bookinfo", test.labels)
+			if uses := IstioNamespaceUsesControlPlane(*namespace, test.controlPlane); uses != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, uses)
+			}
+		})
+	}
+}
+
+func TestPlanIstioCanaryUpgrade(t *testing.T) {
+	enabled := map[string]string{istioInjectionLabel: "enabled"}
+	tests := []struct {
+		name     string
+		canary   *operatorv1alpha1.IstioCanary
+		expected [][]string
+	}{
+		{name: "one namespace at a time", expected: [][]string{{"a"}, {"b"}, {"c"}}},
+		{name: "batch size", canary: &operatorv1alpha1.IstioCanary{BatchSize: 2},
+			expected: [][]string{{"a", "b"}, {"c"}}},
+		{
+			name: "batches first",
+			canary: &operatorv1alpha1.IstioCanary{BatchSize: 2, Batches: []operatorv1alpha1.IstioCanaryBatch{
+				{Namespaces: []string{"c"}}, {Namespaces: []string{"d", "c"}}}},
+			expected: [][]string{{"c"}, {"a", "b"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.Version = "1.3.0"
+			ist.Spec.Canary = test.canary
+			r := fakeIstioReconciler(testNamespace("c", enabled), testNamespace("a", enabled),
+				testNamespace("b", enabled), testNamespace("d", nil),
+				testNamespace("e", map[string]string{operatorv1alpha1.IstioRevisionLabel: "1-2-2"}))
+			if err := r.PlanIstioCanaryUpgrade(context.TODO(), ist); err != nil {
+				t.Fatal(err)
+			}
+			canary := ist.Status.Canary
+			if canary.From != (operatorv1alpha1.IstioControlPlane{}) || canary.To.Revision != "1-3-0" {
+				t.Errorf("unexpected control planes from %+v to %+v", canary.From, canary.To)
+			}
+			if canary.CurrentBatch != 1 || int(canary.Batches) != len(test.expected) {
+				t.Errorf("expected batch 1 of %d, got %d of %d", len(test.expected), canary.CurrentBatch,
+					canary.Batches)
+			}
+			batches := make([][]string, canary.Batches)
+			for _, namespace := range canary.Namespaces {
+				if namespace.Phase != operatorv1alpha1.IstioCanaryNamespacePending {
+					t.Errorf("namespace %s is %s", namespace.Name, namespace.Phase)
+				}
+				batches[namespace.Batch-1] = append(batches[namespace.Batch-1], namespace.Name)
+			}
+			if !reflect.DeepEqual(batches, test.expected) {
+				t.Errorf("expected batches %v, got %v", test.expected, batches)
+			}
+		})
+	}
+}
+
+func TestMoveIstioNamespaces(t *testing.T) {
+	ist := testIstioCR("ccp-istio", true)
+	testCanaryUpgradeInProgress(ist)
+	ist.Status.Canary.CurrentBatch = 1
+	ist.Status.Canary.Batches = 2
+	ist.Status.Canary.Namespaces = []operatorv1alpha1.IstioCanaryNamespace{
+		{Name: "bookinfo", Batch: 1, Phase: operatorv1alpha1.IstioCanaryNamespacePending},
+		{Name: "web", Batch: 2, Phase: operatorv1alpha1.IstioCanaryNamespacePending},
+	}
+	pod := testIstioPod("istiod", true)
+	pod.ObjectMeta.Namespace = "istio-1-3-0"
+	r := fakeIstioReconciler(ist, pod, testDeployment("bookinfo", "productpage", false),
+		testNamespace("bookinfo", map[string]string{istioInjectionLabel: "enabled"}),
+		testNamespace("web", map[string]string{istioInjectionLabel: "enabled"}))
+	ctx := context.TODO()
+	move := func(expected bool, phase operatorv1alpha1.IstioCanaryNamespacePhase) {
+		t.Helper()
+		moved, err := r.MoveIstioNamespaces(ctx, ist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if moved != expected {
+			t.Errorf("expected moved %v, got %v", expected, moved)
+		}
+		if namespace := ist.Status.Canary.Namespaces[0]; namespace.Phase != phase {
+			t.Errorf("expected namespace %s %s, got %s", namespace.Name, phase, namespace.Phase)
+		}
+	}
+
+	// the namespace of the first batch is labeled with the new revision and its workloads restarted
+	move(false, operatorv1alpha1.IstioCanaryNamespaceMoving)
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: "bookinfo"}, namespace); err != nil {
+		t.Fatal(err)
+	}
+	// the fake client keeps the keys a merge patch deletes, istio-injection is not checked
+	if revision := namespace.ObjectMeta.Labels[operatorv1alpha1.IstioRevisionLabel]; revision != "1-3-0" {
+		t.Errorf("expected revision 1-3-0, got %s", revision)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "bookinfo", Name: "productpage"}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Spec.Template.ObjectMeta.Annotations[IstioRestartedAtAnnotation] == "" {
+		t.Error("productpage not restarted")
+	}
+	if ist.Status.Canary.BatchStartTime == nil {
+		t.Fatal("batch start time not set")
+	}
+
+	// the batch is moving until its workloads are ready
+	move(false, operatorv1alpha1.IstioCanaryNamespaceMoving)
+	if ist.Status.Canary.CurrentBatch != 1 {
+		t.Errorf("moved to batch %d with workloads not ready", ist.Status.Canary.CurrentBatch)
+	}
+
+	// the namespace fails after the timeout and is moved again when the step runs again
+	startTime := v1.NewTime(time.Now().Add(-2 * operatorv1alpha1.TimeoutInternal * time.Second))
+	ist.Status.Canary.BatchStartTime = &startTime
+	if _, err := r.MoveIstioNamespaces(ctx, ist); err == nil {
+		t.Error("expected timeout error")
+	}
+	if namespace := ist.Status.Canary.Namespaces[0]; namespace.Phase != operatorv1alpha1.IstioCanaryNamespaceFailed ||
+		!strings.Contains(namespace.Message, "Deployment productpage") {
+		t.Errorf("unexpected namespace %+v", namespace)
+	}
+	move(false, operatorv1alpha1.IstioCanaryNamespaceMoving)
+
+	// the next batch is moved once the workloads are ready
+	ready := testDeployment("bookinfo", "productpage", true)
+	deployment.Status = ready.Status
+	if err := r.Update(ctx, deployment); err != nil {
+		t.Fatal(err)
+	}
+	move(false, operatorv1alpha1.IstioCanaryNamespaceMoved)
+	if ist.Status.Canary.CurrentBatch != 2 || ist.Status.Canary.BatchStartTime != nil {
+		t.Errorf("expected batch 2 to move, got batch %d started at %v", ist.Status.Canary.CurrentBatch,
+			ist.Status.Canary.BatchStartTime)
+	}
+	move(false, operatorv1alpha1.IstioCanaryNamespaceMoved)
+	move(true, operatorv1alpha1.IstioCanaryNamespaceMoved)
+	if ist.Status.Canary.Namespaces[1].Phase != operatorv1alpha1.IstioCanaryNamespaceMoved {
+		t.Errorf("namespace web is %s", ist.Status.Canary.Namespaces[1].Phase)
+	}
+}
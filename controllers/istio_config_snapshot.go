@@ -0,0 +1,459 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// key of the gzipped snapshot in the snapshot ConfigMaps' binaryData
+	istioConfigSnapshotKey = "resources.json.gz"
+	// key of the number of ConfigMaps the snapshot is split across in the data of the
+	// first one
+	istioConfigSnapshotChunksKey = "chunks"
+	// key of the start time of the operation that took the snapshot in the data of the
+	// first ConfigMap, only that operation restores the snapshot
+	istioConfigSnapshotOperationKey = "operationStartTime"
+	// size of the part of the gzipped snapshot in each ConfigMap, binaryData is base64
+	// encoded and a ConfigMap cannot exceed 1MiB
+	istioConfigSnapshotChunkSize = 512 * 1024
+)
+
+// groups of the istio CRDs whose custom resources are snapshotted before istio is
+// deleted and restored after it is installed again. The RBAC rule of the istio custom
+// resources in the +kubebuilder:rbac markers of IstioReconciler grants these groups,
+// TestIstioCRDGroupsRBAC checks that they are the same.
+var IstioCRDGroups = []string{"authentication.istio.io", "config.istio.io", "networking.istio.io",
+	"rbac.istio.io"}
+
+// true if a CRD group is one of the groups of istio's CRDs
+func IsIstioCRDGroup(group string) bool {
+	for _, istioGroup := range IstioCRDGroups {
+		if group == istioGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// istioConfigSnapshotEntry is one istio custom resource in the snapshot
+type istioConfigSnapshotEntry struct {
+	Group    string                 `json:"group"`
+	Version  string                 `json:"version"`
+	Resource string                 `json:"resource"`
+	Object   map[string]interface{} `json:"object"`
+}
+
+func (e istioConfigSnapshotEntry) gvr() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: e.Group, Version: e.Version, Resource: e.Resource}
+}
+
+// key identifying the istio custom resource, for example networking.istio.io/virtualservices/default/reviews
+func (e istioConfigSnapshotEntry) key() string {
+	obj := unstructured.Unstructured{Object: e.Object}
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s/%s/%s", e.Group, e.Resource, obj.GetName())
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", e.Group, e.Resource, obj.GetNamespace(), obj.GetName())
+}
+
+// name of the ConfigMap with the snapshot of istio's custom resources
+func IstioConfigSnapshotName(ist *operatorv1alpha1.Istio) string {
+	return fmt.Sprintf("%s-config-snapshot", ist.ObjectMeta.Name)
+}
+
+// name of the ConfigMap with a part of the snapshot of istio's custom resources, the first
+// part is in the ConfigMap IstioConfigSnapshotName
+func istioConfigSnapshotChunkName(ist *operatorv1alpha1.Istio, chunk int) string {
+	if chunk == 0 {
+		return IstioConfigSnapshotName(ist)
+	}
+	return fmt.Sprintf("%s-%d", IstioConfigSnapshotName(ist), chunk)
+}
+
+// names of the helm releases of istio CR's control planes, the installed one and the
+// one of istio CR's spec
+func istioReleaseNames(ist *operatorv1alpha1.Istio) map[string]bool {
+	specs := []operatorv1alpha1.IstioSpec{ist.Spec, IstioInstalledSpec(ist)}
+	if IstioCanaryUpgradeInProgress(ist) {
+		specs = append(specs, IstioSpecWithControlPlane(ist.Spec, ist.Status.Canary.To))
+	}
+	releases := map[string]bool{}
+	for _, spec := range specs {
+		for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName,
+			operatorv1alpha1.IstioHelmChartName, operatorv1alpha1.IstioRemoteHelmChartName} {
+			releases[IstioReleaseName(spec, chartName)] = true
+		}
+	}
+	return releases
+}
+
+// true if an istio custom resource belongs to one of istio's helm releases (its release
+// label set by istio's charts or by the istio operator is the name of the release) or is
+// owned by another object. They are created again when istio is installed and are not
+// in the snapshot.
+func istioConfigOwnedByRelease(obj unstructured.Unstructured, releases map[string]bool) bool {
+	if len(obj.GetOwnerReferences()) != 0 {
+		return true
+	}
+	labels := obj.GetLabels()
+	return releases[labels["release"]] || releases[labels[IstioReleaseLabel]]
+}
+
+// custom resource to create again from an entry of the snapshot, without the fields set
+// by the api-server and the owners that may not exist anymore
+func istioConfigRestoreObject(entry istioConfigSnapshotEntry) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: runtime.DeepCopyJSON(entry.Object)}
+	for _, field := range []string{"resourceVersion", "uid", "selfLink", "creationTimestamp", "generation",
+		"deletionTimestamp", "deletionGracePeriodSeconds", "ownerReferences"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+	return obj
+}
+
+// list all istio CRDs
+func (r *IstioReconciler) ListIstioCRDs() ([]apiextv1beta1.CustomResourceDefinition, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	extclientset, err := apiextclientset.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	crdList, err := extclientset.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var istioCRDs []apiextv1beta1.CustomResourceDefinition
+	for _, crd := range crdList.Items {
+		if IsIstioCRDGroup(crd.Spec.Group) {
+			istioCRDs = append(istioCRDs, crd)
+		}
+	}
+	return istioCRDs, nil
+}
+
+// snapshot the istio custom resources created by users in ConfigMaps owned by the istio
+// CR before istio is deleted, the ones of istio's helm releases are not in the snapshot.
+// Custom resources already in an earlier snapshot that was not restored yet are kept, so
+// that a failed reinstall does not lose them. Returns the number of istio custom
+// resources in the snapshot.
+func (r *IstioReconciler) SnapshotIstioConfig(ctx context.Context, ist *operatorv1alpha1.Istio) (int, error) {
+	entries, err := r.readIstioConfigSnapshot(ctx, ist)
+	if err != nil {
+		return 0, err
+	}
+	snapshot := map[string]istioConfigSnapshotEntry{}
+	for _, entry := range entries {
+		snapshot[entry.key()] = entry
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return 0, err
+	}
+	dynclient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return 0, err
+	}
+	crds, err := r.ListIstioCRDs()
+	if err != nil {
+		return 0, err
+	}
+	releases := istioReleaseNames(ist)
+	for _, crd := range crds {
+		gvr := schema.GroupVersionResource{
+			Group:    crd.Spec.Group,
+			Version:  crdStorageVersion(crd),
+			Resource: crd.Spec.Names.Plural,
+		}
+		list, err := dynclient.Resource(gvr).List(v1.ListOptions{})
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("failed to list istio custom resources %s, %s",
+				gvr.String(), err.Error()))
+		}
+		for _, item := range list.Items {
+			if istioConfigOwnedByRelease(item, releases) {
+				continue
+			}
+			entry := istioConfigSnapshotEntry{
+				Group:    gvr.Group,
+				Version:  gvr.Version,
+				Resource: gvr.Resource,
+				Object:   item.Object,
+			}
+			snapshot[entry.key()] = entry
+		}
+	}
+
+	entries = make([]istioConfigSnapshotEntry, 0, len(snapshot))
+	for _, entry := range snapshot {
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := r.saveIstioConfigSnapshot(ctx, ist, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	r.Log.Info(fmt.Sprintf("snapshot of %d istio custom resources saved in ConfigMap %s",
+		len(entries), IstioConfigSnapshotName(ist)))
+	return len(entries), nil
+}
+
+// start time of the operation on istio CR that takes or restores a snapshot, empty if
+// no operation is in progress
+func istioConfigSnapshotOperation(ist *operatorv1alpha1.Istio) string {
+	if ist.Status.Operation == nil {
+		return ""
+	}
+	return ist.Status.Operation.StartTime.UTC().Format(time.RFC3339)
+}
+
+// re-create the istio custom resources in the snapshot that do not exist anymore.
+// The snapshot is deleted when all of them are restored. Returns nil if there is
+// no snapshot to restore. A snapshot taken by an earlier operation, for example
+// a reinstall that failed, is stale and is deleted instead of restored, the istio
+// custom resources deleted since then would be created again otherwise.
+func (r *IstioReconciler) RestoreIstioConfig(ctx context.Context,
+	ist *operatorv1alpha1.Istio) (*operatorv1alpha1.IstioConfigRestoreStatus, error) {
+	entries, err := r.readIstioConfigSnapshot(ctx, ist)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		// no snapshot to restore
+		return nil, nil
+	}
+	stale, err := r.istioConfigSnapshotIsStale(ctx, ist)
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		r.Log.Info(fmt.Sprintf("snapshot of istio custom resources in ConfigMap %s was not taken by the "+
+			"current operation, deleting it", IstioConfigSnapshotName(ist)))
+		return nil, r.deleteIstioConfigSnapshot(ctx, ist, 0)
+	}
+	now := v1.Now()
+	restoreStatus := &operatorv1alpha1.IstioConfigRestoreStatus{
+		Snapshot:        IstioConfigSnapshotName(ist),
+		Total:           int32(len(entries)),
+		LastRestoreTime: &now,
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	dynclient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		obj := istioConfigRestoreObject(entry)
+
+		var resource dynamic.ResourceInterface = dynclient.Resource(entry.gvr())
+		if obj.GetNamespace() != "" {
+			resource = dynclient.Resource(entry.gvr()).Namespace(obj.GetNamespace())
+		}
+		if _, err := resource.Create(obj, v1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				restoreStatus.Unchanged++
+				continue
+			}
+			r.Log.Error(err, fmt.Sprintf("failed to restore istio custom resource %s", entry.key()))
+			restoreStatus.Failed = append(restoreStatus.Failed, entry.key())
+			continue
+		}
+		r.Log.Info(fmt.Sprintf("istio custom resource %s restored", entry.key()))
+		restoreStatus.Restored++
+	}
+
+	if len(restoreStatus.Failed) == 0 {
+		if err := r.deleteIstioConfigSnapshot(ctx, ist, 0); err != nil {
+			return restoreStatus, err
+		}
+	}
+	return restoreStatus, nil
+}
+
+// split a gzipped snapshot in parts that fit in a ConfigMap
+func splitIstioConfigSnapshot(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > istioConfigSnapshotChunkSize {
+		chunks, data = append(chunks, data[:istioConfigSnapshotChunkSize]), data[istioConfigSnapshotChunkSize:]
+	}
+	return append(chunks, data)
+}
+
+// save a gzipped snapshot split across ConfigMaps owned by the istio CR, the first one
+// has the number of ConfigMaps and is saved last so that it never refers to parts not
+// saved yet. The parts of an earlier and larger snapshot are deleted.
+func (r *IstioReconciler) saveIstioConfigSnapshot(ctx context.Context, ist *operatorv1alpha1.Istio,
+	data []byte) error {
+	chunks := splitIstioConfigSnapshot(data)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      istioConfigSnapshotChunkName(ist, i),
+				Namespace: ist.ObjectMeta.Namespace,
+			},
+		}
+		chunk := chunks[i]
+		if _, err := ctrl.CreateOrUpdate(ctx, r.Client, cm, func() error {
+			cm.BinaryData = map[string][]byte{istioConfigSnapshotKey: chunk}
+			cm.Data = nil
+			if i == 0 {
+				cm.Data = map[string]string{
+					istioConfigSnapshotChunksKey:    strconv.Itoa(len(chunks)),
+					istioConfigSnapshotOperationKey: istioConfigSnapshotOperation(ist),
+				}
+			}
+			return ctrl.SetControllerReference(ist, cm, r.Scheme)
+		}); err != nil {
+			return errors.New(fmt.Sprintf("failed to save snapshot of istio custom resources in "+
+				"ConfigMap %s, %s", cm.ObjectMeta.Name, err.Error()))
+		}
+	}
+	return r.deleteIstioConfigSnapshot(ctx, ist, len(chunks))
+}
+
+// delete the ConfigMaps of the snapshot from the part first, the ConfigMaps are deleted
+// until one does not exist
+func (r *IstioReconciler) deleteIstioConfigSnapshot(ctx context.Context, ist *operatorv1alpha1.Istio,
+	first int) error {
+	for i := first; ; i++ {
+		cm := &corev1.ConfigMap{}
+		cm.ObjectMeta.Name = istioConfigSnapshotChunkName(ist, i)
+		cm.ObjectMeta.Namespace = ist.ObjectMeta.Namespace
+		if err := r.Delete(ctx, cm); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("failed to delete snapshot of istio custom resources in "+
+				"ConfigMap %s, %s", cm.ObjectMeta.Name, err.Error()))
+		}
+	}
+}
+
+// true if the snapshot of istio custom resources was not taken by the operation in
+// progress on istio CR, snapshots saved before the operation was recorded are stale
+func (r *IstioReconciler) istioConfigSnapshotIsStale(ctx context.Context,
+	ist *operatorv1alpha1.Istio) (bool, error) {
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{Name: IstioConfigSnapshotName(ist), Namespace: ist.ObjectMeta.Namespace}
+	if err := r.Get(ctx, key, cm); err != nil {
+		return false, err
+	}
+	operation := istioConfigSnapshotOperation(ist)
+	return operation == "" || cm.Data[istioConfigSnapshotOperationKey] != operation, nil
+}
+
+// read the snapshot of istio custom resources, returns no entries if there is no snapshot
+func (r *IstioReconciler) readIstioConfigSnapshot(ctx context.Context,
+	ist *operatorv1alpha1.Istio) ([]istioConfigSnapshotEntry, error) {
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{Name: IstioConfigSnapshotName(ist), Namespace: ist.ObjectMeta.Namespace}
+	if err := r.Get(ctx, key, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, ok := cm.BinaryData[istioConfigSnapshotKey]
+	if !ok {
+		return nil, nil
+	}
+	// snapshots saved before they were split have no number of parts
+	chunks := 1
+	if value, ok := cm.Data[istioConfigSnapshotChunksKey]; ok {
+		var err error
+		if chunks, err = strconv.Atoi(value); err != nil || chunks < 1 {
+			return nil, errors.New(fmt.Sprintf("invalid snapshot of istio custom resources in ConfigMap %s, "+
+				"invalid number of parts %s", key.Name, value))
+		}
+	}
+	for i := 1; i < chunks; i++ {
+		chunk := &corev1.ConfigMap{}
+		chunkKey := types.NamespacedName{Name: istioConfigSnapshotChunkName(ist, i), Namespace: key.Namespace}
+		if err := r.Get(ctx, chunkKey, chunk); err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read part %d of %d of the snapshot of istio custom "+
+				"resources in ConfigMap %s, %s", i+1, chunks, chunkKey.Name, err.Error()))
+		}
+		data = append(data[:len(data):len(data)], chunk.BinaryData[istioConfigSnapshotKey]...)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var entries []istioConfigSnapshotEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid snapshot of istio custom resources in ConfigMap %s, %s",
+			key.Name, err.Error()))
+	}
+	return entries, nil
+}
+
+// version in which the custom resources of a CRD are stored
+func crdStorageVersion(crd apiextv1beta1.CustomResourceDefinition) string {
+	for _, version := range crd.Spec.Versions {
+		if version.Storage {
+			return version.Name
+		}
+	}
+	return crd.Spec.Version
+}
@@ -0,0 +1,309 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// the istio operator can read and create the custom resources of all the groups that are
+// snapshotted
+func TestIstioCRDGroupsRBAC(t *testing.T) {
+	expected := append([]string{}, IstioCRDGroups...)
+	sort.Strings(expected)
+
+	source, err := ioutil.ReadFile("istio_controller.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := regexp.MustCompile(`(?m)^// \+kubebuilder:rbac:groups=([^,]*istio\.io[^,]*),resources=\*`).
+		FindSubmatch(source)
+	if marker == nil {
+		t.Fatal("no +kubebuilder:rbac marker of the istio custom resources in istio_controller.go")
+	}
+	groups := strings.Split(string(marker[1]), ";")
+	sort.Strings(groups)
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("groups of the +kubebuilder:rbac marker are %v, IstioCRDGroups are %v", groups, expected)
+	}
+
+	b, err := ioutil.ReadFile("../config/rbac/role.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var role struct {
+		Rules []struct {
+			APIGroups []string `json:"apiGroups"`
+		} `json:"rules"`
+	}
+	if err := yaml.Unmarshal(b, &role); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range role.Rules {
+		if len(rule.APIGroups) != 0 && strings.HasSuffix(rule.APIGroups[0], ".istio.io") {
+			groups := append([]string{}, rule.APIGroups...)
+			sort.Strings(groups)
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("groups of config/rbac/role.yaml are %v, IstioCRDGroups are %v", groups, expected)
+			}
+			return
+		}
+	}
+	t.Error("no rule of the istio custom resources in config/rbac/role.yaml")
+}
+
+func TestIstioConfigOwnedByRelease(t *testing.T) {
+	ist := &operatorv1alpha1.Istio{}
+	ist.Spec.ControlPlane.ReleasePrefix = "canary-"
+	releases := istioReleaseNames(ist)
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		owned    bool
+		expected bool
+	}{
+		{name: "created by users"},
+		{name: "installed by helm", labels: map[string]string{"release": "canary-istio", "heritage": "Tiller"},
+			expected: true},
+		{name: "installed by the istio operator", labels: map[string]string{IstioReleaseLabel: "canary-istio-init"},
+			expected: true},
+		{name: "installed by another helm release", labels: map[string]string{"release": "bookinfo"}},
+		{name: "owned by another object", owned: true, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj := unstructured.Unstructured{}
+			obj.SetName("reviews")
+			obj.SetLabels(test.labels)
+			if test.owned {
+				obj.SetOwnerReferences([]v1.OwnerReference{{Kind: "Deployment", Name: "reviews"}})
+			}
+			if owned := istioConfigOwnedByRelease(obj, releases); owned != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, owned)
+			}
+		})
+	}
+}
+
+func TestIstioConfigRestoreObject(t *testing.T) {
+	entry := istioConfigSnapshotEntry{Group: "networking.istio.io", Version: "v1alpha3",
+		Resource: "virtualservices", Object: map[string]interface{}{
+			"apiVersion": "networking.istio.io/v1alpha3",
+			"kind":       "VirtualService",
+			"metadata": map[string]interface{}{
+				"name":              "reviews",
+				"namespace":         "default",
+				"labels":            map[string]interface{}{"app": "reviews"},
+				"resourceVersion":   "1234",
+				"uid":               "6c3b1f5e",
+				"creationTimestamp": "2019-07-01T00:00:00Z",
+				"ownerReferences":   []interface{}{map[string]interface{}{"kind": "Deployment"}},
+			},
+			"spec":   map[string]interface{}{"hosts": []interface{}{"reviews"}},
+			"status": map[string]interface{}{},
+		}}
+	obj := istioConfigRestoreObject(entry)
+	expected := map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1alpha3",
+		"kind":       "VirtualService",
+		"metadata": map[string]interface{}{
+			"name":      "reviews",
+			"namespace": "default",
+			"labels":    map[string]interface{}{"app": "reviews"},
+		},
+		"spec": map[string]interface{}{"hosts": []interface{}{"reviews"}},
+	}
+	if !reflect.DeepEqual(obj.Object, expected) {
+		t.Errorf("expected %v, got %v", expected, obj.Object)
+	}
+	if _, found := entry.Object["status"]; !found {
+		t.Error("the entry of the snapshot was changed")
+	}
+}
+
+// gzipped snapshot of istio custom resources with a random value of size bytes
+func testIstioConfigSnapshot(t *testing.T, size int) []byte {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	entries := []istioConfigSnapshotEntry{{Group: "networking.istio.io", Version: "v1alpha3",
+		Resource: "envoyfilters", Object: map[string]interface{}{"metadata": map[string]interface{}{
+			"name": "lua"}, "spec": base64.StdEncoding.EncodeToString(random)}}}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestIstioConfigSnapshotChunks(t *testing.T) {
+	ist := &operatorv1alpha1.Istio{}
+	ist.ObjectMeta.Name = "ccp-istio"
+	ist.ObjectMeta.Namespace = "default"
+	ist.ObjectMeta.UID = "d9607e19"
+	r := fakeIstioReconciler(ist)
+	ctx := context.TODO()
+
+	chunkExists := func(chunk int) bool {
+		key := types.NamespacedName{Namespace: "default", Name: istioConfigSnapshotChunkName(ist, chunk)}
+		err := r.Get(ctx, key, &corev1.ConfigMap{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		split bool
+	}{
+		{name: "larger than a ConfigMap", size: 2 * istioConfigSnapshotChunkSize, split: true},
+		{name: "smaller than a ConfigMap", size: 1024},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := testIstioConfigSnapshot(t, test.size)
+			chunks := (len(data) + istioConfigSnapshotChunkSize - 1) / istioConfigSnapshotChunkSize
+			if (chunks > 1) != test.split {
+				t.Fatalf("snapshot of %d bytes is in %d ConfigMaps", len(data), chunks)
+			}
+			if err := r.saveIstioConfigSnapshot(ctx, ist, data); err != nil {
+				t.Fatal(err)
+			}
+			for chunk := 0; chunk <= chunks; chunk++ {
+				if exists := chunkExists(chunk); exists != (chunk < chunks) {
+					t.Errorf("ConfigMap %s exists: %v", istioConfigSnapshotChunkName(ist, chunk), exists)
+				}
+			}
+			entries, err := r.readIstioConfigSnapshot(ctx, ist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || len(entries[0].Object["spec"].(string)) < test.size {
+				t.Errorf("snapshot not read back from %d ConfigMaps", chunks)
+			}
+		})
+	}
+
+	data := testIstioConfigSnapshot(t, istioConfigSnapshotChunkSize)
+	if err := r.saveIstioConfigSnapshot(ctx, ist, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.deleteIstioConfigSnapshot(ctx, ist, 0); err != nil {
+		t.Fatal(err)
+	}
+	if chunkExists(0) || chunkExists(1) {
+		t.Error("snapshot not deleted")
+	}
+	if entries, err := r.readIstioConfigSnapshot(ctx, ist); entries != nil || err != nil {
+		t.Errorf("expected no snapshot, got %v, %v", entries, err)
+	}
+}
+
+func TestRestoreStaleIstioConfigSnapshot(t *testing.T) {
+	started := v1.NewTime(time.Now().Add(-time.Hour))
+	tests := []struct {
+		name string
+		// operation that took the snapshot and operation restoring it
+		snapshotOperation *operatorv1alpha1.IstioOperation
+		restoreOperation  *operatorv1alpha1.IstioOperation
+		stale             bool
+	}{
+		{
+			name:              "snapshot of the current operation",
+			snapshotOperation: &operatorv1alpha1.IstioOperation{StartTime: started},
+			restoreOperation:  &operatorv1alpha1.IstioOperation{StartTime: started},
+		},
+		{
+			name:              "snapshot of an earlier operation",
+			snapshotOperation: &operatorv1alpha1.IstioOperation{StartTime: started},
+			restoreOperation:  &operatorv1alpha1.IstioOperation{StartTime: v1.Now()},
+			stale:             true,
+		},
+		{
+			name:             "snapshot of no operation",
+			restoreOperation: &operatorv1alpha1.IstioOperation{StartTime: started},
+			stale:            true,
+		},
+		{
+			name:              "no operation in progress",
+			snapshotOperation: &operatorv1alpha1.IstioOperation{StartTime: started},
+			stale:             true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := &operatorv1alpha1.Istio{}
+			ist.ObjectMeta.Name = "ccp-istio"
+			ist.ObjectMeta.Namespace = "default"
+			ist.ObjectMeta.UID = "d9607e19"
+			r := fakeIstioReconciler(ist)
+			ctx := context.TODO()
+
+			ist.Status.Operation = test.snapshotOperation
+			if err := r.saveIstioConfigSnapshot(ctx, ist, testIstioConfigSnapshot(t, 1024)); err != nil {
+				t.Fatal(err)
+			}
+			ist.Status.Operation = test.restoreOperation
+			stale, err := r.istioConfigSnapshotIsStale(ctx, ist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stale != test.stale {
+				t.Fatalf("expected stale %v, got %v", test.stale, stale)
+			}
+			if !test.stale {
+				return
+			}
+			// the stale snapshot is deleted, nothing is restored
+			restoreStatus, err := r.RestoreIstioConfig(ctx, ist)
+			if restoreStatus != nil || err != nil {
+				t.Errorf("expected no restore, got %v, %v", restoreStatus, err)
+			}
+			if entries, err := r.readIstioConfigSnapshot(ctx, ist); entries != nil || err != nil {
+				t.Errorf("stale snapshot not deleted, got %v, %v", entries, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// maximum length of the name of a helm release
+const helmReleaseNameMaxLength = 53
+
+// annotation in Chart.yaml of the istio and istio-remote charts that can install a control
+// plane next to others. Such charts honor the namespaces of the control plane and the
+// revision value, select the namespaces labeled with istio.io/rev set to the revision and
+// name their cluster-scoped objects (webhook configurations, cluster roles) with the
+// revision. The charts of istio 1.1 have none of these.
+const IstioChartControlPlanesAnnotation = "operator.ccp.cisco.com/control-planes"
+
+// namespace of istio's control plane of istio CR's spec, istio-system if it is not set
+func IstioControlPlaneNamespace(spec operatorv1alpha1.IstioSpec) string {
+	if spec.ControlPlane.Namespace == "" {
+		return operatorv1alpha1.IstioNamespace
+	}
+	return spec.ControlPlane.Namespace
+}
+
+// name of the helm release of an istio helm chart for istio CR's spec, the name of the
+// helm chart prefixed with spec.controlPlane.releasePrefix
+func IstioReleaseName(spec operatorv1alpha1.IstioSpec, chartName string) string {
+	return spec.ControlPlane.ReleasePrefix + chartName
+}
+
+// check if the control planes of two istio CR specs cannot run side by side. Control
+// planes conflict if they have the same namespace or release prefix (their helm releases
+// and objects would be the same) or the same revision (they would inject the sidecars of
+// the same namespaces).
+func IstioControlPlanesConflict(spec operatorv1alpha1.IstioSpec, other operatorv1alpha1.IstioSpec) bool {
+	return IstioControlPlaneNamespace(spec) == IstioControlPlaneNamespace(other) ||
+		spec.ControlPlane.ReleasePrefix == other.ControlPlane.ReleasePrefix ||
+		spec.ControlPlane.Revision == other.ControlPlane.Revision
+}
+
+// istio CRs whose control plane conflicts with the control plane of istio CR's spec,
+// including the istio CR itself
+func IstioCRsOfControlPlane(istios []operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec) []operatorv1alpha1.Istio {
+	var conflicting []operatorv1alpha1.Istio
+	for _, istio := range istios {
+		if IstioControlPlanesConflict(istio.Spec, spec) {
+			conflicting = append(conflicting, istio)
+		}
+	}
+	return conflicting
+}
+
+// path of the values file with the namespace and revision of istio's control plane in
+// the workspace
+func IstioControlPlaneValuesFilePath(workspace string, chartName string) string {
+	return filepath.Join(workspace, fmt.Sprintf("%s%s", chartName, "-control-plane-values.yaml"))
+}
+
+// check if istio's control plane of istio CR's spec is installed in istio-system without
+// a revision, its helm release does not need the values file of the control plane
+func IstioControlPlaneIsDefault(spec operatorv1alpha1.IstioSpec) bool {
+	return IstioControlPlaneNamespace(spec) == operatorv1alpha1.IstioNamespace && spec.ControlPlane.Revision == ""
+}
+
+// generate the values file with the namespace and revision of istio's control plane used
+// by the istio (or istio-remote) helm chart in the workspace. The namespace is set in the
+// namespaces of istio's components and the revision in the revision value, which the charts
+// use to select the namespaces labeled with istio.io/rev set to the revision.
+func (r *IstioReconciler) GenerateIstioControlPlaneValues(workspace string, spec operatorv1alpha1.IstioSpec) error {
+	if IstioControlPlaneIsDefault(spec) {
+		return nil
+	}
+	namespace := IstioControlPlaneNamespace(spec)
+	values := map[string]interface{}{
+		"global": map[string]interface{}{
+			"istioNamespace":     namespace,
+			"configNamespace":    namespace,
+			"policyNamespace":    namespace,
+			"telemetryNamespace": namespace,
+		},
+	}
+	if spec.ControlPlane.Revision != "" {
+		values["revision"] = spec.ControlPlane.Revision
+	}
+	f, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	chartName := IstioControlPlaneChartName(spec)
+	valuesFileName := IstioControlPlaneValuesFilePath(workspace, chartName)
+	if err := ioutil.WriteFile(valuesFileName, f, 0644); err != nil {
+		return errors.New(fmt.Sprintf("Failed to generate values file with the namespace and revision of the "+
+			"control plane for %s, %s", chartName, err.Error()))
+	}
+	r.Log.Info(fmt.Sprintf("Generated values file %s with the namespace and revision of the control plane",
+		valuesFileName))
+	return nil
+}
+
+// validate the controlPlane section of istio CR spec, the names of the helm releases with
+// the release prefix must be valid helm release names
+func ValidateIstioControlPlane(spec operatorv1alpha1.IstioSpec) error {
+	for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName,
+		operatorv1alpha1.IstioRemoteHelmChartName} {
+		if releaseName := IstioReleaseName(spec, chartName); len(releaseName) > helmReleaseNameMaxLength {
+			return errors.New(fmt.Sprintf("releasePrefix %s in controlPlane section of istio CR spec is too long, "+
+				"helm release name %s is longer than %d characters.", spec.ControlPlane.ReleasePrefix, releaseName,
+				helmReleaseNameMaxLength))
+		}
+	}
+	return nil
+}
+
+// namespaces of the control planes of an istio CR, the namespace in spec.controlPlane, the
+// namespace of the control plane that is installed and the namespaces of the control planes
+// of a canary upgrade in progress
+func IstioCRNamespaces(ist *operatorv1alpha1.Istio) map[string]bool {
+	namespaces := map[string]bool{
+		IstioControlPlaneNamespace(ist.Spec):                true,
+		IstioControlPlaneNamespace(IstioInstalledSpec(ist)): true,
+	}
+	if ist.Status.Canary != nil {
+		namespaces[IstioControlPlaneNamespace(IstioSpecWithControlPlane(ist.Spec, ist.Status.Canary.From))] = true
+		namespaces[IstioControlPlaneNamespace(IstioSpecWithControlPlane(ist.Spec, ist.Status.Canary.To))] = true
+	}
+	return namespaces
+}
+
+// check if the control plane of istio CR's spec is not the default one, it is installed in
+// another namespace, with a release prefix or with a revision
+func IstioControlPlaneIsIsolated(spec operatorv1alpha1.IstioSpec) bool {
+	return !IstioControlPlaneIsDefault(spec) || spec.ControlPlane.ReleasePrefix != ""
+}
+
+// check if the istio (or istio-remote) chart of istio CR's spec can install a control plane
+// next to others when the control plane is not the default one or when istio is upgraded
+// with the Canary upgrade strategy, which installs the new control plane with a revision.
+// Charts that are URLs are checked once they are downloaded into the workspace, they are
+// skipped without a workspace.
+func ValidateIstioControlPlaneChart(spec operatorv1alpha1.IstioSpec, workspace string) error {
+	if !IstioControlPlaneIsIsolated(spec) && spec.UpgradeStrategy != operatorv1alpha1.UpgradeStrategyCanary {
+		return nil
+	}
+	chartName := IstioControlPlaneChartName(spec)
+	location, _ := ParseChartReference(IstioControlPlaneChart(spec))
+	if IsRemoteChart(location) && workspace == "" {
+		return nil
+	}
+	chart := IstioReleaseChart(workspace, chartName, IstioControlPlaneChart(spec))
+	metadata, err := ReadChartMetadata(chart)
+	if err != nil {
+		return err
+	}
+	if metadata.Annotations[IstioChartControlPlanesAnnotation] != "true" {
+		return errors.New(fmt.Sprintf("%s helm chart %s cannot install a control plane next to others, the "+
+			"namespace, releasePrefix and revision in controlPlane section of istio CR spec and canary "+
+			"upgrades need a chart annotated with %s: \"true\" in its Chart.yaml.", chartName, location,
+			IstioChartControlPlanesAnnotation))
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// istio CR spec with a control plane
+func testControlPlaneSpec(namespace string, releasePrefix string, revision string) operatorv1alpha1.IstioSpec {
+	return operatorv1alpha1.IstioSpec{ControlPlane: operatorv1alpha1.IstioControlPlane{Namespace: namespace,
+		ReleasePrefix: releasePrefix, Revision: revision}}
+}
+
+func TestIstioControlPlanesConflict(t *testing.T) {
+	canary := testControlPlaneSpec("istio-canary", "canary-", "canary")
+	tests := []struct {
+		name     string
+		other    operatorv1alpha1.IstioSpec
+		expected bool
+	}{
+		{name: "same control plane", other: canary, expected: true},
+		{name: "another control plane", other: testControlPlaneSpec("istio-1-2", "istio-1-2-", "1-2")},
+		{name: "default control plane", other: testControlPlaneSpec("", "", "")},
+		{name: "same namespace", other: testControlPlaneSpec("istio-canary", "istio-1-2-", "1-2"), expected: true},
+		{name: "same release prefix", other: testControlPlaneSpec("istio-1-2", "canary-", "1-2"), expected: true},
+		{name: "same revision", other: testControlPlaneSpec("istio-1-2", "istio-1-2-", "canary"), expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if conflict := IstioControlPlanesConflict(canary, test.other); conflict != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, conflict)
+			}
+			if conflict := IstioControlPlanesConflict(test.other, canary); conflict != test.expected {
+				t.Errorf("expected %v the other way round, got %v", test.expected, conflict)
+			}
+		})
+	}
+
+	// the default control plane conflicts with a control plane set to istio-system
+	if !IstioControlPlanesConflict(testControlPlaneSpec("", "", ""),
+		testControlPlaneSpec("istio-system", "system-", "system")) {
+		t.Error("control planes in istio-system do not conflict")
+	}
+
+	var istios []operatorv1alpha1.Istio
+	for _, name := range []string{"default", "canary", "other"} {
+		ist := testIstioCR(name, true)
+		istios = append(istios, *ist)
+	}
+	istios[1].Spec = canary
+	istios[2].Spec = testControlPlaneSpec("istio-canary", "other-", "other")
+	var names []string
+	for _, istio := range IstioCRsOfControlPlane(istios, canary) {
+		names = append(names, istio.ObjectMeta.Name)
+	}
+	if expected := []string{"canary", "other"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected istio CRs %v, got %v", expected, names)
+	}
+}
+
+func TestGenerateIstioControlPlaneValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     operatorv1alpha1.IstioSpec
+		file     string
+		expected map[string]interface{}
+	}{
+		{name: "default control plane", spec: testControlPlaneSpec("", "", "")},
+		{name: "istio-system with a release prefix", spec: testControlPlaneSpec("istio-system", "system-", "")},
+		{
+			name: "control plane in another namespace",
+			spec: testControlPlaneSpec("istio-canary", "canary-", ""),
+			file: "istio-control-plane-values.yaml",
+			expected: map[string]interface{}{"global": map[string]interface{}{"istioNamespace": "istio-canary",
+				"configNamespace": "istio-canary", "policyNamespace": "istio-canary",
+				"telemetryNamespace": "istio-canary"}},
+		},
+		{
+			name: "revision of the control plane",
+			spec: testControlPlaneSpec("", "", "canary"),
+			file: "istio-control-plane-values.yaml",
+			expected: map[string]interface{}{"revision": "canary", "global": map[string]interface{}{
+				"istioNamespace": "istio-system", "configNamespace": "istio-system",
+				"policyNamespace": "istio-system", "telemetryNamespace": "istio-system"}},
+		},
+		{
+			name: "control plane of istio-remote",
+			spec: func() operatorv1alpha1.IstioSpec {
+				spec := testControlPlaneSpec("istio-remote", "remote-", "")
+				spec.CcpIstioRemote.Chart = "istio-remote-1.1.8-ccp1.tgz"
+				return spec
+			}(),
+			file: "istio-remote-control-plane-values.yaml",
+			expected: map[string]interface{}{"global": map[string]interface{}{"istioNamespace": "istio-remote",
+				"configNamespace": "istio-remote", "policyNamespace": "istio-remote",
+				"telemetryNamespace": "istio-remote"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workspace, err := ioutil.TempDir("", "workspace-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workspace)
+
+			r := fakeIstioReconciler()
+			if err := r.GenerateIstioControlPlaneValues(workspace, test.spec); err != nil {
+				t.Fatal(err)
+			}
+			files, err := ioutil.ReadDir(workspace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.file == "" {
+				if len(files) != 0 {
+					t.Errorf("values file %s generated for the default control plane", files[0].Name())
+				}
+				return
+			}
+			path := IstioControlPlaneValuesFilePath(workspace, IstioControlPlaneChartName(test.spec))
+			if !strings.HasSuffix(path, "/"+test.file) {
+				t.Errorf("expected values file %s, got %s", test.file, path)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values map[string]interface{}
+			if err := yaml.Unmarshal(b, &values); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Errorf("expected values %v, got %v", test.expected, values)
+			}
+		})
+	}
+}
+
+func TestValidateIstioControlPlane(t *testing.T) {
+	tests := []struct {
+		name          string
+		releasePrefix string
+		err           bool
+	}{
+		{name: "no release prefix"},
+		{name: "release prefix", releasePrefix: "canary-"},
+		{name: "longest release prefix", releasePrefix: strings.Repeat("a", helmReleaseNameMaxLength-len("istio-remote"))},
+		{name: "release prefix too long", releasePrefix: strings.Repeat("a", helmReleaseNameMaxLength-len("istio-init")+1),
+			err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := testControlPlaneSpec("", test.releasePrefix, "")
+			if err := ValidateIstioControlPlane(spec); (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestIstioCRNamespaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		istio    func(*operatorv1alpha1.Istio)
+		expected map[string]bool
+	}{
+		{
+			name:     "default control plane",
+			expected: map[string]bool{"istio-system": true},
+		},
+		{
+			name:     "control plane in another namespace",
+			istio:    func(ist *operatorv1alpha1.Istio) { ist.Spec.ControlPlane.Namespace = "istio-canary" },
+			expected: map[string]bool{"istio-canary": true},
+		},
+		{
+			name: "control plane installed by a canary upgrade",
+			istio: func(ist *operatorv1alpha1.Istio) {
+				ist.Status.ControlPlane = &operatorv1alpha1.IstioControlPlane{Namespace: "istio-1-2"}
+			},
+			expected: map[string]bool{"istio-system": true, "istio-1-2": true},
+		},
+		{
+			name: "canary upgrade in progress",
+			istio: func(ist *operatorv1alpha1.Istio) {
+				ist.Status.ControlPlane = &operatorv1alpha1.IstioControlPlane{Namespace: "istio-1-2"}
+				ist.Status.Canary = &operatorv1alpha1.IstioCanaryStatus{
+					From: operatorv1alpha1.IstioControlPlane{Namespace: "istio-1-2"},
+					To:   operatorv1alpha1.IstioControlPlane{Namespace: "istio-1-3"},
+				}
+			},
+			expected: map[string]bool{"istio-system": true, "istio-1-2": true, "istio-1-3": true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			if test.istio != nil {
+				test.istio(ist)
+			}
+			if namespaces := IstioCRNamespaces(ist); !reflect.DeepEqual(namespaces, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, namespaces)
+			}
+		})
+	}
+}
+
+func TestValidateIstioControlPlaneChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	istio11 := writeTestChartArchive(t, dir, "istio-1.1.8-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.1.8-ccp1\nappVersion: 1.1.8\n")
+	istioControlPlanes := writeTestChartArchive(t, dir, "istio-1.6.0-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.6.0-ccp1\nappVersion: 1.6.0\nannotations:\n  "+
+			IstioChartControlPlanesAnnotation+": \"true\"\n")
+	remote := "https://charts.example.com/istio-1.1.8-ccp1.tgz"
+	workspace := filepath.Join(dir, "workspace")
+	writeTestChartArchive(t, workspace, filepath.Join("charts", "istio", "istio-1.1.8-ccp1.tgz"), "istio",
+		"name: istio\nversion: 1.1.8-ccp1\nappVersion: 1.1.8\n")
+
+	tests := []struct {
+		name      string
+		spec      operatorv1alpha1.IstioSpec
+		chart     string
+		workspace string
+		err       bool
+	}{
+		{name: "default control plane", chart: istio11},
+		{name: "istio-system without a revision", spec: testControlPlaneSpec("istio-system", "", ""), chart: istio11},
+		{name: "namespace", spec: testControlPlaneSpec("istio-canary", "", ""), chart: istio11, err: true},
+		{name: "release prefix", spec: testControlPlaneSpec("", "canary-", ""), chart: istio11, err: true},
+		{name: "revision", spec: testControlPlaneSpec("", "", "canary"), chart: istio11, err: true},
+		{name: "chart with control planes", spec: testControlPlaneSpec("istio-canary", "canary-", "canary"),
+			chart: istioControlPlanes},
+		{name: "canary upgrade", spec: operatorv1alpha1.IstioSpec{
+			UpgradeStrategy: operatorv1alpha1.UpgradeStrategyCanary}, chart: istio11, err: true},
+		{name: "canary upgrade with control planes", spec: operatorv1alpha1.IstioSpec{
+			UpgradeStrategy: operatorv1alpha1.UpgradeStrategyCanary}, chart: istioControlPlanes},
+		{name: "chart not downloaded yet", spec: testControlPlaneSpec("", "", "canary"), chart: remote},
+		{name: "downloaded chart", spec: testControlPlaneSpec("", "", "canary"), chart: remote,
+			workspace: workspace, err: true},
+		{name: "chart not found", spec: testControlPlaneSpec("", "", "canary"),
+			chart: filepath.Join(dir, "istio-1.1.3-ccp1.tgz"), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.spec.CcpIstio.Chart = test.chart
+			if err := ValidateIstioControlPlaneChart(test.spec, test.workspace); (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
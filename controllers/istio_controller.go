@@ -17,22 +17,35 @@ package controllers
 
 import (
 	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	apiextclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
 )
@@ -44,283 +57,594 @@ var (
 // IstioReconciler reconciles a Istio object
 type IstioReconciler struct {
 	client.Client
-	Log logr.Logger
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// helm client of the istio CRs whose helm releases are managed by helm 2
+	Helm HelmClient
+	// helm client of the istio CRs whose helm releases are managed by helm 3
+	Helm3 HelmClient
+	// version of helm of the istio CRs without spec.helmVersion, v2 if not set
+	DefaultHelmVersion operatorv1alpha1.HelmVersion
+	// reads the helm 2 releases and the helm 3 release secrets from the API server
+	// instead of the cache, so that secrets are not cached
+	APIReader client.Reader
+	// client of the kubernetes objects applied by the Manifests and Rendered installers,
+	// Client if not set
+	ObjectClient client.Client
+	// rest mapper of ObjectClient, finds the scope of the kinds applied by the installers
+	ObjectMapper meta.RESTMapper
+	// namespace Tiller stores the helm 2 releases in, kube-system if not set
+	TillerNamespace string
+	// directory of the charts downloaded by istio operator, DefaultChartCacheDir if not set
+	ChartCacheDir string
+	// istio CRs whose charts changed on disk, sent by IstioChartWatcher, not watched if nil
+	ChartEvents <-chan event.GenericEvent
+	// public key verifying the manifests of chart bundles, charts are not loaded from
+	// chart bundles if nil
+	ChartBundleKey crypto.PublicKey
+	// image of the pods reading chart bundles from persistent volume claims, chart bundles
+	// are not read from persistent volume claims if not set
+	ChartBundleLoaderImage string
 }
 
 // +kubebuilder:rbac:groups=operator.ccp.cisco.com,resources=istios,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=operator.ccp.cisco.com,resources=istios/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=operator.ccp.cisco.com,resources=istios/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=apps;extensions,resources=deployments,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets;daemonsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch;update;delete
+// +kubebuilder:rbac:groups=authentication.istio.io;config.istio.io;networking.istio.io;rbac.istio.io,resources=*,verbs=get;list;watch;create
 func (r *IstioReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 	var Istio operatorv1alpha1.Istio
 	var IstioList operatorv1alpha1.IstioList
 
 	r.Log.Info("inside Reconcile() function in istio_controller.go")
-	charts_dir := os.Getenv("CHARTS_PATH")
-	r.Log.Info(fmt.Sprintf("CHARTS_PATH: %s", charts_dir))
-	if len(charts_dir) == 0 {
-		r.Log.Info("environment variable CHARTS_PATH not set")
+
+	// istio CRs are listed in all namespaces as only one istio CR is allowed in the cluster
+	if err := r.List(ctx, &IstioList); err != nil {
+		r.Log.Error(err, "Failed to get list of istio CRs")
+		return ctrl.Result{}, err
+	}
+	if err := r.Get(ctx, req.NamespacedName, &Istio); err != nil {
+		// istio is deleted before the istio CR is deleted using the istio CR's finalizer
+		r.Log.Info(fmt.Sprintf("Istio CR deleted: %s", req.NamespacedName.String()))
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !Istio.ObjectMeta.DeletionTimestamp.IsZero() {
+		// istio CR is being deleted
+		return ctrl.Result{}, r.FinalizeIstio(ctx, &Istio, IstioList.Items)
 	}
 
-	if err := r.List(ctx, &IstioList, client.InNamespace(req.NamespacedName.Namespace)); err != nil {
-		r.Log.Error(err, fmt.Sprintf("Failed to get list of istio CRs in %s namespace", req.NamespacedName.Namespace))
+	// allow only one istio CR for a control plane in the cluster, the other istio CRs are set
+	// to Conflicted until the istio CR that owns the control plane is deleted
+	owner := IstioMeshOwner(IstioCRsOfControlPlane(IstioList.Items, Istio.Spec))
+	if owner != nil && owner.ObjectMeta.UID != Istio.ObjectMeta.UID {
+		return ctrl.Result{}, r.SetIstioConflicted(ctx, &Istio, owner)
+	}
+
+	// add finalizer to istio CR so that istio is deleted before the istio CR is deleted
+	if err := r.AddIstioFinalizer(ctx, &Istio); err != nil {
 		return ctrl.Result{}, err
 	}
-	if len(IstioList.Items) > 1 {
-		// allow only one istio CR
-		r.Log.Info(fmt.Sprintf("More than one istio CR created, only one istio CR allowed as only one instance "+
-			"of istio can be installed on kubernetes. Multiple instances of istio cannot be installed "+
-			"on kubernetes. Use only the first istio CR %s to manage istio and delete all the other "+
-			"istio CRs:", IstioList.Items[0].ObjectMeta.Name))
-		for _, istio := range IstioList.Items {
-			r.Log.Info(fmt.Sprintf("  %s", istio.ObjectMeta.Name))
-		}
-		return ctrl.Result{}, nil
+
+	// migrate istio's helm releases stored by Tiller to helm 3 when istio CR changes from
+	// helm 2 to helm 3, before helm 3 is used to manage them
+	if err := r.MigrateIstioHelmReleases(ctx, &Istio); err != nil {
+		r.Log.Error(err, "failed to migrate istio's helm releases to helm 3")
+		r.UpdateIstioCRStatus(ctx, &Istio, "HelmMigrationFailed", err)
+		return ctrl.Result{}, err
 	}
 
-	if err := r.Get(ctx, req.NamespacedName, &Istio); err != nil {
-		r.Log.Info(fmt.Sprintf("Istio CR deleted: %s", req.NamespacedName.String()))
-		if len(IstioList.Items) == 0 {
-			// delete istio
-			r.Log.Info("deleting istio")
-			if err := r.DeleteIstio(); err != nil {
+	if Istio.Spec.RollbackTo != nil {
+		// roll back istio to an earlier revision, istio CR's spec is updated with the
+		// spec of the revision and istio CR is reconciled again
+		return ctrl.Result{}, r.RollbackIstioCRSpec(ctx, &Istio)
+	}
+
+	if Istio.Status.Operation != nil && Istio.Status.Operation.Generation != Istio.ObjectMeta.Generation &&
+		!IstioCanaryUpgradeInProgress(&Istio) {
+		// istio CR was updated while an operation was in progress, the interrupted
+		// operation is replaced by a new operation that applies the updated spec
+		r.Log.Info(fmt.Sprintf("Istio CR updated during %s of istio at step %s, starting a new operation",
+			Istio.Status.Operation.Type, Istio.Status.Operation.Step))
+		Istio.Status.Operation = nil
+	}
+
+	if Istio.Status.Operation == nil && Istio.Status.ObservedGeneration == Istio.ObjectMeta.Generation {
+		// this branch is hit when metadata.generation in istio CR is not incremented (when
+		// istio CR's status is updated) and no operation on istio is in progress
+		//
+		// no need to reconcile istio when istio CR's status is updated,
+		// istio needs to be reconciled only when the CR's spec is updated and
+		// NOT when the CR's status is updated (when r.Status().Update(ctx, ist) is done in UpdateIstioCRStatus())
+		//
+		// https://kubernetes.io/docs/tasks/access-kubernetes-api/custom-resources/custom-resource-definitions/ says:
+		//
+		//  The .metadata.generation value is incremented for all changes, except for changes to .metadata or .status.
+		r.Log.Info("Istio CR status: ", "status", Istio.Status)
+
+		if istioInstalledStatuses[Istio.Status.Active] {
+			// check if the objects installed by istio's helm releases were changed or
+			// deleted, this is done when istio CR is reconciled after they change
+			if err := r.CheckIstioDrift(ctx, &Istio); err != nil {
+				r.Log.Error(err, "failed to check drift of istio")
 				return ctrl.Result{}, err
 			}
-		}
-	} else {
-		if Istio.Status.ObservedGeneration != Istio.ObjectMeta.Generation {
-			// this if branch is hit when metadata.generation in istio CR is incremented
-			if Istio.Status.ObservedGeneration == 0 && Istio.ObjectMeta.Generation == 1 {
-				r.Log.Info(fmt.Sprintf("New Istio CR created: %s", req.NamespacedName.String()))
-			} else {
-				// CR is updated using:
-				// "kubectl edit istio <name of istio CR>" or
-				// "kubectl apply -f <updated CR manifest file>
-				r.Log.Info(fmt.Sprintf("Istio CR updated: %s", req.NamespacedName.String()))
-			}
-			r.Log.Info(fmt.Sprintf("  metadata.generation = %s",
-				strconv.FormatInt(Istio.ObjectMeta.Generation, 10)))
-			r.Log.Info(fmt.Sprintf("  status.observedGeneration = %s",
-				strconv.FormatInt(Istio.Status.ObservedGeneration, 10)))
-
-			// update ObservedGeneration and Version in CR status
-			Istio.Status.ObservedGeneration = Istio.ObjectMeta.Generation
-			istioVersion := strings.Split(Istio.Spec.CcpIstio.Chart, "/")
-			Istio.Status.Version = istioVersion[len(istioVersion)-1]
-			r.Status().Update(ctx, &Istio)
-
-			r.Log.Info("Istio CR spec: ", "spec", Istio.Spec)
-
-			// validate istio CR spec
-			if !r.IstioCRSpecIsValid(Istio) {
-				r.UpdateIstioCRStatus(ctx, &Istio, "InvalidIstioCRSpec")
-				return ctrl.Result{}, nil
+			// warn if the release of istio installed was deprecated or reached its end of
+			// life in the catalog of istio releases since it was installed
+			releaseChanged, err := r.CheckIstioRelease(ctx, &Istio, Istio.Spec)
+			if err != nil {
+				r.Log.Error(err, "failed to check the release of istio in the catalog of istio releases")
 			}
-
-			// generate values file needed for helm
-			r.UpdateIstioCRStatus(ctx, &Istio, "GeneratingHelmValuesFile")
-			r.GenerateValuesYamlFromIstioSpec("istio-init", Istio.Spec.CcpIstioInit.Values)
-			r.GenerateValuesYamlFromIstioSpec("istio", Istio.Spec.CcpIstio.Values)
-			r.GenerateValuesYamlFromIstioSpec("istio-remote", Istio.Spec.CcpIstioRemote.Values)
-
-			// delete istio if it already exists
-			r.UpdateIstioCRStatus(ctx, &Istio, "CleaningIstioPreinstall")
-			r.Log.Info("deleting istio if it already exists.")
-			if err := r.DeleteIstio(); err != nil {
-				r.UpdateIstioCRStatus(ctx, &Istio, "PreinstallCleanupFailed")
+			// check if the charts installed were changed on disk since they were installed,
+			// istio is upgraded with them if spec.chartChangePolicy is Upgrade
+			contentChanged, err := r.CheckIstioChartContent(&Istio)
+			if err != nil {
+				r.Log.Error(err, "failed to check the content of istio's charts")
 				return ctrl.Result{}, err
 			}
-
-			// TODO: Instead of sleeping below, add post-delete steps here to check if
-			// all the istio pods, CRDs and jobs are deleted before installing istio
-			time.Sleep(10 * time.Second)
-
-			// install istio
-			r.Log.Info("installing istio")
-			r.UpdateIstioCRStatus(ctx, &Istio, "InstallingIstio")
-			if err := r.InstallIstio(Istio.Spec); err != nil {
-				r.UpdateIstioCRStatus(ctx, &Istio, "InstallationFailed")
+			if Istio.Status.IsConditionTrue(operatorv1alpha1.IstioConditionChartContentChanged) &&
+				Istio.Spec.ChartChangePolicy == operatorv1alpha1.ChartChangePolicyUpgrade {
+				r.Log.Info(fmt.Sprintf("upgrading istio with the charts changed on disk for Istio CR %s",
+					req.NamespacedName.String()))
+				if err := r.StartIstioOperation(ctx, &Istio); err != nil {
+					return ctrl.Result{}, err
+				}
+				return ctrl.Result{Requeue: true}, nil
+			}
+			if releaseChanged || contentChanged {
+				if err := r.Status().Update(ctx, &Istio); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			// compare the versions of the sidecars of the pods with the version of
+			// istio's control plane, istio CR is reconciled again for the next audit
+			requeueAfter, err := r.AuditIstioSidecars(ctx, &Istio)
+			if err != nil {
+				r.Log.Error(err, "failed to audit sidecars of istio")
 				return ctrl.Result{}, err
 			}
+			return ctrl.Result{RequeueAfter: requeueAfter}, nil
+		}
+		return ctrl.Result{}, nil
+	}
 
-			r.UpdateIstioCRStatus(ctx, &Istio, "PostInstallChecks")
-			if err := r.DoPostInstallChecks(); err != nil {
-				r.UpdateIstioCRStatus(ctx, &Istio, "PostInstallChecksFailed")
-				r.Log.Error(err, "PostInstallChecksFailed")
-			} else {
-				r.UpdateIstioCRStatus(ctx, &Istio, "IstioInstalledActive")
-			}
+	if Istio.Status.Operation == nil {
+		// this branch is hit when metadata.generation in istio CR is incremented
+		if Istio.Status.ObservedGeneration == 0 && Istio.ObjectMeta.Generation == 1 {
+			r.Log.Info(fmt.Sprintf("New Istio CR created: %s", req.NamespacedName.String()))
 		} else {
-			// this else branch is hit when metadata.generation in istio CR is not incremented (when
-			// istio CR's status is updated)
-			//
-			// no need to reconcile istio when istio CR's status is updated,
-			// istio needs to be reconciled only when the CR's spec is updated and
-			// NOT when the CR's status is updated (when r.Status().Update(ctx, ist) is done in UpdateIstioCRStatus())
-			//
-			// https://kubernetes.io/docs/tasks/access-kubernetes-api/custom-resources/custom-resource-definitions/ says:
-			//
-			//  The .metadata.generation value is incremented for all changes, except for changes to .metadata or .status.
-			r.Log.Info("Istio CR status: ", "status", Istio.Status)
+			// CR is updated using:
+			// "kubectl edit istio <name of istio CR>" or
+			// "kubectl apply -f <updated CR manifest file>
+			r.Log.Info(fmt.Sprintf("Istio CR updated: %s", req.NamespacedName.String()))
+		}
+		r.Log.Info(fmt.Sprintf("  metadata.generation = %s",
+			strconv.FormatInt(Istio.ObjectMeta.Generation, 10)))
+		r.Log.Info(fmt.Sprintf("  status.observedGeneration = %s",
+			strconv.FormatInt(Istio.Status.ObservedGeneration, 10)))
+		r.Log.Info("Istio CR spec: ", "spec", Istio.Spec)
+
+		// validate istio CR spec
+		if err := r.ValidateIstioCRSpec(Istio); err != nil {
+			r.Log.Error(err, "invalid istio CR spec")
+			r.UpdateIstioCRStatus(ctx, &Istio, "InvalidIstioCRSpec", err)
+			return ctrl.Result{}, nil
 		}
+	} else {
+		// an operation on istio is in progress, was interrupted (the istio operator
+		// restarted) or failed, resume it from the step that was running
+		r.Log.Info(fmt.Sprintf("resuming %s of istio for Istio CR %s at step %s", Istio.Status.Operation.Type,
+			req.NamespacedName.String(), Istio.Status.Operation.Step))
 	}
-	return ctrl.Result{}, nil
-}
 
-// check post install if all istio pods have reached Running and Ready state or Completed state
-func (r *IstioReconciler) DoPostInstallChecks() error {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return errors.New(fmt.Sprintf("%s, %s", "post-install check failed", err.Error()))
+	if Istio.Status.Operation == nil {
+		if err := r.StartIstioOperation(ctx, &Istio); err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	// spec applied by the operation, istio CR's spec or the spec of the revision
+	// istio is rolled back to
+	spec, err := IstioOperationSpec(&Istio)
 	if err != nil {
-		return errors.New(fmt.Sprintf("%s, %s", "post-install check failed", err.Error()))
+		r.UpdateIstioCRStatus(ctx, &Istio, "RollbackFailed", err)
+		return ctrl.Result{}, nil
 	}
 
-	for i := 1; i <= operatorv1alpha1.TimeoutInternal/5; i++ {
-		time.Sleep(5 * time.Second)
-		allIstioPodsAreGood := true
-		podList, err := clientset.CoreV1().Pods(operatorv1alpha1.IstioNamespace).List(v1.ListOptions{})
-		if err != nil {
-			return errors.New(fmt.Sprintf("%s, %s", "post-install check failed", err.Error()))
+	// generate values files needed for helm in a workspace used only by this reconcile
+	workspace, err := ioutil.TempDir("", "ccp-istio-operator-")
+	if err != nil {
+		r.UpdateIstioCRStatus(ctx, &Istio, "GeneratingHelmValuesFileFailed", err)
+		return ctrl.Result{}, err
+	}
+	defer os.RemoveAll(workspace)
+	for chartName, values := range map[string]string{
+		operatorv1alpha1.IstioInitHelmChartName:   spec.CcpIstioInit.Values,
+		operatorv1alpha1.IstioHelmChartName:       spec.CcpIstio.Values,
+		operatorv1alpha1.IstioRemoteHelmChartName: spec.CcpIstioRemote.Values,
+	} {
+		if err := r.GenerateValuesYamlFromIstioSpec(workspace, chartName, values); err != nil {
+			r.UpdateIstioCRStatus(ctx, &Istio, "GeneratingHelmValuesFileFailed", err)
+			return ctrl.Result{}, err
 		}
-
-		for _, pod := range podList.Items {
-			for _, containerStatus := range pod.Status.ContainerStatuses {
-				// check if pod has reached Running and Ready state
-				if containerStatus.State.Running != nil && containerStatus.Ready {
-					continue
-					// check if job's pod completed successfully
-				} else if containerStatus.State.Terminated != nil && containerStatus.State.Terminated.Reason == "Completed" {
-					continue
-				} else {
-					r.Log.Info(fmt.Sprintf("%s container in %s pod did not "+
-						"reach Ready or Completed state, "+
-						"will check again after 5 seconds...",
-						containerStatus.Name, pod.ObjectMeta.Name))
-					allIstioPodsAreGood = false
-					continue
-				}
+	}
+	if err := r.GenerateIstioRemoteEndpointsValues(workspace, spec); err != nil {
+		r.UpdateIstioCRStatus(ctx, &Istio, "GeneratingHelmValuesFileFailed", err)
+		return ctrl.Result{}, err
+	}
+	if err := r.GenerateIstioControlPlaneValues(workspace, spec); err != nil {
+		r.UpdateIstioCRStatus(ctx, &Istio, "GeneratingHelmValuesFileFailed", err)
+		return ctrl.Result{}, err
+	}
+	// download the charts that are URLs into the workspace and verify the digests of the
+	// pinned charts
+	if err := r.FetchIstioCharts(ctx, &Istio, spec, workspace); err != nil {
+		if IsChartBundleLoading(err) {
+			// istio CR is reconciled again when the pod reading the chart bundle completes
+			r.Log.Info(err.Error())
+			return ctrl.Result{RequeueAfter: chartBundleLoadInterval}, nil
+		}
+		r.Log.Error(err, "failed to fetch istio's charts")
+		if IsChartDigestMismatch(err) {
+			// the chart is not downloaded again until istio CR is updated
+			r.UpdateIstioCRStatus(ctx, &Istio, "ChartDigestMismatch", err)
+			return ctrl.Result{}, nil
+		}
+		if IsChartBundleInvalid(err) {
+			// the bundle is read again with a backoff, it can be fixed without updating istio CR
+			r.UpdateIstioCRStatus(ctx, &Istio, "ChartBundleInvalid", err)
+			return ctrl.Result{}, err
+		}
+		r.UpdateIstioCRStatus(ctx, &Istio, "ChartDownloadFailed", err)
+		return ctrl.Result{}, err
+	}
+	// the downloaded charts are checked like the charts on disk by ValidateIstioSpec
+	if err := ValidateIstioControlPlaneChart(spec, workspace); err != nil {
+		r.Log.Error(err, "invalid istio CR spec")
+		if Istio.Status.Operation.Step == "" {
+			// no step ran yet, the operation and the canary upgrade it planned are dropped
+			// so that istio CR's spec can be fixed
+			if Istio.Status.Operation.Type == operatorv1alpha1.IstioOperationCanaryUpgrade {
+				Istio.Status.Canary = nil
 			}
-			if pod.Status.Phase != "Running" && pod.Status.Phase != "Succeeded" {
-				r.Log.Info(fmt.Sprintf("%s pod did not reach Running or Succeeded phase, "+
-					"will check again after 5 seconds...", pod.ObjectMeta.Name))
+			Istio.Status.Operation = nil
+		}
+		r.UpdateIstioCRStatus(ctx, &Istio, "InvalidIstioCRSpec", err)
+		return ctrl.Result{}, nil
+	}
+	// warn if the release of istio is deprecated or reached its end of life, the
+	// ReleaseDeprecated condition is saved with istio CR's status by the operation
+	if _, err := r.CheckIstioRelease(ctx, &Istio, spec); err != nil {
+		r.Log.Error(err, "failed to check the release of istio in the catalog of istio releases")
+	}
+
+	return r.RunIstioOperation(ctx, &Istio, spec, workspace)
+}
+
+// check if all istio pods have reached Running and Ready state or Completed state,
+// the pods are read from the manager's cache which is updated by the watch on pods
+func (r *IstioReconciler) IstioPodsAreReady(ctx context.Context, namespace string) (bool, error) {
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList, client.InNamespace(namespace)); err != nil {
+		return false, errors.New(fmt.Sprintf("%s, %s", "post-install check failed", err.Error()))
+	}
+
+	allIstioPodsAreGood := true
+	for _, pod := range podList.Items {
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			// check if pod has reached Running and Ready state
+			if containerStatus.State.Running != nil && containerStatus.Ready {
+				continue
+				// check if job's pod completed successfully
+			} else if containerStatus.State.Terminated != nil && containerStatus.State.Terminated.Reason == "Completed" {
+				continue
+			} else {
+				r.Log.Info(fmt.Sprintf("%s container in %s pod did not "+
+					"reach Ready or Completed state", containerStatus.Name, pod.ObjectMeta.Name))
 				allIstioPodsAreGood = false
 				continue
 			}
 		}
-		if i == operatorv1alpha1.TimeoutInternal/5 {
-			return errors.New(fmt.Sprintf("post-install checks timed out after %s seconds and failed, "+
-				"istio pod(s) did not reach Running and Ready state or Completed state",
-				strconv.FormatInt(operatorv1alpha1.TimeoutInternal, 10)))
-		} else if allIstioPodsAreGood {
-			return nil
+		if pod.Status.Phase != corev1.PodRunning && pod.Status.Phase != corev1.PodSucceeded {
+			r.Log.Info(fmt.Sprintf("%s pod did not reach Running or Succeeded phase", pod.ObjectMeta.Name))
+			allIstioPodsAreGood = false
+			continue
 		}
 	}
-	return nil
+	return allIstioPodsAreGood, nil
 }
 
-// update istio CR's status.active field
-func (r *IstioReconciler) UpdateIstioCRStatus(ctx context.Context, ist *operatorv1alpha1.Istio, status string) {
+// check if all istio's jobs are deleted and all istio's pods are deleted or terminated
+func (r *IstioReconciler) IstioPodsAndJobsAreDeleted(ctx context.Context, namespace string) (bool, error) {
+	var jobList batchv1.JobList
+	if err := r.List(ctx, &jobList, client.InNamespace(namespace)); err != nil {
+		return false, errors.New(fmt.Sprintf("%s, %s", "failed to list istio jobs", err.Error()))
+	}
+	if len(jobList.Items) != 0 {
+		r.Log.Info(fmt.Sprintf("%d istio job(s) not deleted yet", len(jobList.Items)))
+		return false, nil
+	}
+
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList, client.InNamespace(namespace)); err != nil {
+		return false, errors.New(fmt.Sprintf("%s, %s", "failed to list istio pods", err.Error()))
+	}
+	deleted := true
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			r.Log.Info(fmt.Sprintf("%s pod not deleted yet", pod.ObjectMeta.Name))
+			deleted = false
+		}
+	}
+	return deleted, nil
+}
+
+// status.active values of istio CR when istio failed to be installed, upgraded or deleted
+var istioFailedStatuses = map[string]bool{
+	"InvalidIstioCRSpec":             true,
+	"GeneratingHelmValuesFileFailed": true,
+	"IstioConfigSnapshotFailed":      true,
+	"PreinstallCleanupFailed":        true,
+	"InstallationFailed":             true,
+	"UpgradeFailed":                  true,
+	"PostInstallChecksFailed":        true,
+	"IstioConfigRestoreFailed":       true,
+	"DeletionFailed":                 true,
+	"RollbackFailed":                 true,
+	"CanaryUpgradeFailed":            true,
+	"DataPlaneRolloutFailed":         true,
+	"HelmMigrationFailed":            true,
+	"ChartDownloadFailed":            true,
+	"ChartDigestMismatch":            true,
+	"ChartBundleInvalid":             true,
+}
+
+// update istio CR's status.active field, status.lastUpdateTime and the Ready,
+// Progressing and Degraded conditions. err is the error that made istio fail to be
+// installed, upgraded or deleted, its message is set in the conditions. Returns an
+// error if istio CR's status could not be updated.
+func (r *IstioReconciler) UpdateIstioCRStatus(ctx context.Context, ist *operatorv1alpha1.Istio, status string,
+	err error) error {
 	ist.Status.Active = status
+	ist.Status.LastUpdateTime = time.Now().UTC().Format(time.RFC3339)
+	SetIstioConditions(ist, status, err)
 
 	// updating istio CR's status below (r.Status().Update(ctx, ist)) does not
 	// increment metadata.generation in istio CR
 	if err := r.Status().Update(ctx, ist); err != nil {
 		r.Log.Error(err, fmt.Sprintf("unable to update Istio CR status to \"%s\".", status))
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("Istio CR status updated to: %s", ist.Status.Active))
+	return nil
+}
+
+// set the Ready, Progressing and Degraded conditions in istio CR's status for the
+// given status.active value
+func SetIstioConditions(ist *operatorv1alpha1.Istio, status string, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	condition := func(conditionType operatorv1alpha1.IstioConditionType,
+		conditionStatus corev1.ConditionStatus) operatorv1alpha1.IstioCondition {
+		return operatorv1alpha1.IstioCondition{
+			Type:               conditionType,
+			Status:             conditionStatus,
+			ObservedGeneration: ist.ObjectMeta.Generation,
+			Reason:             status,
+			Message:            message,
+		}
+	}
+
+	if status == IstioConflictedStatus {
+		// istio CR does not own the mesh, nothing is done for it
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionConflicted, corev1.ConditionTrue))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionReady, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionProgressing, corev1.ConditionFalse))
 		return
-	} else {
-		r.Log.Info(fmt.Sprintf("Istio CR status updated to: %s", ist.Status.Active))
+	}
+	if ist.Status.GetCondition(operatorv1alpha1.IstioConditionConflicted) != nil {
+		// istio CR owns the mesh
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionConflicted, corev1.ConditionFalse))
+	}
+
+	switch {
+	case status == "IstioInstalledActive":
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionReady, corev1.ConditionTrue))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionProgressing, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionDegraded, corev1.ConditionFalse))
+	case status == "IstioRolledBack":
+		// istio is running the last revision that was installed successfully, but
+		// istio CR's spec could not be applied
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionReady, corev1.ConditionTrue))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionProgressing, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionDegraded, corev1.ConditionTrue))
+	case istioFailedStatuses[status]:
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionReady, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionProgressing, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionDegraded, corev1.ConditionTrue))
+	default:
+		// istio is being installed, upgraded or deleted, Degraded is left unchanged
+		// until the operation succeeds or fails
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionReady, corev1.ConditionFalse))
+		ist.Status.SetCondition(condition(operatorv1alpha1.IstioConditionProgressing, corev1.ConditionTrue))
 	}
 }
 
-// install istio-init and istio
-func (r *IstioReconciler) InstallIstio(istSpec operatorv1alpha1.IstioSpec) error {
-	cmd := ""
-	// install istio-init
-	if istSpec.CcpIstioInit.Values == "" {
-		cmd = fmt.Sprintf("helm install %s %s %s %s %s", istSpec.CcpIstioInit.Chart,
-			" --name ", operatorv1alpha1.IstioInitHelmChartName, " --namespace ",
-			operatorv1alpha1.IstioNamespace)
-	} else {
-		cmd = fmt.Sprintf("helm install %s %s %s %s %s %s", istSpec.CcpIstioInit.Chart, " -f istio-init-values.yaml",
-			" --name ", operatorv1alpha1.IstioInitHelmChartName, " --namespace ",
-			operatorv1alpha1.IstioNamespace)
-	}
-	if _, err := r.RunCommand(cmd); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			e := fmt.Sprintf("Failed to install %s helm chart, error: %s, %s",
-				operatorv1alpha1.IstioInitHelmChartName, string(exitErr.Stderr), err)
-			return errors.New(e)
+// build the helm release for an istio helm chart in the namespace of the control plane
+// of istio CR's spec, the values file is used only if values are set for the helm chart
+// in istio CR spec
+func (r *IstioReconciler) IstioHelmRelease(spec operatorv1alpha1.IstioSpec, chartName string, chart string,
+	values string, workspace string) HelmRelease {
+	release := HelmRelease{
+		Name:      IstioReleaseName(spec, chartName),
+		Chart:     IstioReleaseChart(workspace, chartName, chart),
+		Namespace: IstioControlPlaneNamespace(spec),
+	}
+	if values != "" {
+		release.ValuesFiles = []string{ValuesFilePath(workspace, chartName)}
+	}
+	return release
+}
+
+// version of helm that manages istio's helm releases for istio CR's spec,
+// spec.helmVersion or the default version of helm of the istio operator
+func (r *IstioReconciler) IstioHelmVersion(spec operatorv1alpha1.IstioSpec) operatorv1alpha1.HelmVersion {
+	if spec.HelmVersion != "" {
+		return spec.HelmVersion
+	}
+	if r.DefaultHelmVersion != "" {
+		return r.DefaultHelmVersion
+	}
+	return operatorv1alpha1.HelmVersionV2
+}
+
+// helm client that manages istio's helm releases for istio CR's spec
+func (r *IstioReconciler) HelmFor(spec operatorv1alpha1.IstioSpec) HelmClient {
+	if r.IstioHelmVersion(spec) == operatorv1alpha1.HelmVersionV3 {
+		return r.Helm3
+	}
+	return r.Helm
+}
+
+// check if the istio-init helm release and the helm release of istio's control plane
+// (istio or istio-remote) for istio CR's spec are both installed
+func (r *IstioReconciler) IstioIsInstalled(spec operatorv1alpha1.IstioSpec) bool {
+	return r.HelmReleaseExists(spec, IstioReleaseName(spec, operatorv1alpha1.IstioInitHelmChartName)) &&
+		r.HelmReleaseExists(spec, IstioReleaseName(spec, IstioControlPlaneChartName(spec)))
+}
+
+// check if a helm release exists and is not deleted
+func (r *IstioReconciler) HelmReleaseExists(spec operatorv1alpha1.IstioSpec, releaseName string) bool {
+	release, err := r.InstallerFor(spec).Status(releaseName)
+	if err != nil {
+		if !IsHelmReleaseNotFound(err) {
+			r.Log.Error(err, fmt.Sprintf("failed to get status of %s helm release", releaseName))
 		}
-	} else {
-		r.Log.Info(fmt.Sprintf("%s helm chart installed", operatorv1alpha1.IstioInitHelmChartName))
+		return false
 	}
+	return release.Status != HelmStatusDeleted
+}
 
-	if err := r.DoPostInstallChecks(); err != nil {
+// add the finalizer to istio CR if it does not have it
+func (r *IstioReconciler) AddIstioFinalizer(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	if containsString(ist.ObjectMeta.Finalizers, operatorv1alpha1.IstioFinalizer) {
+		return nil
+	}
+	ist.ObjectMeta.Finalizers = append(ist.ObjectMeta.Finalizers, operatorv1alpha1.IstioFinalizer)
+	if err := r.Update(ctx, ist); err != nil {
 		return err
 	}
+	r.Log.Info(fmt.Sprintf("finalizer %s added to Istio CR %s/%s", operatorv1alpha1.IstioFinalizer,
+		ist.ObjectMeta.Namespace, ist.ObjectMeta.Name))
+	return nil
+}
 
-	// install istio
-	if istSpec.CcpIstioInit.Values == "" {
-		cmd = fmt.Sprintf("helm install %s %s %s %s %s", istSpec.CcpIstio.Chart,
-			" --name ", operatorv1alpha1.IstioHelmChartName, " --namespace ",
-			operatorv1alpha1.IstioNamespace)
-	} else {
-		cmd = fmt.Sprintf("helm install %s %s %s %s %s %s", istSpec.CcpIstio.Chart, " -f istio-values.yaml",
-			" --name ", operatorv1alpha1.IstioHelmChartName, " --namespace ",
-			operatorv1alpha1.IstioNamespace)
-	}
-	if _, err := r.RunCommand(cmd); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			e := fmt.Sprintf("Failed to install %s helm chart, error: %s, %s",
-				operatorv1alpha1.IstioHelmChartName, string(exitErr.Stderr), err)
-			return errors.New(e)
+// delete istio when istio CR is deleted and remove istio CR's finalizer. istio's control
+// plane is deleted only if no other istio CR exists for it (istioCRs are all the istio CRs
+// in the cluster), otherwise it is managed by the istio CR that owns it next. istio's
+// CRDs are shared by all control planes and are deleted only with the last istio CR in
+// the cluster. The finalizer is kept if istio could not be deleted.
+func (r *IstioReconciler) FinalizeIstio(ctx context.Context, ist *operatorv1alpha1.Istio,
+	istioCRs []operatorv1alpha1.Istio) error {
+	if !containsString(ist.ObjectMeta.Finalizers, operatorv1alpha1.IstioFinalizer) {
+		return nil
+	}
+	if len(IstioCRsOfControlPlane(istioCRs, ist.Spec)) == 1 {
+		// istio's helm releases are migrated to helm 3 before they are deleted by helm 3
+		if err := r.MigrateIstioHelmReleases(ctx, ist); err != nil {
+			r.UpdateIstioCRStatus(ctx, ist, "DeletionFailed", err)
+			return err
+		}
+		if err := r.DeleteIstioForDeletionPolicy(ctx, ist, len(istioCRs) == 1); err != nil {
+			r.UpdateIstioCRStatus(ctx, ist, "DeletionFailed", err)
+			return err
 		}
-	} else {
-		r.Log.Info(fmt.Sprintf("%s helm chart installed", operatorv1alpha1.IstioHelmChartName))
 	}
+	DeleteIstioSidecarMetrics(ist)
+	ist.ObjectMeta.Finalizers = removeString(ist.ObjectMeta.Finalizers, operatorv1alpha1.IstioFinalizer)
+	if err := r.Update(ctx, ist); err != nil {
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("finalizer %s removed from Istio CR %s/%s", operatorv1alpha1.IstioFinalizer,
+		ist.ObjectMeta.Namespace, ist.ObjectMeta.Name))
 	return nil
 }
 
-// delete istio, istio-init, istio's CRDs and jobs
-func (r *IstioReconciler) DeleteIstio() error {
-	cmd := fmt.Sprintf("helm ls | grep \"%s \"", operatorv1alpha1.IstioHelmChartName)
-	if out, _ := r.RunCommand(cmd); len(out) == 0 {
-		r.Log.Info(fmt.Sprintf("%s helm chart not found.", operatorv1alpha1.IstioHelmChartName))
-	} else {
-		// delete istio helm chart
-		cmd := fmt.Sprintf("helm delete --purge %s", operatorv1alpha1.IstioHelmChartName)
-		if _, err := r.RunCommand(cmd); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				e := fmt.Sprintf("Failed to delete %s helm chart, error: %s, %s",
-					operatorv1alpha1.IstioHelmChartName, string(exitErr.Stderr), err)
-				return errors.New(e)
-			}
+// delete istio when the istio CR is deleted according to the istio CR's deletion policy,
+// istio's CRDs are deleted only if lastIstioCR is true as they are shared by the control
+// planes of all istio CRs
+func (r *IstioReconciler) DeleteIstioForDeletionPolicy(ctx context.Context, ist *operatorv1alpha1.Istio,
+	lastIstioCR bool) error {
+	switch ist.Spec.DeletionPolicy {
+	case operatorv1alpha1.DeletionPolicyRetain:
+		r.Log.Info(fmt.Sprintf("deletion policy of Istio CR %s is %s, istio will not be deleted",
+			ist.ObjectMeta.Name, ist.Spec.DeletionPolicy))
+		return nil
+	case operatorv1alpha1.DeletionPolicyRetainCRDs:
+		r.Log.Info("deleting istio, istio's CRDs will not be deleted")
+		lastIstioCR = false
+	default:
+		if lastIstioCR {
+			r.Log.Info("deleting istio")
 		} else {
-			r.Log.Info(fmt.Sprintf("%s helm chart deleted", operatorv1alpha1.IstioHelmChartName))
+			r.Log.Info("deleting istio, istio's CRDs will not be deleted as other istio CRs use them")
+		}
+	}
+	r.UpdateIstioCRStatus(ctx, ist, "DeletingIstio", nil)
+	if IstioCanaryUpgradeInProgress(ist) {
+		// the new control plane of a canary upgrade in progress is deleted too
+		if err := r.DeleteIstio(IstioSpecWithControlPlane(IstioInstalledSpec(ist), ist.Status.Canary.To), false); err != nil {
+			return err
 		}
 	}
+	return r.DeleteIstio(IstioInstalledSpec(ist), lastIstioCR)
+}
 
-	cmd = fmt.Sprintf("helm ls | grep \"%s \"", operatorv1alpha1.IstioInitHelmChartName)
-	if out, _ := r.RunCommand(cmd); len(out) == 0 {
-		r.Log.Info(fmt.Sprintf("%s helm chart not found.", operatorv1alpha1.IstioInitHelmChartName))
-	} else {
-		// delete istio-init helm chart
-		cmd := fmt.Sprintf("helm delete --purge %s", operatorv1alpha1.IstioInitHelmChartName)
-		if _, err := r.RunCommand(cmd); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				e := fmt.Sprintf("Failed to delete %s helm chart, error: %s, %s",
-					operatorv1alpha1.IstioInitHelmChartName, string(exitErr.Stderr), err)
-				return errors.New(e)
+// delete istio, istio-remote, istio-init and istio's jobs of the control plane of istio
+// CR's spec, istio's CRDs are deleted only if deleteCRDs is true as deleting them also
+// deletes all istio custom resources created by users
+func (r *IstioReconciler) DeleteIstio(spec operatorv1alpha1.IstioSpec, deleteCRDs bool) error {
+	// delete istio and istio-remote helm charts first and then istio-init helm chart
+	for _, chartName := range []string{operatorv1alpha1.IstioHelmChartName,
+		operatorv1alpha1.IstioRemoteHelmChartName, operatorv1alpha1.IstioInitHelmChartName} {
+		releaseName := IstioReleaseName(spec, chartName)
+		if err := r.InstallerFor(spec).Uninstall(releaseName); err != nil {
+			if !IsHelmReleaseNotFound(err) {
+				return err
 			}
+			r.Log.Info(fmt.Sprintf("%s helm chart not found.", releaseName))
 		} else {
-			r.Log.Info(fmt.Sprintf("%s helm chart deleted", operatorv1alpha1.IstioInitHelmChartName))
+			r.Log.Info(fmt.Sprintf("%s helm chart deleted", releaseName))
 		}
 	}
 
 	// delete all istio CRDs
+	if deleteCRDs {
+		if err := r.DeleteIstioCRDs(); err != nil {
+			return err
+		}
+	}
+
+	return r.DeleteIstioJobs(IstioControlPlaneNamespace(spec))
+}
+
+// delete all istio CRDs
+func (r *IstioReconciler) DeleteIstioCRDs() error {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio CRDs", err.Error()))
@@ -329,31 +653,30 @@ func (r *IstioReconciler) DeleteIstio() error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio CRDs", err.Error()))
 	}
-	crdList, err := extclientset.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
+	crds, err := r.ListIstioCRDs()
 	if err != nil {
 		return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio CRDs", err.Error()))
 	}
-	for _, crd := range crdList.Items {
-		if strings.Contains(crd.ObjectMeta.Name, operatorv1alpha1.IstioCRDGroupSuffix) {
-			if err = extclientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(crd.ObjectMeta.Name, nil); err != nil {
-				return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio CRDs", err.Error()))
-			} else {
-				r.Log.Info(fmt.Sprintf("istio CRD %s deleted", crd.ObjectMeta.Name))
-			}
+	for _, crd := range crds {
+		if err = extclientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(crd.ObjectMeta.Name, nil); err != nil {
+			return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio CRDs", err.Error()))
 		}
+		r.Log.Info(fmt.Sprintf("istio CRD %s deleted", crd.ObjectMeta.Name))
 	}
+	return nil
+}
 
-	// delete all istio jobs
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio jobs", err.Error()))
-	}
-	jobList, err := clientset.BatchV1().Jobs(operatorv1alpha1.IstioNamespace).List(v1.ListOptions{})
-	if err != nil {
+// delete all istio jobs in the namespace of a control plane
+func (r *IstioReconciler) DeleteIstioJobs(namespace string) error {
+	ctx := context.Background()
+	var jobList batchv1.JobList
+	if err := r.List(ctx, &jobList, client.InNamespace(namespace)); err != nil {
 		return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio jobs", err.Error()))
 	}
-	for _, job := range jobList.Items {
-		if err = clientset.BatchV1().Jobs(operatorv1alpha1.IstioNamespace).Delete(job.ObjectMeta.Name, nil); err != nil {
+	// delete the jobs' pods too
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		if err := r.Delete(ctx, job, client.PropagationPolicy(v1.DeletePropagationBackground)); err != nil {
 			return errors.New(fmt.Sprintf("%s, %s", "failed to delete istio jobs", err.Error()))
 		}
 		r.Log.Info(fmt.Sprintf("istio job %s deleted", job.ObjectMeta.Name))
@@ -362,83 +685,267 @@ func (r *IstioReconciler) DeleteIstio() error {
 	return nil
 }
 
-// run linux shell command, return output and error, assumes bash shell
-func (r *IstioReconciler) RunCommand(cmd string) ([]byte, error) {
-	r.Log.Info(fmt.Sprintf("running command: %s", cmd))
-	out, err := exec.Command("bash", "-c", cmd).Output()
-	r.Log.Info(fmt.Sprintf("output: %s", string(out)))
-	return out, err
-}
-
 // validate Istio CR spec
-func (r *IstioReconciler) IstioCRSpecIsValid(ist operatorv1alpha1.Istio) bool {
+func (r *IstioReconciler) ValidateIstioCRSpec(ist operatorv1alpha1.Istio) error {
 	// read istio-init section from Istio CR
 	r.Log.Info("istio-init", "chart", ist.Spec.CcpIstioInit.Chart)
 	r.Log.Info("istio-init", "values", ist.Spec.CcpIstioInit.Values)
-	if ist.Spec.CcpIstioInit.Chart == "" {
-		r.Log.Error(errors.New("invalid istio CR spec"),
-			"istio-init helm chart is empty in istio CR spec, cannot install istio-init and istio.")
-		return false
-	}
-	if _, err := os.Stat(ist.Spec.CcpIstioInit.Chart); os.IsNotExist(err) &&
-		!strings.HasPrefix(ist.Spec.CcpIstioInit.Chart, "http") {
-		e := fmt.Sprintf("istio-init helm chart %s does not exist. "+
-			"Make sure that istio-init helm chart %s exists on the host running this pod, %s on "+
-			"the host will be mounted inside the istio-operator container. Check value of chartsPath "+
-			"in istio-operator's helm chart.", ist.Spec.CcpIstioInit.Chart, ist.Spec.CcpIstioInit.Chart,
-			ist.Spec.CcpIstioInit.Chart)
-		r.Log.Error(errors.New(e), e)
-		return false
-	}
 
 	// read istio section from Istio CR
 	r.Log.Info("istio", "chart", ist.Spec.CcpIstio.Chart)
 	r.Log.Info("istio", "values", ist.Spec.CcpIstio.Values)
-	if ist.Spec.CcpIstio.Chart == "" {
-		r.Log.Error(errors.New("invalid istio CR spec"),
-			"istio helm chart is empty in istio CR spec, cannot install istio.")
-		return false
-	}
-	if _, err := os.Stat(ist.Spec.CcpIstio.Chart); os.IsNotExist(err) &&
-		!strings.HasPrefix(ist.Spec.CcpIstio.Chart, "http") {
-		e := fmt.Sprintf("istio helm chart %s does not exist. "+
-			"Make sure that istio helm chart %s exists on the host running this pod, %s on "+
-			"the host will be mounted inside the istio-operator container. Check value of chartsPath "+
-			"in istio-operator's helm chart.", ist.Spec.CcpIstio.Chart, ist.Spec.CcpIstio.Chart,
-			ist.Spec.CcpIstio.Chart)
-		r.Log.Error(errors.New(e), e)
-		return false
-	}
 
 	// read istio-remote section from Istio CR
 	r.Log.Info("istio-remote", "chart", ist.Spec.CcpIstioRemote.Chart)
 	r.Log.Info("istio-remote", "values", ist.Spec.CcpIstioRemote.Values)
+	r.Log.Info("istio-remote", "remotePilotAddress", ist.Spec.CcpIstioRemote.RemotePilotAddress,
+		"remotePolicyAddress", ist.Spec.CcpIstioRemote.RemotePolicyAddress,
+		"remoteTelemetryAddress", ist.Spec.CcpIstioRemote.RemoteTelemetryAddress)
 
-	return true
+	return ValidateIstioSpec(ist.Spec)
 }
 
-// generate values file needed to install istio using helm
-func (r *IstioReconciler) GenerateValuesYamlFromIstioSpec(chartName string, values string) {
+// path of the values file generated for a helm chart in the workspace
+func ValuesFilePath(workspace string, chartName string) string {
+	return filepath.Join(workspace, fmt.Sprintf("%s%s", chartName, "-values.yaml"))
+}
+
+// generate values file needed to install istio using helm in the workspace
+func (r *IstioReconciler) GenerateValuesYamlFromIstioSpec(workspace string, chartName string, values string) error {
 	if values == "" {
 		r.Log.Info(fmt.Sprintf("values not found for %s %s", chartName, "in Istio CR spec."))
-	} else {
-		f := []byte(values)
-		f = append(f, "\n"...)
-		valuesFileName := fmt.Sprintf("%s%s", chartName, "-values.yaml")
-		os.Remove(valuesFileName)
-		err := ioutil.WriteFile(valuesFileName, f, 0644)
-		if err != nil {
-			r.Log.Error(err, fmt.Sprintf("Failed to generate values file for %s %s",
-				chartName, "in Istio CR spec."))
-			return
-		}
-		r.Log.Info(fmt.Sprintf("Generated values file %s %s %s %s", valuesFileName, "for",
-			chartName, "in Istio CR spec."))
+		return nil
+	}
+	f := []byte(values)
+	f = append(f, "\n"...)
+	valuesFileName := ValuesFilePath(workspace, chartName)
+	if err := ioutil.WriteFile(valuesFileName, f, 0644); err != nil {
+		return errors.New(fmt.Sprintf("Failed to generate values file for %s in Istio CR spec, %s",
+			chartName, err.Error()))
 	}
+	r.Log.Info(fmt.Sprintf("Generated values file %s %s %s %s", valuesFileName, "for",
+		chartName, "in Istio CR spec."))
+	return nil
 }
 
 func (r *IstioReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	// istio's pods and jobs are watched so that operations on istio waiting for them
+	// are run as soon as they change
+	istioWorkloadHandler := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.IstioCRsWaitingForIstioWorkloads),
+	}
+	// the objects installed by istio's helm releases that are checked for drift are
+	// watched so that changes to them are detected as soon as they happen
+	istioDriftHandler := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.IstioCRsWithIstioInstalled),
+	}
+	// istio CRs that do not own the mesh are watched so that one of them owns the mesh
+	// when the istio CR that owns it is deleted
+	istioConflictHandler := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.IstioCRsConflicted),
+	}
+	// istio releases are watched so that istio CRs warn as soon as the release of istio
+	// they installed is deprecated or reaches its end of life
+	istioReleaseHandler := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.IstioCRsWithIstioInstalled),
+	}
+	// the pods reading chart bundles from persistent volume claims are watched so that
+	// the bundle is read as soon as its pod completes
+	chartBundleLoaderHandler := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(r.IstioCRReadingChartBundle),
+	}
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&operatorv1alpha1.Istio{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &operatorv1alpha1.Istio{}}, istioConflictHandler).
+		Watches(&source.Kind{Type: &operatorv1alpha1.IstioRelease{}}, istioReleaseHandler).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, istioWorkloadHandler).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, chartBundleLoaderHandler).
+		Watches(&source.Kind{Type: &batchv1.Job{}}, istioWorkloadHandler).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, istioDriftHandler).
+		Watches(&source.Kind{Type: &corev1.Service{}}, istioDriftHandler).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, istioDriftHandler).
+		Watches(&source.Kind{Type: &admissionregistrationv1beta1.MutatingWebhookConfiguration{}}, istioDriftHandler).
+		Watches(&source.Kind{Type: &admissionregistrationv1beta1.ValidatingWebhookConfiguration{}}, istioDriftHandler)
+	if r.ChartEvents != nil {
+		// istio CRs are reconciled when the charts they installed change on disk
+		builder = builder.Watches(&source.Channel{Source: r.ChartEvents}, &handler.EnqueueRequestForObject{})
+	}
+	return builder.WithEventFilter(r.IstioEventPredicate()).Complete(r)
+}
+
+// istio CRs with an operation on istio in progress, they are reconciled when istio's
+// pods or jobs in the namespace of their control plane change
+func (r *IstioReconciler) IstioCRsWaitingForIstioWorkloads(obj handler.MapObject) []reconcile.Request {
+	var IstioList operatorv1alpha1.IstioList
+	if err := r.List(context.Background(), &IstioList); err != nil {
+		r.Log.Error(err, "Failed to get list of istio CRs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, istio := range IstioList.Items {
+		// operations that failed are requeued with a backoff, they are not run again
+		// every time istio's pods or jobs change
+		if istio.Status.Operation == nil || istioFailedStatuses[istio.Status.Active] ||
+			!IstioCRNamespaces(&istio)[obj.Meta.GetNamespace()] {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name:      istio.ObjectMeta.Name,
+			Namespace: istio.ObjectMeta.Namespace,
+		}})
+	}
+	return requests
+}
+
+// istio CR whose chart bundle is read by a pod, it is reconciled when the pod changes
+func (r *IstioReconciler) IstioCRReadingChartBundle(obj handler.MapObject) []reconcile.Request {
+	name, found := obj.Meta.GetLabels()[ChartBundleLoaderLabel]
+	if !found {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Name:      name,
+		Namespace: obj.Meta.GetNamespace(),
+	}}}
+}
+
+// istio CRs with istio installed and no operation on istio in progress, they are
+// reconciled when the objects installed by istio's helm releases change to check if
+// the objects drifted from their rendered state
+func (r *IstioReconciler) IstioCRsWithIstioInstalled(obj handler.MapObject) []reconcile.Request {
+	var IstioList operatorv1alpha1.IstioList
+	if err := r.List(context.Background(), &IstioList); err != nil {
+		r.Log.Error(err, "Failed to get list of istio CRs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, istio := range IstioList.Items {
+		if istio.Status.Operation != nil || !istioInstalledStatuses[istio.Status.Active] {
+			continue
+		}
+		// webhook configurations are not namespaced and are checked for all control planes
+		if obj.Meta.GetNamespace() != "" && !IstioCRNamespaces(&istio)[obj.Meta.GetNamespace()] {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name:      istio.ObjectMeta.Name,
+			Namespace: istio.ObjectMeta.Namespace,
+		}})
+	}
+	return requests
+}
+
+// filter the events reconciling istio CRs. Istio CRs are reconciled when they are created
+// or deleted and when their spec, finalizers or deletion timestamp change, but not when only
+// their status changes. Istio CRs are all reconciled when the istio operator starts, so that
+// interrupted operations on istio are resumed. Only the events of istio's objects (objects
+// labelled or owned by istio, istio's webhook configurations and istio releases) are used,
+// and the updates of istio's Deployments and webhook configurations are used only when their
+// spec changes. The predicate only looks at the objects of the events, it never reads istio
+// CRs, the namespaces of istio's control planes are checked when the events are mapped.
+func (r *IstioReconciler) IstioEventPredicate() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isIstioCROrIstioObject(e.Object, e.Meta)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isIstioCROrIstioObject(e.Object, e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return isIstioCROrIstioObject(e.Object, e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.MetaOld == nil || e.MetaNew == nil {
+				return true
+			}
+			if _, ok := e.ObjectNew.(*operatorv1alpha1.Istio); !ok {
+				if !isIstioCROrIstioObject(e.ObjectNew, e.MetaNew) {
+					return false
+				}
+				switch e.ObjectNew.(type) {
+				case *corev1.Pod, *batchv1.Job, *operatorv1alpha1.IstioRelease:
+					// the status of istio releases has their deprecated flag
+					return true
+				}
+				// ConfigMaps and Services have no metadata.generation
+				return e.MetaNew.GetGeneration() == 0 || e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration()
+			}
+			return e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration() ||
+				!reflect.DeepEqual(e.MetaOld.GetFinalizers(), e.MetaNew.GetFinalizers()) ||
+				!reflect.DeepEqual(e.MetaOld.GetDeletionTimestamp(), e.MetaNew.GetDeletionTimestamp())
+		},
+	}
+}
+
+// check if an object is an istio CR, an istio release, a pod reading a chart bundle,
+// one of istio's webhook configurations or one of istio's objects
+func isIstioCROrIstioObject(obj runtime.Object, meta v1.Object) bool {
+	if _, ok := obj.(*operatorv1alpha1.Istio); ok {
+		return true
+	}
+	if meta == nil {
+		return false
+	}
+	switch obj.(type) {
+	case *operatorv1alpha1.IstioRelease:
+		return true
+	case *corev1.Pod:
+		if _, found := meta.GetLabels()[ChartBundleLoaderLabel]; found {
+			return true
+		}
+	case *admissionregistrationv1beta1.MutatingWebhookConfiguration,
+		*admissionregistrationv1beta1.ValidatingWebhookConfiguration:
+		return strings.HasPrefix(meta.GetName(), "istio")
+	}
+	return isIstioObject(meta)
+}
+
+// check if an object belongs to istio from its labels, name and owners. The objects of
+// istio's charts are labelled with the name of their helm release (or IstioReleaseLabel
+// when they are applied by the istio operator) and istio's components with istio, the
+// objects of istio-init have no labels but are named after istio, and the pods of istio's
+// jobs and deployments are owned by jobs and replica sets named after istio.
+func isIstioObject(meta v1.Object) bool {
+	labels := meta.GetLabels()
+	if _, found := labels["istio"]; found {
+		return true
+	}
+	for _, release := range []string{labels["release"], labels[IstioReleaseLabel]} {
+		for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName,
+			operatorv1alpha1.IstioHelmChartName, operatorv1alpha1.IstioRemoteHelmChartName} {
+			if release != "" && strings.HasSuffix(release, chartName) {
+				return true
+			}
+		}
+	}
+	if strings.HasPrefix(meta.GetName(), "istio") {
+		return true
+	}
+	for _, owner := range meta.GetOwnerReferences() {
+		if strings.HasPrefix(owner.Name, "istio") {
+			return true
+		}
+	}
+	return false
+}
+
+// check if a string is in a slice of strings
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// remove a string from a slice of strings
+func removeString(slice []string, s string) []string {
+	var result []string
+	for _, item := range slice {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
 }
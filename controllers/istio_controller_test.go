@@ -0,0 +1,212 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// istio CR named name with the finalizer, its UID is its name
+func testIstioCR(name string, finalizer bool) *operatorv1alpha1.Istio {
+	ist := &operatorv1alpha1.Istio{}
+	ist.ObjectMeta.Name = name
+	ist.ObjectMeta.Namespace = "default"
+	ist.ObjectMeta.UID = types.UID(name)
+	if finalizer {
+		ist.ObjectMeta.Finalizers = []string{"foregroundDeletion", operatorv1alpha1.IstioFinalizer}
+	}
+	return ist
+}
+
+func TestAddIstioFinalizer(t *testing.T) {
+	ist := testIstioCR("ccp-istio", false)
+	r := fakeIstioReconciler(ist)
+	for i := 0; i < 2; i++ {
+		if err := r.AddIstioFinalizer(context.TODO(), ist); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := &operatorv1alpha1.Istio{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "ccp-istio"}, saved); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.ObjectMeta.Finalizers, []string{operatorv1alpha1.IstioFinalizer}) {
+		t.Errorf("unexpected finalizers %v", saved.ObjectMeta.Finalizers)
+	}
+}
+
+func TestFinalizeIstio(t *testing.T) {
+	tests := []struct {
+		name      string
+		finalizer bool
+		policy    operatorv1alpha1.DeletionPolicy
+		// another istio CR with the same control plane
+		otherIstioCR bool
+		ops          []string
+		finalized    bool
+		status       string
+	}{
+		{name: "without finalizer", policy: operatorv1alpha1.DeletionPolicyDelete},
+		{name: "retain", finalizer: true, policy: operatorv1alpha1.DeletionPolicyRetain, finalized: true},
+		{name: "control plane of another istio CR", finalizer: true, policy: operatorv1alpha1.DeletionPolicyDelete,
+			otherIstioCR: true, finalized: true},
+		{name: "retain CRDs", finalizer: true, policy: operatorv1alpha1.DeletionPolicyRetainCRDs,
+			ops:       []string{"uninstall istio", "uninstall istio-remote", "uninstall istio-init"},
+			finalized: true, status: "DeletingIstio"},
+		// istio's CRDs cannot be deleted outside of a cluster, the finalizer is kept
+		{name: "deletion failed", finalizer: true, policy: operatorv1alpha1.DeletionPolicyDelete,
+			ops:    []string{"uninstall istio", "uninstall istio-remote", "uninstall istio-init"},
+			status: "DeletionFailed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", test.finalizer)
+			now := v1.Now()
+			ist.ObjectMeta.DeletionTimestamp = &now
+			ist.Spec.DeletionPolicy = test.policy
+			ist.Status.HelmVersion = operatorv1alpha1.HelmVersionV2
+			istioCRs := []operatorv1alpha1.Istio{*ist}
+			if test.otherIstioCR {
+				istioCRs = append(istioCRs, *testIstioCR("ccp-istio-2", false))
+			}
+			r := fakeIstioReconciler(ist)
+			helm := r.Helm.(*fakeHelm)
+			for _, name := range []string{"istio-init", "istio"} {
+				helm.Install(HelmRelease{Name: name, Namespace: "istio-system", Chart: name + "-1.1.8-ccp1.tgz"})
+			}
+			helm.ops = nil
+
+			err := r.FinalizeIstio(context.TODO(), ist, istioCRs)
+			if (err != nil) != (test.status == "DeletionFailed") {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(helm.ops, test.ops) {
+				t.Errorf("expected helm operations %v, got %v", test.ops, helm.ops)
+			}
+			saved := &operatorv1alpha1.Istio{}
+			if err := r.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "ccp-istio"},
+				saved); err != nil {
+				t.Fatal(err)
+			}
+			finalizers := []string{"foregroundDeletion", operatorv1alpha1.IstioFinalizer}
+			if test.finalized {
+				finalizers = []string{"foregroundDeletion"}
+			} else if !test.finalizer {
+				finalizers = nil
+			}
+			if !reflect.DeepEqual(saved.ObjectMeta.Finalizers, finalizers) {
+				t.Errorf("expected finalizers %v, got %v", finalizers, saved.ObjectMeta.Finalizers)
+			}
+			if saved.Status.Active != test.status {
+				t.Errorf("expected status %q, got %q", test.status, saved.Status.Active)
+			}
+		})
+	}
+}
+
+func TestIstioEventPredicate(t *testing.T) {
+	labelled := func(obj v1.Object, labels map[string]string) {
+		obj.SetName("reviews")
+		obj.SetNamespace("istio-system")
+		obj.SetLabels(labels)
+	}
+	pilot := &corev1.Pod{}
+	labelled(pilot, map[string]string{"app": "pilot", "istio": "pilot"})
+	gateway := &appsv1.Deployment{}
+	labelled(gateway, map[string]string{"app": "gateway", "release": "canary-istio", "heritage": "Tiller"})
+	applied := &corev1.Service{}
+	labelled(applied, map[string]string{IstioReleaseLabel: "istio-remote"})
+	job := &batchv1.Job{}
+	labelled(job, nil)
+	job.SetName("istio-init-crd-10")
+	jobPod := &corev1.Pod{}
+	labelled(jobPod, map[string]string{"job-name": "istio-init-crd-10"})
+	jobPod.SetOwnerReferences([]v1.OwnerReference{{Kind: "Job", Name: "istio-init-crd-10"}})
+	app := &corev1.Pod{}
+	labelled(app, map[string]string{"app": "reviews", "release": "bookinfo"})
+	injector := &admissionregistrationv1beta1.MutatingWebhookConfiguration{}
+	injector.SetName("istio-sidecar-injector")
+	webhook := &admissionregistrationv1beta1.ValidatingWebhookConfiguration{}
+	webhook.SetName("cert-manager-webhook")
+
+	tests := []struct {
+		name     string
+		obj      runtime.Object
+		meta     v1.Object
+		expected bool
+	}{
+		{name: "istio CR", obj: testIstioCR("ccp-istio", false), expected: true},
+		{name: "istio release", obj: &operatorv1alpha1.IstioRelease{}, meta: &v1.ObjectMeta{Name: "1.1.8-ccp1"},
+			expected: true},
+		{name: "pod of istio's components", obj: pilot, meta: pilot, expected: true},
+		{name: "object of istio's helm release", obj: gateway, meta: gateway, expected: true},
+		{name: "object applied by the istio operator", obj: applied, meta: applied, expected: true},
+		{name: "job named after istio", obj: job, meta: job, expected: true},
+		{name: "pod of istio's job", obj: jobPod, meta: jobPod, expected: true},
+		{name: "pod of an application", obj: app, meta: app},
+		{name: "istio's webhook configuration", obj: injector, meta: injector, expected: true},
+		{name: "another webhook configuration", obj: webhook, meta: webhook},
+		{name: "object without metadata", obj: &corev1.Pod{}},
+	}
+	// the predicate never reads istio CRs, it has no client
+	p := (&IstioReconciler{}).IstioEventPredicate()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if created := p.Create(event.CreateEvent{Object: test.obj, Meta: test.meta}); created != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, created)
+			}
+		})
+	}
+
+	spec := gateway.DeepCopy()
+	spec.SetGeneration(2)
+	status := gateway.DeepCopy()
+	status.SetGeneration(1)
+	gateway.SetGeneration(1)
+	updates := []struct {
+		name     string
+		old      runtime.Object
+		new      runtime.Object
+		expected bool
+	}{
+		{name: "spec of istio's deployment changed", old: gateway, new: spec, expected: true},
+		{name: "status of istio's deployment changed", old: gateway, new: status},
+		{name: "pod of istio's components changed", old: pilot, new: pilot, expected: true},
+		{name: "pod of an application changed", old: app, new: app},
+	}
+	for _, test := range updates {
+		t.Run(test.name, func(t *testing.T) {
+			e := event.UpdateEvent{ObjectOld: test.old, MetaOld: test.old.(v1.Object),
+				ObjectNew: test.new, MetaNew: test.new.(v1.Object)}
+			if updated := p.Update(e); updated != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, updated)
+			}
+		})
+	}
+}
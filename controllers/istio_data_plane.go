@@ -0,0 +1,356 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// annotation of the pod template of a workload whose pods do not get istio's sidecar
+const istioSidecarInjectAnnotation = "sidecar.istio.io/inject"
+
+// a Deployment, StatefulSet or DaemonSet whose pods get istio's sidecar
+type istioWorkload struct {
+	kind     string
+	object   runtime.Object
+	meta     *v1.ObjectMeta
+	template *corev1.PodTemplateSpec
+	ready    bool
+}
+
+// kind, namespace and name of the workload
+func (w istioWorkload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.kind, w.meta.Namespace, w.meta.Name)
+}
+
+// check if the pods of a Deployment are all updated and available
+func deploymentIsReady(deployment *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.ObjectMeta.Generation && status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas && status.AvailableReplicas == replicas
+}
+
+// check if the pods of a StatefulSet are all updated and ready
+func statefulSetIsReady(statefulSet *appsv1.StatefulSet) bool {
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+	status := statefulSet.Status
+	// the pods of StatefulSets with the OnDelete update strategy are not re-created
+	onDelete := statefulSet.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType
+	return status.ObservedGeneration >= statefulSet.ObjectMeta.Generation && status.ReadyReplicas == replicas &&
+		(onDelete || status.UpdatedReplicas == replicas)
+}
+
+// check if the pods of a DaemonSet are all updated and available
+func daemonSetIsReady(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+	return status.ObservedGeneration >= daemonSet.ObjectMeta.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled
+}
+
+// Deployments, StatefulSets and DaemonSets of a namespace sorted by kind and name
+func (r *IstioReconciler) IstioNamespaceWorkloads(ctx context.Context, name string) ([]istioWorkload, error) {
+	var workloads []istioWorkload
+	var deploymentList appsv1.DeploymentList
+	if err := r.List(ctx, &deploymentList, client.InNamespace(name)); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list deployments in namespace %s, %s", name, err.Error()))
+	}
+	for i := range deploymentList.Items {
+		deployment := &deploymentList.Items[i]
+		workloads = append(workloads, istioWorkload{kind: "Deployment", object: deployment,
+			meta: &deployment.ObjectMeta, template: &deployment.Spec.Template, ready: deploymentIsReady(deployment)})
+	}
+	var statefulSetList appsv1.StatefulSetList
+	if err := r.List(ctx, &statefulSetList, client.InNamespace(name)); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list statefulsets in namespace %s, %s", name, err.Error()))
+	}
+	for i := range statefulSetList.Items {
+		statefulSet := &statefulSetList.Items[i]
+		workloads = append(workloads, istioWorkload{kind: "StatefulSet", object: statefulSet,
+			meta: &statefulSet.ObjectMeta, template: &statefulSet.Spec.Template, ready: statefulSetIsReady(statefulSet)})
+	}
+	var daemonSetList appsv1.DaemonSetList
+	if err := r.List(ctx, &daemonSetList, client.InNamespace(name)); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list daemonsets in namespace %s, %s", name, err.Error()))
+	}
+	for i := range daemonSetList.Items {
+		daemonSet := &daemonSetList.Items[i]
+		workloads = append(workloads, istioWorkload{kind: "DaemonSet", object: daemonSet,
+			meta: &daemonSet.ObjectMeta, template: &daemonSet.Spec.Template, ready: daemonSetIsReady(daemonSet)})
+	}
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].kind != workloads[j].kind {
+			return workloads[i].kind < workloads[j].kind
+		}
+		return workloads[i].meta.Name < workloads[j].meta.Name
+	})
+	return workloads, nil
+}
+
+// restart a workload by setting the time it was restarted in the annotations of its pod
+// template, its pods are re-created and get the sidecar of the control plane the
+// namespace uses
+func (r *IstioReconciler) RestartIstioWorkload(ctx context.Context, workload istioWorkload, restartedAt string) error {
+	original := workload.object.DeepCopyObject()
+	if workload.template.ObjectMeta.Annotations == nil {
+		workload.template.ObjectMeta.Annotations = map[string]string{}
+	}
+	workload.template.ObjectMeta.Annotations[IstioRestartedAtAnnotation] = restartedAt
+	if err := r.Patch(ctx, workload.object, client.MergeFrom(original)); err != nil {
+		return errors.New(fmt.Sprintf("failed to restart %s, %s", workload, err.Error()))
+	}
+	r.Log.Info(fmt.Sprintf("restarting %s", workload))
+	return nil
+}
+
+// workloads whose pods get the sidecar of a control plane of istio, the workloads in the
+// namespaces using the control plane that match the namespace selector, except the ones
+// whose pods are not injected
+func (r *IstioReconciler) IstioDataPlaneWorkloads(ctx context.Context,
+	controlPlane operatorv1alpha1.IstioControlPlane, namespaceSelector *v1.LabelSelector) ([]istioWorkload, error) {
+	selector := labels.Everything()
+	if namespaceSelector != nil {
+		var err error
+		if selector, err = v1.LabelSelectorAsSelector(namespaceSelector); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid namespaceSelector in spec.dataPlaneRollout, %s", err.Error()))
+		}
+	}
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list namespaces, %s", err.Error()))
+	}
+	sort.Slice(namespaceList.Items, func(i, j int) bool {
+		return namespaceList.Items[i].ObjectMeta.Name < namespaceList.Items[j].ObjectMeta.Name
+	})
+	var workloads []istioWorkload
+	for _, namespace := range namespaceList.Items {
+		if !IstioNamespaceUsesControlPlane(namespace, controlPlane) ||
+			!selector.Matches(labels.Set(namespace.ObjectMeta.Labels)) {
+			continue
+		}
+		namespaceWorkloads, err := r.IstioNamespaceWorkloads(ctx, namespace.ObjectMeta.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, workload := range namespaceWorkloads {
+			if workload.template.ObjectMeta.Annotations[istioSidecarInjectAnnotation] == "false" {
+				continue
+			}
+			workloads = append(workloads, workload)
+		}
+	}
+	return workloads, nil
+}
+
+// name of a PodDisruptionBudget that does not allow the pods of a workload to be disrupted,
+// empty if the workload can be restarted. disrupted has the PodDisruptionBudgets of the
+// workloads already restarted in the batch, a PodDisruptionBudget allows one workload it
+// selects to be restarted at a time.
+func (r *IstioReconciler) IstioWorkloadDisruptionBudget(ctx context.Context, workload istioWorkload,
+	disrupted map[string]bool) (string, error) {
+	var pdbList policyv1beta1.PodDisruptionBudgetList
+	if err := r.List(ctx, &pdbList, client.InNamespace(workload.meta.Namespace)); err != nil {
+		return "", errors.New(fmt.Sprintf("failed to list poddisruptionbudgets in namespace %s, %s",
+			workload.meta.Namespace, err.Error()))
+	}
+	var selected []string
+	for _, pdb := range pdbList.Items {
+		selector, err := v1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() || !selector.Matches(labels.Set(workload.template.ObjectMeta.Labels)) {
+			continue
+		}
+		key := pdb.ObjectMeta.Namespace + "/" + pdb.ObjectMeta.Name
+		if pdb.Status.PodDisruptionsAllowed < 1 || disrupted[key] {
+			return pdb.ObjectMeta.Name, nil
+		}
+		selected = append(selected, key)
+	}
+	for _, key := range selected {
+		disrupted[key] = true
+	}
+	return "", nil
+}
+
+// restart the workloads in the namespaces using istio's control plane after istio is
+// installed or upgraded, so that their pods get the sidecar of the new version of istio.
+// The workloads are restarted batchSize at a time, workloads whose PodDisruptionBudgets do
+// not allow a disruption are restarted later, and the next batch is restarted pauseSeconds
+// after the workloads of the batch are ready. The workloads restarted by a rollout have
+// the start time of the rollout in their pod template, so an interrupted rollout resumes
+// with the workloads not restarted yet. Returns true when all the workloads are restarted
+// and ready.
+func (r *IstioReconciler) RollOutIstioDataPlane(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec) (bool, error) {
+	policy := ist.Spec.DataPlaneRollout
+	if policy == nil {
+		return true, nil
+	}
+	operation := ist.Status.Operation
+	now := v1.Now()
+	original := ist.Status.DataPlaneRollout.DeepCopy()
+	rollout := ist.Status.DataPlaneRollout
+	if rollout == nil || rollout.StartTime.Before(&operation.StartTime) {
+		// a new rollout for the operation on istio
+		rollout = &operatorv1alpha1.IstioDataPlaneRolloutStatus{
+			Phase:     operatorv1alpha1.IstioDataPlaneRolloutProgressing,
+			Version:   filepath.Base(IstioControlPlaneChart(spec)),
+			StartTime: now,
+		}
+		ist.Status.DataPlaneRollout = rollout
+		r.Log.Info(fmt.Sprintf("rolling out the sidecars of %s to the workloads of Istio CR %s", rollout.Version,
+			ist.ObjectMeta.Name))
+	}
+	save := func() error {
+		if reflect.DeepEqual(original, rollout) {
+			return nil
+		}
+		return r.SaveIstioOperation(ctx, ist)
+	}
+	if rollout.Phase == operatorv1alpha1.IstioDataPlaneRolloutFailed {
+		// the batch that failed, or the workloads waiting for their PodDisruptionBudgets,
+		// are given another TimeoutInternal seconds when the step runs again
+		rollout.Phase = operatorv1alpha1.IstioDataPlaneRolloutProgressing
+		if rollout.BatchStartTime != nil {
+			rollout.BatchStartTime = &now
+		} else {
+			rollout.LastBatchReadyTime = &now
+		}
+	}
+
+	restartedAt := rollout.StartTime.UTC().Format(time.RFC3339)
+	workloads, err := r.IstioDataPlaneWorkloads(ctx, spec.ControlPlane, policy.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+	restarted := map[string]istioWorkload{}
+	var pending []istioWorkload
+	for _, workload := range workloads {
+		if workload.template.ObjectMeta.Annotations[IstioRestartedAtAnnotation] == restartedAt {
+			restarted[workload.String()] = workload
+		} else {
+			pending = append(pending, workload)
+		}
+	}
+	rollout.Workloads = int32(len(workloads))
+	rollout.Restarted = int32(len(restarted))
+	fail := func(since *v1.Time, message string) error {
+		if since != nil && time.Since(since.Time) < operatorv1alpha1.TimeoutInternal*time.Second {
+			return save()
+		}
+		rollout.Phase = operatorv1alpha1.IstioDataPlaneRolloutFailed
+		if err := save(); err != nil {
+			return err
+		}
+		return errors.New(fmt.Sprintf("rollout of the sidecars of %s timed out after %d seconds and failed, %s",
+			rollout.Version, operatorv1alpha1.TimeoutInternal, message))
+	}
+
+	// check the health of the batch being restarted, the workloads deleted since are ignored
+	if len(rollout.CurrentBatch) != 0 {
+		var notReady []string
+		for _, name := range rollout.CurrentBatch {
+			if workload, ok := restarted[name]; ok && !workload.ready {
+				notReady = append(notReady, name)
+			}
+		}
+		if len(notReady) != 0 {
+			rollout.Message = fmt.Sprintf("workloads not ready: %s", strings.Join(notReady, ", "))
+			return false, fail(rollout.BatchStartTime, rollout.Message)
+		}
+		r.Log.Info(fmt.Sprintf("restarted workloads are ready: %s", strings.Join(rollout.CurrentBatch, ", ")))
+		rollout.CurrentBatch = nil
+		rollout.BatchStartTime = nil
+		rollout.LastBatchReadyTime = &now
+		rollout.Message = ""
+	}
+
+	if len(pending) == 0 {
+		rollout.Phase = operatorv1alpha1.IstioDataPlaneRolloutCompleted
+		rollout.CompletionTime = &now
+		r.Log.Info(fmt.Sprintf("rolled out the sidecars of %s to %d workload(s)", rollout.Version, rollout.Workloads))
+		return true, save()
+	}
+	if rollout.LastBatchReadyTime != nil &&
+		time.Since(rollout.LastBatchReadyTime.Time) < time.Duration(policy.PauseSeconds)*time.Second {
+		return false, save()
+	}
+
+	// restart the next batch with the workloads whose PodDisruptionBudgets allow it
+	batchSize := 1
+	if policy.BatchSize > 0 {
+		batchSize = int(policy.BatchSize)
+	}
+	disrupted := map[string]bool{}
+	var batch []istioWorkload
+	var blocked []string
+	for _, workload := range pending {
+		if len(batch) == batchSize {
+			break
+		}
+		pdb, err := r.IstioWorkloadDisruptionBudget(ctx, workload, disrupted)
+		if err != nil {
+			return false, err
+		}
+		if pdb != "" {
+			blocked = append(blocked, fmt.Sprintf("%s (PodDisruptionBudget %s)", workload, pdb))
+			continue
+		}
+		batch = append(batch, workload)
+	}
+	if len(batch) == 0 {
+		rollout.Message = fmt.Sprintf("waiting for PodDisruptionBudgets to allow disruptions: %s",
+			strings.Join(blocked, ", "))
+		since := rollout.LastBatchReadyTime
+		if since == nil {
+			since = &rollout.StartTime
+		}
+		return false, fail(since, rollout.Message)
+	}
+	for _, workload := range batch {
+		if err := r.RestartIstioWorkload(ctx, workload, restartedAt); err != nil {
+			return false, err
+		}
+		rollout.CurrentBatch = append(rollout.CurrentBatch, workload.String())
+	}
+	rollout.Restarted += int32(len(batch))
+	rollout.BatchStartTime = &now
+	rollout.Message = ""
+	return false, save()
+}
@@ -0,0 +1,275 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestIstioWorkloadIsReady(t *testing.T) {
+	two := int32(2)
+	tests := []struct {
+		name     string
+		workload runtime.Object
+		expected bool
+	}{
+		{name: "deployment ready", workload: testDeployment("bookinfo", "productpage", true), expected: true},
+		{name: "deployment not ready", workload: testDeployment("bookinfo", "productpage", false)},
+		{
+			name: "deployment with pods not updated",
+			workload: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &two},
+				Status: appsv1.DeploymentStatus{Replicas: 3, UpdatedReplicas: 1, AvailableReplicas: 3}},
+		},
+		{
+			name: "deployment not observed",
+			workload: &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Generation: 2},
+				Status: appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1,
+					AvailableReplicas: 1}},
+		},
+		{
+			name: "statefulset ready",
+			workload: &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &two},
+				Status: appsv1.StatefulSetStatus{ReadyReplicas: 2, UpdatedReplicas: 2}},
+			expected: true,
+		},
+		{
+			name: "statefulset with pods not updated",
+			workload: &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &two},
+				Status: appsv1.StatefulSetStatus{ReadyReplicas: 2, UpdatedReplicas: 1}},
+		},
+		{
+			name: "statefulset updated on delete",
+			workload: &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &two,
+				UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}},
+				Status: appsv1.StatefulSetStatus{ReadyReplicas: 2}},
+			expected: true,
+		},
+		{
+			name: "daemonset ready",
+			workload: &appsv1.DaemonSet{Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 3,
+				UpdatedNumberScheduled: 3, NumberAvailable: 3}},
+			expected: true,
+		},
+		{
+			name: "daemonset with pods not available",
+			workload: &appsv1.DaemonSet{Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 3,
+				UpdatedNumberScheduled: 3, NumberAvailable: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ready bool
+			switch workload := test.workload.(type) {
+			case *appsv1.Deployment:
+				ready = deploymentIsReady(workload)
+			case *appsv1.StatefulSet:
+				ready = statefulSetIsReady(workload)
+			case *appsv1.DaemonSet:
+				ready = daemonSetIsReady(workload)
+			}
+			if ready != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, ready)
+			}
+		})
+	}
+}
+
+// workloads of the data plane in namespaces bookinfo and web using the default control
+// plane and in namespace other not using istio
+func testDataPlaneObjects() []runtime.Object {
+	skipped := testDeployment("bookinfo", "skipped", true)
+	skipped.Spec.Template.ObjectMeta.Annotations = map[string]string{istioSidecarInjectAnnotation: "false"}
+	statefulSet := &appsv1.StatefulSet{}
+	statefulSet.ObjectMeta.Namespace = "bookinfo"
+	statefulSet.ObjectMeta.Name = "db"
+	return []runtime.Object{
+		testNamespace("web", map[string]string{istioInjectionLabel: "enabled", "team": "web"}),
+		testNamespace("bookinfo", map[string]string{istioInjectionLabel: "enabled", "team": "bookinfo"}),
+		testNamespace("other", nil),
+		testDeployment("bookinfo", "reviews", true), statefulSet, skipped,
+		testDeployment("bookinfo", "productpage", true), testDeployment("web", "frontend", true),
+		testDeployment("other", "backend", true),
+	}
+}
+
+func TestIstioDataPlaneWorkloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector *v1.LabelSelector
+		expected []string
+	}{
+		{
+			name: "namespaces using the control plane",
+			expected: []string{"Deployment bookinfo/productpage", "Deployment bookinfo/reviews",
+				"StatefulSet bookinfo/db", "Deployment web/frontend"},
+		},
+		{
+			name:     "namespaces matching the selector",
+			selector: &v1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+			expected: []string{"Deployment web/frontend"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := fakeIstioReconciler(testDataPlaneObjects()...)
+			workloads, err := r.IstioDataPlaneWorkloads(context.TODO(), operatorv1alpha1.IstioControlPlane{},
+				test.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, workload := range workloads {
+				names = append(names, workload.String())
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestIstioWorkloadDisruptionBudget(t *testing.T) {
+	pdb := func(name string, app string, allowed int32) *policyv1beta1.PodDisruptionBudget {
+		pdb := &policyv1beta1.PodDisruptionBudget{}
+		pdb.ObjectMeta.Namespace = "bookinfo"
+		pdb.ObjectMeta.Name = name
+		pdb.Spec.Selector = &v1.LabelSelector{MatchLabels: map[string]string{"app": app}}
+		pdb.Status.PodDisruptionsAllowed = allowed
+		return pdb
+	}
+	workload := func(name string, app string) istioWorkload {
+		deployment := testDeployment("bookinfo", name, true)
+		deployment.Spec.Template.ObjectMeta.Labels = map[string]string{"app": app}
+		return istioWorkload{kind: "Deployment", object: deployment, meta: &deployment.ObjectMeta,
+			template: &deployment.Spec.Template}
+	}
+	r := fakeIstioReconciler(pdb("reviews", "reviews", 1), pdb("ratings", "ratings", 0))
+	ctx := context.TODO()
+	disrupted := map[string]bool{}
+	tests := []struct {
+		workload istioWorkload
+		expected string
+	}{
+		{workload: workload("productpage", "productpage")},
+		{workload: workload("reviews-v1", "reviews")},
+		// the PodDisruptionBudget allows one workload of the batch to be restarted
+		{workload: workload("reviews-v2", "reviews"), expected: "reviews"},
+		{workload: workload("ratings", "ratings"), expected: "ratings"},
+	}
+	for _, test := range tests {
+		name, err := r.IstioWorkloadDisruptionBudget(ctx, test.workload, disrupted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != test.expected {
+			t.Errorf("expected PodDisruptionBudget %q for %s, got %q", test.expected, test.workload, name)
+		}
+	}
+}
+
+func TestRollOutIstioDataPlane(t *testing.T) {
+	ist := testIstioCR("ccp-istio", true)
+	ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.3.0.tgz"
+	ist.Status.Operation = &operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationUpgrade,
+		StartTime: v1.NewTime(time.Now().Add(-time.Minute))}
+	objects := append(testDataPlaneObjects(), ist)
+	r := fakeIstioReconciler(objects...)
+	ctx := context.TODO()
+
+	// istio CR without spec.dataPlaneRollout does not restart workloads
+	if done, err := r.RollOutIstioDataPlane(ctx, ist, ist.Spec); !done || err != nil {
+		t.Fatalf("expected no rollout, got %v, %v", done, err)
+	}
+
+	ist.Spec.DataPlaneRollout = &operatorv1alpha1.IstioDataPlaneRollout{BatchSize: 2,
+		NamespaceSelector: &v1.LabelSelector{MatchLabels: map[string]string{"team": "bookinfo"}}}
+	rollOut := func(expected bool, batch ...string) {
+		t.Helper()
+		done, err := r.RollOutIstioDataPlane(ctx, ist, ist.Spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != expected {
+			t.Errorf("expected done %v, got %v", expected, done)
+		}
+		if rollout := ist.Status.DataPlaneRollout; !reflect.DeepEqual(rollout.CurrentBatch, batch) {
+			t.Errorf("expected batch %v, got %v", batch, rollout.CurrentBatch)
+		}
+	}
+	rollOut(false, "Deployment bookinfo/productpage", "Deployment bookinfo/reviews")
+	rollout := ist.Status.DataPlaneRollout
+	if rollout.Version != "istio-1.3.0.tgz" || rollout.Workloads != 3 || rollout.Restarted != 2 ||
+		rollout.Phase != operatorv1alpha1.IstioDataPlaneRolloutProgressing {
+		t.Errorf("unexpected rollout %+v", rollout)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "bookinfo", Name: "reviews"}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	restartedAt := rollout.StartTime.UTC().Format(time.RFC3339)
+	if annotation := deployment.Spec.Template.ObjectMeta.Annotations[IstioRestartedAtAnnotation]; annotation !=
+		restartedAt {
+		t.Errorf("expected reviews restarted at %s, got %q", restartedAt, annotation)
+	}
+
+	// the next batch is restarted once the batch is ready
+	rollOut(false, "StatefulSet bookinfo/db")
+	rollout = ist.Status.DataPlaneRollout
+	if rollout.LastBatchReadyTime == nil || rollout.Restarted != 3 {
+		t.Errorf("unexpected rollout %+v", rollout)
+	}
+
+	// the rollout fails when the batch is not ready in time and resumes when the step runs again
+	startTime := v1.NewTime(time.Now().Add(-2 * operatorv1alpha1.TimeoutInternal * time.Second))
+	ist.Status.DataPlaneRollout.BatchStartTime = &startTime
+	if _, err := r.RollOutIstioDataPlane(ctx, ist, ist.Spec); err == nil {
+		t.Error("expected timeout error")
+	}
+	rollout = ist.Status.DataPlaneRollout
+	if rollout.Phase != operatorv1alpha1.IstioDataPlaneRolloutFailed ||
+		rollout.Message != "workloads not ready: StatefulSet bookinfo/db" {
+		t.Errorf("unexpected rollout %+v", rollout)
+	}
+	rollOut(false, "StatefulSet bookinfo/db")
+	if rollout = ist.Status.DataPlaneRollout; rollout.Phase != operatorv1alpha1.IstioDataPlaneRolloutProgressing {
+		t.Errorf("expected rollout to resume, got %s", rollout.Phase)
+	}
+
+	statefulSet := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "bookinfo", Name: "db"}, statefulSet); err != nil {
+		t.Fatal(err)
+	}
+	statefulSet.Status = appsv1.StatefulSetStatus{ReadyReplicas: 1, UpdatedReplicas: 1}
+	if err := r.Update(ctx, statefulSet); err != nil {
+		t.Fatal(err)
+	}
+	rollOut(true)
+	rollout = ist.Status.DataPlaneRollout
+	if rollout.Phase != operatorv1alpha1.IstioDataPlaneRolloutCompleted || rollout.CompletionTime == nil {
+		t.Errorf("unexpected rollout %+v", rollout)
+	}
+}
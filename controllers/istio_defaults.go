@@ -0,0 +1,328 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// IstioDefaults defines the platform defaults set in istio CR spec by the defaulting
+// webhook when spec.version is set
+type IstioDefaults struct {
+	// directory containing istio's helm charts, value of CHARTS_PATH
+	ChartsPath string
+	// registry of istio's images
+	Hub string
+	// pull policy of istio's images
+	ImagePullPolicy string
+}
+
+// set the charts of the version of istio in spec.version that are empty in istio CR
+// spec, and the hub, tag and imagePullPolicy of istio's images in their values. When
+// spec.version changes, the charts and tags that were set for the old version are set
+// again for the new version. old is nil when istio CR is created.
+func (d IstioDefaults) DefaultIstioSpec(old *operatorv1alpha1.IstioSpec, spec *operatorv1alpha1.IstioSpec) error {
+	if spec.Version == "" {
+		return nil
+	}
+	versionChanged := old != nil && old.Version != "" && old.Version != spec.Version
+
+	init := &spec.CcpIstioInit
+	if versionChanged {
+		d.resetIstioChart(old.CcpIstioInit.Chart, &init.Chart, &init.Values)
+	}
+	if err := d.defaultIstioChart(operatorv1alpha1.IstioInitHelmChartName, spec.Version, &init.Chart,
+		&init.Values); err != nil {
+		return err
+	}
+
+	// istio-remote is installed instead of istio in a remote cluster of a multi-cluster
+	// mesh, its chart is set if the address of istio-pilot in the primary cluster is set
+	if IstioIsRemote(*spec) || spec.CcpIstioRemote.RemotePilotAddress != "" {
+		remote := &spec.CcpIstioRemote
+		if versionChanged {
+			d.resetIstioChart(old.CcpIstioRemote.Chart, &remote.Chart, &remote.Values)
+		}
+		return d.defaultIstioChart(operatorv1alpha1.IstioRemoteHelmChartName, spec.Version, &remote.Chart,
+			&remote.Values)
+	}
+	ist := &spec.CcpIstio
+	if versionChanged {
+		d.resetIstioChart(old.CcpIstio.Chart, &ist.Chart, &ist.Values)
+	}
+	return d.defaultIstioChart(operatorv1alpha1.IstioHelmChartName, spec.Version, &ist.Chart, &ist.Values)
+}
+
+// clear a chart that was not changed when spec.version changed, and its tag if it is
+// the tag set for the chart, so that they are set again for the new version
+func (d IstioDefaults) resetIstioChart(oldChart string, chart *string, values *string) {
+	if oldChart == "" || *chart != oldChart {
+		return
+	}
+	*chart = ""
+	parsed, err := parseIstioValues(*values)
+	if err != nil {
+		return
+	}
+	global, _ := parsed["global"].(map[string]interface{})
+	if global == nil || global["tag"] != IstioChartTag(oldChart) {
+		return
+	}
+	if patched, err := patchIstioGlobalValues(*values, nil, "tag"); err == nil {
+		*values = patched
+	}
+}
+
+// set a chart of the version of istio if it is empty, and the hub, tag and
+// imagePullPolicy of istio's images in its values if they are not set
+func (d IstioDefaults) defaultIstioChart(chartName string, version string, chart *string, values *string) error {
+	if *chart == "" {
+		resolved, err := ResolveIstioChart(d.ChartsPath, chartName, version)
+		if err != nil {
+			return err
+		}
+		*chart = resolved
+	}
+
+	parsed, err := parseIstioValues(*values)
+	if err != nil {
+		// invalid values are rejected by the validating webhook
+		return nil
+	}
+	global, _ := parsed["global"].(map[string]interface{})
+	set := map[string]string{}
+	for key, value := range map[string]string{
+		"hub":             d.Hub,
+		"tag":             IstioChartTag(*chart),
+		"imagePullPolicy": d.ImagePullPolicy,
+	} {
+		if _, ok := global[key]; ok || value == "" {
+			continue
+		}
+		set[key] = value
+	}
+	if len(set) == 0 {
+		// the values are left as they were written
+		return nil
+	}
+	patched, err := patchIstioGlobalValues(*values, set, "")
+	if err != nil {
+		return err
+	}
+	*values = patched
+	return nil
+}
+
+// set keys in (or remove a key from) the global section of the values of a helm chart in
+// istio CR spec. The lines of the keys are inserted in (or removed from) the text of the
+// values so that the comments and the order of the keys written by users are kept. Values
+// that cannot be patched line by line, for example with a global section in flow style
+// (global: {hub: ...}), are marshalled again, which drops their comments and sorts their
+// keys.
+func patchIstioGlobalValues(values string, set map[string]string, remove string) (string, error) {
+	parsed, err := parseIstioValues(values)
+	if err != nil {
+		return "", err
+	}
+	global, _ := parsed["global"].(map[string]interface{})
+	if global == nil {
+		global = map[string]interface{}{}
+	}
+	for key, value := range set {
+		global[key] = value
+	}
+	delete(global, remove)
+	parsed["global"] = global
+
+	if patched, ok := patchIstioGlobalValuesText(values, set, remove); ok {
+		if result, err := parseIstioValues(patched); err == nil && reflect.DeepEqual(result, parsed) {
+			return patched, nil
+		}
+	}
+	f, err := yaml.Marshal(parsed)
+	if err != nil {
+		return "", err
+	}
+	return string(f), nil
+}
+
+// global section in block style at the top level of the values of a helm chart
+var istioGlobalValuesRegexp = regexp.MustCompile(`^global:\s*(#.*)?$`)
+
+// patch the lines of the global section of values, false if the global section is not
+// in block style
+func patchIstioGlobalValuesText(values string, set map[string]string, remove string) (string, bool) {
+	lines := strings.Split(strings.TrimSuffix(values, "\n"), "\n")
+	if values == "" {
+		lines = nil
+	}
+	start := -1
+	for i, line := range lines {
+		if istioGlobalValuesRegexp.MatchString(line) {
+			start = i
+		} else if strings.HasPrefix(line, "global:") {
+			return "", false
+		}
+	}
+
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if start == -1 {
+		// the global section is added after the values
+		start = len(lines)
+		lines = append(lines, "global:")
+	}
+
+	// the global section ends at the next line that is not indented
+	end := start + 1
+	indent := ""
+	for ; end < len(lines); end++ {
+		line := lines[end]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == line {
+			break
+		}
+		if indent == "" {
+			indent = line[:len(line)-len(trimmed)]
+		}
+	}
+	if indent == "" {
+		indent = "  "
+	}
+
+	var section []string
+	for i := start + 1; i < end; i++ {
+		line := lines[i]
+		if remove != "" && strings.HasPrefix(line, indent+remove+":") {
+			// the value of the key is on its line or on the lines indented below it
+			for i+1 < end && strings.HasPrefix(lines[i+1], indent+" ") {
+				i++
+			}
+			continue
+		}
+		section = append(section, line)
+	}
+	var inserted []string
+	for _, key := range keys {
+		value, err := yaml.Marshal(set[key])
+		if err != nil {
+			return "", false
+		}
+		inserted = append(inserted, fmt.Sprintf("%s%s: %s", indent, key, strings.TrimSpace(string(value))))
+	}
+
+	result := append([]string{}, lines[:start+1]...)
+	result = append(result, inserted...)
+	result = append(result, section...)
+	result = append(result, lines[end:]...)
+	return strings.Join(result, "\n") + "\n", true
+}
+
+// find the helm chart of a version of istio in the charts directory, for example
+// /opt/ccp/charts/istio-1.1.8-ccp1.tgz for istio and 1.1.8. If several charts match the
+// version (1.1.8-ccp1 and 1.1.8-ccp2), the latest one is used.
+func ResolveIstioChart(chartsPath string, chartName string, version string) (string, error) {
+	if chartsPath == "" {
+		return "", errors.New(fmt.Sprintf("cannot find %s helm chart for istio %s, environment variable "+
+			"CHARTS_PATH not set", chartName, version))
+	}
+	files, err := ioutil.ReadDir(chartsPath)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("cannot find %s helm chart for istio %s in %s, %s", chartName,
+			version, chartsPath, err.Error()))
+	}
+	chartRegexp := regexp.MustCompile(fmt.Sprintf(`^%s-%s(-[^-]+)?\.tgz$`, regexp.QuoteMeta(chartName),
+		regexp.QuoteMeta(version)))
+	var charts []string
+	builds := map[string]int{}
+	for _, file := range files {
+		if match := chartRegexp.FindStringSubmatch(file.Name()); !file.IsDir() && match != nil {
+			charts = append(charts, file.Name())
+			builds[file.Name()] = istioChartBuild(match[1])
+		}
+	}
+	if len(charts) == 0 {
+		return "", errors.New(fmt.Sprintf("%s helm chart for istio %s not found in %s", chartName, version,
+			chartsPath))
+	}
+	// the build numbers of ccpN are compared as numbers, ccp10 is later than ccp2
+	sort.Slice(charts, func(i, j int) bool {
+		if builds[charts[i]] != builds[charts[j]] {
+			return builds[charts[i]] < builds[charts[j]]
+		}
+		return charts[i] < charts[j]
+	})
+	return filepath.Join(chartsPath, charts[len(charts)-1]), nil
+}
+
+// build of a chart in the suffix of its version, for example -ccp2 in istio-1.1.8-ccp2.tgz
+var istioChartBuildRegexp = regexp.MustCompile(`^-ccp(\d+)$`)
+
+// build number of a helm chart of a version of istio from the suffix of its version, N
+// for a -ccpN build, -1 for the chart without a suffix that is older than its builds,
+// and 0 for other suffixes
+func istioChartBuild(suffix string) int {
+	if suffix == "" {
+		return -1
+	}
+	if match := istioChartBuildRegexp.FindStringSubmatch(suffix); match != nil {
+		if build, err := strconv.Atoi(match[1]); err == nil {
+			return build
+		}
+	}
+	return 0
+}
+
+// tag of istio's images for a helm chart, the version in the name of the chart, for
+// example 1.1.8-ccp1 for /opt/ccp/charts/istio-1.1.8-ccp1.tgz
+func IstioChartTag(chart string) string {
+	location, _ := ParseChartReference(chart)
+	name := strings.TrimSuffix(filepath.Base(location), ".tgz")
+	if loc := istioVersionRegexp.FindStringIndex(name); loc != nil {
+		return name[loc[0]:]
+	}
+	return ""
+}
+
+// parse the values of a helm chart in istio CR spec
+func parseIstioValues(values string) (map[string]interface{}, error) {
+	parsed := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(values), &parsed); err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		parsed = map[string]interface{}{}
+	}
+	return parsed, nil
+}
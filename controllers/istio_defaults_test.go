@@ -0,0 +1,200 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestResolveIstioChart(t *testing.T) {
+	tests := []struct {
+		name     string
+		charts   []string
+		version  string
+		expected string
+	}{
+		{name: "ccp10 is later than ccp2",
+			charts:  []string{"istio-1.1.8-ccp2.tgz", "istio-1.1.8-ccp10.tgz", "istio-1.1.8-ccp9.tgz"},
+			version: "1.1.8", expected: "istio-1.1.8-ccp10.tgz"},
+		{name: "chart without a suffix is older than its builds",
+			charts: []string{"istio-1.1.8.tgz", "istio-1.1.8-ccp1.tgz"}, version: "1.1.8",
+			expected: "istio-1.1.8-ccp1.tgz"},
+		{name: "only the chart without a suffix",
+			charts: []string{"istio-1.1.8.tgz", "istio-1.1.9-ccp1.tgz"}, version: "1.1.8",
+			expected: "istio-1.1.8.tgz"},
+		{name: "other versions are not used",
+			charts:  []string{"istio-1.1.8-ccp2.tgz", "istio-1.1.80-ccp1.tgz", "istio-init-1.1.8-ccp3.tgz"},
+			version: "1.1.8", expected: "istio-1.1.8-ccp2.tgz"},
+		{name: "version with a build",
+			charts:  []string{"istio-1.1.8-ccp2.tgz", "istio-1.1.8-ccp10.tgz"},
+			version: "1.1.8-ccp2", expected: "istio-1.1.8-ccp2.tgz"},
+		{name: "no chart of the version", charts: []string{"istio-1.1.9-ccp1.tgz"}, version: "1.1.8"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{}
+			for _, chart := range test.charts {
+				files[chart] = ""
+			}
+			dir := writeTestChart(t, files)
+			defer os.RemoveAll(dir)
+
+			chart, err := ResolveIstioChart(dir, "istio", test.version)
+			if test.expected == "" {
+				if err == nil {
+					t.Errorf("expected no chart, got %s", chart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chart != filepath.Join(dir, test.expected) {
+				t.Errorf("expected %s, got %s", test.expected, filepath.Base(chart))
+			}
+		})
+	}
+}
+
+func TestPatchIstioGlobalValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   string
+		set      map[string]string
+		remove   string
+		expected string
+	}{
+		{
+			name:     "no values",
+			set:      map[string]string{"tag": "1.1.8-ccp1", "hub": "docker.io/istio"},
+			expected: "global:\n  hub: docker.io/istio\n  tag: 1.1.8-ccp1\n",
+		},
+		{
+			name: "comments and order of the keys kept",
+			values: `# gateways of the mesh
+gateways:
+  enabled: false
+global:
+    # mutual TLS between all the services
+    mtls:
+      enabled: true
+    proxy:
+      image: proxyv2
+mixer:
+  enabled: true
+`,
+			set: map[string]string{"tag": "1.1.8-ccp1"},
+			expected: `# gateways of the mesh
+gateways:
+  enabled: false
+global:
+    tag: 1.1.8-ccp1
+    # mutual TLS between all the services
+    mtls:
+      enabled: true
+    proxy:
+      image: proxyv2
+mixer:
+  enabled: true
+`,
+		},
+		{
+			name:   "global section added",
+			values: "# sidecar injection\nsidecarInjectorWebhook:\n  enabled: true\n",
+			set:    map[string]string{"imagePullPolicy": "IfNotPresent"},
+			expected: "# sidecar injection\nsidecarInjectorWebhook:\n  enabled: true\n" +
+				"global:\n  imagePullPolicy: IfNotPresent\n",
+		},
+		{
+			name:     "values that look like numbers stay strings",
+			values:   "global: # images\n  hub: docker.io/istio\n",
+			set:      map[string]string{"tag": "1.10"},
+			expected: "global: # images\n  tag: \"1.10\"\n  hub: docker.io/istio\n",
+		},
+		{
+			name:     "key removed",
+			values:   "global:\n  # tag of the old version\n  tag: 1.1.8-ccp1\n  hub: docker.io/istio\npilot:\n  replicas: 2\n",
+			remove:   "tag",
+			expected: "global:\n  # tag of the old version\n  hub: docker.io/istio\npilot:\n  replicas: 2\n",
+		},
+		{
+			name:     "flow style rewritten",
+			values:   "# images\nglobal: {hub: docker.io/istio}\n",
+			set:      map[string]string{"tag": "1.1.8-ccp1"},
+			expected: "global:\n  hub: docker.io/istio\n  tag: 1.1.8-ccp1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := patchIstioGlobalValues(test.values, test.set, test.remove)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if values != test.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expected, values)
+			}
+		})
+	}
+}
+
+func TestDefaultIstioSpec(t *testing.T) {
+	dir := writeTestChart(t, map[string]string{"istio-init-1.1.8-ccp1.tgz": "", "istio-1.1.8-ccp1.tgz": "",
+		"istio-init-1.1.9-ccp1.tgz": "", "istio-1.1.9-ccp1.tgz": ""})
+	defer os.RemoveAll(dir)
+	defaults := IstioDefaults{ChartsPath: dir, Hub: "docker.io/istio"}
+
+	values := "# images of istio\nglobal:\n  hub: registry.example.com/istio\n"
+	spec := operatorv1alpha1.IstioSpec{Version: "1.1.8"}
+	spec.CcpIstio.Values = values
+	if err := defaults.DefaultIstioSpec(nil, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.CcpIstio.Chart != filepath.Join(dir, "istio-1.1.8-ccp1.tgz") ||
+		spec.CcpIstioInit.Chart != filepath.Join(dir, "istio-init-1.1.8-ccp1.tgz") {
+		t.Errorf("unexpected charts %s, %s", spec.CcpIstioInit.Chart, spec.CcpIstio.Chart)
+	}
+	expected := "# images of istio\nglobal:\n  tag: 1.1.8-ccp1\n  hub: registry.example.com/istio\n"
+	if spec.CcpIstio.Values != expected {
+		t.Errorf("expected values:\n%s\ngot:\n%s", expected, spec.CcpIstio.Values)
+	}
+
+	// the values are not rewritten when all their keys are set
+	defaulted := spec
+	if err := defaults.DefaultIstioSpec(&defaulted, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.CcpIstio.Values != expected {
+		t.Errorf("values rewritten:\n%s", spec.CcpIstio.Values)
+	}
+
+	// the chart and tag of the old version are set again for the new version
+	old := spec
+	spec.Version = "1.1.9"
+	if err := defaults.DefaultIstioSpec(&old, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.CcpIstio.Chart != filepath.Join(dir, "istio-1.1.9-ccp1.tgz") {
+		t.Errorf("unexpected chart %s", spec.CcpIstio.Chart)
+	}
+	expected = "# images of istio\nglobal:\n  tag: 1.1.9-ccp1\n  hub: registry.example.com/istio\n"
+	if spec.CcpIstio.Values != expected {
+		t.Errorf("expected values:\n%s\ngot:\n%s", expected, spec.CcpIstio.Values)
+	}
+}
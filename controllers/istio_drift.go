@@ -0,0 +1,388 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// kinds of the objects installed by istio's helm releases that are checked for drift
+var istioDriftKinds = map[string]bool{
+	"Deployment":                     true,
+	"Service":                        true,
+	"ConfigMap":                      true,
+	"MutatingWebhookConfiguration":   true,
+	"ValidatingWebhookConfiguration": true,
+}
+
+// kinds of the objects checked for drift that are not namespaced
+var istioDriftClusterScopedKinds = map[string]bool{
+	"MutatingWebhookConfiguration":   true,
+	"ValidatingWebhookConfiguration": true,
+}
+
+// maximum number of differing fields reported for a drifted object
+const istioDriftMaxFields = 10
+
+// compare the Deployments, Services, ConfigMaps and webhook configurations installed by
+// istio's helm releases with their rendered state, report the objects that differ in
+// istio CR's status and re-apply them if istio CR's drift policy is Correct
+func (r *IstioReconciler) CheckIstioDrift(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	desiredObjects, err := r.RenderedIstioObjects(IstioInstalledSpec(ist))
+	if err != nil {
+		return err
+	}
+
+	var drifted []operatorv1alpha1.IstioDriftedObject
+	for _, desired := range desiredObjects {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(desired.GroupVersionKind())
+		key := types.NamespacedName{Name: desired.GetName(), Namespace: desired.GetNamespace()}
+		driftedObject := operatorv1alpha1.IstioDriftedObject{
+			APIVersion: desired.GetAPIVersion(),
+			Kind:       desired.GetKind(),
+			Namespace:  desired.GetNamespace(),
+			Name:       desired.GetName(),
+		}
+		if err := r.Get(ctx, key, live); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return errors.New(fmt.Sprintf("failed to get %s %s, %s", desired.GetKind(), key.String(),
+					err.Error()))
+			}
+			driftedObject.Reason = "Missing"
+		} else {
+			fields := DriftedFields(desired.Object, live.Object)
+			if len(fields) == 0 {
+				continue
+			}
+			driftedObject.Reason = "Modified"
+			if len(fields) > istioDriftMaxFields {
+				fields = fields[:istioDriftMaxFields]
+			}
+			driftedObject.Fields = fields
+		}
+		r.Log.Info(fmt.Sprintf("%s %s drifted from istio's rendered state: %s %s", desired.GetKind(),
+			key.String(), driftedObject.Reason, strings.Join(driftedObject.Fields, ", ")))
+
+		if ist.Spec.DriftPolicy == operatorv1alpha1.DriftPolicyCorrect {
+			if err := r.CorrectIstioDrift(ctx, &desired, live, driftedObject.Reason); err != nil {
+				r.Log.Error(err, fmt.Sprintf("failed to re-apply %s %s", desired.GetKind(), key.String()))
+			} else {
+				driftedObject.Corrected = true
+			}
+		}
+		drifted = append(drifted, driftedObject)
+	}
+
+	now := v1.Now()
+	ist.Status.Drift = &operatorv1alpha1.IstioDriftStatus{LastCheckTime: &now, Objects: drifted}
+	SetIstioDriftCondition(ist, drifted)
+	return r.Status().Update(ctx, ist)
+}
+
+// set the Drifted condition in istio CR's status, the condition is True if some objects
+// differ from their rendered state and were not re-applied
+func SetIstioDriftCondition(ist *operatorv1alpha1.Istio, drifted []operatorv1alpha1.IstioDriftedObject) {
+	var notCorrected []string
+	for _, object := range drifted {
+		if !object.Corrected {
+			notCorrected = append(notCorrected, fmt.Sprintf("%s %s", object.Kind, object.Name))
+		}
+	}
+	condition := operatorv1alpha1.IstioCondition{
+		Type:               operatorv1alpha1.IstioConditionDrifted,
+		Status:             corev1.ConditionFalse,
+		ObservedGeneration: ist.ObjectMeta.Generation,
+		Reason:             "NoDrift",
+	}
+	if len(notCorrected) != 0 {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "DriftDetected"
+		condition.Message = fmt.Sprintf("objects differ from istio's rendered state: %s",
+			strings.Join(notCorrected, ", "))
+	} else if len(drifted) != 0 {
+		condition.Reason = "DriftCorrected"
+		condition.Message = fmt.Sprintf("%d object(s) re-applied", len(drifted))
+	}
+	ist.Status.SetCondition(condition)
+}
+
+// re-apply an object installed by istio's helm releases that drifted, a missing object
+// is created again and the rendered fields of a modified object are set again
+func (r *IstioReconciler) CorrectIstioDrift(ctx context.Context, desired *unstructured.Unstructured,
+	live *unstructured.Unstructured, reason string) error {
+	if reason == "Missing" {
+		if err := r.Create(ctx, desired.DeepCopy()); err != nil {
+			return err
+		}
+	} else {
+		live.Object = MergeRenderedFields(live.Object, desired.Object)
+		if err := r.Update(ctx, live); err != nil {
+			return err
+		}
+	}
+	r.Log.Info(fmt.Sprintf("%s %s/%s re-applied", desired.GetKind(), desired.GetNamespace(), desired.GetName()))
+	return nil
+}
+
+// objects rendered by the istio-init and istio (or istio-remote) helm releases of the
+// control plane of istio CR's spec that are checked for drift
+func (r *IstioReconciler) RenderedIstioObjects(spec operatorv1alpha1.IstioSpec) ([]unstructured.Unstructured, error) {
+	var objects []unstructured.Unstructured
+	for _, chartName := range []string{operatorv1alpha1.IstioInitHelmChartName,
+		operatorv1alpha1.IstioHelmChartName, operatorv1alpha1.IstioRemoteHelmChartName} {
+		releaseName := IstioReleaseName(spec, chartName)
+		manifest, err := r.InstallerFor(spec).Manifest(releaseName)
+		if err != nil {
+			if IsHelmReleaseNotFound(err) {
+				// istio is installed in the primary cluster and istio-remote in a remote cluster
+				continue
+			}
+			return nil, err
+		}
+		releaseObjects, err := ParseManifest(manifest)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to parse manifest of %s helm release, %s",
+				releaseName, err.Error()))
+		}
+		for _, object := range releaseObjects {
+			if !istioDriftKinds[object.GetKind()] {
+				continue
+			}
+			// helm installs the namespaced objects without a namespace in the
+			// namespace of the helm release
+			if istioDriftClusterScopedKinds[object.GetKind()] {
+				object.SetNamespace("")
+			} else if object.GetNamespace() == "" {
+				object.SetNamespace(IstioControlPlaneNamespace(spec))
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// parse the kubernetes objects in a multi-document YAML manifest
+func ParseManifest(manifest string) ([]unstructured.Unstructured, error) {
+	var objects []unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	for {
+		object := map[string]interface{}{}
+		if err := decoder.Decode(&object); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, err
+		}
+		if len(object) == 0 {
+			// empty document, for example a template with only comments
+			continue
+		}
+		objects = append(objects, unstructured.Unstructured{Object: object})
+	}
+}
+
+// fields of a rendered object that are not checked for drift because they are set by
+// kubernetes or by istio at runtime
+func istioDriftIgnoredField(path string) bool {
+	switch {
+	case path == "status":
+		return true
+	case strings.HasPrefix(path, "metadata.") && !strings.HasPrefix(path, "metadata.labels") &&
+		!strings.HasPrefix(path, "metadata.annotations"):
+		return true
+	case strings.HasPrefix(path, "webhooks[") && strings.HasSuffix(path, ".clientConfig.caBundle"):
+		// galley and the sidecar injector patch the CA bundle of their webhooks
+		return true
+	}
+	return false
+}
+
+// fields set in the rendered object that differ in the live object. Fields that are
+// only set in the live object (for example defaults set by kubernetes) are ignored.
+func DriftedFields(desired map[string]interface{}, live map[string]interface{}) []string {
+	var fields []string
+	driftedFields("", desired, live, &fields)
+	return fields
+}
+
+func driftedFields(path string, desired interface{}, live interface{}, fields *[]string) {
+	if istioDriftIgnoredField(path) {
+		return
+	}
+	switch desiredValue := desired.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		liveValue, ok := live.(map[string]interface{})
+		if !ok {
+			*fields = append(*fields, path)
+			return
+		}
+		for key, value := range desiredValue {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			driftedFields(fieldPath, value, liveValue[key], fields)
+		}
+	case []interface{}:
+		liveValue, ok := live.([]interface{})
+		if !ok || len(liveValue) != len(desiredValue) {
+			*fields = append(*fields, path)
+			return
+		}
+		for i := range desiredValue {
+			driftedFields(fmt.Sprintf("%s[%d]", path, i), desiredValue[i], liveValue[i], fields)
+		}
+	default:
+		if !scalarsAreEqual(path, desiredValue, live) {
+			*fields = append(*fields, path)
+		}
+	}
+}
+
+// compare scalar values of unstructured objects, numbers are equal if they have the
+// same value even if one is decoded as an integer and the other as a float. Resource
+// quantities are equal if they have the same value (kubernetes stores 1024Mi as 1Gi and
+// 0.5 as 500m) and int-or-string ports are equal to the string of their number.
+func scalarsAreEqual(path string, a interface{}, b interface{}) bool {
+	if isResourceQuantityField(path) {
+		aq, aok := toQuantity(a)
+		bq, bok := toQuantity(b)
+		if aok && bok {
+			return aq.Cmp(bq) == 0
+		}
+	}
+	if isPortField(path) {
+		a, b = portNumber(a), portNumber(b)
+	}
+	if af, ok := toFloat64(a); ok {
+		bf, ok := toFloat64(b)
+		return ok && af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// true if the field is a resource quantity, for example
+// spec.template.spec.containers[0].resources.limits.memory
+func isResourceQuantityField(path string) bool {
+	return strings.Contains("."+path, ".resources.limits.") || strings.Contains("."+path, ".resources.requests.")
+}
+
+// true if the field is a port, for example spec.ports[0].targetPort
+func isPortField(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path[strings.LastIndex(path, ".")+1:]), "port")
+}
+
+// resource quantity of a string or a number
+func toQuantity(value interface{}) (resource.Quantity, bool) {
+	s, ok := value.(string)
+	if !ok {
+		f, ok := toFloat64(value)
+		if !ok {
+			return resource.Quantity{}, false
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	q, err := resource.ParseQuantity(s)
+	return q, err == nil
+}
+
+// number of an int-or-string port whose string is a number, other values are unchanged
+func portNumber(value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		if port, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return port
+		}
+	}
+	return value
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// set the fields of the rendered object in the live object, maps and lists of the same
+// length are merged and other values are replaced by the rendered values. Fields that are
+// not checked for drift keep their live values.
+func MergeRenderedFields(live map[string]interface{}, desired map[string]interface{}) map[string]interface{} {
+	return mergeRenderedFields("", live, desired).(map[string]interface{})
+}
+
+func mergeRenderedFields(path string, live interface{}, desired interface{}) interface{} {
+	if path != "" && live != nil && istioDriftIgnoredField(path) {
+		return live
+	}
+	switch desiredValue := desired.(type) {
+	case map[string]interface{}:
+		liveValue, ok := live.(map[string]interface{})
+		if !ok {
+			return desired
+		}
+		merged := make(map[string]interface{}, len(liveValue))
+		for key, value := range liveValue {
+			merged[key] = value
+		}
+		for key, value := range desiredValue {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			merged[key] = mergeRenderedFields(fieldPath, liveValue[key], value)
+		}
+		return merged
+	case []interface{}:
+		liveValue, ok := live.([]interface{})
+		if !ok || len(liveValue) != len(desiredValue) {
+			return desired
+		}
+		merged := make([]interface{}, len(desiredValue))
+		for i := range desiredValue {
+			merged[i] = mergeRenderedFields(fmt.Sprintf("%s[%d]", path, i), liveValue[i], desiredValue[i])
+		}
+		return merged
+	}
+	return desired
+}
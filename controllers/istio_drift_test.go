@@ -0,0 +1,293 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestDriftedFields(t *testing.T) {
+	desired := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "istio-pilot", "labels": map[string]interface{}{"app": "pilot"}},
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+			"ports":    []interface{}{map[string]interface{}{"port": int64(15010), "targetPort": "15010"}},
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"cpu": "0.5", "memory": "1024Mi"},
+				"limits":   map[string]interface{}{"cpu": int64(1)},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		live     map[string]interface{}
+		expected []string
+	}{
+		{
+			name: "same object",
+			live: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio-pilot", "labels": map[string]interface{}{"app": "pilot"},
+					"resourceVersion": "42", "uid": "b3a5f2c1"},
+				"spec": map[string]interface{}{
+					"replicas": float64(1),
+					"ports": []interface{}{map[string]interface{}{"port": int64(15010),
+						"targetPort": int64(15010), "protocol": "TCP"}},
+					"resources": map[string]interface{}{
+						"requests": map[string]interface{}{"cpu": "500m", "memory": "1Gi"},
+						"limits":   map[string]interface{}{"cpu": "1"},
+					},
+				},
+				"status": map[string]interface{}{"replicas": int64(1)},
+			},
+		},
+		{
+			name: "fields changed",
+			live: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio-pilot", "labels": map[string]interface{}{"app": "x"}},
+				"spec": map[string]interface{}{
+					"replicas": int64(3),
+					"ports":    []interface{}{map[string]interface{}{"port": int64(8080), "targetPort": "http"}},
+					"resources": map[string]interface{}{
+						"requests": map[string]interface{}{"cpu": "250m", "memory": "1000Mi"},
+						"limits":   map[string]interface{}{"cpu": "2"},
+					},
+				},
+			},
+			expected: []string{"metadata.labels.app", "spec.ports[0].port", "spec.ports[0].targetPort",
+				"spec.replicas", "spec.resources.limits.cpu", "spec.resources.requests.cpu",
+				"spec.resources.requests.memory"},
+		},
+		{
+			name: "fields missing",
+			live: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio-pilot"},
+				"spec":     map[string]interface{}{"ports": []interface{}{}},
+			},
+			expected: []string{"metadata.labels", "spec.ports", "spec.replicas", "spec.resources"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := DriftedFields(desired, test.live)
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, fields)
+			}
+		})
+	}
+
+	// the CA bundles of the webhooks are set by istio
+	webhook := map[string]interface{}{"webhooks": []interface{}{map[string]interface{}{
+		"clientConfig": map[string]interface{}{"caBundle": ""}}}}
+	patched := map[string]interface{}{"webhooks": []interface{}{map[string]interface{}{
+		"clientConfig": map[string]interface{}{"caBundle": "LS0tLS1CRUdJTi"}}}}
+	if fields := DriftedFields(webhook, patched); len(fields) != 0 {
+		t.Errorf("CA bundle checked for drift: %v", fields)
+	}
+}
+
+func TestMergeRenderedFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     map[string]interface{}
+		desired  map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name: "rendered fields are set again",
+			live: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio", "resourceVersion": "42"},
+				"data":     map[string]interface{}{"mesh": "mtls: false", "extra": "kept"},
+			},
+			desired: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio"},
+				"data":     map[string]interface{}{"mesh": "mtls: true"},
+			},
+			expected: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "istio", "resourceVersion": "42"},
+				"data":     map[string]interface{}{"mesh": "mtls: true", "extra": "kept"},
+			},
+		},
+		{
+			name: "lists of the same length are merged",
+			live: map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": int64(80), "protocol": "TCP"}}},
+			desired: map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(8080)}}},
+			expected: map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": int64(8080), "protocol": "TCP"}}},
+		},
+		{
+			name: "lists of another length are replaced",
+			live: map[string]interface{}{"ports": []interface{}{
+				map[string]interface{}{"port": int64(80)}, map[string]interface{}{"port": int64(443)}}},
+			desired:  map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(80)}}},
+			expected: map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(80)}}},
+		},
+		{
+			name: "CA bundles keep their live values",
+			live: map[string]interface{}{"webhooks": []interface{}{map[string]interface{}{
+				"clientConfig": map[string]interface{}{"caBundle": "LS0tLS1CRUdJTi"}}}},
+			desired: map[string]interface{}{"webhooks": []interface{}{map[string]interface{}{
+				"clientConfig": map[string]interface{}{"caBundle": ""}}}},
+			expected: map[string]interface{}{"webhooks": []interface{}{map[string]interface{}{
+				"clientConfig": map[string]interface{}{"caBundle": "LS0tLS1CRUdJTi"}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if merged := MergeRenderedFields(test.live, test.desired); !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, merged)
+			}
+			if fields := DriftedFields(test.desired, test.expected); len(fields) != 0 {
+				t.Errorf("merged object drifted: %v", fields)
+			}
+		})
+	}
+}
+
+const testIstioManifest = `---
+# Source: istio/charts/pilot/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: istio
+data:
+  mesh: "mtls: true"
+---
+# Source: istio/charts/pilot/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: istio-pilot
+spec:
+  ports:
+  - port: 15010
+---
+# Source: istio/templates/NOTES.txt
+---
+# Source: istio/charts/pilot/templates/serviceaccount.yaml
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: istio-pilot-service-account
+`
+
+func TestCheckIstioDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  operatorv1alpha1.DriftPolicy
+		mesh    string
+		service bool
+
+		drifted   []operatorv1alpha1.IstioDriftedObject
+		condition corev1.ConditionStatus
+		reason    string
+		// data of istio's ConfigMap after the check
+		liveMesh string
+	}{
+		{
+			name:      "no drift",
+			mesh:      "mtls: true",
+			service:   true,
+			condition: corev1.ConditionFalse,
+			reason:    "NoDrift",
+			liveMesh:  "mtls: true",
+		},
+		{
+			name: "drift reported",
+			mesh: "mtls: false",
+			drifted: []operatorv1alpha1.IstioDriftedObject{
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "istio-system", Name: "istio", Reason: "Modified",
+					Fields: []string{"data.mesh"}},
+				{APIVersion: "v1", Kind: "Service", Namespace: "istio-system", Name: "istio-pilot", Reason: "Missing"},
+			},
+			condition: corev1.ConditionTrue,
+			reason:    "DriftDetected",
+			liveMesh:  "mtls: false",
+		},
+		{
+			name:   "drift corrected",
+			policy: operatorv1alpha1.DriftPolicyCorrect,
+			mesh:   "mtls: false",
+			drifted: []operatorv1alpha1.IstioDriftedObject{
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "istio-system", Name: "istio", Reason: "Modified",
+					Fields: []string{"data.mesh"}, Corrected: true},
+				{APIVersion: "v1", Kind: "Service", Namespace: "istio-system", Name: "istio-pilot", Reason: "Missing",
+					Corrected: true},
+			},
+			condition: corev1.ConditionFalse,
+			reason:    "DriftCorrected",
+			liveMesh:  "mtls: true",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.DriftPolicy = test.policy
+			ist.Spec.CcpIstio.Chart = "istio-1.1.8-ccp1.tgz"
+			// the fake client reads the objects in unstructured objects only with their kind
+			mesh := &corev1.ConfigMap{TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}}
+			mesh.ObjectMeta.Name = "istio"
+			mesh.ObjectMeta.Namespace = "istio-system"
+			mesh.Data = map[string]string{"mesh": test.mesh}
+			service := &corev1.Service{TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "Service"}}
+			service.ObjectMeta.Name = "istio-pilot"
+			service.ObjectMeta.Namespace = "istio-system"
+			service.Spec.Ports = []corev1.ServicePort{{Port: 15010}}
+			objs := []runtime.Object{ist, mesh}
+			if test.service {
+				objs = append(objs, service)
+			}
+			r := fakeIstioReconciler(objs...)
+			helm := r.Helm.(*fakeHelm)
+			helm.Install(HelmRelease{Name: "istio", Namespace: "istio-system", Chart: ist.Spec.CcpIstio.Chart})
+			helm.manifests[ist.Spec.CcpIstio.Chart] = testIstioManifest
+
+			ctx := context.TODO()
+			if err := r.CheckIstioDrift(ctx, ist); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ist.Status.Drift.Objects, test.drifted) {
+				t.Errorf("expected drifted objects %+v, got %+v", test.drifted, ist.Status.Drift.Objects)
+			}
+			condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionDrifted)
+			if condition == nil || condition.Status != test.condition || condition.Reason != test.reason {
+				t.Errorf("expected condition %s %s, got %+v", test.condition, test.reason, condition)
+			}
+			live := &corev1.ConfigMap{}
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "istio-system", Name: "istio"}, live); err != nil {
+				t.Fatal(err)
+			}
+			if live.Data["mesh"] != test.liveMesh {
+				t.Errorf("expected mesh %q, got %q", test.liveMesh, live.Data["mesh"])
+			}
+			err := r.Get(ctx, types.NamespacedName{Namespace: "istio-system", Name: "istio-pilot"}, service)
+			if exists := err == nil; exists != (test.service || test.policy == operatorv1alpha1.DriftPolicyCorrect) {
+				t.Errorf("Service istio-pilot exists: %v", exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// time to wait before the next step of an operation on istio runs
+	istioOperationStepInterval = 1 * time.Second
+	// time to wait before a step waiting for istio's pods and jobs checks them again,
+	// the step is also run when istio's pods and jobs change
+	istioOperationPollInterval = 5 * time.Second
+)
+
+// steps of each operation on istio in the order they run, the name of a step is
+// the status of istio CR while the step runs
+var istioOperationSteps = map[operatorv1alpha1.IstioOperationType][]string{
+	operatorv1alpha1.IstioOperationInstall: {
+		"SnapshottingIstioConfig",
+		"CleaningIstioPreinstall",
+		"WaitingForIstioCleanup",
+		"InstallingIstioInit",
+		"WaitingForIstioInit",
+		"InstallingIstio",
+		"PostInstallChecks",
+		"RestoringIstioConfig",
+		"RollingOutDataPlane",
+	},
+	operatorv1alpha1.IstioOperationUpgrade: {
+		"UpgradingIstioInit",
+		"WaitingForIstioInit",
+		"UpgradingIstio",
+		"PostInstallChecks",
+		"RestoringIstioConfig",
+		"RollingOutDataPlane",
+	},
+	// the new control plane is installed next to the old one, which keeps running until
+	// all the namespaces are moved to the new control plane
+	operatorv1alpha1.IstioOperationCanaryUpgrade: {
+		"CleaningIstioPreinstall",
+		"WaitingForIstioCleanup",
+		"InstallingIstioInit",
+		"WaitingForIstioInit",
+		"InstallingIstio",
+		"PostInstallChecks",
+		"MovingNamespaces",
+		"DeletingOldControlPlane",
+		"WaitingForOldControlPlaneCleanup",
+	},
+}
+
+// steps that wait for istio's pods and jobs, they run until istio's pods and jobs
+// reach the expected state or until TimeoutInternal seconds have passed
+var istioOperationWaitSteps = map[string]bool{
+	"WaitingForIstioCleanup":           true,
+	"WaitingForIstioInit":              true,
+	"PostInstallChecks":                true,
+	"MovingNamespaces":                 true,
+	"WaitingForOldControlPlaneCleanup": true,
+	"RollingOutDataPlane":              true,
+}
+
+// status of istio CR when a step of an operation on istio fails
+var istioOperationStepFailedStatuses = map[string]string{
+	"SnapshottingIstioConfig": "IstioConfigSnapshotFailed",
+	"CleaningIstioPreinstall": "PreinstallCleanupFailed",
+	"WaitingForIstioCleanup":  "PreinstallCleanupFailed",
+	"InstallingIstioInit":     "InstallationFailed",
+	"InstallingIstio":         "InstallationFailed",
+	"UpgradingIstioInit":      "UpgradeFailed",
+	"UpgradingIstio":          "UpgradeFailed",
+	"PostInstallChecks":       "PostInstallChecksFailed",
+	"RestoringIstioConfig":    "IstioConfigRestoreFailed",
+	"RollingOutDataPlane":     "DataPlaneRolloutFailed",
+}
+
+// status of istio CR when a step of an operation on istio fails
+func istioOperationStepFailedStatus(operationType operatorv1alpha1.IstioOperationType, step string) string {
+	if operationType == operatorv1alpha1.IstioOperationCanaryUpgrade {
+		return "CanaryUpgradeFailed"
+	}
+	if step == "WaitingForIstioInit" {
+		if operationType == operatorv1alpha1.IstioOperationUpgrade {
+			return "UpgradeFailed"
+		}
+		return "InstallationFailed"
+	}
+	return istioOperationStepFailedStatuses[step]
+}
+
+// start a new operation to apply istio CR's spec and save it in istio CR's status.
+// Istio is upgraded in place if it is installed and the upgrade strategy is not
+// Reinstall, otherwise istio is deleted if it exists and installed. Istio is installed
+// again if the cluster changes from the primary cluster to a remote cluster of a
+// multi-cluster mesh or the other way around. With the Canary upgrade strategy, a new
+// control plane is installed when the revision of the new version differs from the
+// revision of the installed control plane.
+func (r *IstioReconciler) StartIstioOperation(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	operationType := operatorv1alpha1.IstioOperationInstall
+	if ist.Spec.UpgradeStrategy != operatorv1alpha1.UpgradeStrategyReinstall && r.IstioIsInstalled(IstioInstalledSpec(ist)) {
+		operationType = operatorv1alpha1.IstioOperationUpgrade
+		if ist.Spec.UpgradeStrategy == operatorv1alpha1.UpgradeStrategyCanary &&
+			IstioCanaryControlPlane(ist.Spec) != IstioInstalledControlPlane(ist) {
+			operationType = operatorv1alpha1.IstioOperationCanaryUpgrade
+		}
+	}
+	ist.Status.Operation = &operatorv1alpha1.IstioOperation{
+		Type:       operationType,
+		Generation: ist.ObjectMeta.Generation,
+		StartTime:  v1.Now(),
+	}
+	if operationType == operatorv1alpha1.IstioOperationCanaryUpgrade {
+		if err := r.PlanIstioCanaryUpgrade(ctx, ist); err != nil {
+			return err
+		}
+	}
+	if err := r.SaveIstioOperation(ctx, ist); err != nil {
+		return err
+	}
+	r.Log.Info(fmt.Sprintf("started %s of istio for generation %d of Istio CR %s", operationType,
+		ist.ObjectMeta.Generation, ist.ObjectMeta.Name))
+	return nil
+}
+
+// run the next step of the operation in istio CR's status that has not completed yet.
+// The step is saved in istio CR's status before it runs, so if the istio operator
+// restarts during a step, the operation is resumed from that step. Only one step runs
+// in a reconcile, the reconcile is requeued to run the next step so that the worker is
+// never blocked and istio CR's updates and deletion are handled while istio is being
+// installed or upgraded. A partial install of istio that was interrupted or failed is
+// rolled back (deleted) before istio is installed again.
+func (r *IstioReconciler) RunIstioOperation(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec, workspace string) (ctrl.Result, error) {
+	operation := ist.Status.Operation
+	for _, step := range istioOperationSteps[operation.Type] {
+		if containsString(operation.CompletedSteps, step) {
+			continue
+		}
+
+		// a step that was started before is run again if it was interrupted or if it
+		// failed, steps waiting for istio's pods and jobs and pending steps are run until
+		// they complete
+		retried := step == operation.Step && (istioFailedStatuses[ist.Status.Active] ||
+			!(istioOperationWaitSteps[step] || operation.StepPending))
+		if retried && (step == "InstallingIstioInit" || step == "InstallingIstio") {
+			return r.RollbackIstioInstall(ctx, ist)
+		}
+		if step != operation.Step || retried {
+			if retried {
+				operation.Resumes++
+				r.Log.Info(fmt.Sprintf("running step %s of %s of istio again", step, operation.Type))
+			}
+			now := v1.Now()
+			operation.Step = step
+			operation.StepStartTime = &now
+			operation.StepPending = false
+			if err := r.UpdateIstioCRStatus(ctx, ist, step, nil); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+
+		done, err := r.RunIstioOperationStep(ctx, ist, spec, workspace, step)
+		if err != nil {
+			failedStatus := istioOperationStepFailedStatus(operation.Type, step)
+			r.UpdateIstioCRStatus(ctx, ist, failedStatus, err)
+			r.Log.Error(err, failedStatus)
+			if ShouldRollbackIstio(ist) {
+				// roll back istio to the last revision that was installed successfully
+				if err := r.StartIstioRollback(ctx, ist, err); err != nil {
+					return ctrl.Result{}, err
+				}
+				return ctrl.Result{RequeueAfter: istioOperationStepInterval}, nil
+			}
+			// the reconcile is requeued with a backoff and the step, waiting steps
+			// included, is run again
+			return ctrl.Result{}, err
+		}
+		if !done {
+			// a step that applies istio's objects is pending until they can be applied, it
+			// resumes where it stopped when it runs again
+			if !istioOperationWaitSteps[step] && !operation.StepPending {
+				operation.StepPending = true
+				if err := r.SaveIstioOperation(ctx, ist); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			return ctrl.Result{RequeueAfter: istioOperationPollInterval}, nil
+		}
+		operation.CompletedSteps = append(operation.CompletedSteps, step)
+		operation.StepPending = false
+		if err := r.SaveIstioOperation(ctx, ist); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Log.Info(fmt.Sprintf("step %s of %s of istio completed", step, operation.Type))
+		return ctrl.Result{RequeueAfter: istioOperationStepInterval}, nil
+	}
+
+	// istio CR's spec is applied, ObservedGeneration is updated only now so that an
+	// operation that did not complete is never mistaken for an applied spec
+	// the version of istio is the version of the chart in its Chart.yaml, the chart's file
+	// name is used only if its Chart.yaml cannot be read as the file name may not have it
+	chartLocation, _ := ParseChartReference(IstioControlPlaneChart(spec))
+	istioVersion := strings.Split(chartLocation, "/")
+	ist.Status.Version = istioVersion[len(istioVersion)-1]
+	ist.Status.AppVersion = ""
+	chart := IstioReleaseChart(workspace, IstioControlPlaneChartName(spec), IstioControlPlaneChart(spec))
+	if metadata, err := ReadChartMetadata(chart); err == nil {
+		if metadata.Version != "" {
+			ist.Status.Version = metadata.Version
+		}
+		ist.Status.AppVersion = metadata.AppVersion
+	} else {
+		r.Log.Info(fmt.Sprintf("version of istio not found in its chart, %s", err.Error()))
+	}
+	// the charts are watched for changes on disk from now on
+	installedCharts, err := InstalledIstioCharts(spec)
+	if err != nil {
+		r.Log.Error(err, "failed to record the charts installed by istio CR")
+	}
+	RecordInstalledIstioCharts(ist, installedCharts)
+	ist.Status.ObservedGeneration = operation.Generation
+	ist.Status.Operation = nil
+	if operation.Type == operatorv1alpha1.IstioOperationCanaryUpgrade {
+		// the control plane installed by the canary upgrade replaced the old one
+		controlPlane := spec.ControlPlane
+		ist.Status.ControlPlane = &controlPlane
+	}
+	if operation.Revision != 0 {
+		// istio was rolled back to an earlier revision after an operation on istio failed,
+		// the failed generation is not applied again until istio CR is updated
+		r.Log.Info(fmt.Sprintf("istio rolled back to revision %d for Istio CR %s", operation.Revision,
+			ist.ObjectMeta.Name))
+		ist.Status.CurrentRevision = operation.Revision
+		return ctrl.Result{}, r.UpdateIstioCRStatus(ctx, ist, "IstioRolledBack",
+			errors.New(operation.RollbackReason))
+	}
+	r.Log.Info(fmt.Sprintf("%s of istio for generation %d of Istio CR %s completed", operation.Type,
+		operation.Generation, ist.ObjectMeta.Name))
+	RecordIstioRevision(ist, spec, operation.Generation)
+	return ctrl.Result{}, r.UpdateIstioCRStatus(ctx, ist, "IstioInstalledActive", nil)
+}
+
+// roll back a partial install of istio by running the steps of the install again from
+// the step that deletes istio, the snapshot of istio's custom resources is kept
+func (r *IstioReconciler) RollbackIstioInstall(ctx context.Context,
+	ist *operatorv1alpha1.Istio) (ctrl.Result, error) {
+	operation := ist.Status.Operation
+	r.Log.Info(fmt.Sprintf("step %s of %s of istio was interrupted or failed, deleting istio "+
+		"partially installed and installing istio again", operation.Step, operation.Type))
+	var completedSteps []string
+	for _, step := range operation.CompletedSteps {
+		if step == "CleaningIstioPreinstall" {
+			break
+		}
+		completedSteps = append(completedSteps, step)
+	}
+	operation.CompletedSteps = completedSteps
+	operation.Step = ""
+	operation.StepStartTime = nil
+	operation.StepPending = false
+	operation.Resumes++
+	if err := r.SaveIstioOperation(ctx, ist); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: istioOperationStepInterval}, nil
+}
+
+// run one step of an operation on istio, returns true if the step completed and false
+// if the step is waiting for istio's pods or jobs and needs to run again
+func (r *IstioReconciler) RunIstioOperationStep(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec, workspace string, step string) (bool, error) {
+	switch step {
+	case "SnapshottingIstioConfig":
+		// snapshot istio's custom resources before istio is deleted so that
+		// they can be restored after istio is installed again
+		_, err := r.SnapshotIstioConfig(ctx, ist)
+		return err == nil, err
+	case "CleaningIstioPreinstall":
+		// delete istio if it already exists, istio's CRDs are not deleted so
+		// that istio's custom resources created by users are not deleted
+		r.Log.Info("deleting istio if it already exists.")
+		err := r.DeleteIstio(spec, false)
+		return err == nil, err
+	case "WaitingForIstioCleanup":
+		// wait until all istio's pods and jobs are deleted before installing istio
+		deleted, err := r.IstioPodsAndJobsAreDeleted(ctx, IstioControlPlaneNamespace(spec))
+		if err != nil || deleted {
+			return deleted, err
+		}
+		return false, r.CheckIstioOperationStepTimeout(ist, "istio's pods and jobs were not deleted")
+	case "InstallingIstioInit":
+		err := r.InstallerFor(spec).Install(r.IstioHelmRelease(spec, operatorv1alpha1.IstioInitHelmChartName,
+			spec.CcpIstioInit.Chart, spec.CcpIstioInit.Values, workspace))
+		if err == nil {
+			r.Log.Info(fmt.Sprintf("%s helm chart installed", operatorv1alpha1.IstioInitHelmChartName))
+		}
+		return r.IstioInstallStepDone(ist, err)
+	case "UpgradingIstioInit":
+		// istio-init's jobs that create istio's CRDs cannot be patched by helm, delete
+		// them so that helm re-creates them when istio-init is upgraded. They were deleted
+		// already when the upgrade is pending.
+		if !ist.Status.Operation.StepPending {
+			if err := r.DeleteIstioJobs(IstioControlPlaneNamespace(spec)); err != nil {
+				return false, err
+			}
+		}
+		err := r.InstallerFor(spec).Upgrade(r.IstioHelmRelease(spec, operatorv1alpha1.IstioInitHelmChartName,
+			spec.CcpIstioInit.Chart, spec.CcpIstioInit.Values, workspace))
+		if err == nil {
+			r.Log.Info(fmt.Sprintf("%s helm chart upgraded", operatorv1alpha1.IstioInitHelmChartName))
+		}
+		return r.IstioInstallStepDone(ist, err)
+	case "WaitingForIstioInit", "PostInstallChecks":
+		// wait until istio-init's jobs complete (istio's CRDs are created) before istio
+		// is installed or upgraded, and until all istio's pods are ready after
+		ready, err := r.IstioPodsAreReady(ctx, IstioControlPlaneNamespace(spec))
+		if err != nil || ready {
+			return ready, err
+		}
+		return false, r.CheckIstioOperationStepTimeout(ist, "istio pod(s) did not reach Running and "+
+			"Ready state or Completed state")
+	case "InstallingIstio":
+		// install istio in the primary cluster or istio-remote in a remote cluster
+		err := r.InstallerFor(spec).Install(r.IstioControlPlaneHelmRelease(spec, workspace))
+		if err == nil {
+			r.Log.Info(fmt.Sprintf("%s helm chart installed", IstioControlPlaneChartName(spec)))
+		}
+		return r.IstioInstallStepDone(ist, err)
+	case "UpgradingIstio":
+		// upgrade istio (or istio-remote) helm release in place so that the control
+		// plane keeps running while istio's configuration is updated. helm upgrade is
+		// idempotent, an interrupted upgrade is run again.
+		err := r.InstallerFor(spec).Upgrade(r.IstioControlPlaneHelmRelease(spec, workspace))
+		if err == nil {
+			r.Log.Info(fmt.Sprintf("%s helm chart upgraded", IstioControlPlaneChartName(spec)))
+		}
+		return r.IstioInstallStepDone(ist, err)
+	case "MovingNamespaces":
+		// move the namespaces to the new control plane one batch at a time
+		return r.MoveIstioNamespaces(ctx, ist)
+	case "DeletingOldControlPlane":
+		// delete the old control plane once no namespace uses it, istio's CRDs are kept
+		r.Log.Info(fmt.Sprintf("deleting the old control plane of istio in %s", ist.Status.Canary.From.Namespace))
+		err := r.DeleteIstio(IstioSpecWithControlPlane(spec, ist.Status.Canary.From), false)
+		return err == nil, err
+	case "WaitingForOldControlPlaneCleanup":
+		fromNamespace := IstioControlPlaneNamespace(IstioSpecWithControlPlane(spec, ist.Status.Canary.From))
+		deleted, err := r.IstioPodsAndJobsAreDeleted(ctx, fromNamespace)
+		if err != nil || deleted {
+			return deleted, err
+		}
+		return false, r.CheckIstioOperationStepTimeout(ist, "pods and jobs of the old control plane of istio "+
+			"were not deleted")
+	case "RollingOutDataPlane":
+		// restart the workloads using istio's control plane one batch at a time so that
+		// they get the sidecar of the version of istio installed
+		return r.RollOutIstioDataPlane(ctx, ist, spec)
+	case "RestoringIstioConfig":
+		// restore istio's custom resources in the snapshot that were deleted
+		restoreStatus, err := r.RestoreIstioConfig(ctx, ist)
+		if restoreStatus != nil {
+			ist.Status.ConfigRestore = restoreStatus
+		}
+		if err == nil && restoreStatus != nil && len(restoreStatus.Failed) != 0 {
+			err = errors.New(fmt.Sprintf("failed to restore istio custom resources: %s",
+				strings.Join(restoreStatus.Failed, ", ")))
+		}
+		return err == nil, err
+	}
+	return false, errors.New(fmt.Sprintf("unknown step %s of istio %s", step, ist.Status.Operation.Type))
+}
+
+// result of a step that installs or upgrades a helm release, a step whose objects cannot
+// be applied yet is not done and fails when it is pending for more than TimeoutInternal
+// seconds
+func (r *IstioReconciler) IstioInstallStepDone(ist *operatorv1alpha1.Istio, err error) (bool, error) {
+	if IsInstallPending(err) {
+		return false, r.CheckIstioOperationStepTimeout(ist, err.Error())
+	}
+	return err == nil, err
+}
+
+// return an error if the running step of the operation on istio has been running for
+// more than TimeoutInternal seconds
+func (r *IstioReconciler) CheckIstioOperationStepTimeout(ist *operatorv1alpha1.Istio, reason string) error {
+	operation := ist.Status.Operation
+	if operation.StepStartTime == nil ||
+		time.Since(operation.StepStartTime.Time) < operatorv1alpha1.TimeoutInternal*time.Second {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("step %s of %s of istio timed out after %d seconds and failed, %s",
+		operation.Step, operation.Type, operatorv1alpha1.TimeoutInternal, reason))
+}
+
+// save the operation on istio in istio CR's status
+func (r *IstioReconciler) SaveIstioOperation(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	if err := r.Status().Update(ctx, ist); err != nil {
+		return errors.New(fmt.Sprintf("failed to save %s of istio in Istio CR %s status, %s",
+			ist.Status.Operation.Type, ist.ObjectMeta.Name, err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestIstioOperationStepFailedStatus(t *testing.T) {
+	tests := []struct {
+		operation operatorv1alpha1.IstioOperationType
+		step      string
+		expected  string
+	}{
+		{operatorv1alpha1.IstioOperationInstall, "SnapshottingIstioConfig", "IstioConfigSnapshotFailed"},
+		{operatorv1alpha1.IstioOperationInstall, "WaitingForIstioCleanup", "PreinstallCleanupFailed"},
+		{operatorv1alpha1.IstioOperationInstall, "WaitingForIstioInit", "InstallationFailed"},
+		{operatorv1alpha1.IstioOperationUpgrade, "WaitingForIstioInit", "UpgradeFailed"},
+		{operatorv1alpha1.IstioOperationUpgrade, "UpgradingIstio", "UpgradeFailed"},
+		{operatorv1alpha1.IstioOperationUpgrade, "RollingOutDataPlane", "DataPlaneRolloutFailed"},
+		{operatorv1alpha1.IstioOperationCanaryUpgrade, "InstallingIstio", "CanaryUpgradeFailed"},
+		{operatorv1alpha1.IstioOperationCanaryUpgrade, "MovingNamespaces", "CanaryUpgradeFailed"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.operation)+"/"+test.step, func(t *testing.T) {
+			if status := istioOperationStepFailedStatus(test.operation, test.step); status != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, status)
+			}
+		})
+	}
+
+	// every step of every operation fails with a failed status of istio CR
+	for operationType, steps := range istioOperationSteps {
+		for _, step := range steps {
+			if !istioFailedStatuses[istioOperationStepFailedStatus(operationType, step)] {
+				t.Errorf("step %s of %s has no failed status", step, operationType)
+			}
+		}
+	}
+}
+
+// pod of istio's control plane in istio-system, ready or not
+func testIstioPod(name string, ready bool) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Name = name
+	pod.ObjectMeta.Namespace = "istio-system"
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "discovery", Ready: ready,
+		State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}
+	return pod
+}
+
+func TestRunIstioOperation(t *testing.T) {
+	install := []string{"SnapshottingIstioConfig", "CleaningIstioPreinstall", "WaitingForIstioCleanup"}
+	timedOut := v1.NewTime(time.Now().Add(-2 * operatorv1alpha1.TimeoutInternal * time.Second))
+	tests := []struct {
+		name      string
+		operation operatorv1alpha1.IstioOperation
+		// status.active of istio CR
+		status string
+		// helm releases installed
+		releases []string
+		// helm releases whose install or upgrade is pending
+		pending []string
+		objects []runtime.Object
+
+		result         ctrl.Result
+		err            bool
+		ops            []string
+		step           string
+		completedSteps []string
+		resumes        int32
+		finalStatus    string
+		stepPending    bool
+	}{
+		{
+			name: "runs the next step",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: install},
+			result:         ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			ops:            []string{"install istio-init"},
+			step:           "InstallingIstioInit",
+			completedSteps: append(install, "InstallingIstioInit"),
+			finalStatus:    "InstallingIstioInit",
+		},
+		{
+			name: "rolls back an interrupted install step",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit"), Step: "InstallingIstio"},
+			status:         "InstallingIstio",
+			releases:       []string{"istio-init"},
+			result:         ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			completedSteps: []string{"SnapshottingIstioConfig"},
+			resumes:        1,
+			finalStatus:    "InstallingIstio",
+		},
+		{
+			name: "runs an interrupted upgrade step again",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationUpgrade,
+				CompletedSteps: []string{"UpgradingIstioInit", "WaitingForIstioInit"}, Step: "UpgradingIstio"},
+			status:   "UpgradingIstio",
+			releases: []string{"istio-init", "istio"},
+			result:   ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			ops:      []string{"upgrade istio"},
+			step:     "UpgradingIstio",
+			completedSteps: []string{"UpgradingIstioInit", "WaitingForIstioInit",
+				"UpgradingIstio"},
+			resumes:     1,
+			finalStatus: "UpgradingIstio",
+		},
+		{
+			name: "waits for istio's pods",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit"), Step: "WaitingForIstioInit"},
+			status:         "WaitingForIstioInit",
+			objects:        []runtime.Object{testIstioPod("istio-pilot", true), testIstioPod("istio-policy", false)},
+			result:         ctrl.Result{RequeueAfter: istioOperationPollInterval},
+			step:           "WaitingForIstioInit",
+			completedSteps: append(install, "InstallingIstioInit"),
+			finalStatus:    "WaitingForIstioInit",
+		},
+		{
+			name: "completes a waiting step when istio's pods are ready",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit"), Step: "WaitingForIstioInit"},
+			status:         "WaitingForIstioInit",
+			objects:        []runtime.Object{testIstioPod("istio-pilot", true)},
+			result:         ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			step:           "WaitingForIstioInit",
+			completedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit"),
+			finalStatus:    "WaitingForIstioInit",
+		},
+		{
+			name: "fails a waiting step that timed out",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit"), Step: "WaitingForIstioInit",
+				StepStartTime: &timedOut},
+			status:         "WaitingForIstioInit",
+			objects:        []runtime.Object{testIstioPod("istio-pilot", false)},
+			err:            true,
+			step:           "WaitingForIstioInit",
+			completedSteps: append(install, "InstallingIstioInit"),
+			finalStatus:    "InstallationFailed",
+		},
+		{
+			name: "runs a failed waiting step again",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit"), Step: "WaitingForIstioInit",
+				StepStartTime: &timedOut},
+			status:         "InstallationFailed",
+			objects:        []runtime.Object{testIstioPod("istio-pilot", true)},
+			result:         ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			step:           "WaitingForIstioInit",
+			completedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit"),
+			resumes:        1,
+			finalStatus:    "WaitingForIstioInit",
+		},
+		{
+			name: "marks a step pending when its objects cannot be applied yet",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: install},
+			pending:        []string{"istio-init"},
+			result:         ctrl.Result{RequeueAfter: istioOperationPollInterval},
+			ops:            []string{"install istio-init"},
+			step:           "InstallingIstioInit",
+			completedSteps: install,
+			finalStatus:    "InstallingIstioInit",
+			stepPending:    true,
+		},
+		{
+			name: "resumes a pending install step instead of rolling it back",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit"), Step: "InstallingIstio",
+				StepPending: true},
+			status:         "InstallingIstio",
+			releases:       []string{"istio-init"},
+			result:         ctrl.Result{RequeueAfter: istioOperationStepInterval},
+			ops:            []string{"install istio"},
+			step:           "InstallingIstio",
+			completedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit", "InstallingIstio"),
+			finalStatus:    "InstallingIstio",
+		},
+		{
+			name: "fails a pending step that timed out",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationUpgrade,
+				CompletedSteps: []string{"UpgradingIstioInit", "WaitingForIstioInit"}, Step: "UpgradingIstio",
+				StepStartTime: &timedOut, StepPending: true},
+			status:         "UpgradingIstio",
+			releases:       []string{"istio-init", "istio"},
+			pending:        []string{"istio"},
+			err:            true,
+			ops:            []string{"upgrade istio"},
+			step:           "UpgradingIstio",
+			completedSteps: []string{"UpgradingIstioInit", "WaitingForIstioInit"},
+			finalStatus:    "UpgradeFailed",
+			stepPending:    true,
+		},
+		{
+			name: "fails a step",
+			operation: operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationInstall,
+				CompletedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit")},
+			releases:       []string{"istio-init", "istio"},
+			err:            true,
+			ops:            []string{"install istio"},
+			step:           "InstallingIstio",
+			completedSteps: append(install, "InstallingIstioInit", "WaitingForIstioInit"),
+			finalStatus:    "InstallationFailed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			operation := test.operation
+			operation.CompletedSteps = append([]string{}, operation.CompletedSteps...)
+			ist.Status.Operation = &operation
+			ist.Status.Active = test.status
+			r := fakeIstioReconciler(append(test.objects, ist)...)
+			helm := r.Helm.(*fakeHelm)
+			for _, name := range test.releases {
+				helm.Install(HelmRelease{Name: name, Namespace: "istio-system", Chart: name + "-1.1.8-ccp1.tgz"})
+			}
+			helm.ops = nil
+			helm.pending = map[string]bool{}
+			for _, name := range test.pending {
+				helm.pending[name] = true
+			}
+
+			result, err := r.RunIstioOperation(context.TODO(), ist, ist.Spec, "")
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if result != test.result {
+				t.Errorf("expected result %+v, got %+v", test.result, result)
+			}
+			if !reflect.DeepEqual(helm.ops, test.ops) {
+				t.Errorf("expected helm operations %v, got %v", test.ops, helm.ops)
+			}
+			if operation.Step != test.step {
+				t.Errorf("expected step %q, got %q", test.step, operation.Step)
+			}
+			if !reflect.DeepEqual(operation.CompletedSteps, test.completedSteps) {
+				t.Errorf("expected completed steps %v, got %v", test.completedSteps, operation.CompletedSteps)
+			}
+			if operation.Resumes != test.resumes {
+				t.Errorf("expected %d resumes, got %d", test.resumes, operation.Resumes)
+			}
+			if operation.StepPending != test.stepPending {
+				t.Errorf("expected step pending %v, got %v", test.stepPending, operation.StepPending)
+			}
+			if ist.Status.Active != test.finalStatus {
+				t.Errorf("expected status %q, got %q", test.finalStatus, ist.Status.Active)
+			}
+		})
+	}
+}
+
+func TestApplyIstioSpecChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy operatorv1alpha1.UpgradeStrategy
+		// helm releases installed before the spec changes
+		releases  []string
+		operation operatorv1alpha1.IstioOperationType
+		ops       []string
+	}{
+		{
+			name:      "upgrades istio in place",
+			releases:  []string{"istio-init", "istio"},
+			operation: operatorv1alpha1.IstioOperationUpgrade,
+			ops:       []string{"upgrade istio-init", "upgrade istio"},
+		},
+		{
+			name:      "upgrades istio in place with the Upgrade strategy",
+			strategy:  operatorv1alpha1.UpgradeStrategyUpgrade,
+			releases:  []string{"istio-init", "istio"},
+			operation: operatorv1alpha1.IstioOperationUpgrade,
+			ops:       []string{"upgrade istio-init", "upgrade istio"},
+		},
+		{
+			name:      "reinstalls istio with the Reinstall strategy",
+			strategy:  operatorv1alpha1.UpgradeStrategyReinstall,
+			releases:  []string{"istio-init", "istio"},
+			operation: operatorv1alpha1.IstioOperationInstall,
+			ops: []string{"uninstall istio", "uninstall istio-remote", "uninstall istio-init", "install istio-init",
+				"install istio"},
+		},
+		{
+			name:      "installs istio that is not installed",
+			releases:  []string{"istio-init"},
+			operation: operatorv1alpha1.IstioOperationInstall,
+			ops: []string{"uninstall istio", "uninstall istio-remote", "uninstall istio-init", "install istio-init",
+				"install istio"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.ObjectMeta.Generation = 2
+			ist.Spec.UpgradeStrategy = test.strategy
+			ist.Spec.CcpIstioInit.Chart = "/charts/istio-init-1.1.8-ccp1.tgz"
+			ist.Spec.CcpIstio.Chart = "/charts/istio-1.1.8-ccp1.tgz"
+			r := fakeIstioReconciler(ist)
+			helm := r.Helm.(*fakeHelm)
+			for _, name := range test.releases {
+				helm.Install(HelmRelease{Name: name, Namespace: "istio-system", Chart: name + "-1.1.3-ccp1.tgz"})
+			}
+			helm.ops = nil
+
+			if err := r.StartIstioOperation(context.TODO(), ist); err != nil {
+				t.Fatal(err)
+			}
+			if ist.Status.Operation.Type != test.operation {
+				t.Fatalf("expected %s, got %s", test.operation, ist.Status.Operation.Type)
+			}
+			// the snapshot of istio's custom resources lists the CRDs of the cluster, which
+			// the fake client cannot do
+			ist.Status.Operation.CompletedSteps = []string{"SnapshottingIstioConfig"}
+			// the steps of the operation run one per reconcile until the operation completes
+			for i := 0; ist.Status.Operation != nil; i++ {
+				if i > 2*len(istioOperationSteps[test.operation]) {
+					t.Fatalf("%s did not complete, step %s", test.operation, ist.Status.Operation.Step)
+				}
+				if _, err := r.RunIstioOperation(context.TODO(), ist, ist.Spec, ""); err != nil {
+					t.Fatalf("step %s failed, %v", ist.Status.Operation.Step, err)
+				}
+			}
+			if !reflect.DeepEqual(helm.ops, test.ops) {
+				t.Errorf("expected helm operations %v, got %v", test.ops, helm.ops)
+			}
+			if ist.Status.Active != "IstioInstalledActive" || ist.Status.ObservedGeneration != 2 {
+				t.Errorf("expected generation 2 applied, got status %q and generation %d", ist.Status.Active,
+					ist.Status.ObservedGeneration)
+			}
+		})
+	}
+}
+
+func TestIstioOperationStatusVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the file name of the chart does not have the version of istio
+	chart := writeTestChartArchive(t, dir, "istio.tgz", "istio",
+		"apiVersion: v1\nname: istio\nversion: 1.1.8-ccp2\nappVersion: 1.1.8\n")
+	tests := []struct {
+		name       string
+		chart      string
+		version    string
+		appVersion string
+	}{
+		{name: "version of the chart", chart: chart, version: "1.1.8-ccp2", appVersion: "1.1.8"},
+		{name: "file name of a chart that cannot be read", chart: filepath.Join(dir, "istio-1.1.8-ccp1.tgz"),
+			version: "istio-1.1.8-ccp1.tgz"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.CcpIstioInit.Chart = filepath.Join(dir, "istio-init.tgz")
+			ist.Spec.CcpIstio.Chart = test.chart
+			r := fakeIstioReconciler(ist)
+			if err := r.StartIstioOperation(context.TODO(), ist); err != nil {
+				t.Fatal(err)
+			}
+			ist.Status.Operation.CompletedSteps = []string{"SnapshottingIstioConfig"}
+			for i := 0; ist.Status.Operation != nil; i++ {
+				if i > 2*len(istioOperationSteps[operatorv1alpha1.IstioOperationInstall]) {
+					t.Fatalf("install did not complete, step %s", ist.Status.Operation.Step)
+				}
+				if _, err := r.RunIstioOperation(context.TODO(), ist, ist.Spec, ""); err != nil {
+					t.Fatalf("step %s failed, %v", ist.Status.Operation.Step, err)
+				}
+			}
+			if ist.Status.Version != test.version || ist.Status.AppVersion != test.appVersion {
+				t.Errorf("expected version %q and appVersion %q, got %q and %q", test.version, test.appVersion,
+					ist.Status.Version, ist.Status.AppVersion)
+			}
+			if n := len(ist.Status.Revisions); n == 0 || ist.Status.Revisions[n-1].Version != test.version {
+				t.Errorf("expected revision of version %q, got revisions %+v", test.version, ist.Status.Revisions)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// interval between two scans of CHARTS_PATH if IstioReleaseCatalog.Interval is not set
+const DefaultIstioReleaseScanInterval = time.Minute
+
+// Chart.yaml larger than this is not a Chart.yaml of istio's charts
+const maxChartMetadataSize = 1 << 20
+
+// charts of istio's releases, the istio-init chart is paired with the istio and
+// istio-remote charts of the same release
+var istioReleaseChartNames = []string{
+	operatorv1alpha1.IstioInitHelmChartName,
+	operatorv1alpha1.IstioHelmChartName,
+	operatorv1alpha1.IstioRemoteHelmChartName,
+}
+
+// IstioChartMetadata defines the fields of a chart's Chart.yaml used by istio operator
+type IstioChartMetadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion,omitempty"`
+	Deprecated bool   `json:"deprecated,omitempty"`
+	// annotations of the chart, IstioChartControlPlanesAnnotation marks the charts
+	// that can install a control plane next to others
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IstioReleaseCatalog keeps an IstioRelease for each release of istio in CHARTS_PATH, it
+// scans CHARTS_PATH when the manager starts and every Interval after that
+type IstioReleaseCatalog struct {
+	client.Client
+	Log logr.Logger
+	// directory of istio's charts, the catalog is not kept if it is not set
+	ChartsPath string
+	// interval between two scans of CHARTS_PATH, DefaultIstioReleaseScanInterval if not set
+	Interval time.Duration
+}
+
+// +kubebuilder:rbac:groups=operator.ccp.cisco.com,resources=istioreleases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=operator.ccp.cisco.com,resources=istioreleases/status,verbs=get;update;patch
+
+// Start scans CHARTS_PATH until stop is closed, it is run by the manager
+func (c *IstioReleaseCatalog) Start(stop <-chan struct{}) error {
+	if c.ChartsPath == "" {
+		c.Log.Info("environment variable CHARTS_PATH not set, the catalog of istio releases is not kept")
+		// the manager stops when a runnable returns
+		<-stop
+		return nil
+	}
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultIstioReleaseScanInterval
+	}
+	c.Log.Info(fmt.Sprintf("scanning CHARTS_PATH %s for istio releases every %s", c.ChartsPath, interval))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sync(context.Background()); err != nil {
+			c.Log.Error(err, fmt.Sprintf("failed to scan CHARTS_PATH %s for istio releases", c.ChartsPath))
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync scans CHARTS_PATH and updates the IstioReleases. An IstioRelease is created for each
+// release found, the IstioReleases whose charts were removed are kept as not installable so
+// that their spec set by the admins is not lost.
+func (c *IstioReleaseCatalog) Sync(ctx context.Context) error {
+	releases, err := ScanIstioReleases(c.ChartsPath)
+	if err != nil {
+		return err
+	}
+	var releaseList operatorv1alpha1.IstioReleaseList
+	if err := c.List(ctx, &releaseList); err != nil {
+		return errors.New(fmt.Sprintf("failed to list istio releases, %s", err.Error()))
+	}
+	existing := map[string]bool{}
+	for i := range releaseList.Items {
+		release := &releaseList.Items[i]
+		existing[release.ObjectMeta.Name] = true
+		status, found := releases[release.ObjectMeta.Name]
+		if !found {
+			status = operatorv1alpha1.IstioReleaseStatus{Message: fmt.Sprintf("charts of release %s not found in %s",
+				release.ObjectMeta.Name, c.ChartsPath)}
+		}
+		if err := c.updateStatus(ctx, release, status); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range releases {
+		if !existing[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		release := &operatorv1alpha1.IstioRelease{ObjectMeta: v1.ObjectMeta{Name: name}}
+		if err := c.Create(ctx, release); err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.New(fmt.Sprintf("failed to create istio release %s, %s", name, err.Error()))
+		}
+		if err := c.updateStatus(ctx, release, releases[name]); err != nil {
+			return err
+		}
+		c.Log.Info(fmt.Sprintf("istio release %s found in %s, installable: %t", name, c.ChartsPath,
+			release.Status.Installable))
+	}
+	return nil
+}
+
+// update the status of an IstioRelease if its charts or flags changed
+func (c *IstioReleaseCatalog) updateStatus(ctx context.Context, release *operatorv1alpha1.IstioRelease,
+	status operatorv1alpha1.IstioReleaseStatus) error {
+	status.Deprecated = release.Spec.Deprecated
+	for _, chart := range status.Charts {
+		status.Deprecated = status.Deprecated || chart.Deprecated
+	}
+	status.LastUpdateTime = release.Status.LastUpdateTime
+	if reflect.DeepEqual(release.Status, status) {
+		return nil
+	}
+	status.LastUpdateTime = v1.Now()
+	release.Status = status
+	if err := c.Status().Update(ctx, release); err != nil {
+		return errors.New(fmt.Sprintf("failed to update status of istio release %s, %s", release.ObjectMeta.Name,
+			err.Error()))
+	}
+	return nil
+}
+
+// scan the charts in CHARTS_PATH for releases of istio. The charts of a release have its
+// version in their names, for example istio-init-1.1.8-ccp1.tgz and istio-1.1.8-ccp1.tgz are
+// the charts of release 1.1.8-ccp1. The version, appVersion and checksum of each chart are
+// read from the chart itself.
+func ScanIstioReleases(chartsPath string) (map[string]operatorv1alpha1.IstioReleaseStatus, error) {
+	files, err := ioutil.ReadDir(chartsPath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read charts in %s, %s", chartsPath, err.Error()))
+	}
+	charts := map[string][]operatorv1alpha1.IstioReleaseChart{}
+	problems := map[string][]string{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".tgz") {
+			continue
+		}
+		tag := IstioChartTag(file.Name())
+		chartName := strings.TrimSuffix(strings.TrimSuffix(file.Name(), ".tgz"), "-"+tag)
+		// the release is named after the version in the names of its charts
+		if tag == "" || !containsString(istioReleaseChartNames, chartName) ||
+			len(validation.IsDNS1123Subdomain(tag)) != 0 {
+			continue
+		}
+		path := filepath.Join(chartsPath, file.Name())
+		chart, err := ReadIstioReleaseChart(path)
+		if err != nil {
+			problems[tag] = append(problems[tag], err.Error())
+			continue
+		}
+		if chart.Name != chartName {
+			problems[tag] = append(problems[tag], fmt.Sprintf("chart %s is named %s in its Chart.yaml",
+				path, chart.Name))
+			continue
+		}
+		charts[tag] = append(charts[tag], *chart)
+	}
+	for tag := range problems {
+		if _, found := charts[tag]; !found {
+			charts[tag] = nil
+		}
+	}
+
+	releases := map[string]operatorv1alpha1.IstioReleaseStatus{}
+	for tag, releaseCharts := range charts {
+		sort.Slice(releaseCharts, func(i, j int) bool { return releaseCharts[i].Name < releaseCharts[j].Name })
+		release := operatorv1alpha1.IstioReleaseStatus{Charts: releaseCharts}
+		messages := append([]string{}, problems[tag]...)
+		initChart := release.GetChart(operatorv1alpha1.IstioInitHelmChartName)
+		var controlPlaneCharts []*operatorv1alpha1.IstioReleaseChart
+		for _, chartName := range []string{operatorv1alpha1.IstioHelmChartName,
+			operatorv1alpha1.IstioRemoteHelmChartName} {
+			if chart := release.GetChart(chartName); chart != nil {
+				controlPlaneCharts = append(controlPlaneCharts, chart)
+			}
+		}
+		if initChart == nil {
+			messages = append(messages, fmt.Sprintf("istio-init chart of release %s not found", tag))
+		}
+		if len(controlPlaneCharts) == 0 {
+			messages = append(messages, fmt.Sprintf("istio and istio-remote charts of release %s not found", tag))
+		}
+		for _, chart := range controlPlaneCharts {
+			if initChart != nil && chart.Version != initChart.Version {
+				messages = append(messages, fmt.Sprintf("version %s of chart %s does not match version %s of "+
+					"chart %s", chart.Version, chart.Path, initChart.Version, initChart.Path))
+			}
+		}
+		// the version of the release is the version of its istio chart, or of the chart
+		// found if it doesn't have one
+		versionChart := initChart
+		if len(controlPlaneCharts) != 0 {
+			versionChart = controlPlaneCharts[0]
+		}
+		if versionChart == nil && len(releaseCharts) != 0 {
+			versionChart = &releaseCharts[0]
+		}
+		if versionChart != nil {
+			release.Version = versionChart.Version
+			release.AppVersion = versionChart.AppVersion
+		}
+		release.Installable = len(messages) == 0
+		release.Message = strings.Join(messages, "; ")
+		releases[tag] = release
+	}
+	return releases, nil
+}
+
+// read the name, version, appVersion and checksum of a chart in CHARTS_PATH
+func ReadIstioReleaseChart(path string) (*operatorv1alpha1.IstioReleaseChart, error) {
+	metadata, err := ReadChartMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to compute checksum of chart %s, %s", path, err.Error()))
+	}
+	return &operatorv1alpha1.IstioReleaseChart{
+		Name:       metadata.Name,
+		Path:       path,
+		Version:    metadata.Version,
+		AppVersion: metadata.AppVersion,
+		Sha256:     digest,
+		Deprecated: metadata.Deprecated,
+	}, nil
+}
+
+// read Chart.yaml of a chart (.tgz), it is in the chart's directory at the root of the tarball
+func ReadChartMetadata(chart string) (*IstioChartMetadata, error) {
+	f, err := os.Open(chart)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart %s, %s", chart, err.Error()))
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to read chart %s, %s", chart, err.Error()))
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, errors.New(fmt.Sprintf("Chart.yaml not found in chart %s", chart))
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read chart %s, %s", chart, err.Error()))
+		}
+		parts := strings.Split(strings.TrimPrefix(header.Name, "./"), "/")
+		if header.Typeflag != tar.TypeReg || len(parts) != 2 || parts[1] != "Chart.yaml" {
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(tarReader, maxChartMetadataSize))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("failed to read Chart.yaml of chart %s, %s", chart, err.Error()))
+		}
+		metadata := &IstioChartMetadata{}
+		if err := yaml.Unmarshal(content, metadata); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid Chart.yaml in chart %s, %s", chart, err.Error()))
+		}
+		if metadata.Name == "" || metadata.Version == "" {
+			return nil, errors.New(fmt.Sprintf("Chart.yaml in chart %s has no name or version", chart))
+		}
+		return metadata, nil
+	}
+}
+
+// the IstioRelease of the control plane chart of istio CR's spec, found by the path of the
+// chart in CHARTS_PATH or by its sha256 digest. Returns nil if the chart is not in the catalog.
+func (r *IstioReconciler) IstioReleaseOfSpec(ctx context.Context,
+	spec operatorv1alpha1.IstioSpec) (*operatorv1alpha1.IstioRelease, error) {
+	var releaseList operatorv1alpha1.IstioReleaseList
+	if err := r.List(ctx, &releaseList); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to list istio releases, %s", err.Error()))
+	}
+	location, digest := ParseChartReference(IstioControlPlaneChart(spec))
+	for i := range releaseList.Items {
+		chart := releaseList.Items[i].Status.GetChart(IstioControlPlaneChartName(spec))
+		if chart == nil {
+			continue
+		}
+		if (!IsRemoteChart(location) && filepath.Clean(chart.Path) == filepath.Clean(location)) ||
+			(digest != "" && chart.Sha256 == digest) {
+			return &releaseList.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// set the ReleaseDeprecated condition of istio CR and warn if the release of istio used by
+// istio CR's spec is deprecated or reached its end of life. Returns true if the condition
+// changed.
+func (r *IstioReconciler) CheckIstioRelease(ctx context.Context, ist *operatorv1alpha1.Istio,
+	spec operatorv1alpha1.IstioSpec) (bool, error) {
+	release, err := r.IstioReleaseOfSpec(ctx, spec)
+	if err != nil {
+		return false, err
+	}
+	existing := ist.Status.GetCondition(operatorv1alpha1.IstioConditionReleaseDeprecated)
+	condition := operatorv1alpha1.IstioCondition{
+		Type:               operatorv1alpha1.IstioConditionReleaseDeprecated,
+		Status:             corev1.ConditionFalse,
+		ObservedGeneration: ist.ObjectMeta.Generation,
+	}
+	switch {
+	case release == nil:
+		if existing == nil {
+			return false, nil
+		}
+		condition.Status = corev1.ConditionUnknown
+		condition.Reason = "ReleaseNotInCatalog"
+		condition.Message = fmt.Sprintf("chart %s is not in the catalog of istio releases",
+			IstioControlPlaneChart(spec))
+	case release.Spec.EndOfLife:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "ReleaseEndOfLife"
+		condition.Message = fmt.Sprintf("release %s of istio reached its end of life", release.ObjectMeta.Name)
+	case release.Status.Deprecated:
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "ReleaseDeprecated"
+		condition.Message = fmt.Sprintf("release %s of istio is deprecated", release.ObjectMeta.Name)
+	default:
+		condition.Reason = "ReleaseSupported"
+		condition.Message = fmt.Sprintf("release %s of istio is supported", release.ObjectMeta.Name)
+	}
+	if condition.Status == corev1.ConditionTrue && release.Spec.Message != "" {
+		condition.Message = fmt.Sprintf("%s, %s", condition.Message, release.Spec.Message)
+	}
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason &&
+		existing.Message == condition.Message {
+		return false, nil
+	}
+	if condition.Status == corev1.ConditionTrue {
+		r.Log.Info(fmt.Sprintf("WARNING: Istio CR %s uses chart %s, %s", istioCRName(ist),
+			IstioControlPlaneChart(spec), condition.Message))
+	}
+	ist.Status.SetCondition(condition)
+	return true, nil
+}
@@ -0,0 +1,134 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// directory of charts of a test, the returned func removes it
+func testChartsPath(t *testing.T) (string, func()) {
+	chartsPath, err := ioutil.TempDir("", "charts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chartsPath, func() { os.RemoveAll(chartsPath) }
+}
+
+func TestScanIstioReleases(t *testing.T) {
+	chartsPath, cleanup := testChartsPath(t)
+	defer cleanup()
+	writeTestChartArchive(t, chartsPath, "istio-init-1.1.8-ccp1.tgz", "istio-init",
+		"name: istio-init\nversion: 1.1.8\nappVersion: 1.1.8\n")
+	istioChart := writeTestChartArchive(t, chartsPath, "istio-1.1.8-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.1.8\nappVersion: 1.1.8\n")
+	digest, err := fileDigest(istioChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releases, err := ScanIstioReleases(chartsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 1 {
+		t.Fatalf("expected 1 release, got %+v", releases)
+	}
+	release := releases["1.1.8-ccp1"]
+	if !release.Installable || release.Message != "" {
+		t.Errorf("release not installable, %s", release.Message)
+	}
+	if release.Version != "1.1.8" || release.AppVersion != "1.1.8" {
+		t.Errorf("unexpected version %s and appVersion %s", release.Version, release.AppVersion)
+	}
+	if len(release.Charts) != 2 {
+		t.Errorf("expected 2 charts, got %+v", release.Charts)
+	}
+	chart := release.GetChart(operatorv1alpha1.IstioHelmChartName)
+	if chart == nil || chart.Path != istioChart || chart.Sha256 != digest {
+		t.Errorf("unexpected istio chart %+v", chart)
+	}
+}
+
+func TestScanIstioReleasesNotInstallable(t *testing.T) {
+	chartsPath, cleanup := testChartsPath(t)
+	defer cleanup()
+	writeTestChartArchive(t, chartsPath, "istio-init-1.1.3-ccp1.tgz", "istio-init",
+		"name: istio-init\nversion: 1.1.3\n")
+	writeTestChartArchive(t, chartsPath, "istio-init-1.1.8-ccp1.tgz", "istio-init",
+		"name: istio-init\nversion: 1.1.8\n")
+	writeTestChartArchive(t, chartsPath, "istio-1.1.8-ccp1.tgz", "istio",
+		"name: istio\nversion: 1.1.9\ndeprecated: true\n")
+	for file, content := range map[string]string{"istio-remote-1.1.8-ccp1.tgz": "not a chart", "README.md": "charts"} {
+		if err := ioutil.WriteFile(filepath.Join(chartsPath, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	releases, err := ScanIstioReleases(chartsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("expected 2 releases, got %+v", releases)
+	}
+	if release := releases["1.1.3-ccp1"]; release.Installable ||
+		!strings.Contains(release.Message, "istio and istio-remote charts") {
+		t.Errorf("release 1.1.3-ccp1 without an istio chart is installable, %s", release.Message)
+	}
+	release := releases["1.1.8-ccp1"]
+	if release.Installable {
+		t.Error("release 1.1.8-ccp1 with mismatched charts is installable")
+	}
+	for _, message := range []string{"istio-remote-1.1.8-ccp1.tgz", "version 1.1.9 of chart"} {
+		if !strings.Contains(release.Message, message) {
+			t.Errorf("expected %q in message %q", message, release.Message)
+		}
+	}
+	if release.Version != "1.1.9" {
+		t.Errorf("expected version 1.1.9, got %s", release.Version)
+	}
+	if chart := release.GetChart(operatorv1alpha1.IstioHelmChartName); chart == nil || !chart.Deprecated {
+		t.Errorf("istio chart not deprecated, %+v", chart)
+	}
+}
+
+func TestReadChartMetadata(t *testing.T) {
+	chartsPath, cleanup := testChartsPath(t)
+	defer cleanup()
+	chart := writeTestChartArchive(t, chartsPath, "istio-1.1.8-ccp1.tgz", "istio",
+		"apiVersion: v1\nname: istio\nversion: 1.1.8\nappVersion: 1.1.8\ntillerVersion: \">=2.7.2\"\n")
+	metadata, err := ReadChartMetadata(chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := IstioChartMetadata{Name: "istio", Version: "1.1.8", AppVersion: "1.1.8"}
+	if metadata.Name != expected.Name || metadata.Version != expected.Version ||
+		metadata.AppVersion != expected.AppVersion || metadata.Deprecated || len(metadata.Annotations) != 0 {
+		t.Errorf("expected %+v, got %+v", expected, *metadata)
+	}
+
+	chart = writeTestChartArchive(t, chartsPath, "istio-1.1.9-ccp1.tgz", "istio", "description: no name\n")
+	if _, err := ReadChartMetadata(chart); err == nil {
+		t.Error("read Chart.yaml without a name")
+	}
+}
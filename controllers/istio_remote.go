@@ -0,0 +1,140 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// check if istio CR's spec is for a remote cluster of a multi-cluster mesh, istio-remote
+// is installed instead of istio in a remote cluster
+func IstioIsRemote(spec operatorv1alpha1.IstioSpec) bool {
+	return spec.CcpIstioRemote.Chart != ""
+}
+
+// name of the helm chart (and helm release) of istio's control plane, istio in a primary
+// cluster and istio-remote in a remote cluster of a multi-cluster mesh
+func IstioControlPlaneChartName(spec operatorv1alpha1.IstioSpec) string {
+	if IstioIsRemote(spec) {
+		return operatorv1alpha1.IstioRemoteHelmChartName
+	}
+	return operatorv1alpha1.IstioHelmChartName
+}
+
+// chart of istio's control plane, istio in a primary cluster and istio-remote in a
+// remote cluster of a multi-cluster mesh
+func IstioControlPlaneChart(spec operatorv1alpha1.IstioSpec) string {
+	if IstioIsRemote(spec) {
+		return spec.CcpIstioRemote.Chart
+	}
+	return spec.CcpIstio.Chart
+}
+
+// build the helm release of istio's control plane. In a remote cluster, the addresses of
+// pilot, policy and telemetry in the primary cluster are passed to istio-remote in a
+// values file that takes precedence over istio-remote's values in istio CR spec. The
+// namespace and revision of a control plane that is not the default one are passed in
+// another values file that takes precedence too.
+func (r *IstioReconciler) IstioControlPlaneHelmRelease(spec operatorv1alpha1.IstioSpec,
+	workspace string) HelmRelease {
+	var release HelmRelease
+	if !IstioIsRemote(spec) {
+		release = r.IstioHelmRelease(spec, operatorv1alpha1.IstioHelmChartName, spec.CcpIstio.Chart,
+			spec.CcpIstio.Values, workspace)
+	} else {
+		release = r.IstioHelmRelease(spec, operatorv1alpha1.IstioRemoteHelmChartName, spec.CcpIstioRemote.Chart,
+			spec.CcpIstioRemote.Values, workspace)
+		release.ValuesFiles = append(release.ValuesFiles, IstioRemoteEndpointsValuesFilePath(workspace))
+	}
+	if !IstioControlPlaneIsDefault(spec) {
+		release.ValuesFiles = append(release.ValuesFiles,
+			IstioControlPlaneValuesFilePath(workspace, IstioControlPlaneChartName(spec)))
+	}
+	return release
+}
+
+// path of the values file with the addresses of the primary cluster in the workspace
+func IstioRemoteEndpointsValuesFilePath(workspace string) string {
+	return filepath.Join(workspace, fmt.Sprintf("%s%s", operatorv1alpha1.IstioRemoteHelmChartName,
+		"-endpoints-values.yaml"))
+}
+
+// generate the values file with the addresses of pilot, policy and telemetry in the
+// primary cluster used by istio-remote in the workspace
+func (r *IstioReconciler) GenerateIstioRemoteEndpointsValues(workspace string,
+	spec operatorv1alpha1.IstioSpec) error {
+	if !IstioIsRemote(spec) {
+		return nil
+	}
+	global := map[string]interface{}{
+		"istioRemote":        true,
+		"remotePilotAddress": spec.CcpIstioRemote.RemotePilotAddress,
+	}
+	if spec.CcpIstioRemote.RemotePolicyAddress != "" {
+		global["remotePolicyAddress"] = spec.CcpIstioRemote.RemotePolicyAddress
+	}
+	if spec.CcpIstioRemote.RemoteTelemetryAddress != "" {
+		global["remoteTelemetryAddress"] = spec.CcpIstioRemote.RemoteTelemetryAddress
+	}
+	f, err := yaml.Marshal(map[string]interface{}{"global": global})
+	if err != nil {
+		return err
+	}
+	valuesFileName := IstioRemoteEndpointsValuesFilePath(workspace)
+	if err := ioutil.WriteFile(valuesFileName, f, 0644); err != nil {
+		return errors.New(fmt.Sprintf("Failed to generate values file with the addresses of the primary "+
+			"cluster for %s, %s", operatorv1alpha1.IstioRemoteHelmChartName, err.Error()))
+	}
+	r.Log.Info(fmt.Sprintf("Generated values file %s with the addresses of the primary cluster",
+		valuesFileName))
+	return nil
+}
+
+// validate the istio and istio-remote sections of istio CR spec, a cluster is either
+// the primary cluster (istio is installed) or a remote cluster (istio-remote is
+// installed) of a multi-cluster mesh
+func ValidateIstioTopology(spec operatorv1alpha1.IstioSpec) error {
+	remote := spec.CcpIstioRemote
+	if spec.CcpIstio.Chart != "" && remote.Chart != "" {
+		return errors.New("both istio and istio-remote helm charts are set in istio CR spec, set " +
+			"only istio's chart in the primary cluster and only istio-remote's chart in a remote cluster " +
+			"of a multi-cluster mesh.")
+	}
+	if spec.CcpIstio.Chart == "" && remote.Chart == "" {
+		return errors.New("istio helm chart is empty in istio CR spec, cannot install istio.")
+	}
+	if remote.Chart == "" {
+		if remote.RemotePilotAddress != "" || remote.RemotePolicyAddress != "" ||
+			remote.RemoteTelemetryAddress != "" {
+			return errors.New("addresses of the primary cluster are set in istio-remote section of " +
+				"istio CR spec but istio-remote helm chart is empty, the addresses of the primary cluster " +
+				"are used only in a remote cluster of a multi-cluster mesh.")
+		}
+		return nil
+	}
+	if remote.RemotePilotAddress == "" {
+		return errors.New("remotePilotAddress is empty in istio-remote section of istio CR spec, " +
+			"cannot install istio-remote without the address of istio-pilot in the primary cluster.")
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestValidateIstioTopology(t *testing.T) {
+	tests := []struct {
+		name   string
+		istio  string
+		remote operatorv1alpha1.IstioRemoteValues
+		err    bool
+	}{
+		{name: "primary cluster", istio: "istio-1.1.8-ccp1.tgz"},
+		{name: "remote cluster", remote: operatorv1alpha1.IstioRemoteValues{Chart: "istio-remote-1.1.8-ccp1.tgz",
+			RemotePilotAddress: "10.0.0.1"}},
+		{name: "remote cluster with all the addresses", remote: operatorv1alpha1.IstioRemoteValues{
+			Chart: "istio-remote-1.1.8-ccp1.tgz", RemotePilotAddress: "10.0.0.1", RemotePolicyAddress: "10.0.0.2",
+			RemoteTelemetryAddress: "10.0.0.3"}},
+		{name: "both istio and istio-remote", istio: "istio-1.1.8-ccp1.tgz",
+			remote: operatorv1alpha1.IstioRemoteValues{Chart: "istio-remote-1.1.8-ccp1.tgz",
+				RemotePilotAddress: "10.0.0.1"}, err: true},
+		{name: "neither istio nor istio-remote", err: true},
+		{name: "addresses in the primary cluster", istio: "istio-1.1.8-ccp1.tgz",
+			remote: operatorv1alpha1.IstioRemoteValues{RemotePolicyAddress: "10.0.0.2"}, err: true},
+		{name: "remote cluster without pilot's address", remote: operatorv1alpha1.IstioRemoteValues{
+			Chart: "istio-remote-1.1.8-ccp1.tgz", RemoteTelemetryAddress: "10.0.0.3"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := operatorv1alpha1.IstioSpec{CcpIstioRemote: test.remote}
+			spec.CcpIstio.Chart = test.istio
+			if err := ValidateIstioTopology(spec); (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestIstioControlPlaneHelmRelease(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         operatorv1alpha1.IstioSpec
+		expected     HelmRelease
+		chartName    string
+		controlPlane string
+	}{
+		{
+			name: "primary cluster",
+			spec: operatorv1alpha1.IstioSpec{CcpIstio: operatorv1alpha1.IstioValues{Chart: "/charts/istio.tgz",
+				Values: "gateways:\n  enabled: false\n"}},
+			expected: HelmRelease{Name: "istio", Namespace: "istio-system", Chart: "/charts/istio.tgz",
+				ValuesFiles: []string{"/workspace/istio-values.yaml"}},
+			chartName: "istio",
+		},
+		{
+			name: "remote cluster",
+			spec: operatorv1alpha1.IstioSpec{CcpIstioRemote: operatorv1alpha1.IstioRemoteValues{
+				Chart: "/charts/istio-remote.tgz", RemotePilotAddress: "10.0.0.1"}},
+			expected: HelmRelease{Name: "istio-remote", Namespace: "istio-system", Chart: "/charts/istio-remote.tgz",
+				ValuesFiles: []string{"/workspace/istio-remote-endpoints-values.yaml"}},
+			chartName: "istio-remote",
+		},
+		{
+			name: "remote cluster with a control plane in another namespace",
+			spec: operatorv1alpha1.IstioSpec{
+				CcpIstioRemote: operatorv1alpha1.IstioRemoteValues{Chart: "/charts/istio-remote.tgz",
+					Values: "global:\n  mtls: true\n", RemotePilotAddress: "10.0.0.1"},
+				ControlPlane: operatorv1alpha1.IstioControlPlane{Namespace: "istio-canary", ReleasePrefix: "canary-"},
+			},
+			expected: HelmRelease{Name: "canary-istio-remote", Namespace: "istio-canary",
+				Chart: "/charts/istio-remote.tgz", ValuesFiles: []string{"/workspace/istio-remote-values.yaml",
+					"/workspace/istio-remote-endpoints-values.yaml",
+					"/workspace/istio-remote-control-plane-values.yaml"}},
+			chartName: "istio-remote",
+		},
+	}
+	r := fakeIstioReconciler()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if chartName := IstioControlPlaneChartName(test.spec); chartName != test.chartName {
+				t.Errorf("expected chart name %s, got %s", test.chartName, chartName)
+			}
+			if chart := IstioControlPlaneChart(test.spec); chart != test.expected.Chart {
+				t.Errorf("expected chart %s, got %s", test.expected.Chart, chart)
+			}
+			release := r.IstioControlPlaneHelmRelease(test.spec, "/workspace")
+			if !reflect.DeepEqual(release, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, release)
+			}
+		})
+	}
+}
+
+func TestGenerateIstioRemoteEndpointsValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   operatorv1alpha1.IstioRemoteValues
+		expected map[string]interface{}
+	}{
+		{name: "primary cluster"},
+		{
+			name:   "address of pilot",
+			remote: operatorv1alpha1.IstioRemoteValues{Chart: "istio-remote.tgz", RemotePilotAddress: "10.0.0.1"},
+			expected: map[string]interface{}{"global": map[string]interface{}{"istioRemote": true,
+				"remotePilotAddress": "10.0.0.1"}},
+		},
+		{
+			name: "addresses of pilot, policy and telemetry",
+			remote: operatorv1alpha1.IstioRemoteValues{Chart: "istio-remote.tgz", RemotePilotAddress: "10.0.0.1",
+				RemotePolicyAddress: "10.0.0.2", RemoteTelemetryAddress: "10.0.0.3"},
+			expected: map[string]interface{}{"global": map[string]interface{}{"istioRemote": true,
+				"remotePilotAddress": "10.0.0.1", "remotePolicyAddress": "10.0.0.2",
+				"remoteTelemetryAddress": "10.0.0.3"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workspace, err := ioutil.TempDir("", "workspace-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workspace)
+
+			r := fakeIstioReconciler()
+			spec := operatorv1alpha1.IstioSpec{CcpIstioRemote: test.remote}
+			if err := r.GenerateIstioRemoteEndpointsValues(workspace, spec); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(IstioRemoteEndpointsValuesFilePath(workspace))
+			if test.expected == nil {
+				if !os.IsNotExist(err) {
+					t.Errorf("values file generated in the primary cluster: %s", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values map[string]interface{}
+			if err := yaml.Unmarshal(b, &values); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Errorf("expected values %v, got %v", test.expected, values)
+			}
+		})
+	}
+}
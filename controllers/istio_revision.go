@@ -0,0 +1,161 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// statuses of istio CR when istio is installed and running
+var istioInstalledStatuses = map[string]bool{
+	"IstioInstalledActive": true,
+	"IstioRolledBack":      true,
+}
+
+// get a revision of istio in istio CR's status, nil if the revision is not in the
+// revision history
+func FindIstioRevision(ist *operatorv1alpha1.Istio, revision int64) *operatorv1alpha1.IstioRevision {
+	for i := range ist.Status.Revisions {
+		if ist.Status.Revisions[i].Revision == revision {
+			return &ist.Status.Revisions[i]
+		}
+	}
+	return nil
+}
+
+// spec applied by the operation on istio in progress, it is istio CR's spec or the
+// spec of the revision istio is rolled back to
+func IstioOperationSpec(ist *operatorv1alpha1.Istio) (operatorv1alpha1.IstioSpec, error) {
+	spec := IstioInstalledSpec(ist)
+	if IstioCanaryUpgradeInProgress(ist) {
+		// a canary upgrade installs the new control plane next to the installed one
+		spec.ControlPlane = ist.Status.Canary.To
+	}
+	if ist.Status.Operation == nil || ist.Status.Operation.Revision == 0 {
+		return spec, nil
+	}
+	revision := FindIstioRevision(ist, ist.Status.Operation.Revision)
+	if revision == nil {
+		return spec, errors.New(fmt.Sprintf("revision %d of istio not found in Istio CR status",
+			ist.Status.Operation.Revision))
+	}
+	spec.CcpIstioInit = revision.CcpIstioInit
+	spec.CcpIstio = revision.CcpIstio
+	spec.CcpIstioRemote = revision.CcpIstioRemote
+	return spec, nil
+}
+
+// add a revision of istio to istio CR's status after istio CR's spec is applied
+// successfully, the oldest revisions are removed so that at most
+// spec.revisionHistoryLimit revisions are kept
+func RecordIstioRevision(ist *operatorv1alpha1.Istio, spec operatorv1alpha1.IstioSpec, generation int64) {
+	revision := operatorv1alpha1.IstioRevision{
+		Revision:       1,
+		Generation:     generation,
+		Version:        ist.Status.Version,
+		AppliedTime:    v1.Now(),
+		CcpIstioInit:   spec.CcpIstioInit,
+		CcpIstio:       spec.CcpIstio,
+		CcpIstioRemote: spec.CcpIstioRemote,
+	}
+	if len(ist.Status.Revisions) != 0 {
+		revision.Revision = ist.Status.Revisions[len(ist.Status.Revisions)-1].Revision + 1
+	}
+	ist.Status.Revisions = append(ist.Status.Revisions, revision)
+	ist.Status.CurrentRevision = revision.Revision
+
+	limit := int32(operatorv1alpha1.DefaultRevisionHistoryLimit)
+	if ist.Spec.RevisionHistoryLimit != nil && *ist.Spec.RevisionHistoryLimit > 0 {
+		limit = *ist.Spec.RevisionHistoryLimit
+	}
+	if len(ist.Status.Revisions) > int(limit) {
+		ist.Status.Revisions = ist.Status.Revisions[len(ist.Status.Revisions)-int(limit):]
+	}
+}
+
+// check if istio is rolled back to the last revision that was installed successfully
+// when the operation on istio in progress fails
+func ShouldRollbackIstio(ist *operatorv1alpha1.Istio) bool {
+	// a canary upgrade that failed keeps the old control plane, the namespaces not moved
+	// yet still use it
+	return ist.Spec.RollbackOnFailure && !IstioCanaryUpgradeInProgress(ist) &&
+		ist.Status.Operation != nil && ist.Status.Operation.Revision == 0 &&
+		ist.Status.CurrentRevision != 0 && FindIstioRevision(ist, ist.Status.CurrentRevision) != nil
+}
+
+// replace the operation on istio that failed with an operation that rolls istio back
+// to the last revision that was installed successfully
+func (r *IstioReconciler) StartIstioRollback(ctx context.Context, ist *operatorv1alpha1.Istio,
+	reason error) error {
+	failed := ist.Status.Operation
+	revision := FindIstioRevision(ist, ist.Status.CurrentRevision)
+	spec := IstioInstalledSpec(ist)
+	spec.CcpIstioRemote = revision.CcpIstioRemote
+	operationType := operatorv1alpha1.IstioOperationInstall
+	if ist.Spec.UpgradeStrategy != operatorv1alpha1.UpgradeStrategyReinstall && r.IstioIsInstalled(spec) {
+		operationType = operatorv1alpha1.IstioOperationUpgrade
+	}
+	ist.Status.Operation = &operatorv1alpha1.IstioOperation{
+		Type:       operationType,
+		Generation: failed.Generation,
+		Revision:   ist.Status.CurrentRevision,
+		RollbackReason: fmt.Sprintf("%s of istio for generation %d failed at step %s, %s", failed.Type,
+			failed.Generation, failed.Step, reason.Error()),
+		StartTime: v1.Now(),
+	}
+	r.Log.Info(fmt.Sprintf("rolling back istio to revision %d, %s", ist.Status.Operation.Revision,
+		ist.Status.Operation.RollbackReason))
+	return r.UpdateIstioCRStatus(ctx, ist, "RollingBackIstio", nil)
+}
+
+// roll back istio to the revision in istio CR's spec.rollbackTo. The istio-init, istio
+// and istio-remote sections of istio CR's spec are replaced with the ones of the
+// revision, so that istio is upgraded to the revision like for any other update of
+// istio CR's spec.
+func (r *IstioReconciler) RollbackIstioCRSpec(ctx context.Context, ist *operatorv1alpha1.Istio) error {
+	revisionNumber := ist.Spec.RollbackTo.Revision
+	revision := FindIstioRevision(ist, revisionNumber)
+	if revision != nil {
+		ist.Spec.CcpIstioInit = revision.CcpIstioInit
+		ist.Spec.CcpIstio = revision.CcpIstio
+		ist.Spec.CcpIstioRemote = revision.CcpIstioRemote
+	}
+	ist.Spec.RollbackTo = nil
+	if err := r.Update(ctx, ist); err != nil {
+		return err
+	}
+	if revision == nil {
+		var revisions []string
+		for _, rev := range ist.Status.Revisions {
+			revisions = append(revisions, fmt.Sprintf("%d", rev.Revision))
+		}
+		err := errors.New(fmt.Sprintf("revision %d of istio not found in Istio CR status, revisions "+
+			"that can be rolled back to: %s", revisionNumber, strings.Join(revisions, ", ")))
+		r.Log.Error(err, "RollbackFailed")
+		r.UpdateIstioCRStatus(ctx, ist, "RollbackFailed", err)
+		return nil
+	}
+	r.Log.Info(fmt.Sprintf("spec of Istio CR %s set to revision %d of istio", ist.ObjectMeta.Name,
+		revisionNumber))
+	return nil
+}
@@ -0,0 +1,232 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// revision of istio installed with the charts of istio 1.1.<revision>
+func testIstioRevision(revision int64) operatorv1alpha1.IstioRevision {
+	return operatorv1alpha1.IstioRevision{
+		Revision:     revision,
+		Generation:   revision,
+		CcpIstioInit: operatorv1alpha1.IstioInitValues{Chart: fmt.Sprintf("istio-init-1.1.%d-ccp1.tgz", revision)},
+		CcpIstio:     operatorv1alpha1.IstioValues{Chart: fmt.Sprintf("istio-1.1.%d-ccp1.tgz", revision)},
+	}
+}
+
+// revision numbers of istio in istio CR's status
+func testIstioRevisionNumbers(ist *operatorv1alpha1.Istio) []int64 {
+	var revisions []int64
+	for _, revision := range ist.Status.Revisions {
+		revisions = append(revisions, revision.Revision)
+	}
+	return revisions
+}
+
+func TestRecordIstioRevision(t *testing.T) {
+	limit := func(limit int32) *int32 { return &limit }
+	tests := []struct {
+		name      string
+		revisions int64
+		limit     *int32
+		expected  []int64
+	}{
+		{name: "first revision", expected: []int64{1}},
+		{name: "next revision", revisions: 2, expected: []int64{1, 2, 3}},
+		{name: "oldest revisions removed", revisions: 3, limit: limit(2), expected: []int64{3, 4}},
+		{name: "default limit", revisions: operatorv1alpha1.DefaultRevisionHistoryLimit, limit: limit(0),
+			expected: []int64{2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.RevisionHistoryLimit = test.limit
+			for revision := int64(1); revision <= test.revisions; revision++ {
+				ist.Status.Revisions = append(ist.Status.Revisions, testIstioRevision(revision))
+			}
+			ist.Status.Version = "1.1.9"
+			spec := ist.Spec
+			spec.CcpIstio.Chart = "istio-1.1.9-ccp1.tgz"
+
+			RecordIstioRevision(ist, spec, 7)
+			if revisions := testIstioRevisionNumbers(ist); !reflect.DeepEqual(revisions, test.expected) {
+				t.Errorf("expected revisions %v, got %v", test.expected, revisions)
+			}
+			current := test.expected[len(test.expected)-1]
+			if ist.Status.CurrentRevision != current {
+				t.Errorf("expected current revision %d, got %d", current, ist.Status.CurrentRevision)
+			}
+			revision := FindIstioRevision(ist, current)
+			if revision.Generation != 7 || revision.Version != "1.1.9" || revision.CcpIstio.Chart != spec.CcpIstio.Chart {
+				t.Errorf("unexpected revision %+v", revision)
+			}
+		})
+	}
+}
+
+func TestIstioOperationSpec(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation *operatorv1alpha1.IstioOperation
+		chart     string
+		err       bool
+	}{
+		{name: "no operation", chart: "istio-1.1.9-ccp1.tgz"},
+		{name: "operation on istio CR's spec", operation: &operatorv1alpha1.IstioOperation{},
+			chart: "istio-1.1.9-ccp1.tgz"},
+		{name: "rollback to a revision", operation: &operatorv1alpha1.IstioOperation{Revision: 1},
+			chart: "istio-1.1.1-ccp1.tgz"},
+		{name: "rollback to a revision not found", operation: &operatorv1alpha1.IstioOperation{Revision: 3},
+			chart: "istio-1.1.9-ccp1.tgz", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.CcpIstio.Chart = "istio-1.1.9-ccp1.tgz"
+			ist.Status.Revisions = []operatorv1alpha1.IstioRevision{testIstioRevision(1), testIstioRevision(2)}
+			ist.Status.Operation = test.operation
+			spec, err := IstioOperationSpec(ist)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if spec.CcpIstio.Chart != test.chart {
+				t.Errorf("expected chart %s, got %s", test.chart, spec.CcpIstio.Chart)
+			}
+		})
+	}
+}
+
+func TestShouldRollbackIstio(t *testing.T) {
+	tests := []struct {
+		name              string
+		rollbackOnFailure bool
+		operation         *operatorv1alpha1.IstioOperation
+		currentRevision   int64
+		expected          bool
+	}{
+		{name: "rollback on failure", rollbackOnFailure: true, operation: &operatorv1alpha1.IstioOperation{},
+			currentRevision: 2, expected: true},
+		{name: "rollback not enabled", operation: &operatorv1alpha1.IstioOperation{}, currentRevision: 2},
+		{name: "no operation", rollbackOnFailure: true, currentRevision: 2},
+		{name: "rollback failed", rollbackOnFailure: true, operation: &operatorv1alpha1.IstioOperation{Revision: 2},
+			currentRevision: 2},
+		{name: "first install", rollbackOnFailure: true, operation: &operatorv1alpha1.IstioOperation{}},
+		{name: "current revision not in the history", rollbackOnFailure: true,
+			operation: &operatorv1alpha1.IstioOperation{}, currentRevision: 5},
+		{name: "canary upgrade", rollbackOnFailure: true, currentRevision: 2,
+			operation: &operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationCanaryUpgrade}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.RollbackOnFailure = test.rollbackOnFailure
+			ist.Status.Revisions = []operatorv1alpha1.IstioRevision{testIstioRevision(1), testIstioRevision(2)}
+			ist.Status.CurrentRevision = test.currentRevision
+			ist.Status.Operation = test.operation
+			ist.Status.Canary = &operatorv1alpha1.IstioCanaryStatus{}
+			if rollback := ShouldRollbackIstio(ist); rollback != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, rollback)
+			}
+		})
+	}
+}
+
+func TestStartIstioRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy operatorv1alpha1.UpgradeStrategy
+		releases []string
+		expected operatorv1alpha1.IstioOperationType
+	}{
+		{name: "istio installed", releases: []string{"istio-init", "istio"},
+			expected: operatorv1alpha1.IstioOperationUpgrade},
+		{name: "istio partially installed", releases: []string{"istio-init"},
+			expected: operatorv1alpha1.IstioOperationInstall},
+		{name: "reinstall strategy", strategy: operatorv1alpha1.UpgradeStrategyReinstall,
+			releases: []string{"istio-init", "istio"}, expected: operatorv1alpha1.IstioOperationInstall},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.UpgradeStrategy = test.strategy
+			ist.Status.Revisions = []operatorv1alpha1.IstioRevision{testIstioRevision(1), testIstioRevision(2)}
+			ist.Status.CurrentRevision = 2
+			ist.Status.Operation = &operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationUpgrade,
+				Generation: 3, Step: "UpgradingIstio"}
+			r := fakeIstioReconciler(ist)
+			for _, name := range test.releases {
+				r.Helm.Install(HelmRelease{Name: name, Namespace: "istio-system", Chart: name + "-1.1.2-ccp1.tgz"})
+			}
+
+			if err := r.StartIstioRollback(context.TODO(), ist, errors.New("istio-pilot is not ready")); err != nil {
+				t.Fatal(err)
+			}
+			operation := ist.Status.Operation
+			if operation.Type != test.expected || operation.Revision != 2 || operation.Generation != 3 {
+				t.Errorf("unexpected operation %+v", operation)
+			}
+			reason := "Upgrade of istio for generation 3 failed at step UpgradingIstio, istio-pilot is not ready"
+			if operation.RollbackReason != reason {
+				t.Errorf("expected rollback reason %q, got %q", reason, operation.RollbackReason)
+			}
+			if ist.Status.Active != "RollingBackIstio" {
+				t.Errorf("expected status RollingBackIstio, got %s", ist.Status.Active)
+			}
+		})
+	}
+}
+
+func TestRollbackIstioCRSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		revision int64
+		chart    string
+		status   string
+	}{
+		{name: "revision found", revision: 1, chart: "istio-1.1.1-ccp1.tgz"},
+		{name: "revision not found", revision: 3, chart: "istio-1.1.9-ccp1.tgz", status: "RollbackFailed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Spec.CcpIstio.Chart = "istio-1.1.9-ccp1.tgz"
+			ist.Spec.RollbackTo = &operatorv1alpha1.IstioRollback{Revision: test.revision}
+			ist.Status.Revisions = []operatorv1alpha1.IstioRevision{testIstioRevision(1), testIstioRevision(2)}
+			r := fakeIstioReconciler(ist)
+
+			if err := r.RollbackIstioCRSpec(context.TODO(), ist); err != nil {
+				t.Fatal(err)
+			}
+			if ist.Spec.RollbackTo != nil {
+				t.Error("spec.rollbackTo not removed")
+			}
+			if ist.Spec.CcpIstio.Chart != test.chart {
+				t.Errorf("expected chart %s, got %s", test.chart, ist.Spec.CcpIstio.Chart)
+			}
+			if ist.Status.Active != test.status {
+				t.Errorf("expected status %q, got %q", test.status, ist.Status.Active)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+const (
+	// name of the container of istio's sidecar injected in the pods
+	istioProxyContainerName = "istio-proxy"
+	// time between two audits of the versions of istio's sidecars
+	istioSidecarAuditInterval = 5 * time.Minute
+	// values of the skew label of the ccp_istio_operator_sidecars metric
+	istioSidecarUpToDate        = "up_to_date"
+	istioSidecarStale           = "stale"
+	istioSidecarUnsupportedSkew = "unsupported_skew"
+)
+
+// number of pods with istio's sidecar by namespace and version skew, published on the
+// metrics endpoint of the istio operator
+var istioSidecarsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ccp_istio_operator_sidecars",
+	Help: "Number of pods with istio's sidecar by namespace and skew between the version of the sidecar " +
+		"and the version of istio's control plane",
+}, []string{"istio", "namespace", "skew"})
+
+func init() {
+	metrics.Registry.MustRegister(istioSidecarsGauge)
+}
+
+// version of istio's control plane in istio CR's status, for example 1.1.8-ccp1, or
+// 1.1.8-ccp1 for istio-1.1.8-ccp1.tgz when the version is the chart's file name
+func IstioControlPlaneVersion(ist *operatorv1alpha1.Istio) string {
+	loc := istioVersionRegexp.FindStringIndex(ist.Status.Version)
+	if loc == nil {
+		return ""
+	}
+	return strings.TrimSuffix(ist.Status.Version[loc[0]:], ".tgz")
+}
+
+// tag of the image of istio's sidecar in a pod, empty if the pod has no sidecar
+func istioProxyImageTag(pod corev1.Pod) (string, bool) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != istioProxyContainerName {
+			continue
+		}
+		image := container.Image
+		if i := strings.Index(image, "@"); i != -1 {
+			// images pinned by digest have no version
+			image = image[:i]
+		}
+		name := image[strings.LastIndex(image, "/")+1:]
+		if i := strings.LastIndex(name, ":"); i != -1 {
+			return name[i+1:], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// skew between the version of istio's sidecar and the version of istio's control plane.
+// Sidecars with the version of the control plane are up to date, sidecars with another
+// patch version or one minor version older are stale and are still supported by istio,
+// the other sidecars have an unsupported skew.
+func IstioSidecarSkew(controlPlaneVersion string, sidecarVersion string) string {
+	if sidecarVersion == controlPlaneVersion {
+		return istioSidecarUpToDate
+	}
+	controlPlane := istioVersionRegexp.FindStringSubmatch(controlPlaneVersion)
+	sidecar := istioVersionRegexp.FindStringSubmatch(sidecarVersion)
+	if controlPlane == nil || sidecar == nil || controlPlane[1] != sidecar[1] {
+		return istioSidecarUnsupportedSkew
+	}
+	controlPlaneMinor, _ := strconv.Atoi(controlPlane[2])
+	sidecarMinor, _ := strconv.Atoi(sidecar[2])
+	if skew := controlPlaneMinor - sidecarMinor; skew == 0 || skew == 1 {
+		return istioSidecarStale
+	}
+	return istioSidecarUnsupportedSkew
+}
+
+// check if the pods of a namespace are audited for a control plane of istio, the namespaces
+// using the control plane and, for the control plane without a revision, the namespaces
+// without a revision whose pods were injected manually
+func istioNamespaceAuditedForControlPlane(namespace corev1.Namespace, controlPlane operatorv1alpha1.IstioControlPlane) bool {
+	if IstioNamespaceUsesControlPlane(namespace, controlPlane) {
+		return true
+	}
+	_, ok := namespace.ObjectMeta.Labels[operatorv1alpha1.IstioRevisionLabel]
+	return controlPlane.Revision == "" && !ok
+}
+
+// compare the versions of istio's sidecars in the running pods with the version of istio's
+// control plane, and save the number of pods up to date, stale and with an unsupported
+// skew in each namespace in istio CR's status and in the ccp_istio_operator_sidecars
+// metric. The sidecars are audited at most every istioSidecarAuditInterval and when the
+// version of the control plane changes, returns the time until the next audit.
+func (r *IstioReconciler) AuditIstioSidecars(ctx context.Context, ist *operatorv1alpha1.Istio) (time.Duration, error) {
+	version := IstioControlPlaneVersion(ist)
+	if version == "" {
+		return 0, nil
+	}
+	if audit := ist.Status.SidecarAudit; audit != nil && audit.Version == version &&
+		time.Since(audit.LastAuditTime.Time) < istioSidecarAuditInterval {
+		// the metric is published again from istio CR's status after the istio operator restarts
+		SetIstioSidecarMetrics(ist, nil)
+		return istioSidecarAuditInterval - time.Since(audit.LastAuditTime.Time), nil
+	}
+
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return 0, errors.New(fmt.Sprintf("failed to list namespaces, %s", err.Error()))
+	}
+	controlPlane := IstioInstalledControlPlane(ist)
+	audited := map[string]bool{}
+	for _, namespace := range namespaceList.Items {
+		audited[namespace.ObjectMeta.Name] = istioNamespaceAuditedForControlPlane(namespace, controlPlane)
+	}
+	var podList corev1.PodList
+	if err := r.List(ctx, &podList); err != nil {
+		return 0, errors.New(fmt.Sprintf("failed to list pods, %s", err.Error()))
+	}
+
+	audit := &operatorv1alpha1.IstioSidecarAuditStatus{Version: version, LastAuditTime: v1.Now()}
+	namespaces := map[string]*operatorv1alpha1.IstioSidecarNamespaceStatus{}
+	for _, pod := range podList.Items {
+		if !audited[pod.ObjectMeta.Namespace] || pod.Status.Phase == corev1.PodSucceeded ||
+			pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		tag, ok := istioProxyImageTag(pod)
+		if !ok {
+			continue
+		}
+		namespace := namespaces[pod.ObjectMeta.Namespace]
+		if namespace == nil {
+			namespace = &operatorv1alpha1.IstioSidecarNamespaceStatus{Name: pod.ObjectMeta.Namespace}
+			namespaces[pod.ObjectMeta.Namespace] = namespace
+		}
+		skew := IstioSidecarSkew(version, tag)
+		switch skew {
+		case istioSidecarUpToDate:
+			namespace.UpToDate++
+			audit.UpToDate++
+		case istioSidecarStale:
+			namespace.Stale++
+			audit.Stale++
+		default:
+			namespace.UnsupportedSkew++
+			audit.UnsupportedSkew++
+		}
+		if tag == "" {
+			tag = "unknown"
+		}
+		if skew != istioSidecarUpToDate && !containsString(namespace.SkewedVersions, tag) {
+			namespace.SkewedVersions = append(namespace.SkewedVersions, tag)
+		}
+	}
+	for _, namespace := range namespaces {
+		sort.Strings(namespace.SkewedVersions)
+		audit.Namespaces = append(audit.Namespaces, *namespace)
+	}
+	sort.Slice(audit.Namespaces, func(i, j int) bool {
+		return audit.Namespaces[i].Name < audit.Namespaces[j].Name
+	})
+
+	previous := ist.Status.SidecarAudit
+	ist.Status.SidecarAudit = audit
+	if err := r.Status().Update(ctx, ist); err != nil {
+		return 0, errors.New(fmt.Sprintf("failed to save sidecar audit in Istio CR %s status, %s",
+			ist.ObjectMeta.Name, err.Error()))
+	}
+	SetIstioSidecarMetrics(ist, previous)
+	if audit.Stale != 0 || audit.UnsupportedSkew != 0 {
+		r.Log.Info(fmt.Sprintf("sidecars of istio %s: %d up to date, %d stale, %d with unsupported skew", version,
+			audit.UpToDate, audit.Stale, audit.UnsupportedSkew))
+	}
+	return istioSidecarAuditInterval, nil
+}
+
+// set the ccp_istio_operator_sidecars metric of istio CR to the last sidecar audit in its
+// status, the series of the namespaces in the previous audit that have no pods with
+// istio's sidecar anymore are deleted
+func SetIstioSidecarMetrics(ist *operatorv1alpha1.Istio, previous *operatorv1alpha1.IstioSidecarAuditStatus) {
+	name := istioCRName(ist)
+	current := map[string]bool{}
+	if audit := ist.Status.SidecarAudit; audit != nil {
+		for _, namespace := range audit.Namespaces {
+			current[namespace.Name] = true
+			istioSidecarsGauge.WithLabelValues(name, namespace.Name, istioSidecarUpToDate).Set(float64(namespace.UpToDate))
+			istioSidecarsGauge.WithLabelValues(name, namespace.Name, istioSidecarStale).Set(float64(namespace.Stale))
+			istioSidecarsGauge.WithLabelValues(name, namespace.Name, istioSidecarUnsupportedSkew).Set(
+				float64(namespace.UnsupportedSkew))
+		}
+	}
+	if previous == nil {
+		return
+	}
+	for _, namespace := range previous.Namespaces {
+		if !current[namespace.Name] {
+			deleteIstioSidecarMetrics(name, namespace.Name)
+		}
+	}
+}
+
+// delete the ccp_istio_operator_sidecars metric of istio CR when istio CR is deleted
+func DeleteIstioSidecarMetrics(ist *operatorv1alpha1.Istio) {
+	if ist.Status.SidecarAudit == nil {
+		return
+	}
+	for _, namespace := range ist.Status.SidecarAudit.Namespaces {
+		deleteIstioSidecarMetrics(istioCRName(ist), namespace.Name)
+	}
+}
+
+// delete the series of the ccp_istio_operator_sidecars metric of a namespace
+func deleteIstioSidecarMetrics(name string, namespace string) {
+	for _, skew := range []string{istioSidecarUpToDate, istioSidecarStale, istioSidecarUnsupportedSkew} {
+		istioSidecarsGauge.DeleteLabelValues(name, namespace, skew)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// running pod with istio's sidecar of an image, without sidecar if the image is empty
+func testSidecarPod(namespace string, name string, image string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.ObjectMeta.Namespace = namespace
+	pod.ObjectMeta.Name = name
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "docker.io/bookinfo/" + name + ":1.0"}}
+	if image != "" {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: istioProxyContainerName,
+			Image: image})
+	}
+	pod.Status.Phase = corev1.PodRunning
+	return pod
+}
+
+// series of the ccp_istio_operator_sidecars metric of istio CR by namespace and skew
+func testIstioSidecarMetrics(t *testing.T, ist *operatorv1alpha1.Istio) map[string]float64 {
+	metrics := make(chan prometheus.Metric, 100)
+	istioSidecarsGauge.Collect(metrics)
+	close(metrics)
+	series := map[string]float64{}
+	for metric := range metrics {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		labels := map[string]string{}
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["istio"] == istioCRName(ist) {
+			series[labels["namespace"]+" "+labels["skew"]] = m.GetGauge().GetValue()
+		}
+	}
+	return series
+}
+
+func TestIstioControlPlaneVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{"", ""},
+		{"istio-1.1.8-ccp1.tgz", "1.1.8-ccp1"},
+		{"/opt/ccp/charts/istio-1.3.0.tgz", "1.3.0"},
+		{"bundle://istio.tgz", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			ist := testIstioCR("ccp-istio", true)
+			ist.Status.Version = test.version
+			if version := IstioControlPlaneVersion(ist); version != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, version)
+			}
+		})
+	}
+}
+
+func TestIstioProxyImageTag(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+		sidecar  bool
+	}{
+		{image: ""},
+		{image: "docker.io/istio/proxyv2:1.3.0", expected: "1.3.0", sidecar: true},
+		{image: "registry.example.com:5000/istio/proxyv2:1.1.8-ccp1", expected: "1.1.8-ccp1", sidecar: true},
+		{image: "registry.example.com:5000/istio/proxyv2", sidecar: true},
+		{image: "docker.io/istio/proxyv2@sha256:0123456789abcdef", sidecar: true},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			tag, sidecar := istioProxyImageTag(*testSidecarPod("bookinfo", "productpage", test.image))
+			if tag != test.expected || sidecar != test.sidecar {
+				t.Errorf("expected %q, %v, got %q, %v", test.expected, test.sidecar, tag, sidecar)
+			}
+		})
+	}
+}
+
+func TestIstioSidecarSkew(t *testing.T) {
+	tests := []struct {
+		sidecar  string
+		expected string
+	}{
+		{"1.3.0", istioSidecarUpToDate},
+		{"1.3.1", istioSidecarStale},
+		{"1.2.5", istioSidecarStale},
+		{"1.1.8", istioSidecarUnsupportedSkew},
+		{"1.4.0", istioSidecarUnsupportedSkew},
+		{"2.3.0", istioSidecarUnsupportedSkew},
+		{"", istioSidecarUnsupportedSkew},
+	}
+	for _, test := range tests {
+		t.Run(test.sidecar, func(t *testing.T) {
+			if skew := IstioSidecarSkew("1.3.0", test.sidecar); skew != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, skew)
+			}
+		})
+	}
+}
+
+func TestAuditIstioSidecars(t *testing.T) {
+	ist := testIstioCR("sidecar-audit", true)
+	ist.Status.Version = "istio-1.3.0.tgz"
+	failed := testSidecarPod("bookinfo", "failed", "docker.io/istio/proxyv2:1.1.8")
+	failed.Status.Phase = corev1.PodFailed
+	r := fakeIstioReconciler(ist,
+		testNamespace("bookinfo", map[string]string{istioInjectionLabel: "enabled"}),
+		testNamespace("manual", nil),
+		testNamespace("canary", map[string]string{operatorv1alpha1.IstioRevisionLabel: "canary"}),
+		testSidecarPod("bookinfo", "productpage", "docker.io/istio/proxyv2:1.3.0"),
+		testSidecarPod("bookinfo", "reviews", "docker.io/istio/proxyv2:1.2.5"),
+		testSidecarPod("bookinfo", "ratings", "docker.io/istio/proxyv2@sha256:0123456789abcdef"),
+		testSidecarPod("bookinfo", "details", ""), failed,
+		testSidecarPod("manual", "legacy", "docker.io/istio/proxyv2:1.1.8"),
+		testSidecarPod("canary", "frontend", "docker.io/istio/proxyv2:1.1.8"))
+	ctx := context.TODO()
+
+	after, err := r.AuditIstioSidecars(ctx, ist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != istioSidecarAuditInterval {
+		t.Errorf("expected next audit after %s, got %s", istioSidecarAuditInterval, after)
+	}
+	audit := ist.Status.SidecarAudit
+	expected := []operatorv1alpha1.IstioSidecarNamespaceStatus{
+		{Name: "bookinfo", UpToDate: 1, Stale: 1, UnsupportedSkew: 1, SkewedVersions: []string{"1.2.5", "unknown"}},
+		{Name: "manual", UnsupportedSkew: 1, SkewedVersions: []string{"1.1.8"}},
+	}
+	if audit.Version != "1.3.0" || audit.UpToDate != 1 || audit.Stale != 1 || audit.UnsupportedSkew != 2 ||
+		!reflect.DeepEqual(audit.Namespaces, expected) {
+		t.Errorf("unexpected audit %+v", audit)
+	}
+	series := map[string]float64{"bookinfo up_to_date": 1, "bookinfo stale": 1, "bookinfo unsupported_skew": 1,
+		"manual up_to_date": 0, "manual stale": 0, "manual unsupported_skew": 1}
+	if metrics := testIstioSidecarMetrics(t, ist); !reflect.DeepEqual(metrics, series) {
+		t.Errorf("expected metrics %v, got %v", series, metrics)
+	}
+
+	// the sidecars are not audited again before the interval
+	if err := r.Delete(ctx, testSidecarPod("manual", "legacy", "")); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := r.AuditIstioSidecars(ctx, ist); err != nil || after > istioSidecarAuditInterval ||
+		ist.Status.SidecarAudit != audit {
+		t.Errorf("sidecars audited again after %s, %v", after, err)
+	}
+
+	// the sidecars are audited again when the version of the control plane changes, the
+	// series of the namespaces without sidecars are deleted
+	ist.Status.Version = "istio-1.2.5.tgz"
+	if _, err := r.AuditIstioSidecars(ctx, ist); err != nil {
+		t.Fatal(err)
+	}
+	series = map[string]float64{"bookinfo up_to_date": 1, "bookinfo stale": 0, "bookinfo unsupported_skew": 2}
+	if metrics := testIstioSidecarMetrics(t, ist); !reflect.DeepEqual(metrics, series) {
+		t.Errorf("expected metrics %v, got %v", series, metrics)
+	}
+
+	DeleteIstioSidecarMetrics(ist)
+	if metrics := testIstioSidecarMetrics(t, ist); len(metrics) != 0 {
+		t.Errorf("metrics not deleted: %v", metrics)
+	}
+
+	// istio CR without a version of the control plane is not audited
+	ist.Status.Version = ""
+	ist.Status.SidecarAudit = nil
+	if after, err := r.AuditIstioSidecars(ctx, ist); err != nil || after != 0 || ist.Status.SidecarAudit != nil {
+		t.Errorf("sidecars audited without a version, %s, %v", after, err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// status.active value of istio CRs that do not own the mesh
+const IstioConflictedStatus = "Conflicted"
+
+// the istio CR that owns the mesh among istio CRs in all namespaces with the same control
+// plane. Only one instance of a control plane of istio can be installed on kubernetes, so
+// only one istio CR is allowed for a control plane in the cluster. The istio CR that has
+// the istio operator's finalizer owns the mesh as it installed istio, otherwise the oldest
+// istio CR owns the mesh. Returns nil if there is no istio CR.
+func IstioMeshOwner(istios []operatorv1alpha1.Istio) *operatorv1alpha1.Istio {
+	var candidates []operatorv1alpha1.Istio
+	for _, istio := range istios {
+		if containsString(istio.ObjectMeta.Finalizers, operatorv1alpha1.IstioFinalizer) {
+			candidates = append(candidates, istio)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, istios...)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// istio CRs created at the same time are ordered by namespace and name so that
+	// all reconciles agree on the owner
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ti, tj := candidates[i].ObjectMeta.CreationTimestamp, candidates[j].ObjectMeta.CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return istioCRName(&candidates[i]) < istioCRName(&candidates[j])
+	})
+	return &candidates[0]
+}
+
+// set the Conflicted condition of an istio CR that does not own the mesh, naming the
+// istio CR that owns it. The status is not updated again if it did not change.
+func (r *IstioReconciler) SetIstioConflicted(ctx context.Context, ist *operatorv1alpha1.Istio,
+	owner *operatorv1alpha1.Istio) error {
+	message := fmt.Sprintf("istio is managed by Istio CR %s, only one istio CR is allowed for a control plane "+
+		"of istio. Delete Istio CR %s or set a namespace, releasePrefix and revision in its controlPlane section "+
+		"that are not used by another istio CR.", istioCRName(owner), istioCRName(ist))
+	condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionConflicted)
+	if ist.Status.Active == IstioConflictedStatus && condition != nil &&
+		condition.Status == corev1.ConditionTrue && condition.Message == message {
+		return nil
+	}
+	r.Log.Info(fmt.Sprintf("Istio CR %s conflicts with Istio CR %s", istioCRName(ist), istioCRName(owner)))
+	return r.UpdateIstioCRStatus(ctx, ist, IstioConflictedStatus, errors.New(message))
+}
+
+// istio CRs that do not own the mesh, they are reconciled when an istio CR is created,
+// updated or deleted so that one of them owns the mesh when its owner is deleted
+func (r *IstioReconciler) IstioCRsConflicted(obj handler.MapObject) []reconcile.Request {
+	var IstioList operatorv1alpha1.IstioList
+	if err := r.List(context.Background(), &IstioList); err != nil {
+		r.Log.Error(err, "Failed to get list of istio CRs")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, istio := range IstioList.Items {
+		if !istio.Status.IsConditionTrue(operatorv1alpha1.IstioConditionConflicted) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name:      istio.ObjectMeta.Name,
+			Namespace: istio.ObjectMeta.Namespace,
+		}})
+	}
+	return requests
+}
+
+// namespace/name of an istio CR
+func istioCRName(ist *operatorv1alpha1.Istio) string {
+	return types.NamespacedName{Namespace: ist.ObjectMeta.Namespace, Name: ist.ObjectMeta.Name}.String()
+}
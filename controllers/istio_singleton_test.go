@@ -0,0 +1,137 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// istio CR created age ago
+func testIstioCRCreated(namespace string, name string, finalizer bool, age time.Duration) operatorv1alpha1.Istio {
+	ist := testIstioCR(name, finalizer)
+	ist.ObjectMeta.Namespace = namespace
+	ist.ObjectMeta.CreationTimestamp = v1.NewTime(time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC).Add(-age))
+	return *ist
+}
+
+func TestIstioMeshOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		istios   []operatorv1alpha1.Istio
+		expected string
+	}{
+		{name: "no istio CR"},
+		{name: "oldest istio CR", istios: []operatorv1alpha1.Istio{
+			testIstioCRCreated("default", "new", false, time.Minute),
+			testIstioCRCreated("default", "old", false, time.Hour)},
+			expected: "default/old"},
+		{name: "istio CR that installed istio", istios: []operatorv1alpha1.Istio{
+			testIstioCRCreated("default", "old", false, time.Hour),
+			testIstioCRCreated("default", "installed", true, time.Minute)},
+			expected: "default/installed"},
+		{name: "oldest istio CR that installed istio", istios: []operatorv1alpha1.Istio{
+			testIstioCRCreated("default", "new", true, time.Minute),
+			testIstioCRCreated("default", "old", true, time.Hour),
+			testIstioCRCreated("default", "oldest", false, 2*time.Hour)},
+			expected: "default/old"},
+		{name: "istio CRs created at the same time", istios: []operatorv1alpha1.Istio{
+			testIstioCRCreated("team-b", "istio", false, time.Hour),
+			testIstioCRCreated("team-a", "istio", false, time.Hour)},
+			expected: "team-a/istio"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owner := IstioMeshOwner(test.istios)
+			if test.expected == "" {
+				if owner != nil {
+					t.Errorf("expected no owner, got %s", istioCRName(owner))
+				}
+				return
+			}
+			if owner == nil || istioCRName(owner) != test.expected {
+				t.Errorf("expected owner %s, got %v", test.expected, owner)
+			}
+		})
+	}
+}
+
+func TestSetIstioConflicted(t *testing.T) {
+	owner := testIstioCRCreated("default", "owner", true, time.Hour)
+	ist := testIstioCR("conflicted", false)
+	r := fakeIstioReconciler(ist)
+	ctx := context.TODO()
+
+	if err := r.SetIstioConflicted(ctx, ist, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if ist.Status.Active != IstioConflictedStatus {
+		t.Errorf("expected status %s, got %s", IstioConflictedStatus, ist.Status.Active)
+	}
+	condition := ist.Status.GetCondition(operatorv1alpha1.IstioConditionConflicted)
+	if condition == nil || condition.Status != corev1.ConditionTrue {
+		t.Fatalf("expected Conflicted condition, got %+v", condition)
+	}
+
+	// the status is not updated again when it did not change
+	updated := ist.Status.LastUpdateTime
+	ist.Status.LastUpdateTime = ""
+	if err := r.SetIstioConflicted(ctx, ist, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if ist.Status.LastUpdateTime != "" {
+		t.Errorf("status updated again at %s, first updated at %s", ist.Status.LastUpdateTime, updated)
+	}
+
+	// the status is updated when istio CR conflicts with another istio CR
+	other := testIstioCRCreated("default", "other", true, time.Hour)
+	if err := r.SetIstioConflicted(ctx, ist, &other); err != nil {
+		t.Fatal(err)
+	}
+	if ist.Status.LastUpdateTime == "" {
+		t.Error("status not updated for another owner")
+	}
+}
+
+func TestIstioCRsConflicted(t *testing.T) {
+	conflicted := func(name string, status corev1.ConditionStatus) runtime.Object {
+		ist := testIstioCR(name, false)
+		ist.Status.SetCondition(operatorv1alpha1.IstioCondition{Type: operatorv1alpha1.IstioConditionConflicted,
+			Status: status})
+		return ist
+	}
+	r := fakeIstioReconciler(conflicted("a", corev1.ConditionTrue), conflicted("b", corev1.ConditionFalse),
+		testIstioCR("c", true), conflicted("d", corev1.ConditionTrue))
+	requests := r.IstioCRsConflicted(handler.MapObject{})
+	var names []types.NamespacedName
+	for _, request := range requests {
+		names = append(names, request.NamespacedName)
+	}
+	expected := []types.NamespacedName{{Namespace: "default", Name: "a"}, {Namespace: "default", Name: "d"}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+// version of istio in the name of a helm chart or in istio CR's status, for example
+// 1.1.8 in /opt/ccp/charts/istio-1.1.8-ccp1.tgz
+var istioVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// validate istio CR spec, istio CR spec is validated by the validating webhook when
+// istio CR is created or updated and again by the istio operator before it is applied
+func ValidateIstioSpec(spec operatorv1alpha1.IstioSpec) error {
+	if spec.CcpIstioInit.Chart == "" && spec.Version != "" {
+		return errors.New(fmt.Sprintf("istio-init helm chart for istio %s is empty in istio CR spec, the "+
+			"charts of spec.version are set by the defaulting webhook of istio CR.", spec.Version))
+	}
+	if spec.CcpIstioInit.Chart == "" {
+		return errors.New("istio-init helm chart is empty in istio CR spec, cannot install istio-init and istio.")
+	}
+	if err := ValidateIstioChart(operatorv1alpha1.IstioInitHelmChartName, spec.CcpIstioInit.Chart); err != nil {
+		return err
+	}
+	if err := ValidateIstioControlPlane(spec); err != nil {
+		return err
+	}
+	if spec.DataPlaneRollout != nil && spec.DataPlaneRollout.NamespaceSelector != nil {
+		if _, err := v1.LabelSelectorAsSelector(spec.DataPlaneRollout.NamespaceSelector); err != nil {
+			return errors.New(fmt.Sprintf("invalid namespaceSelector in spec.dataPlaneRollout, %s", err.Error()))
+		}
+	}
+
+	// istio is installed in the primary cluster and istio-remote in a remote cluster
+	if err := ValidateIstioTopology(spec); err != nil {
+		return err
+	}
+	if err := ValidateIstioChart(IstioControlPlaneChartName(spec), IstioControlPlaneChart(spec)); err != nil {
+		return err
+	}
+	if err := ValidateIstioControlPlaneChart(spec, ""); err != nil {
+		return err
+	}
+	if err := ValidateIstioChartBundle(spec); err != nil {
+		return err
+	}
+
+	if err := ValidateIstioValues(operatorv1alpha1.IstioInitHelmChartName, spec.CcpIstioInit.Values); err != nil {
+		return err
+	}
+	if err := ValidateIstioValues(operatorv1alpha1.IstioHelmChartName, spec.CcpIstio.Values); err != nil {
+		return err
+	}
+	return ValidateIstioValues(operatorv1alpha1.IstioRemoteHelmChartName, spec.CcpIstioRemote.Values)
+}
+
+// check if a helm chart in istio CR spec exists and if its sha256 digest is valid, charts
+// that are URLs are downloaded by istio operator and charts of the chart bundle are loaded
+// from it
+func ValidateIstioChart(chartName string, chart string) error {
+	chart, digest := ParseChartReference(chart)
+	if digest != "" && !chartDigestRegexp.MatchString(digest) {
+		return errors.New(fmt.Sprintf("sha256 digest %s of %s helm chart %s is not 64 lowercase hexadecimal "+
+			"characters.", digest, chartName, chart))
+	}
+	if IsOCIChart(chart) {
+		if _, err := parseOCIReference(chart); err != nil {
+			return errors.New(fmt.Sprintf("%s helm chart %s is not a valid OCI reference "+
+				"oci://<registry>/<repository>:<tag>.", chartName, chart))
+		}
+		return nil
+	}
+	if IsBundleChart(chart) {
+		if name := bundleChartName(chart); name == "" || strings.Contains(name, "/") {
+			return errors.New(fmt.Sprintf("%s helm chart %s is not a file name in the chart bundle "+
+				"bundle://<file name>.", chartName, chart))
+		}
+		return nil
+	}
+	if IsRemoteChart(chart) {
+		if u, err := url.Parse(chart); err != nil || u.Host == "" {
+			return errors.New(fmt.Sprintf("%s helm chart %s is not a valid URL.", chartName, chart))
+		}
+		return nil
+	}
+	if _, err := os.Stat(chart); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("%s helm chart %s does not exist. "+
+			"Make sure that %s helm chart %s exists on the host running this pod, %s on "+
+			"the host will be mounted inside the istio-operator container. Check value of chartsPath "+
+			"in istio-operator's helm chart.", chartName, chart, chartName, chart, chart))
+	}
+	return nil
+}
+
+// check if the values of a helm chart in istio CR spec are a valid YAML map
+func ValidateIstioValues(chartName string, values string) error {
+	if values == "" {
+		return nil
+	}
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal([]byte(values), &parsed); err != nil {
+		return errors.New(fmt.Sprintf("values of %s in istio CR spec are not valid YAML, %s", chartName,
+			err.Error()))
+	}
+	return nil
+}
+
+// validate an update of istio CR. The cluster's role in a multi-cluster mesh (primary
+// cluster or remote cluster) and the control plane cannot be changed, and istio cannot be
+// downgraded to an older minor version in place as istio does not support it, it must be
+// reinstalled (spec.upgradeStrategy Reinstall) or rolled back (spec.rollbackTo).
+func ValidateIstioSpecUpdate(old *operatorv1alpha1.Istio, ist *operatorv1alpha1.Istio) error {
+	if IstioIsRemote(old.Spec) != IstioIsRemote(ist.Spec) {
+		return errors.New(fmt.Sprintf("%s helm chart cannot be replaced with %s helm chart in istio CR spec, "+
+			"the cluster's role in a multi-cluster mesh is immutable. Delete istio CR and create it again.",
+			IstioControlPlaneChartName(old.Spec), IstioControlPlaneChartName(ist.Spec)))
+	}
+	if IstioControlPlaneNamespace(old.Spec) != IstioControlPlaneNamespace(ist.Spec) ||
+		old.Spec.ControlPlane.ReleasePrefix != ist.Spec.ControlPlane.ReleasePrefix ||
+		old.Spec.ControlPlane.Revision != ist.Spec.ControlPlane.Revision {
+		return errors.New("controlPlane section of istio CR spec is immutable, create another istio CR to " +
+			"install another control plane of istio.")
+	}
+	if ist.Spec.HelmVersion == operatorv1alpha1.HelmVersionV2 &&
+		(old.Status.HelmVersion == operatorv1alpha1.HelmVersionV3 || old.Spec.HelmVersion == operatorv1alpha1.HelmVersionV3) {
+		return errors.New("istio's helm releases are managed by helm 3 and cannot be managed by helm 2 again, " +
+			"spec.helmVersion cannot be changed from v3 to v2.")
+	}
+	if old.Status.Version != "" && IstioInstaller(old.Spec) != IstioInstaller(ist.Spec) {
+		return errors.New(fmt.Sprintf("istio is installed by the %s installer, spec.installer cannot be changed "+
+			"once istio is installed. Delete istio CR and create it again.", IstioInstaller(old.Spec)))
+	}
+	if IstioCanaryUpgradeInProgress(old) {
+		// only the batches of the canary upgrade in progress can be changed
+		oldSpec, newSpec := old.Spec, ist.Spec
+		oldSpec.Canary, newSpec.Canary = nil, nil
+		if !reflect.DeepEqual(oldSpec, newSpec) {
+			return errors.New(fmt.Sprintf("a canary upgrade of istio to revision %s is in progress, istio CR spec "+
+				"can be updated only after all the namespaces are moved to revision %s.",
+				old.Status.Canary.To.Revision, old.Status.Canary.To.Revision))
+		}
+		return nil
+	}
+
+	// istio is not downgraded in place when it is reinstalled or when a new control plane
+	// is installed by a canary upgrade
+	if ist.Spec.UpgradeStrategy == operatorv1alpha1.UpgradeStrategyReinstall ||
+		ist.Spec.UpgradeStrategy == operatorv1alpha1.UpgradeStrategyCanary {
+		return nil
+	}
+	if old.Spec.RollbackTo != nil && ist.Spec.RollbackTo == nil {
+		// the istio operator sets istio CR's spec to the revision in spec.rollbackTo
+		return nil
+	}
+	installed := old.Status.Version
+	if installed == "" {
+		installed = IstioControlPlaneChart(old.Spec)
+	}
+	if IstioVersionIsOlder(IstioControlPlaneChart(ist.Spec), installed) {
+		return errors.New(fmt.Sprintf("cannot downgrade istio from %s to %s in place, set upgradeStrategy "+
+			"to Reinstall in istio CR spec to delete istio and install %s, or use rollbackTo to roll istio "+
+			"back to an earlier revision.", filepath.Base(installed),
+			filepath.Base(IstioControlPlaneChart(ist.Spec)), filepath.Base(IstioControlPlaneChart(ist.Spec))))
+	}
+	return nil
+}
+
+// check if the version of istio of a helm chart is an older minor version than the
+// version of istio of another helm chart, patch versions are not compared as istio can
+// be downgraded in place to an older patch version
+func IstioVersionIsOlder(chart string, than string) bool {
+	version := istioVersionRegexp.FindStringSubmatch(filepath.Base(chart))
+	thanVersion := istioVersionRegexp.FindStringSubmatch(filepath.Base(than))
+	if version == nil || thanVersion == nil {
+		return false
+	}
+	for i := 1; i <= 2; i++ {
+		v, _ := strconv.Atoi(version[i])
+		t, _ := strconv.Atoi(thanVersion[i])
+		if v != t {
+			return v < t
+		}
+	}
+	return false
+}
+
+// check if istio CR's spec changed in an update of istio CR
+func IstioSpecChanged(old *operatorv1alpha1.Istio, ist *operatorv1alpha1.Istio) bool {
+	return !reflect.DeepEqual(old.Spec, ist.Spec)
+}
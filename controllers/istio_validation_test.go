@@ -0,0 +1,190 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+)
+
+func TestIstioVersionIsOlder(t *testing.T) {
+	tests := []struct {
+		chart    string
+		than     string
+		expected bool
+	}{
+		{"/opt/ccp/charts/istio-1.1.8-ccp1.tgz", "/opt/ccp/charts/istio-1.2.2-ccp1.tgz", true},
+		{"/opt/ccp/charts/istio-1.2.2-ccp1.tgz", "/opt/ccp/charts/istio-1.1.8-ccp1.tgz", false},
+		{"istio-1.9.0.tgz", "istio-1.10.0.tgz", true},
+		{"istio-0.9.0.tgz", "1.1.8", true},
+		{"istio-1.1.7-ccp1.tgz", "istio-1.1.8-ccp2.tgz", false},
+		{"istio-1.1.8-ccp1.tgz", "istio-1.1.8-ccp1.tgz", false},
+		{"istio-1.10.0.tgz", "istio-1.9.0.tgz", false},
+		{"https://charts.example.com/istio-1.1.8.tgz", "1.2.2", true},
+		{"bundle://istio.tgz", "istio-1.2.2.tgz", false},
+	}
+	for _, test := range tests {
+		t.Run(test.chart+" "+test.than, func(t *testing.T) {
+			if older := IstioVersionIsOlder(test.chart, test.than); older != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, older)
+			}
+		})
+	}
+}
+
+func TestValidateIstioValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values string
+		err    bool
+	}{
+		{name: "no values"},
+		{name: "map", values: "global:\n  hub: docker.io/istio\n"},
+		{name: "not YAML", values: "global:\n\thub: docker.io/istio\n", err: true},
+		{name: "not a map", values: "- global\n", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ValidateIstioValues("istio", test.values); (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateIstioSpecUpdate(t *testing.T) {
+	istio := func(chart string) *operatorv1alpha1.Istio {
+		ist := testIstioCR("ccp-istio", true)
+		ist.Spec.CcpIstioInit.Chart = "/opt/ccp/charts/istio-init-1.2.2-ccp1.tgz"
+		ist.Spec.CcpIstio.Chart = chart
+		return ist
+	}
+	tests := []struct {
+		name   string
+		old    func(*operatorv1alpha1.Istio)
+		update func(*operatorv1alpha1.Istio)
+		err    bool
+	}{
+		{
+			name:   "upgrade",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.3.0.tgz" },
+		},
+		{
+			name:   "downgrade to an older patch version",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.2.1.tgz" },
+		},
+		{
+			name:   "downgrade to an older minor version",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.1.8.tgz" },
+			err:    true,
+		},
+		{
+			name: "downgrade below the installed version",
+			old:  func(ist *operatorv1alpha1.Istio) { ist.Status.Version = "1.3.0" },
+			err:  true,
+		},
+		{
+			name: "downgrade by a reinstall",
+			update: func(ist *operatorv1alpha1.Istio) {
+				ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.1.8.tgz"
+				ist.Spec.UpgradeStrategy = operatorv1alpha1.UpgradeStrategyReinstall
+			},
+		},
+		{
+			name: "downgrade by a rollback",
+			old: func(ist *operatorv1alpha1.Istio) {
+				ist.Spec.RollbackTo = &operatorv1alpha1.IstioRollback{Revision: 1}
+			},
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.CcpIstio.Chart = "/opt/ccp/charts/istio-1.1.8.tgz" },
+		},
+		{
+			name: "primary cluster becomes a remote cluster",
+			update: func(ist *operatorv1alpha1.Istio) {
+				ist.Spec.CcpIstio.Chart = ""
+				ist.Spec.CcpIstioRemote.Chart = "/opt/ccp/charts/istio-remote-1.2.2-ccp1.tgz"
+			},
+			err: true,
+		},
+		{
+			name:   "control plane changed",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.ControlPlane.Namespace = "istio-canary" },
+			err:    true,
+		},
+		{
+			name:   "control plane set to its defaults",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.ControlPlane.Namespace = "istio-system" },
+		},
+		{
+			name:   "helm 3 back to helm 2",
+			old:    func(ist *operatorv1alpha1.Istio) { ist.Status.HelmVersion = operatorv1alpha1.HelmVersionV3 },
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.HelmVersion = operatorv1alpha1.HelmVersionV2 },
+			err:    true,
+		},
+		{
+			name:   "helm 2 to helm 3",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.HelmVersion = operatorv1alpha1.HelmVersionV3 },
+		},
+		{
+			name:   "installer changed after istio is installed",
+			old:    func(ist *operatorv1alpha1.Istio) { ist.Status.Version = "1.2.2" },
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.Installer = operatorv1alpha1.InstallerManifests },
+			err:    true,
+		},
+		{
+			name:   "installer changed before istio is installed",
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.Installer = operatorv1alpha1.InstallerManifests },
+		},
+		{
+			name:   "spec changed during a canary upgrade",
+			old:    testCanaryUpgradeInProgress,
+			update: func(ist *operatorv1alpha1.Istio) { ist.Spec.CcpIstio.Values = "gateways:\n  enabled: false\n" },
+			err:    true,
+		},
+		{
+			name: "batches changed during a canary upgrade",
+			old:  testCanaryUpgradeInProgress,
+			update: func(ist *operatorv1alpha1.Istio) {
+				ist.Spec.Canary = &operatorv1alpha1.IstioCanary{Batches: []operatorv1alpha1.IstioCanaryBatch{
+					{Namespaces: []string{"bookinfo"}}}}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old := istio("/opt/ccp/charts/istio-1.2.2-ccp1.tgz")
+			if test.old != nil {
+				test.old(old)
+			}
+			ist := old.DeepCopy()
+			ist.Spec.RollbackTo = nil
+			if test.update != nil {
+				test.update(ist)
+			}
+			if err := ValidateIstioSpecUpdate(old, ist); (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+// canary upgrade of istio to the revision 1-3-0 in progress
+func testCanaryUpgradeInProgress(ist *operatorv1alpha1.Istio) {
+	ist.Spec.UpgradeStrategy = operatorv1alpha1.UpgradeStrategyCanary
+	ist.Status.Operation = &operatorv1alpha1.IstioOperation{Type: operatorv1alpha1.IstioOperationCanaryUpgrade}
+	ist.Status.Canary = &operatorv1alpha1.IstioCanaryStatus{To: operatorv1alpha1.IstioControlPlane{
+		Namespace: "istio-1-3-0", ReleasePrefix: "istio-1-3-0-", Revision: "1-3-0"}}
+}
@@ -0,0 +1,211 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+	operatorv1alpha2 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha2"
+)
+
+// paths at which the admission and conversion webhooks of istio CR are served
+const (
+	IstioConversionWebhookPath = "/convert"
+	IstioDefaultingWebhookPath = "/mutate-operator-ccp-cisco-com-v1alpha1-istio"
+	IstioValidatingWebhookPath = "/validate-operator-ccp-cisco-com-v1alpha1-istio"
+)
+
+// +kubebuilder:webhook:path=/mutate-operator-ccp-cisco-com-v1alpha1-istio,mutating=true,failurePolicy=fail,groups=operator.ccp.cisco.com,resources=istios,verbs=create;update,versions=v1alpha1;v1alpha2,name=mistio.operator.ccp.cisco.com
+
+// IstioDefaulter sets the charts and values of the version of istio in spec.version in
+// istio CRs when they are created or updated, so that an istio CR only needs the
+// version of istio
+type IstioDefaulter struct {
+	Log      logr.Logger
+	Defaults IstioDefaults
+	decoder  *admission.Decoder
+}
+
+// InjectDecoder injects the decoder of admission requests
+func (d *IstioDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
+
+// Handle sets the defaults of the istio CR in an admission request
+func (d *IstioDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ist, err := decodeIstio(d.decoder, req.Object, req.Kind.Version)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if ist.ObjectMeta.DeletionTimestamp != nil {
+		return admission.Allowed("")
+	}
+
+	var oldSpec *operatorv1alpha1.IstioSpec
+	if req.Operation == admissionv1beta1.Update {
+		old, err := decodeIstio(d.decoder, req.OldObject, req.Kind.Version)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		oldSpec = &old.Spec
+	}
+	if err := d.Defaults.DefaultIstioSpec(oldSpec, &ist.Spec); err != nil {
+		d.Log.Info(fmt.Sprintf("%s of Istio CR %s denied, %s", req.Operation, ist.ObjectMeta.Name, err.Error()))
+		return admission.Denied(err.Error())
+	}
+
+	// the defaulted istio CR is patched in the version of the admission request, without
+	// the values of v1alpha1 that are only kept when istio CR is read as v1alpha2
+	var obj runtime.Object = ist
+	if req.Kind.Version == operatorv1alpha2.GroupVersion.Version {
+		converted := &operatorv1alpha2.Istio{}
+		if err := converted.ConvertFrom(ist); err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		converted.ObjectMeta.Annotations = ist.ObjectMeta.Annotations
+		obj = converted
+	}
+	defaulted, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, defaulted)
+}
+
+// register the defaulting webhook of istio CR with the manager's webhook server
+func (d *IstioDefaulter) SetupWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(IstioDefaultingWebhookPath, &webhook.Admission{Handler: d})
+	return nil
+}
+
+// +kubebuilder:webhook:path=/validate-operator-ccp-cisco-com-v1alpha1-istio,mutating=false,failurePolicy=fail,groups=operator.ccp.cisco.com,resources=istios,verbs=create;update,versions=v1alpha1;v1alpha2,name=vistio.operator.ccp.cisco.com
+
+// IstioValidator validates istio CRs when they are created or updated so that invalid
+// istio CRs are rejected by kubectl instead of failing later with InvalidIstioCRSpec
+type IstioValidator struct {
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder of admission requests
+func (v *IstioValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle validates the istio CR in an admission request
+func (v *IstioValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ist, err := decodeIstio(v.decoder, req.Object, req.Kind.Version)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if req.Operation == admissionv1beta1.Update {
+		old, err := decodeIstio(v.decoder, req.OldObject, req.Kind.Version)
+		if err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// istio CR is updated by the istio operator to add and remove its finalizer,
+		// the spec is validated only when it changes
+		if ist.ObjectMeta.DeletionTimestamp != nil || !IstioSpecChanged(old, ist) {
+			return admission.Allowed("")
+		}
+		if err := ValidateIstioSpecUpdate(old, ist); err != nil {
+			v.Log.Info(fmt.Sprintf("update of Istio CR %s denied, %s", ist.ObjectMeta.Name, err.Error()))
+			return admission.Denied(err.Error())
+		}
+	}
+
+	if err := ValidateIstioSpec(ist.Spec); err != nil {
+		v.Log.Info(fmt.Sprintf("%s of Istio CR %s denied, %s", req.Operation, ist.ObjectMeta.Name, err.Error()))
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// register the validating webhook of istio CR with the manager's webhook server
+func (v *IstioValidator) SetupWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(IstioValidatingWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// decode the istio CR of an admission request, istio CRs of version v1alpha2 are
+// converted to v1alpha1 so that they are defaulted and validated as v1alpha1 istio CRs
+func decodeIstio(decoder *admission.Decoder, raw runtime.RawExtension, version string) (*operatorv1alpha1.Istio, error) {
+	ist := &operatorv1alpha1.Istio{}
+	if version != operatorv1alpha2.GroupVersion.Version {
+		if err := decoder.DecodeRaw(raw, ist); err != nil {
+			return nil, err
+		}
+		return ist, nil
+	}
+	src := &operatorv1alpha2.Istio{}
+	if err := decoder.DecodeRaw(raw, src); err != nil {
+		return nil, err
+	}
+	if err := src.ConvertTo(ist); err != nil {
+		return nil, err
+	}
+	return ist, nil
+}
+
+// set the conversion webhook of the CRD of istio CR to the service of the istio operator's
+// webhooks so that istio CRs are converted between v1alpha1 and v1alpha2 by the istio
+// operator, caBundle is the CA that signed the certificate served by the webhooks
+func SetIstioConversionWebhook(config *rest.Config, namespace string, service string, caBundle []byte) error {
+	extclientset, err := apiextclientset.NewForConfig(config)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s, %s", "failed to set conversion webhook of istio CRD", err.Error()))
+	}
+	crds := extclientset.ApiextensionsV1beta1().CustomResourceDefinitions()
+	crd, err := crds.Get(operatorv1alpha1.IstioCRDName, metav1.GetOptions{})
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s, %s", "failed to set conversion webhook of istio CRD", err.Error()))
+	}
+	path := IstioConversionWebhookPath
+	crd.Spec.Conversion = &apiextv1beta1.CustomResourceConversion{
+		Strategy: apiextv1beta1.WebhookConverter,
+		WebhookClientConfig: &apiextv1beta1.WebhookClientConfig{
+			Service: &apiextv1beta1.ServiceReference{
+				Namespace: namespace,
+				Name:      service,
+				Path:      &path,
+			},
+			CABundle: caBundle,
+		},
+	}
+	if _, err = crds.Update(crd); err != nil {
+		return errors.New(fmt.Sprintf("%s, %s", "failed to set conversion webhook of istio CRD", err.Error()))
+	}
+	return nil
+}
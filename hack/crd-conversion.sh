@@ -0,0 +1,33 @@
+#!/bin/sh
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# add the conversion webhook of the istio CRD generated by controller-gen, which does not
+# generate it. The service and the CA bundle are placeholders, the istio operator sets
+# them to --webhook-service, --webhook-service-namespace and its CA when it starts.
+set -e
+
+crd=${1:-config/crd/bases/operator.ccp.cisco.com_istios.yaml}
+grep -q '^  conversion:$' "$crd" && exit 0
+awk '/^  group: / {
+	print "  conversion:"
+	print "    strategy: Webhook"
+	print "    webhookClientConfig:"
+	print "      caBundle: Cg=="
+	print "      service:"
+	print "        name: webhook-service"
+	print "        namespace: system"
+	print "        path: /convert"
+}
+{ print }' "$crd" > "$crd.tmp"
+mv "$crd.tmp" "$crd"
@@ -16,15 +16,23 @@ limitations under the License.
 package main
 
 import (
+	"crypto"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	operatorv1alpha1 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha1"
+	operatorv1alpha2 "wwwin-github.cisco.com/CPSG/ccp-istio-operator/api/v1alpha2"
 	"wwwin-github.cisco.com/CPSG/ccp-istio-operator/controllers"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	// +kubebuilder:scaffold:imports
 )
@@ -36,31 +44,177 @@ var (
 
 func init() {
 
+	clientgoscheme.AddToScheme(scheme)
 	operatorv1alpha1.AddToScheme(scheme)
+	operatorv1alpha2.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
 	var metricsAddr string
+	var tillerHost string
+	var helmVersion string
+	var tillerNamespace string
+	var chartCacheDir string
+	var chartBundlePublicKey string
+	var chartBundleLoaderImage string
+	var releaseScanInterval time.Duration
+	var enableWebhooks bool
+	var webhookPort int
+	var webhookCertDir string
+	var webhookService string
+	var webhookServiceNamespace string
+	var defaultHub string
+	var defaultImagePullPolicy string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
+	flag.StringVar(&tillerHost, "tiller-host", "",
+		"The address of Tiller managing istio's helm 2 releases, tiller-deploy in --tiller-namespace if not set.")
+	flag.StringVar(&helmVersion, "helm-version", string(operatorv1alpha1.HelmVersionV2),
+		"The version of helm (v2 or v3) used for istio CRs that do not set spec.helmVersion.")
+	flag.StringVar(&tillerNamespace, "tiller-namespace", controllers.DefaultTillerNamespace,
+		"The namespace of Tiller, it stores the helm 2 releases that are migrated to helm 3 with spec.helmVersion v3.")
+	flag.StringVar(&chartCacheDir, "chart-cache-dir", controllers.DefaultChartCacheDir,
+		"The directory the charts downloaded from URLs in istio CRs are cached in.")
+	flag.StringVar(&chartBundlePublicKey, "chart-bundle-public-key", "",
+		"The PEM encoded public key verifying the signed manifests of the chart bundles of istio CRs.")
+	flag.StringVar(&chartBundleLoaderImage, "chart-bundle-loader-image", "",
+		"The image (with sh, tar, gzip and base64) of the pods reading the chart bundles of istio CRs from "+
+			"persistent volume claims, they are not read from persistent volume claims if not set.")
+	flag.DurationVar(&releaseScanInterval, "release-scan-interval", controllers.DefaultIstioReleaseScanInterval,
+		"The interval between two scans of CHARTS_PATH for the catalog of istio releases.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Serve the admission webhooks of istio CR.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port the admission webhooks are served at.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs",
+		"The directory containing tls.crt and tls.key served by the webhooks, and ca.crt that signed them.")
+	flag.StringVar(&webhookService, "webhook-service", "ccp-istio-operator-webhook",
+		"The service of the webhooks set in the conversion webhook of istio CRD.")
+	flag.StringVar(&webhookServiceNamespace, "webhook-service-namespace", "default",
+		"The namespace of the service of the webhooks set in the conversion webhook of istio CRD.")
+	flag.StringVar(&defaultHub, "default-hub", operatorv1alpha1.DefaultIstioHub,
+		"The registry of istio's images set in istio CRs with spec.version.")
+	flag.StringVar(&defaultImagePullPolicy, "default-image-pull-policy", operatorv1alpha1.DefaultIstioImagePullPolicy,
+		"The pull policy of istio's images set in istio CRs with spec.version.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.Logger(true))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{Scheme: scheme, MetricsBindAddress: metricsAddr})
+	if helmVersion != string(operatorv1alpha1.HelmVersionV2) && helmVersion != string(operatorv1alpha1.HelmVersionV3) {
+		setupLog.Error(nil, fmt.Sprintf("invalid --helm-version %s, it must be v2 or v3", helmVersion))
+		os.Exit(1)
+	}
+
+	if tillerHost == "" {
+		tillerHost = controllers.TillerHost(tillerNamespace)
+	}
+
+	// charts are not loaded from chart bundles without a public key to verify them
+	var chartBundleKey crypto.PublicKey
+	if chartBundlePublicKey != "" {
+		key, err := controllers.LoadChartBundlePublicKey(chartBundlePublicKey)
+		if err != nil {
+			setupLog.Error(err, "invalid --chart-bundle-public-key")
+			os.Exit(1)
+		}
+		chartBundleKey = key
+	}
+
+	config := ctrl.GetConfigOrDie()
+	mgr, err := ctrl.NewManager(config, ctrl.Options{Scheme: scheme, MetricsBindAddress: metricsAddr,
+		Port: webhookPort})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	// client of the objects applied by the Manifests and Rendered installers and helm 3, its rest
+	// mapper discovers the kinds again when a kind is not found, unlike the manager's
+	objectClient, objectMapper, err := controllers.NewObjectClient(config, mgr.GetScheme())
+	if err != nil {
+		setupLog.Error(err, "unable to create the client of istio's objects")
+		os.Exit(1)
+	}
+
+	// helm 3 releases are managed in-process, their objects are applied with the object client
+	helm3Client := controllers.NewHelm3Client(mgr.GetClient(), objectClient, objectMapper, mgr.GetAPIReader(),
+		ctrl.Log.WithName("helm3"))
+
+	// istio CRs are reconciled when the charts they installed change in CHARTS_PATH
+	chartEvents := make(chan event.GenericEvent, 100)
 	err = (&controllers.IstioReconciler{
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Istio"),
+		Scheme: mgr.GetScheme(),
+		Helm:   controllers.NewHelmClient(tillerHost, ctrl.Log.WithName("helm")),
+		Helm3:  helm3Client,
+
+		DefaultHelmVersion: operatorv1alpha1.HelmVersion(helmVersion),
+		APIReader:          mgr.GetAPIReader(),
+		ObjectClient:       objectClient,
+		ObjectMapper:       objectMapper,
+		TillerNamespace:    tillerNamespace,
+		ChartCacheDir:      chartCacheDir,
+		ChartEvents:        chartEvents,
+
+		ChartBundleKey:         chartBundleKey,
+		ChartBundleLoaderImage: chartBundleLoaderImage,
 	}).SetupWithManager(mgr)
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Istio")
 		os.Exit(1)
 	}
+	// the catalog of istio releases is kept up to date with the charts in CHARTS_PATH
+	catalog := &controllers.IstioReleaseCatalog{
+		Client:     mgr.GetClient(),
+		Log:        ctrl.Log.WithName("controllers").WithName("IstioRelease"),
+		ChartsPath: os.Getenv("CHARTS_PATH"),
+		Interval:   releaseScanInterval,
+	}
+	if err = mgr.Add(catalog); err != nil {
+		setupLog.Error(err, "unable to create catalog of istio releases", "controller", "IstioRelease")
+		os.Exit(1)
+	}
+	err = mgr.Add(&controllers.IstioChartWatcher{
+		Client:     mgr.GetClient(),
+		Log:        ctrl.Log.WithName("controllers").WithName("ChartWatcher"),
+		ChartsPath: os.Getenv("CHARTS_PATH"),
+		Events:     chartEvents,
+		Catalog:    catalog,
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to create watcher of istio's charts", "controller", "ChartWatcher")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		mgr.GetWebhookServer().CertDir = webhookCertDir
+		err = (&controllers.IstioDefaulter{
+			Log: ctrl.Log.WithName("webhooks").WithName("Istio"),
+			Defaults: controllers.IstioDefaults{
+				ChartsPath:      os.Getenv("CHARTS_PATH"),
+				Hub:             defaultHub,
+				ImagePullPolicy: defaultImagePullPolicy,
+			},
+		}).SetupWithManager(mgr)
+		if err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Istio")
+			os.Exit(1)
+		}
+		err = (&controllers.IstioValidator{
+			Log: ctrl.Log.WithName("webhooks").WithName("Istio"),
+		}).SetupWithManager(mgr)
+		if err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Istio")
+			os.Exit(1)
+		}
+		// istio CRs are converted between v1alpha1 and v1alpha2 by the conversion webhook
+		// served at /convert, which is trusted by the API server with ca.crt
+		caBundle, err := ioutil.ReadFile(filepath.Join(webhookCertDir, "ca.crt"))
+		if err != nil {
+			setupLog.Error(err, "unable to read CA of webhooks, istio CRs can only be used as v1alpha1")
+		} else if err = controllers.SetIstioConversionWebhook(config, webhookServiceNamespace, webhookService,
+			caBundle); err != nil {
+			setupLog.Error(err, "unable to set conversion webhook, istio CRs can only be used as v1alpha1")
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("\n\n**** Starting CCP Istio Operator's controller manager generated using kubebuilder 2.0.0-alpha.1 on k8s 1.14.1 ****\n\n")